@@ -0,0 +1,319 @@
+// Package client is a typed Go client for the dispatcher's command protocol.
+// There is one method per dispatcher command. Every method takes a context,
+// applies a per-attempt timeout, retries transient failures with exponential
+// backoff, and returns the dispatcher's errors as *util.Error so that callers
+// can branch on util.CodeOf(err).
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/stmansour/simq/proto"
+	"github.com/stmansour/simq/util"
+)
+
+// Defaults for the zero values of the Client fields
+const (
+	DefaultTimeout = 30 * time.Second
+	DefaultRetries = 3
+	DefaultBackoff = 500 * time.Millisecond
+	maxBackoff     = 10 * time.Second
+)
+
+// Client sends commands to a dispatcher
+type Client struct {
+	URL      string        // the dispatcher's command URL, e.g. http://host:8250/command
+	Username string        // sent with every command
+	Token    string        // API token; if empty, the one set with util.SetAuthToken is used
+	HTTP     *http.Client  // if nil, util.HTTPClient() is used
+	Timeout  time.Duration // limit for each attempt, 0 = DefaultTimeout
+	Retries  int           // retries after the first attempt, 0 = DefaultRetries, < 0 = none
+	Backoff  time.Duration // wait before the first retry, doubled for each one after
+}
+
+// New returns a Client for the dispatcher command URL url
+// -----------------------------------------------------------------------------
+func New(url, username string) *Client {
+	return &Client{URL: url, Username: username}
+}
+
+// idempotent lists the commands that can safely be sent again when a reply is
+// lost or the dispatcher fails. Other commands are only retried when the
+// connection was refused, i.e. when the dispatcher never saw them.
+var idempotent = map[string]bool{
+	"AckAlert":          true,
+	"GetActiveQueue":    true,
+	"GetAlerts":         true,
+	"GetCompletedQueue": true,
+	"GetEmailPrefs":     true,
+	"GetMachineQueue":   true,
+	"GetProgress":       true,
+	"GetResults":        true,
+	"Capabilities":      true,
+	"GetSID":            true,
+	"Heartbeat":         true,
+	"ListResults":       true,
+	"ListWebhooks":      true,
+	"Pause":             true,
+	"Priority":          true,
+	"ReportProgress":    true,
+	"Resume":            true,
+	"SetEmailPrefs":     true,
+	"UpdateItem":        true,
+}
+
+type correlationKey struct{}
+
+// WithCorrelationID returns a context whose requests carry the correlation
+// ID id
+// -----------------------------------------------------------------------------
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationKey{}, id)
+}
+
+// CorrelationID returns the correlation ID set with WithCorrelationID
+// -----------------------------------------------------------------------------
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
+
+// payload is the encoded body of a request
+type payload struct {
+	body        []byte
+	contentType string
+}
+
+// command builds the command envelope for name with data
+// -----------------------------------------------------------------------------
+func (c *Client) command(ctx context.Context, name string, data interface{}) (*proto.Command, error) {
+	cmd := proto.Command{
+		Command:       name,
+		Username:      c.Username,
+		CorrelationID: CorrelationID(ctx),
+		Protocol:      proto.ProtocolVersion,
+		ClientVersion: util.Version(),
+	}
+	if data != nil {
+		b, err := json.Marshal(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: failed to marshal request: %v", name, err)
+		}
+		cmd.Data = json.RawMessage(b)
+	}
+	return &cmd, nil
+}
+
+// encode builds the request body for cmd. If fname is not empty the request
+// is multipart and the file is attached.
+// -----------------------------------------------------------------------------
+func encode(command string, cmd interface{}, fname string) (*payload, error) {
+	cmdBytes, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("%s: failed to marshal command: %v", command, err)
+	}
+	if len(fname) == 0 {
+		return &payload{body: cmdBytes, contentType: "application/json"}, nil
+	}
+
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+	if err := w.WriteField("data", string(cmdBytes)); err != nil {
+		return nil, fmt.Errorf("%s: failed to write command data: %v", command, err)
+	}
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", command, err)
+	}
+	defer f.Close()
+	part, err := w.CreateFormFile("file", filepath.Base(fname))
+	if err != nil {
+		return nil, fmt.Errorf("%s: failed to create file part: %v", command, err)
+	}
+	if _, err := io.Copy(part, f); err != nil {
+		return nil, fmt.Errorf("%s: failed to copy %s: %v", command, fname, err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("%s: failed to close multipart writer: %v", command, err)
+	}
+	return &payload{body: b.Bytes(), contentType: w.FormDataContentType()}, nil
+}
+
+// send posts cmd, the body of command, to the dispatcher, retrying as
+// allowed, and returns the response with its body unread. If stream is true
+// the per-attempt timeout only covers the wait for the response headers, so
+// that the caller can read a long body. The caller must close the body.
+// -----------------------------------------------------------------------------
+func (c *Client) send(ctx context.Context, command string, cmd interface{}, fname string, stream bool) (*http.Response, error) {
+	p, err := encode(command, cmd, fname)
+	if err != nil {
+		return nil, err
+	}
+	retries := c.Retries
+	if retries == 0 {
+		retries = DefaultRetries
+	}
+	backoff := c.Backoff
+	if backoff == 0 {
+		backoff = DefaultBackoff
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := c.attempt(ctx, p, stream)
+		if err == nil && (resp.StatusCode < 500 || !idempotent[command]) {
+			return resp, nil
+		}
+		if err == nil {
+			err = replyError(resp)
+		}
+		if attempt >= retries || ctx.Err() != nil || !retryable(command, err) {
+			return nil, fmt.Errorf("%s: %w", command, err)
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%s: %w", command, ctx.Err())
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// attempt sends p once
+// -----------------------------------------------------------------------------
+func (c *Client) attempt(ctx context.Context, p *payload, stream bool) (*http.Response, error) {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	actx, cancel := context.WithCancel(ctx)
+	timer := time.AfterFunc(timeout, cancel)
+
+	req, err := http.NewRequestWithContext(actx, "POST", c.URL, bytes.NewReader(p.body))
+	if err != nil {
+		timer.Stop()
+		cancel()
+		return nil, err
+	}
+	req.Header.Set("Content-Type", p.contentType)
+	if id := CorrelationID(ctx); len(id) > 0 {
+		req.Header.Set(util.CorrelationHeader, id)
+	}
+	if len(c.Token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	} else {
+		util.SetAuthHeader(req)
+	}
+
+	hc := c.HTTP
+	if hc == nil {
+		hc = util.HTTPClient()
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		timer.Stop()
+		cancel()
+		return nil, err
+	}
+	if stream {
+		timer.Stop() // the caller's context limits the rest
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: func() { timer.Stop(); cancel() }}
+	return resp, nil
+}
+
+// cancelBody releases the attempt's context when the body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// retryable reports whether command should be sent again after err
+// -----------------------------------------------------------------------------
+func retryable(command string, err error) bool {
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true // the dispatcher never saw the request
+	}
+	if !idempotent[command] {
+		return false
+	}
+	var ue *util.Error
+	if errors.As(err, &ue) {
+		return ue.Code == util.ErrInternal
+	}
+	var ne net.Error
+	return errors.As(err, &ne) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// replyError reads and closes the body of an unsuccessful response and
+// returns its error
+// -----------------------------------------------------------------------------
+func replyError(resp *http.Response) error {
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading reply: %v", err)
+	}
+	if e := util.DecodeError(body); e != nil {
+		return e
+	}
+	return fmt.Errorf("unexpected HTTP status: %s", resp.Status)
+}
+
+// call sends command and decodes the JSON reply into out, which may be nil.
+// A reply with Status "error" is returned as an error.
+// -----------------------------------------------------------------------------
+func (c *Client) call(ctx context.Context, command string, data interface{}, fname string, out interface{}) error {
+	cmd, err := c.command(ctx, command, data)
+	if err != nil {
+		return err
+	}
+	resp, err := c.send(ctx, command, cmd, fname, false)
+	if err != nil {
+		return err
+	}
+	return decodeReply(command, resp, out)
+}
+
+// decodeReply reads and closes the body of resp and decodes the JSON reply
+// into out, which may be nil
+// -----------------------------------------------------------------------------
+func decodeReply(command string, resp *http.Response, out interface{}) error {
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("%s: %w", command, replyError(resp))
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("%s: error reading reply: %v", command, err)
+	}
+	if e := util.DecodeError(body); e != nil {
+		return fmt.Errorf("%s: %w", command, e)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("%s: error decoding reply: %v", command, err)
+	}
+	return nil
+}
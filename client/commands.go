@@ -0,0 +1,381 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/stmansour/simq/data"
+	"github.com/stmansour/simq/proto"
+	"github.com/stmansour/simq/util"
+)
+
+// Booking is the dispatcher's answer to Book and Rebook. If nothing was
+// booked, SID is 0 and Code says why (util.CodeQueueEmpty or util.CodePaused).
+type Booking struct {
+	SID            int64
+	ConfigFilename string // base name of the simulation's config file
+	Executor       string // the executor the job asked for, empty = the machine's default
+	Config         []byte // contents of the config file
+	Code           util.ErrorCode
+	Message        string
+}
+
+// Book asks the dispatcher for the highest priority queued simulation
+// -----------------------------------------------------------------------------
+func (c *Client) Book(ctx context.Context, req *proto.SimulationBookingRequest) (*Booking, error) {
+	return c.book(ctx, "Book", req)
+}
+
+// Rebook asks the dispatcher to hand sid to machineID again, e.g. after simd
+// restarted and lost the simulation's config file
+// -----------------------------------------------------------------------------
+func (c *Client) Rebook(ctx context.Context, machineID string, sid int64) (*Booking, error) {
+	return c.book(ctx, "Rebook", &proto.SimulationRebookRequest{SID: sid, MachineID: machineID})
+}
+
+// book sends a Book or Rebook command. The reply is either a JSON status
+// when nothing was booked, or a multipart message with a "json" part that
+// describes the booking and a "file" part with the config file.
+// -----------------------------------------------------------------------------
+func (c *Client) book(ctx context.Context, command string, req interface{}) (*Booking, error) {
+	cmd, err := c.command(ctx, command, req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.send(ctx, command, cmd, "", false)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "multipart/") {
+		var st proto.SvcStatus201
+		if err := decodeReply(command, resp, &st); err != nil {
+			return nil, err
+		}
+		return &Booking{Code: st.Code, Message: st.Message}, nil
+	}
+	defer resp.Body.Close()
+
+	var b Booking
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", command, err)
+	}
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: error reading multipart reply: %v", command, err)
+		}
+		switch part.FormName() {
+		case "json":
+			if err := json.NewDecoder(part).Decode(&b); err != nil {
+				return nil, fmt.Errorf("%s: failed to decode booking: %v", command, err)
+			}
+		case "file":
+			if b.Config, err = io.ReadAll(part); err != nil {
+				return nil, fmt.Errorf("%s: failed to read config file: %v", command, err)
+			}
+		}
+	}
+	if b.SID == 0 || b.Config == nil {
+		return nil, fmt.Errorf("%s: incomplete booking reply", command)
+	}
+	return &b, nil
+}
+
+// NewSimulation adds the simulation whose config file is fname to the queue
+// and returns its SID
+// -----------------------------------------------------------------------------
+func (c *Client) NewSimulation(ctx context.Context, req *proto.CreateQueueEntryRequest, fname string) (int64, error) {
+	if len(req.OriginalFilename) == 0 {
+		req.OriginalFilename = filepath.Base(fname)
+	}
+	var st proto.SvcStatus201
+	if err := c.call(ctx, "NewSimulation", req, fname, &st); err != nil {
+		return 0, err
+	}
+	return st.ID, nil
+}
+
+// GetSID returns the queue item for sid
+// -----------------------------------------------------------------------------
+func (c *Client) GetSID(ctx context.Context, sid int64) (*data.QueueItem, error) {
+	var resp struct {
+		Data data.QueueItem
+	}
+	if err := c.call(ctx, "GetSID", &proto.GetSIDRequest{SID: sid}, "", &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Data, nil
+}
+
+// GetActiveQueue returns the queued, booked and executing items
+// -----------------------------------------------------------------------------
+func (c *Client) GetActiveQueue(ctx context.Context) ([]data.QueueItem, error) {
+	return c.queue(ctx, "GetActiveQueue", nil)
+}
+
+// GetCompletedQueue returns the completed items
+// -----------------------------------------------------------------------------
+func (c *Client) GetCompletedQueue(ctx context.Context) ([]data.QueueItem, error) {
+	return c.queue(ctx, "GetCompletedQueue", nil)
+}
+
+// GetMachineQueue returns the unfinished items booked by machineID
+// -----------------------------------------------------------------------------
+func (c *Client) GetMachineQueue(ctx context.Context, machineID string) ([]data.QueueItem, error) {
+	return c.queue(ctx, "GetMachineQueue", &proto.MachineQueueRequest{MachineID: machineID})
+}
+
+// queue sends one of the commands that return a list of queue items
+// -----------------------------------------------------------------------------
+func (c *Client) queue(ctx context.Context, command string, req interface{}) ([]data.QueueItem, error) {
+	var resp struct {
+		Data []data.QueueItem
+	}
+	if err := c.call(ctx, command, req, "", &resp); err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+// SetPriority changes the priority of sid
+// -----------------------------------------------------------------------------
+func (c *Client) SetPriority(ctx context.Context, sid int64, priority int) (*proto.SvcStatus201, error) {
+	return c.status(ctx, "Priority", &proto.PriorityRequest{SID: sid, Priority: priority})
+}
+
+// UpdateItem changes the fields of a queue item that are set in req
+// -----------------------------------------------------------------------------
+func (c *Client) UpdateItem(ctx context.Context, req *proto.UpdateItemRequest) (*proto.SvcStatus201, error) {
+	return c.status(ctx, "UpdateItem", req)
+}
+
+// DeleteItem removes sid from the queue
+// -----------------------------------------------------------------------------
+func (c *Client) DeleteItem(ctx context.Context, sid int64) (*proto.SvcStatus201, error) {
+	return c.status(ctx, "DeleteItem", &proto.GetSIDRequest{SID: sid})
+}
+
+// Redo puts a finished simulation back in the queue to be run again
+// -----------------------------------------------------------------------------
+func (c *Client) Redo(ctx context.Context, sid int64) (*proto.SvcStatus201, error) {
+	return c.status(ctx, "Redo", &proto.GetSIDRequest{SID: sid})
+}
+
+// Pause stops the dispatcher from booking simulations
+// -----------------------------------------------------------------------------
+func (c *Client) Pause(ctx context.Context) (*proto.SvcStatus201, error) {
+	return c.status(ctx, "Pause", nil)
+}
+
+// Resume lets the dispatcher book simulations again
+// -----------------------------------------------------------------------------
+func (c *Client) Resume(ctx context.Context) (*proto.SvcStatus201, error) {
+	return c.status(ctx, "Resume", nil)
+}
+
+// Shutdown stops the dispatcher
+// -----------------------------------------------------------------------------
+func (c *Client) Shutdown(ctx context.Context) (*proto.SvcStatus201, error) {
+	return c.status(ctx, "Shutdown", nil)
+}
+
+// status sends one of the commands whose reply is a Status
+// -----------------------------------------------------------------------------
+func (c *Client) status(ctx context.Context, command string, req interface{}) (*proto.SvcStatus201, error) {
+	var st proto.SvcStatus201
+	if err := c.call(ctx, command, req, "", &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// EndSimulation uploads the results archive of sid, a tar.gz file, and tells
+// the dispatcher that the simulation is done
+// -----------------------------------------------------------------------------
+func (c *Client) EndSimulation(ctx context.Context, sid int64, archive string) (*proto.SvcStatus201, error) {
+	//------------------------------------------------------------
+	// Unlike the other commands, EndSimulation carries its
+	// arguments next to Command rather than in Data
+	//------------------------------------------------------------
+	cmd, err := c.command(ctx, "EndSimulation", nil)
+	if err != nil {
+		return nil, err
+	}
+	req := proto.EndSimulationRequest{Command: *cmd, SID: sid, Filename: filepath.Base(archive)}
+	resp, err := c.send(ctx, "EndSimulation", &req, archive, false)
+	if err != nil {
+		return nil, err
+	}
+	var st proto.SvcStatus201
+	if err := decodeReply("EndSimulation", resp, &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// Capabilities returns the protocol versions, commands and features the
+// dispatcher supports
+// -----------------------------------------------------------------------------
+func (c *Client) Capabilities(ctx context.Context) (*proto.Capabilities, error) {
+	var resp struct {
+		Data proto.Capabilities
+	}
+	if err := c.call(ctx, "Capabilities", nil, "", &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Data, nil
+}
+
+// ListResults returns the result files stored for sid
+// -----------------------------------------------------------------------------
+func (c *Client) ListResults(ctx context.Context, sid int64) ([]proto.ResultFileInfo, error) {
+	var resp struct {
+		Data []proto.ResultFileInfo
+	}
+	if err := c.call(ctx, "ListResults", &proto.ResultsRequest{SID: sid}, "", &resp); err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+// GetResults returns a reader for the result file fname of sid, or for a
+// tar.gz of all its result files if fname is empty. The download is limited
+// only by ctx, not by the client's Timeout. The caller must close the reader.
+// -----------------------------------------------------------------------------
+func (c *Client) GetResults(ctx context.Context, sid int64, fname string) (io.ReadCloser, error) {
+	cmd, err := c.command(ctx, "GetResults", &proto.ResultsRequest{SID: sid, Filename: fname})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.send(ctx, "GetResults", cmd, "", true)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK || strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		if err := decodeReply("GetResults", resp, nil); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("GetResults: the reply has no file")
+	}
+	return resp.Body, nil
+}
+
+// AddWebhook subscribes a URL to simulation lifecycle events and returns the
+// new webhook's ID
+// -----------------------------------------------------------------------------
+func (c *Client) AddWebhook(ctx context.Context, req *proto.AddWebhookRequest) (int64, error) {
+	var st proto.SvcStatus201
+	if err := c.call(ctx, "AddWebhook", req, "", &st); err != nil {
+		return 0, err
+	}
+	return st.ID, nil
+}
+
+// ListWebhooks returns the caller's webhooks, or all of them for an admin.
+// Secrets are not returned.
+// -----------------------------------------------------------------------------
+func (c *Client) ListWebhooks(ctx context.Context) ([]data.Webhook, error) {
+	var resp struct {
+		Data []data.Webhook
+	}
+	if err := c.call(ctx, "ListWebhooks", nil, "", &resp); err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+// DeleteWebhook removes the webhook wid
+// -----------------------------------------------------------------------------
+func (c *Client) DeleteWebhook(ctx context.Context, wid int64) (*proto.SvcStatus201, error) {
+	return c.status(ctx, "DeleteWebhook", &proto.WebhookRequest{WID: wid})
+}
+
+// SetEmailPrefs sets the caller's email preferences. An empty Email turns
+// their email off.
+// -----------------------------------------------------------------------------
+func (c *Client) SetEmailPrefs(ctx context.Context, req *proto.EmailPrefsRequest) (*proto.SvcStatus201, error) {
+	return c.status(ctx, "SetEmailPrefs", req)
+}
+
+// GetEmailPrefs returns the caller's email preferences. Email is off if the
+// Email field is empty.
+// -----------------------------------------------------------------------------
+func (c *Client) GetEmailPrefs(ctx context.Context) (*data.EmailPref, error) {
+	var resp struct {
+		Data data.EmailPref
+	}
+	if err := c.call(ctx, "GetEmailPrefs", nil, "", &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Data, nil
+}
+
+// GetAlerts returns the open alerts, including the acknowledged ones if all
+// is set
+// -----------------------------------------------------------------------------
+func (c *Client) GetAlerts(ctx context.Context, all bool) ([]proto.Alert, error) {
+	var resp struct {
+		Data []proto.Alert
+	}
+	if err := c.call(ctx, "GetAlerts", &proto.AlertsRequest{All: all}, "", &resp); err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+// AckAlert acknowledges the alert aid
+// -----------------------------------------------------------------------------
+func (c *Client) AckAlert(ctx context.Context, aid int64) (*proto.SvcStatus201, error) {
+	return c.status(ctx, "AckAlert", &proto.AckAlertRequest{AID: aid})
+}
+
+// Heartbeat tells the dispatcher that the machine in req is alive
+// -----------------------------------------------------------------------------
+func (c *Client) Heartbeat(ctx context.Context, req *proto.HeartbeatRequest) error {
+	return c.call(ctx, "Heartbeat", req, "", nil)
+}
+
+// ReportProgress sends the dispatcher a new status of the simulator running
+// sid
+// -----------------------------------------------------------------------------
+func (c *Client) ReportProgress(ctx context.Context, sid int64, st *proto.SimulatorStatus) error {
+	return c.call(ctx, "ReportProgress", &proto.ReportProgressRequest{SID: sid, Status: *st}, "", nil)
+}
+
+// GetProgress returns the progress samples of sid and what they add up to
+// -----------------------------------------------------------------------------
+func (c *Client) GetProgress(ctx context.Context, sid int64) (*proto.ProgressReport, error) {
+	var resp struct {
+		Data proto.ProgressReport
+	}
+	if err := c.call(ctx, "GetProgress", &proto.ProgressRequest{SID: sid}, "", &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Data, nil
+}
+
+// Fsck cross-checks the Queue table, qdconfigs and the result store. With
+// repair set, the dispatcher also fixes what it safely can.
+// -----------------------------------------------------------------------------
+func (c *Client) Fsck(ctx context.Context, repair bool) (*proto.FsckReport, error) {
+	req := proto.FsckRequest{Repair: repair}
+	var resp struct {
+		Data proto.FsckReport
+	}
+	if err := c.call(ctx, "Fsck", &req, "", &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Data, nil
+}
@@ -0,0 +1,168 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stmansour/simq/proto"
+	"github.com/stmansour/simq/util"
+)
+
+// EventsURL returns the URL of the dispatcher's event stream, which sits next
+// to the command URL
+// -----------------------------------------------------------------------------
+func (c *Client) EventsURL(filter *proto.EventFilter) (string, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return "", fmt.Errorf("invalid dispatcher URL %q: %v", c.URL, err)
+	}
+	u.Path = strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), "/command") + "/events"
+	q := url.Values{}
+	if filter != nil {
+		if filter.SID > 0 {
+			q.Set("sid", strconv.FormatInt(filter.SID, 10))
+		}
+		if len(filter.Username) > 0 {
+			q.Set("user", filter.Username)
+		}
+		if len(filter.Campaign) > 0 {
+			q.Set("campaign", filter.Campaign)
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// Watch streams the queue events that match filter to fn until ctx is done
+// or fn returns an error. If the stream breaks, Watch reconnects with backoff
+// and asks for the events it missed. It returns ctx.Err(), the error from
+// fn, or the dispatcher's error if it refuses the stream.
+// -----------------------------------------------------------------------------
+func (c *Client) Watch(ctx context.Context, filter *proto.EventFilter, fn func(*proto.Event) error) error {
+	u, err := c.EventsURL(filter)
+	if err != nil {
+		return err
+	}
+	backoff := c.Backoff
+	if backoff == 0 {
+		backoff = DefaultBackoff
+	}
+	var lastID int64
+	wait := backoff
+	for {
+		connected, err := c.watchOnce(ctx, u, &lastID, fn)
+		var ue *util.Error
+		var ce callbackError
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case errors.As(err, &ue) && ue.Code != util.ErrInternal:
+			return fmt.Errorf("Watch: %w", err)
+		case errors.As(err, &ce):
+			return ce.err
+		}
+		if connected {
+			wait = backoff // the stream worked for a while, start over
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if wait *= 2; wait > maxBackoff {
+			wait = maxBackoff
+		}
+	}
+}
+
+// callbackError wraps the error returned by the Watch callback
+type callbackError struct{ err error }
+
+func (e callbackError) Error() string { return e.err.Error() }
+
+// watchOnce reads one connection's worth of events. connected reports
+// whether the dispatcher accepted the stream.
+// -----------------------------------------------------------------------------
+func (c *Client) watchOnce(ctx context.Context, u string, lastID *int64, fn func(*proto.Event) error) (connected bool, err error) {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	sctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	timer := time.AfterFunc(timeout, cancel) // only until the headers arrive
+
+	req, err := http.NewRequestWithContext(sctx, "GET", u, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set(proto.UserHeader, c.Username)
+	if *lastID > 0 {
+		req.Header.Set("Last-Event-ID", strconv.FormatInt(*lastID, 10))
+	}
+	if id := CorrelationID(ctx); len(id) > 0 {
+		req.Header.Set(util.CorrelationHeader, id)
+	}
+	if len(c.Token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	} else {
+		util.SetAuthHeader(req)
+	}
+	hc := c.HTTP
+	if hc == nil {
+		hc = util.HTTPClient()
+	}
+	resp, err := hc.Do(req)
+	timer.Stop()
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, replyError(resp)
+	}
+	defer resp.Body.Close()
+
+	//------------------------------------------------------------
+	// An event is a block of "field: value" lines ended by a
+	// blank line. Lines starting with ':' are comments.
+	//------------------------------------------------------------
+	var data strings.Builder
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := sc.Text()
+		if len(line) == 0 {
+			if data.Len() == 0 {
+				continue
+			}
+			var e proto.Event
+			if err := json.Unmarshal([]byte(data.String()), &e); err != nil {
+				return true, fmt.Errorf("invalid event: %v", err)
+			}
+			data.Reset()
+			*lastID = e.ID
+			if err := fn(&e); err != nil {
+				return true, callbackError{err}
+			}
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		if field == "data" {
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(value)
+		}
+	}
+	return true, sc.Err()
+}
@@ -0,0 +1,76 @@
+package data
+
+import (
+	"strings"
+	"time"
+)
+
+// EmailPref is a user's opt-in to email about their simulations. A user
+// without one gets no email.
+type EmailPref struct {
+	Username string
+	Email    string // where the messages go
+	Events   string // comma separated event types, empty = all of them
+	Digest   bool   // send completions in a periodic digest rather than one by one
+	Modified time.Time
+}
+
+// emailPrefColumns lists the EmailPrefs columns in the order scanEmailPref
+// reads them
+const emailPrefColumns = "Username, Email, Events, Digest, Modified"
+
+// emailPrefSchema creates the EmailPrefs table
+const emailPrefSchema = `CREATE TABLE IF NOT EXISTS EmailPrefs (
+		Username VARCHAR(40) NOT NULL PRIMARY KEY,
+		Email VARCHAR(256) NOT NULL DEFAULT '',
+		Events VARCHAR(256) NOT NULL DEFAULT '',
+		Digest TINYINT(1) NOT NULL DEFAULT 0,
+		Modified TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+	);`
+
+// Wants reports whether the user wants email about events of type typ
+func (p *EmailPref) Wants(typ string) bool {
+	if len(p.Email) == 0 {
+		return false
+	}
+	if len(p.Events) == 0 {
+		return true
+	}
+	for _, e := range strings.Split(p.Events, ",") {
+		if strings.TrimSpace(e) == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// scanEmailPref reads the emailPrefColumns of one row into p
+func scanEmailPref(row interface{ Scan(dest ...any) error }, p *EmailPref) error {
+	return row.Scan(&p.Username, &p.Email, &p.Events, &p.Digest, &p.Modified)
+}
+
+// SetEmailPref adds or replaces the email preferences of p.Username
+func (qm *QueueManager) SetEmailPref(p EmailPref) error {
+	setSQL := `INSERT INTO EmailPrefs (Username, Email, Events, Digest) VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE Email = VALUES(Email), Events = VALUES(Events), Digest = VALUES(Digest)`
+	_, err := qm.db.Exec(setSQL, p.Username, p.Email, p.Events, p.Digest)
+	return qm.check("SetEmailPref", err)
+}
+
+// GetEmailPref returns the email preferences of username. It returns
+// sql.ErrNoRows if the user has not opted in.
+func (qm *QueueManager) GetEmailPref(username string) (EmailPref, error) {
+	var p EmailPref
+	row := qm.db.QueryRow(`SELECT `+emailPrefColumns+` FROM EmailPrefs WHERE Username = ?`, username)
+	if err := scanEmailPref(row, &p); err != nil {
+		return p, qm.check("GetEmailPref", err)
+	}
+	return p, nil
+}
+
+// DeleteEmailPref removes the email preferences of username, which turns
+// their email off
+func (qm *QueueManager) DeleteEmailPref(username string) error {
+	_, err := qm.db.Exec(`DELETE FROM EmailPrefs WHERE Username = ?`, username)
+	return qm.check("DeleteEmailPref", err)
+}
@@ -0,0 +1,50 @@
+package data
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestEmailPrefs tests setting, replacing and removing email preferences
+func TestEmailPrefs(t *testing.T) {
+	qm, err := initTest(t)
+	if err != nil {
+		return
+	}
+
+	_, err = qm.GetEmailPref("alice")
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	require.NoError(t, qm.SetEmailPref(EmailPref{Username: "alice", Email: "alice@example.com"}))
+	p, err := qm.GetEmailPref("alice")
+	require.NoError(t, err)
+	assert.Equal(t, "alice@example.com", p.Email)
+	assert.False(t, p.Digest)
+
+	require.NoError(t, qm.SetEmailPref(EmailPref{Username: "alice", Email: "a@example.com", Events: "saved", Digest: true}))
+	p, err = qm.GetEmailPref("alice")
+	require.NoError(t, err)
+	assert.Equal(t, "a@example.com", p.Email)
+	assert.Equal(t, "saved", p.Events)
+	assert.True(t, p.Digest)
+
+	require.NoError(t, qm.DeleteEmailPref("alice"))
+	_, err = qm.GetEmailPref("alice")
+	assert.Equal(t, sql.ErrNoRows, err)
+}
+
+// TestEmailPrefWants tests which events a user gets email about
+func TestEmailPrefWants(t *testing.T) {
+	all := EmailPref{Email: "alice@example.com"}
+	assert.True(t, all.Wants("error"))
+
+	some := EmailPref{Email: "alice@example.com", Events: "saved, expired"}
+	assert.True(t, some.Wants("expired"))
+	assert.False(t, some.Wants("error"))
+
+	off := EmailPref{Events: "saved"}
+	assert.False(t, off.Wants("saved"))
+}
@@ -0,0 +1,82 @@
+package data
+
+import "time"
+
+// ProgressSample is one status snapshot of a running simulator. The samples
+// of a simulation, in time order, show how fast it progressed and how its
+// estimated completion moved.
+type ProgressSample struct {
+	PSID                   int64
+	SID                    int64
+	Source                 string // who took it: "simd" or "poll"
+	LoopCount              int
+	GenerationsRequested   int
+	CompletedLoops         int
+	CompletedGenerations   int // generations done in the current loop
+	ElapsedTimeLastGen     string
+	EstimatedTimeRemaining string
+	EstimatedCompletion    string
+	Recorded               time.Time
+}
+
+// progressColumns lists the Progress columns in the order scanProgress reads
+// them
+const progressColumns = "PSID, SID, Source, LoopCount, GenerationsRequested, CompletedLoops, CompletedGenerations, ElapsedTimeLastGen, EstimatedTimeRemaining, EstimatedCompletion, Recorded"
+
+// progressSchema creates the Progress table
+const progressSchema = `CREATE TABLE IF NOT EXISTS Progress (
+		PSID BIGINT AUTO_INCREMENT PRIMARY KEY,
+		SID BIGINT NOT NULL,
+		Source VARCHAR(16) NOT NULL DEFAULT '',
+		LoopCount INT NOT NULL DEFAULT 0,
+		GenerationsRequested INT NOT NULL DEFAULT 0,
+		CompletedLoops INT NOT NULL DEFAULT 0,
+		CompletedGenerations INT NOT NULL DEFAULT 0,
+		ElapsedTimeLastGen VARCHAR(40) NOT NULL DEFAULT '',
+		EstimatedTimeRemaining VARCHAR(40) NOT NULL DEFAULT '',
+		EstimatedCompletion VARCHAR(40) NOT NULL DEFAULT '',
+		Recorded DATETIME NOT NULL,
+		INDEX (SID, Recorded)
+	);`
+
+// scanProgress reads the progressColumns of one row into p
+func scanProgress(row interface{ Scan(dest ...any) error }, p *ProgressSample) error {
+	return row.Scan(&p.PSID, &p.SID, &p.Source, &p.LoopCount, &p.GenerationsRequested, &p.CompletedLoops,
+		&p.CompletedGenerations, &p.ElapsedTimeLastGen, &p.EstimatedTimeRemaining, &p.EstimatedCompletion, &p.Recorded)
+}
+
+// InsertProgress adds a progress sample and returns its PSID
+func (qm *QueueManager) InsertProgress(p ProgressSample) (int64, error) {
+	insertSQL := `INSERT INTO Progress (SID, Source, LoopCount, GenerationsRequested, CompletedLoops, CompletedGenerations,
+		ElapsedTimeLastGen, EstimatedTimeRemaining, EstimatedCompletion, Recorded) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	result, err := qm.db.Exec(insertSQL, p.SID, p.Source, p.LoopCount, p.GenerationsRequested, p.CompletedLoops,
+		p.CompletedGenerations, p.ElapsedTimeLastGen, p.EstimatedTimeRemaining, p.EstimatedCompletion, p.Recorded)
+	if err != nil {
+		return 0, qm.check("InsertProgress", err)
+	}
+	return result.LastInsertId()
+}
+
+// GetProgress returns the progress samples of sid, oldest first
+func (qm *QueueManager) GetProgress(sid int64) ([]ProgressSample, error) {
+	rows, err := qm.db.Query(`SELECT `+progressColumns+` FROM Progress WHERE SID = ? ORDER BY Recorded, PSID`, sid)
+	if err != nil {
+		return nil, qm.check("GetProgress", err)
+	}
+	defer rows.Close()
+	var samples []ProgressSample
+	for rows.Next() {
+		var p ProgressSample
+		if err := scanProgress(rows, &p); err != nil {
+			return nil, qm.check("GetProgress", err)
+		}
+		samples = append(samples, p)
+	}
+	return samples, qm.check("GetProgress", rows.Err())
+}
+
+// DeleteProgress removes the progress samples of sid
+func (qm *QueueManager) DeleteProgress(sid int64) error {
+	_, err := qm.db.Exec(`DELETE FROM Progress WHERE SID = ?`, sid)
+	return qm.check("DeleteProgress", err)
+}
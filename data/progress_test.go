@@ -0,0 +1,48 @@
+package data
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestProgress tests storing and reading a simulation's progress samples
+func TestProgress(t *testing.T) {
+	qm, err := initTest(t)
+	if err != nil {
+		return
+	}
+
+	start := time.Now().UTC().Truncate(time.Second)
+	for i := 0; i < 3; i++ {
+		_, err := qm.InsertProgress(ProgressSample{
+			SID:                  7,
+			Source:               "simd",
+			LoopCount:            2,
+			GenerationsRequested: 10,
+			CompletedGenerations: i * 3,
+			EstimatedCompletion:  start.Add(time.Duration(i) * time.Hour).Format(time.RFC3339),
+			Recorded:             start.Add(time.Duration(i) * time.Minute),
+		})
+		require.NoError(t, err)
+	}
+	_, err = qm.InsertProgress(ProgressSample{SID: 8, Source: "poll", Recorded: start})
+	require.NoError(t, err)
+
+	samples, err := qm.GetProgress(7)
+	require.NoError(t, err)
+	require.Len(t, samples, 3)
+	assert.Equal(t, 6, samples[2].CompletedGenerations)
+	assert.Equal(t, "simd", samples[0].Source)
+	assert.True(t, samples[0].Recorded.Before(samples[1].Recorded))
+
+	require.NoError(t, qm.DeleteProgress(7))
+	samples, err = qm.GetProgress(7)
+	require.NoError(t, err)
+	assert.Empty(t, samples)
+	samples, err = qm.GetProgress(8)
+	require.NoError(t, err)
+	assert.Len(t, samples, 1)
+}
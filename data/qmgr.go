@@ -1,8 +1,11 @@
 package data
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	// Register the SQL driver
@@ -24,9 +27,19 @@ const (
 	StateError = 5
 )
 
+// ErrNoQueuedItems is returned when no queued item can be booked
+var ErrNoQueuedItems = errors.New("no queued items found")
+
+// itemColumns lists the Queue columns in the order scanItem reads them
+const itemColumns = "SID, File, Username, Name, Priority, Description, MachineID, URL, Campaign, Executor, State, DtEstimate, DtCompleted, Created, Modified"
+
 // QueueManager is a wrapper around the MySQL database
 type QueueManager struct {
 	db *sql.DB
+
+	// ErrorHook, if set, is called with the name of the operation whenever
+	// a database call fails. sql.ErrNoRows is not treated as a failure.
+	ErrorHook func(op string, err error)
 }
 
 // QueueItem is an item in the queue
@@ -39,6 +52,8 @@ type QueueItem struct {
 	Description string
 	MachineID   string
 	URL         string
+	Campaign    string // groups the simulations of one study, may be empty
+	Executor    string // the simd executor that runs it, e.g. "v3", empty = the machine's default
 	State       int
 	DtEstimate  sql.NullTime
 	DtCompleted sql.NullTime
@@ -63,6 +78,19 @@ func NewQueueManager(dataSourceName string) (*QueueManager, error) {
 	return manager, nil
 }
 
+// Ping verifies that the database can be reached
+func (qm *QueueManager) Ping(ctx context.Context) error {
+	return qm.check("Ping", qm.db.PingContext(ctx))
+}
+
+// check reports err to the ErrorHook and returns it unchanged
+func (qm *QueueManager) check(op string, err error) error {
+	if err != nil && err != sql.ErrNoRows && qm.ErrorHook != nil {
+		qm.ErrorHook(op, err)
+	}
+	return err
+}
+
 func (qm *QueueManager) executeCmdList(cmds []string) error {
 	for _, cmd := range cmds {
 		_, err := qm.db.Exec(cmd)
@@ -73,16 +101,21 @@ func (qm *QueueManager) executeCmdList(cmds []string) error {
 	return nil
 }
 
-// RemoveSchemaForTesting removes the Queue table
+// RemoveSchemaForTesting removes the Queue, Webhooks, EmailPrefs and Progress
+// tables
 func (qm *QueueManager) RemoveSchemaForTesting() error {
 	stmts := []string{
 		"DROP TABLE IF EXISTS Queue;",
+		"DROP TABLE IF EXISTS Webhooks;",
+		"DROP TABLE IF EXISTS EmailPrefs;",
+		"DROP TABLE IF EXISTS Progress;",
 	}
 	return qm.executeCmdList(stmts)
 
 }
 
-// EnsureSchemaExists creates the Queue table if it does not exist
+// EnsureSchemaExists creates the Queue, Webhooks, EmailPrefs and Progress
+// tables if they do not exist
 func (qm *QueueManager) EnsureSchemaExists() error {
 	cmds := []string{
 		`CREATE TABLE IF NOT EXISTS Queue (
@@ -94,67 +127,100 @@ func (qm *QueueManager) EnsureSchemaExists() error {
 		Description VARCHAR(256) NOT NULL DEFAULT '',
 		MachineID VARCHAR(80) NOT NULL DEFAULT '',
 		URL VARCHAR(80) NOT NULL DEFAULT '',
+		Campaign VARCHAR(80) NOT NULL DEFAULT '',
+		Executor VARCHAR(40) NOT NULL DEFAULT '',
 		State INT NOT NULL DEFAULT 0,
 		DtEstimate DATETIME,
 		DtCompleted DATETIME,
 		Created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
 		Modified TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
 	);`,
+		webhookSchema,
+		emailPrefSchema,
+		progressSchema,
+	}
+	if err := qm.executeCmdList(cmds); err != nil {
+		return err
 	}
-	return qm.executeCmdList(cmds)
+
+	//------------------------------------------------------------
+	// Columns added after the table was first released
+	//------------------------------------------------------------
+	if err := qm.ensureColumn("Queue", "Campaign", "VARCHAR(80) NOT NULL DEFAULT '' AFTER URL"); err != nil {
+		return err
+	}
+	return qm.ensureColumn("Queue", "Executor", "VARCHAR(40) NOT NULL DEFAULT '' AFTER Campaign")
+}
+
+// ensureColumn adds column to table, with the definition def, if the table
+// does not have it yet
+func (qm *QueueManager) ensureColumn(table, column, def string) error {
+	var n int
+	err := qm.db.QueryRow(`SELECT COUNT(*) FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?`, table, column).Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+	_, err = qm.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, def))
+	return err
+}
+
+// scanItem reads the itemColumns of one row into item
+func scanItem(row interface{ Scan(dest ...any) error }, item *QueueItem) error {
+	return row.Scan(&item.SID, &item.File, &item.Username, &item.Name, &item.Priority, &item.Description, &item.MachineID, &item.URL, &item.Campaign, &item.Executor, &item.State, &item.DtEstimate, &item.DtCompleted, &item.Created, &item.Modified)
 }
 
 // GetItemByID retrieves a queue item by its SID
 func (qm *QueueManager) GetItemByID(SID int64) (QueueItem, error) {
 	var item QueueItem
-	querySQL := `SELECT SID, File, Username,Name, Priority, Description, MachineID, URL, State, DtEstimate, DtCompleted, Created, Modified
+	querySQL := `SELECT ` + itemColumns + `
 				 FROM Queue WHERE SID = ?`
 	row := qm.db.QueryRow(querySQL, SID)
-	err := row.Scan(&item.SID, &item.File, &item.Username, &item.Name, &item.Priority, &item.Description, &item.MachineID, &item.URL, &item.State, &item.DtEstimate, &item.DtCompleted, &item.Created, &item.Modified)
+	err := scanItem(row, &item)
 	if err != nil {
-		return item, err
+		return item, qm.check("GetItemByID", err)
 	}
 	return item, nil
 }
 
 // InsertItem inserts an item into the queue
 func (qm *QueueManager) InsertItem(item QueueItem) (int64, error) {
-	insertSQL := `INSERT INTO Queue (File, Username, Name, Priority, Description, URL, State, DtEstimate)
-				  VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
-	result, err := qm.db.Exec(insertSQL, item.File, item.Username, item.Name, item.Priority, item.Description, item.URL, item.State, item.DtEstimate)
+	insertSQL := `INSERT INTO Queue (File, Username, Name, Priority, Description, URL, Campaign, Executor, State, DtEstimate)
+				  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	result, err := qm.db.Exec(insertSQL, item.File, item.Username, item.Name, item.Priority, item.Description, item.URL, item.Campaign, item.Executor, item.State, item.DtEstimate)
 	if err != nil {
-		return 0, err
+		return 0, qm.check("InsertItem", err)
 	}
 	return result.LastInsertId()
 }
 
 // UpdateItem updates an item in the queue
 func (qm *QueueManager) UpdateItem(item QueueItem) error {
-	updateSQL := `UPDATE Queue SET File = ?, Username = ?, Name = ?, Priority = ?, Description = ?, MachineID = ?, URL = ?, State = ?, DtEstimate = ?, DtCompleted = ?, Modified = CURRENT_TIMESTAMP
+	updateSQL := `UPDATE Queue SET File = ?, Username = ?, Name = ?, Priority = ?, Description = ?, MachineID = ?, URL = ?, Campaign = ?, Executor = ?, State = ?, DtEstimate = ?, DtCompleted = ?, Modified = CURRENT_TIMESTAMP
 				  WHERE SID = ?`
-	_, err := qm.db.Exec(updateSQL, item.File, item.Username, item.Name, item.Priority, item.Description, item.MachineID, item.URL, item.State, item.DtEstimate, item.DtCompleted, item.SID)
-	return err
+	_, err := qm.db.Exec(updateSQL, item.File, item.Username, item.Name, item.Priority, item.Description, item.MachineID, item.URL, item.Campaign, item.Executor, item.State, item.DtEstimate, item.DtCompleted, item.SID)
+	return qm.check("UpdateItem", err)
 }
 
 // DeleteItem deletes an item from the queue
 func (qm *QueueManager) DeleteItem(SID int64) error {
 	deleteSQL := `DELETE FROM Queue WHERE SID = ?`
 	_, err := qm.db.Exec(deleteSQL, SID)
-	return err
+	return qm.check("DeleteItem", err)
 }
 
 func (qm *QueueManager) queryCore(querySQL string) ([]QueueItem, error) {
 	rows, err := qm.db.Query(querySQL)
 	if err != nil {
-		return nil, err
+		return nil, qm.check("query", err)
 	}
 	defer rows.Close()
 	var items []QueueItem
 	for rows.Next() {
 		var item QueueItem
-		err := rows.Scan(&item.SID, &item.File, &item.Username, &item.Name, &item.Priority, &item.Description, &item.MachineID, &item.URL, &item.State, &item.DtEstimate, &item.DtCompleted, &item.Created, &item.Modified)
+		err := scanItem(rows, &item)
 		if err != nil {
-			return nil, err
+			return nil, qm.check("query", err)
 		}
 		items = append(items, item)
 	}
@@ -164,7 +230,7 @@ func (qm *QueueManager) queryCore(querySQL string) ([]QueueItem, error) {
 // GetQueuedAndExecutingItems returns all items in the queue
 func (qm *QueueManager) GetQueuedAndExecutingItems() ([]QueueItem, error) {
 	querySQL := `
-    SELECT SID, File, Username, Name, Priority, Description, MachineID, URL, State, DtEstimate, DtCompleted, Created, Modified
+    SELECT ` + itemColumns + `
     FROM Queue 
     WHERE State IN (0, 1, 2)
     ORDER BY 
@@ -183,10 +249,38 @@ func (qm *QueueManager) GetQueuedAndExecutingItems() ([]QueueItem, error) {
 	return qm.queryCore(querySQL)
 }
 
+// GetAllItems returns every item in the queue, in SID order
+func (qm *QueueManager) GetAllItems() ([]QueueItem, error) {
+	querySQL := `
+	SELECT ` + itemColumns + `
+    FROM Queue ORDER BY SID ASC;
+    `
+	return qm.queryCore(querySQL)
+}
+
+// GetStateCounts returns the number of items in each state
+func (qm *QueueManager) GetStateCounts() (map[int]int64, error) {
+	rows, err := qm.db.Query(`SELECT State, COUNT(*) FROM Queue GROUP BY State`)
+	if err != nil {
+		return nil, qm.check("GetStateCounts", err)
+	}
+	defer rows.Close()
+	counts := map[int]int64{}
+	for rows.Next() {
+		var state int
+		var n int64
+		if err := rows.Scan(&state, &n); err != nil {
+			return nil, qm.check("GetStateCounts", err)
+		}
+		counts[state] = n
+	}
+	return counts, qm.check("GetStateCounts", rows.Err())
+}
+
 // GetCompletedItems returns all items in the queue
 func (qm *QueueManager) GetCompletedItems() ([]QueueItem, error) {
 	querySQL := `
-	SELECT SID, File, Username, Name, Priority, Description, MachineID, URL, State, DtEstimate, DtCompleted, Created, Modified
+	SELECT ` + itemColumns + `
     FROM Queue 
     WHERE State IN (3,4) ORDER BY DtCompleted ASC LIMIT 50;
     `
@@ -196,7 +290,7 @@ func (qm *QueueManager) GetCompletedItems() ([]QueueItem, error) {
 // GetIncompleteItemsByMachineID returns all items in the queue
 func (qm *QueueManager) GetIncompleteItemsByMachineID(mid string) ([]QueueItem, error) {
 	querySQL := `
-	SELECT SID, File, Username, Name, Priority, Description, MachineID, URL, State, DtEstimate, DtCompleted, Created, Modified
+	SELECT ` + itemColumns + `
     FROM Queue 
     WHERE MachineID = %q AND State IN (0,1,2,3) ORDER BY DtCompleted ASC LIMIT 50;
     `
@@ -206,18 +300,39 @@ func (qm *QueueManager) GetIncompleteItemsByMachineID(mid string) ([]QueueItem,
 
 // GetHighestPriorityQueuedItem retrieves the highest priority item from the queue
 func (qm *QueueManager) GetHighestPriorityQueuedItem() (QueueItem, error) {
+	return qm.highestPriorityItem("GetHighestPriorityQueuedItem", "", nil)
+}
+
+// GetBookableItem retrieves the highest priority queued item that a machine
+// with the named executors can run: one that names none of them runs with
+// the machine's default executor
+func (qm *QueueManager) GetBookableItem(executors []string) (QueueItem, error) {
+	where := " AND (Executor = ''"
+	args := []any{}
+	if len(executors) > 0 {
+		where += " OR Executor IN (?" + strings.Repeat(", ?", len(executors)-1) + ")"
+		for _, e := range executors {
+			args = append(args, e)
+		}
+	}
+	return qm.highestPriorityItem("GetBookableItem", where+")", args)
+}
+
+// highestPriorityItem retrieves the highest priority queued item that also
+// matches the SQL condition where, whose arguments are args
+func (qm *QueueManager) highestPriorityItem(op, where string, args []any) (QueueItem, error) {
 	var item QueueItem
 
 	// Query to select the highest priority queued item
-	query := `SELECT SID, File, Username, Name, Priority, Description, MachineID, URL, State, DtEstimate, DtCompleted, Created, Modified
-			  FROM Queue WHERE State = ? ORDER BY Priority ASC, SID ASC LIMIT 1`
-	row := qm.db.QueryRow(query, StateQueued)
-	err := row.Scan(&item.SID, &item.File, &item.Username, &item.Name, &item.Priority, &item.Description, &item.MachineID, &item.URL, &item.State, &item.DtEstimate, &item.DtCompleted, &item.Created, &item.Modified)
+	query := `SELECT ` + itemColumns + `
+			  FROM Queue WHERE State = ?` + where + ` ORDER BY Priority ASC, SID ASC LIMIT 1`
+	row := qm.db.QueryRow(query, append([]any{StateQueued}, args...)...)
+	err := scanItem(row, &item)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return QueueItem{}, fmt.Errorf("no queued items found")
+			return QueueItem{}, ErrNoQueuedItems
 		}
-		return QueueItem{}, fmt.Errorf("failed to get highest priority queued item: %w", err)
+		return QueueItem{}, fmt.Errorf("failed to get highest priority queued item: %w", qm.check(op, err))
 	}
 
 	return item, nil
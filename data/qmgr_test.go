@@ -2,6 +2,7 @@ package data
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"testing"
 	"time"
@@ -90,6 +91,60 @@ func TestGetHighestPriorityQueuedItem(t *testing.T) {
 	}
 }
 
+// TestGetBookableItem tests that machines only book the executors they have
+func TestGetBookableItem(t *testing.T) {
+	qm, err := initTest(t)
+	if err != nil {
+		return
+	}
+
+	items := []QueueItem{
+		{File: "file1.json5", Name: "v3 job", Priority: 1, Executor: "v3", State: StateQueued},
+		{File: "file2.json5", Name: "default job", Priority: 2, State: StateQueued},
+		{File: "file3.json5", Name: "v2 job", Priority: 3, Executor: "v2", State: StateQueued},
+	}
+	for _, item := range items {
+		if _, err := qm.InsertItem(item); err != nil {
+			t.Fatalf("Failed to insert item: %v", err)
+		}
+	}
+
+	for _, tc := range []struct {
+		executors []string
+		want      string
+	}{
+		{nil, "default job"},
+		{[]string{"default"}, "default job"},
+		{[]string{"default", "v3"}, "v3 job"},
+		{[]string{"v2"}, "default job"},
+	} {
+		item, err := qm.GetBookableItem(tc.executors)
+		if err != nil {
+			t.Fatalf("GetBookableItem(%v): %v", tc.executors, err)
+		}
+		if item.Name != tc.want {
+			t.Errorf("GetBookableItem(%v): expected %q, got %q", tc.executors, tc.want, item.Name)
+		}
+	}
+
+	// With the default job booked, a v2 machine gets the v2 job and a
+	// machine without v2 or v3 gets nothing
+	item, err := qm.GetBookableItem(nil)
+	if err != nil {
+		t.Fatalf("GetBookableItem: %v", err)
+	}
+	item.State = StateBooked
+	if err := qm.UpdateItem(item); err != nil {
+		t.Fatalf("Failed to update item: %v", err)
+	}
+	if item, err = qm.GetBookableItem([]string{"v2"}); err != nil || item.Name != "v2 job" {
+		t.Errorf("GetBookableItem([v2]): expected \"v2 job\", got %q, %v", item.Name, err)
+	}
+	if _, err = qm.GetBookableItem([]string{"default"}); !errors.Is(err, ErrNoQueuedItems) {
+		t.Errorf("GetBookableItem([default]): expected ErrNoQueuedItems, got %v", err)
+	}
+}
+
 // TestQueueManager tests the basic functionalities of QueueManager
 func TestQueueManager(t *testing.T) {
 	qm, err := initTest(t)
@@ -104,6 +159,7 @@ func TestQueueManager(t *testing.T) {
 		Priority:    5,
 		Description: "A test simulation",
 		URL:         "http://localhost:8080",
+		Executor:    "v3",
 		State:       StateQueued,
 		DtEstimate:  sql.NullTime{Time: time.Now().Add(24 * time.Hour), Valid: true},
 	}
@@ -311,6 +367,9 @@ func TestGetItemByID(t *testing.T) {
 	if retrievedItem.URL != newItem.URL {
 		t.Errorf("Retrieved URL does not match: got %s want %s", retrievedItem.URL, newItem.URL)
 	}
+	if retrievedItem.Executor != newItem.Executor {
+		t.Errorf("Retrieved Executor does not match: got %s want %s", retrievedItem.Executor, newItem.Executor)
+	}
 	if retrievedItem.State != newItem.State {
 		t.Errorf("Retrieved State does not match: got %d want %d", retrievedItem.State, newItem.State)
 	}
@@ -0,0 +1,114 @@
+package data
+
+import (
+	"strings"
+	"time"
+)
+
+// Webhook is a subscription to simulation lifecycle events. The dispatcher
+// POSTs a JSON payload to URL for each matching event.
+//
+// A webhook with Global set receives events for every simulation. Otherwise
+// one with a SID receives the events for that simulation only, and one
+// without receives the events for all of its owner's simulations.
+type Webhook struct {
+	WID      int64
+	Username string // the owner
+	SID      int64  // 0 = all of the owner's simulations
+	Global   bool   // all simulations, regardless of owner
+	URL      string
+	Secret   string `json:",omitempty"` // HMAC key for the signature header, may be empty
+	Events   string // comma separated event types, empty = all of them
+	Created  time.Time
+}
+
+// webhookColumns lists the Webhooks columns in the order scanWebhook reads them
+const webhookColumns = "WID, Username, SID, Global, URL, Secret, Events, Created"
+
+// webhookSchema creates the Webhooks table
+const webhookSchema = `CREATE TABLE IF NOT EXISTS Webhooks (
+		WID BIGINT AUTO_INCREMENT PRIMARY KEY,
+		Username VARCHAR(40) NOT NULL DEFAULT '',
+		SID BIGINT NOT NULL DEFAULT 0,
+		Global TINYINT(1) NOT NULL DEFAULT 0,
+		URL VARCHAR(2048) NOT NULL DEFAULT '',
+		Secret VARCHAR(256) NOT NULL DEFAULT '',
+		Events VARCHAR(256) NOT NULL DEFAULT '',
+		Created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);`
+
+// Wants reports whether the webhook subscribes to events of type typ
+func (w *Webhook) Wants(typ string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range strings.Split(w.Events, ",") {
+		if strings.TrimSpace(e) == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// Covers reports whether the webhook applies to simulation sid owned by
+// username
+func (w *Webhook) Covers(sid int64, username string) bool {
+	switch {
+	case w.Global:
+		return true
+	case w.SID > 0:
+		return w.SID == sid
+	default:
+		return w.Username == username
+	}
+}
+
+// scanWebhook reads the webhookColumns of one row into w
+func scanWebhook(row interface{ Scan(dest ...any) error }, w *Webhook) error {
+	return row.Scan(&w.WID, &w.Username, &w.SID, &w.Global, &w.URL, &w.Secret, &w.Events, &w.Created)
+}
+
+// InsertWebhook adds a webhook and returns its WID
+func (qm *QueueManager) InsertWebhook(w Webhook) (int64, error) {
+	insertSQL := `INSERT INTO Webhooks (Username, SID, Global, URL, Secret, Events) VALUES (?, ?, ?, ?, ?, ?)`
+	result, err := qm.db.Exec(insertSQL, w.Username, w.SID, w.Global, w.URL, w.Secret, w.Events)
+	if err != nil {
+		return 0, qm.check("InsertWebhook", err)
+	}
+	return result.LastInsertId()
+}
+
+// GetWebhook returns the webhook with the supplied WID
+func (qm *QueueManager) GetWebhook(wid int64) (Webhook, error) {
+	var w Webhook
+	row := qm.db.QueryRow(`SELECT `+webhookColumns+` FROM Webhooks WHERE WID = ?`, wid)
+	if err := scanWebhook(row, &w); err != nil {
+		return w, qm.check("GetWebhook", err)
+	}
+	return w, nil
+}
+
+// GetWebhooks returns every webhook, in WID order
+func (qm *QueueManager) GetWebhooks() ([]Webhook, error) {
+	rows, err := qm.db.Query(`SELECT ` + webhookColumns + ` FROM Webhooks ORDER BY WID ASC`)
+	if err != nil {
+		return nil, qm.check("GetWebhooks", err)
+	}
+	defer rows.Close()
+
+	var hooks []Webhook
+	for rows.Next() {
+		var w Webhook
+		if err := scanWebhook(rows, &w); err != nil {
+			return nil, qm.check("GetWebhooks", err)
+		}
+		hooks = append(hooks, w)
+	}
+	return hooks, qm.check("GetWebhooks", rows.Err())
+}
+
+// DeleteWebhook removes the webhook with the supplied WID
+func (qm *QueueManager) DeleteWebhook(wid int64) error {
+	_, err := qm.db.Exec(`DELETE FROM Webhooks WHERE WID = ?`, wid)
+	return qm.check("DeleteWebhook", err)
+}
@@ -0,0 +1,55 @@
+package data
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestWebhooks tests adding, listing and deleting webhooks
+func TestWebhooks(t *testing.T) {
+	qm, err := initTest(t)
+	if err != nil {
+		return
+	}
+
+	wid1, err := qm.InsertWebhook(Webhook{Username: "alice", URL: "http://localhost:9000/a", Secret: "s1"})
+	require.NoError(t, err)
+	wid2, err := qm.InsertWebhook(Webhook{Username: "bob", SID: 42, URL: "http://localhost:9000/b", Events: "completed,error"})
+	require.NoError(t, err)
+
+	w, err := qm.GetWebhook(wid1)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", w.Username)
+	assert.Equal(t, "s1", w.Secret)
+	assert.False(t, w.Created.IsZero())
+
+	hooks, err := qm.GetWebhooks()
+	require.NoError(t, err)
+	require.Len(t, hooks, 2)
+	assert.Equal(t, wid2, hooks[1].WID)
+	assert.EqualValues(t, 42, hooks[1].SID)
+
+	require.NoError(t, qm.DeleteWebhook(wid1))
+	hooks, err = qm.GetWebhooks()
+	require.NoError(t, err)
+	assert.Len(t, hooks, 1)
+}
+
+// TestWebhookMatching tests which events and simulations a webhook covers
+func TestWebhookMatching(t *testing.T) {
+	all := Webhook{Username: "alice"}
+	assert.True(t, all.Wants("saved"))
+	assert.True(t, all.Covers(7, "alice"))
+	assert.False(t, all.Covers(7, "bob"))
+
+	one := Webhook{Username: "alice", SID: 7, Events: "completed, error"}
+	assert.True(t, one.Wants("error"))
+	assert.False(t, one.Wants("saved"))
+	assert.True(t, one.Covers(7, "bob"))
+	assert.False(t, one.Covers(8, "alice"))
+
+	global := Webhook{Global: true}
+	assert.True(t, global.Covers(9, "carol"))
+}
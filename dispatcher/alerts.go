@@ -0,0 +1,619 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/stmansour/simq/data"
+	"github.com/stmansour/simq/proto"
+	"github.com/stmansour/simq/util"
+)
+
+//----------------------------------------------------------------------------
+// ALERTS
+//
+// The alert manager evaluates its rules every alertInterval:
+//
+//	overdue     a booked simulation's DtEstimate passed OverdueMin ago
+//	stalled     a booked simulation was not updated for StallMin
+//	silent      a machine was not heard from for SilentMin
+//	unreachable the poller could not reach a running simulator
+//	error-rate  ErrorRate of the simulations that finished in the last
+//	            ErrorWindowMin failed, judged over at least ErrorMinCount
+//
+// A simulator that its machine paused or reniced, as the machine's
+// heartbeat says, is not stalled, and a paused one is not unreachable.
+//
+// Each match is keyed by its rule and subject. A new match raises an alert:
+// it is logged, POSTed to Alerts.WebhookURL and passed to Alerts.Command.
+// While the condition holds the alert stays open and is not raised again,
+// whether or not someone acknowledged it with "psq ack". When the condition
+// clears the alert is resolved and forgotten.
+//
+// Machines are heard from through Heartbeat, Book and the events that carry
+// their machine ID. Alerts live in memory; after a restart the conditions
+// that still hold are raised again.
+//----------------------------------------------------------------------------
+
+const (
+	alertInterval  = time.Minute
+	alertTimeout   = 30 * time.Second // limit for each alert action
+	alertQueueSize = 256              // events waiting to be observed
+)
+
+// alertRules holds the thresholds of the rules. A zero duration turns a
+// rule off.
+type alertRules struct {
+	overdue     time.Duration
+	stall       time.Duration
+	silent      time.Duration
+	errorRate   float64
+	errorWindow time.Duration
+	errorMin    int
+}
+
+// condition is one match found by an evaluation
+type condition struct {
+	Rule      string
+	Subject   string
+	SID       int64
+	MachineID string
+	Message   string
+}
+
+// key identifies the alert that c raises
+func (c *condition) key() string {
+	return c.Rule + "|" + c.Subject
+}
+
+// outcome is how a simulation finished
+type outcome struct {
+	t      time.Time
+	failed bool
+}
+
+// throttledSim is a simulator its machine paused or reniced
+type throttledSim struct {
+	machine string
+	paused  bool // stopped, rather than only reniced
+}
+
+// alertManager evaluates the alert rules and keeps the open alerts
+type alertManager struct {
+	rules    alertRules
+	cfg      util.AlertConfig
+	client   *http.Client
+	mu       sync.Mutex
+	lastAID  int64
+	open     map[string]*proto.Alert // condition key -> alert
+	machines map[string]time.Time    // MachineID -> when it was last heard from
+	outcomes []outcome               // simulations finished in the error window, oldest first
+	events   chan proto.Event
+	unreach  map[int64]string       // SID -> why the poller could not reach its simulator
+	throttle map[int64]throttledSim // SID -> what its machine did to its simulator
+	actions  sync.WaitGroup         // alert actions still running
+}
+
+var alerts = newAlertManager(util.AlertConfig{})
+
+// minutes converts a config value to a rule threshold: 0 is def, < 0 is off
+// -----------------------------------------------------------------------------
+func minutes(n, def int) time.Duration {
+	switch {
+	case n < 0:
+		return 0
+	case n == 0:
+		n = def
+	}
+	return time.Duration(n) * time.Minute
+}
+
+// newAlertManager returns an alert manager for the rules in cfg
+// -----------------------------------------------------------------------------
+func newAlertManager(cfg util.AlertConfig) *alertManager {
+	rules := alertRules{
+		overdue:     minutes(cfg.OverdueMin, 60),
+		stall:       minutes(cfg.StallMin, 120),
+		silent:      minutes(cfg.SilentMin, 15),
+		errorRate:   cfg.ErrorRate,
+		errorWindow: minutes(cfg.ErrorWindowMin, 60),
+		errorMin:    cfg.ErrorMinCount,
+	}
+	if rules.errorRate == 0 {
+		rules.errorRate = 0.5
+	}
+	if rules.errorMin <= 0 {
+		rules.errorMin = 5
+	}
+	if rules.errorRate < 0 {
+		rules.errorWindow = 0
+	}
+	return &alertManager{
+		rules:    rules,
+		cfg:      cfg,
+		client:   &http.Client{Timeout: alertTimeout},
+		open:     map[string]*proto.Alert{},
+		machines: map[string]time.Time{},
+		events:   make(chan proto.Event, alertQueueSize),
+		unreach:  map[int64]string{},
+		throttle: map[int64]throttledSim{},
+	}
+}
+
+// seen records that machine was heard from at t
+// -----------------------------------------------------------------------------
+func (a *alertManager) seen(machine string, t time.Time) {
+	if len(machine) == 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if t.After(a.machines[machine]) {
+		a.machines[machine] = t
+	}
+}
+
+// setUnreachable records that the simulator of sid could not be reached,
+// and why. An empty msg means it answered.
+// -----------------------------------------------------------------------------
+func (a *alertManager) setUnreachable(sid int64, msg string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(msg) == 0 {
+		delete(a.unreach, sid)
+		return
+	}
+	a.unreach[sid] = msg
+}
+
+// forgetUnreachable drops the unreachable and throttled simulators that are
+// not in running
+// -----------------------------------------------------------------------------
+func (a *alertManager) forgetUnreachable(running map[int64]bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for sid := range a.unreach {
+		if !running[sid] {
+			delete(a.unreach, sid)
+		}
+	}
+	for sid := range a.throttle {
+		if !running[sid] {
+			delete(a.throttle, sid)
+		}
+	}
+}
+
+// setThrottled records the simulators that machine has paused and reniced,
+// in place of those it reported before
+// -----------------------------------------------------------------------------
+func (a *alertManager) setThrottled(machine string, paused, reniced []int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for sid, t := range a.throttle {
+		if t.machine == machine {
+			delete(a.throttle, sid)
+		}
+	}
+	for _, sid := range reniced {
+		a.throttle[sid] = throttledSim{machine: machine}
+	}
+	for _, sid := range paused {
+		a.throttle[sid] = throttledSim{machine: machine, paused: true}
+		delete(a.unreach, sid) // it cannot answer
+	}
+}
+
+// bookedOn returns those of sids whose simulations are booked on machine,
+// looked up with get. A machine's heartbeat speaks only for its own.
+// -----------------------------------------------------------------------------
+func bookedOn(machine string, sids []int64, get func(int64) (data.QueueItem, error)) []int64 {
+	var mine []int64
+	for _, sid := range sids {
+		item, err := get(sid)
+		if err != nil || item.MachineID != machine || (item.State != data.StateBooked && item.State != data.StateExecuting) {
+			continue
+		}
+		mine = append(mine, sid)
+	}
+	return mine
+}
+
+// throttled reports whether the machine of sid paused or reniced its
+// simulator, and whether it paused it
+// -----------------------------------------------------------------------------
+func (a *alertManager) throttled(sid int64) (throttled, paused bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	t, ok := a.throttle[sid]
+	return ok, t.paused
+}
+
+// notify is called by the event bus for every event. It must not block.
+// -----------------------------------------------------------------------------
+func (a *alertManager) notify(e *proto.Event) {
+	select {
+	case a.events <- *e:
+	default:
+		slog.Warn("alert queue is full, event dropped", "sid", e.SID, "event", e.Type)
+	}
+}
+
+// observe notes the machine and the outcome in e
+// -----------------------------------------------------------------------------
+func (a *alertManager) observe(e *proto.Event) {
+	if e.Type != proto.EventExpired {
+		a.seen(e.MachineID, e.Time)
+	}
+	if e.Type != proto.EventCompleted && e.Type != proto.EventError {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.outcomes = append(a.outcomes, outcome{t: e.Time, failed: e.Type == proto.EventError})
+}
+
+// evaluate returns the conditions that hold at now for the booked and
+// executing simulations in items
+// -----------------------------------------------------------------------------
+func (a *alertManager) evaluate(items []data.QueueItem, now time.Time) []condition {
+	var conds []condition
+	held := map[string]time.Time{} // MachineID -> latest update of its simulations
+	for _, item := range items {
+		if item.State != data.StateBooked && item.State != data.StateExecuting {
+			continue
+		}
+		if item.Modified.After(held[item.MachineID]) {
+			held[item.MachineID] = item.Modified
+		}
+		if r := a.rules.overdue; r > 0 && item.DtEstimate.Valid && now.Sub(item.DtEstimate.Time) >= r {
+			conds = append(conds, condition{
+				Rule:      proto.AlertOverdue,
+				Subject:   fmt.Sprintf("SID %d", item.SID),
+				SID:       item.SID,
+				MachineID: item.MachineID,
+				Message:   fmt.Sprintf("SID %d (%s) on %s was due at %s", item.SID, item.Name, item.MachineID, item.DtEstimate.Time.Format(time.RFC3339)),
+			})
+		}
+		if throttled, _ := a.throttled(item.SID); throttled {
+			continue // slowed down on purpose, so not stalled
+		}
+		if r := a.rules.stall; r > 0 && now.Sub(item.Modified) >= r {
+			conds = append(conds, condition{
+				Rule:      proto.AlertStalled,
+				Subject:   fmt.Sprintf("SID %d", item.SID),
+				SID:       item.SID,
+				MachineID: item.MachineID,
+				Message:   fmt.Sprintf("SID %d (%s) on %s has not been updated for %s", item.SID, item.Name, item.MachineID, now.Sub(item.Modified).Round(time.Minute)),
+			})
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, item := range items {
+		msg, ok := a.unreach[item.SID]
+		if !ok || (item.State != data.StateBooked && item.State != data.StateExecuting) || a.throttle[item.SID].paused {
+			continue
+		}
+		conds = append(conds, condition{
+			Rule:      proto.AlertUnreachable,
+			Subject:   fmt.Sprintf("SID %d", item.SID),
+			SID:       item.SID,
+			MachineID: item.MachineID,
+			Message:   msg,
+		})
+	}
+
+	//------------------------------------------------------
+	// Machines holding simulations count as heard from when
+	// those were last updated, which covers machines that
+	// were busy before the dispatcher started
+	//------------------------------------------------------
+	for m, t := range held {
+		if len(m) > 0 && t.After(a.machines[m]) {
+			a.machines[m] = t
+		}
+	}
+	if r := a.rules.silent; r > 0 {
+		for m, t := range a.machines {
+			if now.Sub(t) >= r {
+				conds = append(conds, condition{
+					Rule:      proto.AlertSilent,
+					Subject:   m,
+					MachineID: m,
+					Message:   fmt.Sprintf("machine %s has not been heard from since %s", m, t.Format(time.RFC3339)),
+				})
+			}
+		}
+	}
+
+	if r := a.rules.errorWindow; r > 0 {
+		i := 0
+		for i < len(a.outcomes) && now.Sub(a.outcomes[i].t) > r {
+			i++
+		}
+		a.outcomes = a.outcomes[i:]
+		failed := 0
+		for _, o := range a.outcomes {
+			if o.failed {
+				failed++
+			}
+		}
+		if n := len(a.outcomes); n >= a.rules.errorMin && float64(failed)/float64(n) >= a.rules.errorRate {
+			conds = append(conds, condition{
+				Rule:    proto.AlertErrorRate,
+				Subject: "queue",
+				Message: fmt.Sprintf("%d of the %d simulations that finished in the last %s failed", failed, n, r),
+			})
+		}
+	}
+	return conds
+}
+
+// update opens an alert for each new condition in conds, refreshes the ones
+// that are still open and resolves the rest. It returns the new alerts.
+// -----------------------------------------------------------------------------
+func (a *alertManager) update(conds []condition, now time.Time) []proto.Alert {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var raised []proto.Alert
+	current := map[string]bool{}
+	for _, c := range conds {
+		k := c.key()
+		current[k] = true
+		if al, ok := a.open[k]; ok {
+			al.LastSeen = now
+			al.Message = c.Message
+			continue
+		}
+		a.lastAID++
+		al := &proto.Alert{
+			AID:       a.lastAID,
+			Rule:      c.Rule,
+			Subject:   c.Subject,
+			SID:       c.SID,
+			MachineID: c.MachineID,
+			Message:   c.Message,
+			Raised:    now,
+			LastSeen:  now,
+		}
+		a.open[k] = al
+		raised = append(raised, *al)
+	}
+	for k, al := range a.open {
+		if !current[k] {
+			slog.Info("alert resolved", "aid", al.AID, "rule", al.Rule, "subject", al.Subject)
+			delete(a.open, k)
+		}
+	}
+	sort.Slice(raised, func(i, j int) bool { return raised[i].AID < raised[j].AID })
+	return raised
+}
+
+// list returns the open alerts in AID order, without the acknowledged ones
+// unless all is set
+// -----------------------------------------------------------------------------
+func (a *alertManager) list(all bool) []proto.Alert {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	list := []proto.Alert{}
+	for _, al := range a.open {
+		if all || len(al.AckedBy) == 0 {
+			list = append(list, *al)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].AID < list[j].AID })
+	return list
+}
+
+// ack acknowledges the open alert aid on behalf of who
+// -----------------------------------------------------------------------------
+func (a *alertManager) ack(aid int64, who string, now time.Time) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, al := range a.open {
+		if al.AID == aid {
+			if len(al.AckedBy) == 0 {
+				al.AckedBy, al.AckedAt = who, now
+			}
+			return nil
+		}
+	}
+	return util.Errorf(util.ErrNotFound, "alert %d is not open", aid)
+}
+
+// start subscribes the alert manager to bus and evaluates the rules until
+// ctx is done
+// -----------------------------------------------------------------------------
+func (a *alertManager) start(ctx context.Context, bus *eventBus) {
+	bus.listen(a.notify)
+	go a.run(ctx)
+}
+
+// run observes events and evaluates the rules periodically until ctx is done
+// -----------------------------------------------------------------------------
+func (a *alertManager) run(ctx context.Context) {
+	ticker := time.NewTicker(alertInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-a.events:
+			a.observe(&e)
+		case <-ticker.C:
+			items, err := app.qm.GetQueuedAndExecutingItems()
+			if err != nil {
+				slog.Warn("alert check failed", "err", err)
+				continue
+			}
+			now := time.Now()
+			for _, al := range a.update(a.evaluate(items, now), now) {
+				a.raise(ctx, &al)
+			}
+		}
+	}
+}
+
+// raise logs the new alert al and starts its actions. They run on their own
+// so that a slow webhook or command does not hold up the rules.
+// -----------------------------------------------------------------------------
+func (a *alertManager) raise(ctx context.Context, al *proto.Alert) {
+	metrics.alerts.Inc(al.Rule)
+	slog.Warn("ALERT", "aid", al.AID, "rule", al.Rule, "subject", al.Subject, "message", al.Message)
+	body, err := json.Marshal(al)
+	if err != nil {
+		slog.Error("alert", "aid", al.AID, "err", err)
+		return
+	}
+	if len(a.cfg.WebhookURL) == 0 && len(a.cfg.Command) == 0 {
+		return
+	}
+	a.actions.Add(1)
+	go a.act(ctx, *al, body)
+}
+
+// act runs the actions for the alert al, whose JSON is body
+// -----------------------------------------------------------------------------
+func (a *alertManager) act(ctx context.Context, al proto.Alert, body []byte) {
+	defer a.actions.Done()
+	if len(a.cfg.WebhookURL) > 0 {
+		if err := a.post(ctx, body); err != nil {
+			slog.Warn("alert webhook failed", "aid", al.AID, "url", a.cfg.WebhookURL, "err", err)
+		}
+	}
+	if len(a.cfg.Command) > 0 {
+		if err := a.command(ctx, &al, body); err != nil {
+			slog.Warn("alert command failed", "aid", al.AID, "command", a.cfg.Command, "err", err)
+		}
+	}
+}
+
+// post sends the alert body to the alert webhook
+// -----------------------------------------------------------------------------
+func (a *alertManager) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", a.cfg.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "simq-dispatcher/"+util.Version())
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return nil
+}
+
+// command runs the alert command with the alert body on stdin and the main
+// fields in the environment
+// -----------------------------------------------------------------------------
+func (a *alertManager) command(ctx context.Context, al *proto.Alert, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, alertTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", a.cfg.Command)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(),
+		"SIMQ_ALERT_ID="+strconv.FormatInt(al.AID, 10),
+		"SIMQ_ALERT_RULE="+al.Rule,
+		"SIMQ_ALERT_SUBJECT="+al.Subject,
+		"SIMQ_ALERT_MESSAGE="+al.Message,
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil && len(out) > 0 {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	return err
+}
+
+// handleGetAlerts handles the GetAlerts command. It returns the open alerts.
+//
+//	Cmd
+//	    Command - GetAlerts
+//	    Username - the person or process making this call
+//	    Data - proto.AlertsRequest, optional
+//
+// -----------------------------------------------------------------------------
+func handleGetAlerts(w http.ResponseWriter, r *http.Request, d *HInfo) {
+	var req proto.AlertsRequest
+	if len(d.cmd.Data) > 0 {
+		if err := json.Unmarshal(d.cmd.Data, &req); err != nil {
+			util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "handleGetAlerts: invalid request data"))
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	resp := struct {
+		Status string
+		Data   []proto.Alert
+	}{
+		Status: "success",
+		Data:   alerts.list(req.All),
+	}
+	util.SvcWriteResponse(w, &resp)
+}
+
+// handleAckAlert handles the AckAlert command
+// -----------------------------------------------------------------------------
+func handleAckAlert(w http.ResponseWriter, r *http.Request, d *HInfo) {
+	var req proto.AckAlertRequest
+	if err := json.Unmarshal(d.cmd.Data, &req); err != nil {
+		util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "handleAckAlert: invalid request data"))
+		return
+	}
+	if err := alerts.ack(req.AID, d.cmd.Username, time.Now()); err != nil {
+		util.SvcErrorReturn(w, fmt.Errorf("handleAckAlert: %w", err))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	msg := proto.SvcStatus201{
+		Status:  "success",
+		Message: "alert acknowledged",
+		ID:      req.AID,
+	}
+	util.SvcWriteResponse(w, &msg)
+	d.log.Info("alert acknowledged", "aid", req.AID)
+}
+
+// handleHeartbeat handles the Heartbeat command, which machines send to show
+// that they are alive
+// -----------------------------------------------------------------------------
+func handleHeartbeat(w http.ResponseWriter, r *http.Request, d *HInfo) {
+	var req proto.HeartbeatRequest
+	if err := json.Unmarshal(d.cmd.Data, &req); err != nil || len(req.MachineID) == 0 {
+		util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "handleHeartbeat: invalid heartbeat data"))
+		return
+	}
+	if err := checkMachine(d, req.MachineID); err != nil {
+		util.SvcErrorReturn(w, fmt.Errorf("handleHeartbeat: %w", err))
+		return
+	}
+	alerts.seen(req.MachineID, time.Now())
+	paused := bookedOn(req.MachineID, req.PausedSIDs, app.qm.GetItemByID)
+	reniced := bookedOn(req.MachineID, req.RenicedSIDs, app.qm.GetItemByID)
+	alerts.setThrottled(req.MachineID, paused, reniced)
+	w.WriteHeader(http.StatusOK)
+	msg := util.SvcStatus200{Status: "success", Message: "ok"}
+	util.SvcWriteResponse(w, &msg)
+	lg := d.log.With("machine", req.MachineID, "sids", req.SIDs, "paused", req.Paused, "paused_sids", req.PausedSIDs, "reniced_sids", req.RenicedSIDs)
+	if req.Profile != nil {
+		lg = lg.With("profile", req.Profile.String())
+	}
+	lg.Debug("heartbeat")
+}
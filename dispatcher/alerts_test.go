@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stmansour/simq/data"
+	"github.com/stmansour/simq/proto"
+	"github.com/stmansour/simq/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rules maps "subject rule" to the message of each of conds
+func rules(conds []condition) map[string]string {
+	m := map[string]string{}
+	for _, c := range conds {
+		m[c.Subject+" "+c.Rule] = c.Message
+	}
+	return m
+}
+
+func TestAlertRules(t *testing.T) {
+	now := time.Now()
+	a := newAlertManager(util.AlertConfig{})
+	items := []data.QueueItem{
+		// due an hour and a half ago
+		{SID: 1, State: data.StateExecuting, MachineID: "m1", Modified: now, DtEstimate: sql.NullTime{Time: now.Add(-90 * time.Minute), Valid: true}},
+		// not updated for three hours
+		{SID: 2, State: data.StateBooked, MachineID: "m2", Modified: now.Add(-3 * time.Hour)},
+		// due, but queued
+		{SID: 3, State: data.StateQueued, Modified: now.Add(-3 * time.Hour), DtEstimate: sql.NullTime{Time: now.Add(-3 * time.Hour), Valid: true}},
+		// fine
+		{SID: 4, State: data.StateExecuting, MachineID: "m1", Modified: now.Add(-time.Minute), DtEstimate: sql.NullTime{Time: now.Add(time.Hour), Valid: true}},
+	}
+	a.seen("m3", now.Add(-time.Minute))
+	a.seen("m4", now.Add(-20*time.Minute))
+
+	got := rules(a.evaluate(items, now))
+	assert.Len(t, got, 4, got)
+	assert.Contains(t, got, "SID 1 overdue")
+	assert.Contains(t, got, "SID 2 stalled")
+	assert.Contains(t, got, "m2 silent", "machines holding simulations are known from their updates")
+	assert.Contains(t, got, "m4 silent")
+
+	//-----------------------------------------------------
+	// a heartbeat quiets a machine; negative thresholds
+	// turn rules off
+	//-----------------------------------------------------
+	a.seen("m2", now)
+	got = rules(a.evaluate(items, now))
+	assert.NotContains(t, got, "m2 silent")
+
+	off := newAlertManager(util.AlertConfig{OverdueMin: -1, StallMin: -1, SilentMin: -1, ErrorRate: -1})
+	off.seen("m4", now.Add(-24*time.Hour))
+	assert.Empty(t, off.evaluate(items, now))
+}
+
+func TestAlertErrorRate(t *testing.T) {
+	now := time.Now()
+	a := newAlertManager(util.AlertConfig{ErrorMinCount: 4, ErrorRate: 0.5, ErrorWindowMin: 30})
+	for i, failed := range []bool{true, true, false} {
+		typ := proto.EventCompleted
+		if failed {
+			typ = proto.EventError
+		}
+		a.observe(&proto.Event{Type: typ, SID: int64(i), MachineID: "m1", Time: now.Add(-time.Minute)})
+	}
+	assert.Empty(t, rules(a.evaluate(nil, now)), "too few simulations to judge")
+
+	a.observe(&proto.Event{Type: proto.EventCompleted, SID: 9, Time: now})
+	got := rules(a.evaluate(nil, now))
+	assert.Equal(t, "2 of the 4 simulations that finished in the last 30m0s failed", got["queue error-rate"])
+
+	//-----------------------------------------------------
+	// outcomes age out of the window
+	//-----------------------------------------------------
+	assert.NotContains(t, rules(a.evaluate(nil, now.Add(31*time.Minute))), "queue error-rate")
+	assert.Len(t, a.outcomes, 0)
+}
+
+func TestAlertThrottled(t *testing.T) {
+	now := time.Now()
+	a := newAlertManager(util.AlertConfig{})
+	items := []data.QueueItem{
+		{SID: 1, State: data.StateExecuting, MachineID: "m1", Modified: now.Add(-3 * time.Hour)},
+		{SID: 2, State: data.StateExecuting, MachineID: "m1", Modified: now.Add(-3 * time.Hour)},
+	}
+	a.setUnreachable(1, "no answer")
+	a.setUnreachable(2, "no answer")
+
+	//-----------------------------------------------------
+	// a paused simulator is neither stalled nor
+	// unreachable, a reniced one is not stalled
+	//-----------------------------------------------------
+	a.setThrottled("m1", []int64{1}, []int64{2})
+	got := rules(a.evaluate(items, now))
+	assert.NotContains(t, got, "SID 1 stalled")
+	assert.NotContains(t, got, "SID 1 unreachable")
+	assert.NotContains(t, got, "SID 2 stalled")
+	assert.Contains(t, got, "SID 2 unreachable")
+
+	//-----------------------------------------------------
+	// the next heartbeat replaces what the machine said
+	//-----------------------------------------------------
+	a.setThrottled("m1", nil, nil)
+	got = rules(a.evaluate(items, now))
+	assert.Contains(t, got, "SID 1 stalled")
+	assert.Contains(t, got, "SID 2 stalled")
+	assert.Empty(t, a.throttle)
+}
+
+func TestBookedOn(t *testing.T) {
+	items := map[int64]data.QueueItem{
+		1: {SID: 1, MachineID: "m1", State: data.StateBooked},
+		2: {SID: 2, MachineID: "m1", State: data.StateExecuting},
+		3: {SID: 3, MachineID: "m2", State: data.StateBooked},
+		4: {SID: 4, MachineID: "m1", State: data.StateCompleted},
+	}
+	get := func(sid int64) (data.QueueItem, error) {
+		item, ok := items[sid]
+		if !ok {
+			return item, fmt.Errorf("no SID %d", sid)
+		}
+		return item, nil
+	}
+	assert.Equal(t, []int64{1, 2}, bookedOn("m1", []int64{1, 2, 3, 4, 5}, get))
+	assert.Equal(t, []int64{3}, bookedOn("m2", []int64{1, 3}, get))
+	assert.Empty(t, bookedOn("m1", nil, get))
+}
+
+func TestAlertDedup(t *testing.T) {
+	now := time.Now()
+	a := newAlertManager(util.AlertConfig{})
+	stalled := condition{Rule: proto.AlertStalled, Subject: "SID 2", SID: 2, Message: "old"}
+	silent := condition{Rule: proto.AlertSilent, Subject: "m1", MachineID: "m1"}
+
+	raised := a.update([]condition{stalled, silent}, now)
+	require.Len(t, raised, 2)
+	assert.EqualValues(t, 1, raised[0].AID)
+
+	//-----------------------------------------------------
+	// conditions that still hold are not raised again,
+	// acknowledged or not
+	//-----------------------------------------------------
+	require.NoError(t, a.ack(raised[0].AID, "alice", now))
+	assert.Equal(t, util.ErrNotFound, util.CodeOf(a.ack(99, "alice", now)))
+	stalled.Message = "new"
+	assert.Empty(t, a.update([]condition{stalled, silent}, now.Add(time.Minute)))
+	open := a.list(false)
+	require.Len(t, open, 1)
+	assert.Equal(t, "m1", open[0].Subject)
+	all := a.list(true)
+	require.Len(t, all, 2)
+	assert.Equal(t, "alice", all[0].AckedBy)
+	assert.Equal(t, "new", all[0].Message)
+	assert.Equal(t, now.Add(time.Minute), all[0].LastSeen)
+
+	//-----------------------------------------------------
+	// cleared conditions are resolved; if they come back
+	// they are new alerts
+	//-----------------------------------------------------
+	assert.Empty(t, a.update([]condition{silent}, now.Add(2*time.Minute)))
+	assert.Len(t, a.list(true), 1)
+	raised = a.update([]condition{stalled, silent}, now.Add(3*time.Minute))
+	require.Len(t, raised, 1)
+	assert.EqualValues(t, 3, raised[0].AID)
+	assert.Empty(t, raised[0].AckedBy)
+}
+
+func TestAlertActions(t *testing.T) {
+	got := make(chan proto.Alert, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var al proto.Alert
+		json.NewDecoder(r.Body).Decode(&al)
+		got <- al
+	}))
+	defer srv.Close()
+	out := filepath.Join(t.TempDir(), "alert.out")
+	a := newAlertManager(util.AlertConfig{
+		WebhookURL: srv.URL,
+		Command:    `sleep 1 && cat > ` + out + ` && echo "$SIMQ_ALERT_RULE $SIMQ_ALERT_SUBJECT" >> ` + out,
+	})
+
+	al := proto.Alert{AID: 7, Rule: proto.AlertSilent, Subject: "m1", MachineID: "m1", Message: "quiet"}
+	start := time.Now()
+	a.raise(context.Background(), &al)
+	assert.Less(t, time.Since(start), time.Second, "raise waited for the command")
+	select {
+	case posted := <-got:
+		assert.Equal(t, al.AID, posted.AID)
+		assert.Equal(t, "quiet", posted.Message)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the alert webhook was not called")
+	}
+	a.actions.Wait()
+	b, err := os.ReadFile(out)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `"AID":7`)
+	assert.Contains(t, string(b), "silent m1\n")
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+
+	"github.com/stmansour/simq/data"
+	"github.com/stmansour/simq/util"
+)
+
+//----------------------------------------------------------------------------
+// AUTHENTICATION AND AUTHORIZATION
+//
+// Callers send an API token in the Authorization header as "Bearer <token>".
+// The tokens are listed in the APITokens section of the configuration, each
+// with a name and a role. The role decides which commands the caller may run;
+// users may only change their own simulations, and machines only the ones
+// booked with their MachineID. The caller's name replaces the Username in the
+// command so that it cannot be forged.
+//
+// If no tokens are configured, authentication is off and every caller is
+// treated as an admin using the Username it supplies.
+//----------------------------------------------------------------------------
+
+// roleSet is a set of roles. Admins may run every command, so the handler
+// table lists only the other roles.
+type roleSet int
+
+const (
+	roleUser roleSet = 1 << iota
+	roleMachine
+	roleAdmin
+)
+
+// anyRole is for commands that every authenticated caller may run
+const anyRole = roleUser | roleMachine
+
+// caller is the authenticated identity behind a request
+type caller struct {
+	Name      string
+	Role      string
+	MachineID string // for a machine, the MachineID it books with
+}
+
+// roleByName maps the role names used in the configuration to roleSets
+var roleByName = map[string]roleSet{
+	util.RoleUser:    roleUser,
+	util.RoleMachine: roleMachine,
+	util.RoleAdmin:   roleAdmin,
+}
+
+// setAPITokens validates and installs the configured tokens
+// -----------------------------------------------------------------------------
+func setAPITokens(tokens []util.APIToken) error {
+	seen := map[string]bool{}
+	for i, t := range tokens {
+		if len(t.Token) == 0 || len(t.Name) == 0 {
+			return fmt.Errorf("APITokens[%d]: Token and Name are required", i)
+		}
+		if _, ok := roleByName[t.Role]; !ok {
+			return fmt.Errorf("APITokens[%d] (%s): unknown role %q", i, t.Name, t.Role)
+		}
+		if seen[t.Token] {
+			return fmt.Errorf("APITokens[%d] (%s): duplicate token", i, t.Name)
+		}
+		seen[t.Token] = true
+	}
+	app.tokens = tokens
+	return nil
+}
+
+// lookupToken returns the configured token matching tok
+// -----------------------------------------------------------------------------
+func lookupToken(tok string) (util.APIToken, bool) {
+	var found util.APIToken
+	ok := false
+	for _, t := range app.tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(tok)) == 1 {
+			found, ok = t, true
+		}
+	}
+	return found, ok
+}
+
+// authorize identifies the caller of d.cmd and returns an error if it may
+// not run the command.
+// -----------------------------------------------------------------------------
+func authorize(r *http.Request, d *HInfo, h HandlerTableEntry) error {
+	if len(app.tokens) == 0 {
+		d.caller = caller{Name: d.cmd.Username, Role: util.RoleAdmin}
+		return nil
+	}
+	tok := util.BearerToken(r)
+	if len(tok) == 0 {
+		return util.Errorf(util.ErrUnauthorized, "authorization required")
+	}
+	t, ok := lookupToken(tok)
+	if !ok {
+		return util.Errorf(util.ErrUnauthorized, "invalid API token")
+	}
+	d.caller = caller{Name: t.Name, Role: t.Role}
+	if t.Role == util.RoleMachine {
+		d.caller.MachineID = t.MachineID
+		if len(d.caller.MachineID) == 0 {
+			d.caller.MachineID = t.Name
+		}
+	}
+	d.cmd.Username = t.Name
+	if role := roleByName[t.Role]; role != roleAdmin && h.Roles&role == 0 {
+		return util.Errorf(util.ErrForbidden, "%s %s may not run %s", t.Role, t.Name, d.cmd.Command)
+	}
+	return nil
+}
+
+// checkOwner returns an error if the caller is a user and item belongs to
+// someone else. Machines and admins may act on any simulation.
+// -----------------------------------------------------------------------------
+func checkOwner(d *HInfo, item *data.QueueItem) error {
+	if d.caller.Role == util.RoleUser && item.Username != d.caller.Name {
+		return util.Errorf(util.ErrForbidden, "simulation %d belongs to %s", item.SID, item.Username)
+	}
+	return nil
+}
+
+// checkMachine returns an error if the caller is a machine and machineID, the
+// machine a request is for, is another one. Users and admins are not checked.
+// -----------------------------------------------------------------------------
+func checkMachine(d *HInfo, machineID string) error {
+	if d.caller.Role == util.RoleMachine && machineID != d.caller.MachineID {
+		return util.Errorf(util.ErrForbidden, "machine %s may not act for machine %q", d.caller.MachineID, machineID)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stmansour/simq/data"
+	"github.com/stmansour/simq/proto"
+	"github.com/stmansour/simq/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sendAuthed(t *testing.T, body, token string) *httptest.ResponseRecorder {
+	r, err := http.NewRequest("POST", "/command", bytes.NewBufferString(body))
+	require.NoError(t, err)
+	r.Header.Set("Content-Type", "application/json")
+	if len(token) > 0 {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	commandDispatcher(rr, r)
+	return rr
+}
+
+func TestAuthorize(t *testing.T) {
+	require.Error(t, setAPITokens([]util.APIToken{{Token: "x", Name: "a", Role: "root"}}))
+	require.Error(t, setAPITokens([]util.APIToken{{Token: "x", Name: "a", Role: "user"}, {Token: "x", Name: "b", Role: "user"}}))
+	require.NoError(t, setAPITokens([]util.APIToken{
+		{Token: "usertok", Name: "alice", Role: util.RoleUser},
+		{Token: "machtok", Name: "plato", Role: util.RoleMachine},
+		{Token: "mach2tok", Name: "socrates", Role: util.RoleMachine, MachineID: "m-2"},
+		{Token: "admintok", Name: "root", Role: util.RoleAdmin},
+	}))
+	defer setAPITokens(nil)
+	defer app.paused.Store(false)
+
+	assert.Equal(t, http.StatusUnauthorized, sendAuthed(t, `{"Command":"Pause"}`, "").Code)
+	assert.Equal(t, http.StatusUnauthorized, sendAuthed(t, `{"Command":"Pause"}`, "nope").Code)
+	assert.Equal(t, http.StatusForbidden, sendAuthed(t, `{"Command":"Pause"}`, "usertok").Code)
+	assert.Equal(t, http.StatusForbidden, sendAuthed(t, `{"Command":"Pause"}`, "machtok").Code)
+	assert.False(t, app.paused.Load())
+	assert.Equal(t, http.StatusOK, sendAuthed(t, `{"Command":"Pause"}`, "admintok").Code)
+	assert.True(t, app.paused.Load())
+
+	// the caller's name replaces the Username it sends
+	d := HInfo{cmd: &proto.Command{Command: "NewSimulation", Username: "mallory"}}
+	r := httptest.NewRequest("POST", "/command", nil)
+	r.Header.Set("Authorization", "Bearer usertok")
+	require.NoError(t, authorize(r, &d, handlerTable["NewSimulation"]))
+	assert.Equal(t, "alice", d.cmd.Username)
+	assert.Equal(t, util.ErrForbidden, util.CodeOf(authorize(r, &d, handlerTable["Book"])))
+
+	// users may only change their own simulations
+	assert.NoError(t, checkOwner(&d, &data.QueueItem{SID: 1, Username: "alice"}))
+	assert.Equal(t, util.ErrForbidden, util.CodeOf(checkOwner(&d, &data.QueueItem{SID: 2, Username: "bob"})))
+	d.caller.Role = util.RoleMachine
+	assert.NoError(t, checkOwner(&d, &data.QueueItem{SID: 2, Username: "bob"}))
+
+	// machines may only act for their own MachineID, which is their name
+	// unless the token sets one
+	assert.NoError(t, checkMachine(&HInfo{caller: caller{Role: util.RoleUser}}, "m-1"))
+	for _, tc := range []struct {
+		token, machine string
+	}{
+		{"machtok", "plato"},
+		{"mach2tok", "m-2"},
+	} {
+		d := HInfo{cmd: &proto.Command{Command: "UpdateItem"}}
+		r := httptest.NewRequest("POST", "/command", nil)
+		r.Header.Set("Authorization", "Bearer "+tc.token)
+		require.NoError(t, authorize(r, &d, handlerTable["UpdateItem"]))
+		assert.NoError(t, checkMachine(&d, tc.machine))
+		assert.Equal(t, util.ErrForbidden, util.CodeOf(checkMachine(&d, "m-3")))
+		assert.Equal(t, util.ErrForbidden, util.CodeOf(checkMachine(&d, "")))
+	}
+
+	// which includes heartbeats and reading a machine's queue
+	defer func(a *alertManager) { alerts = a }(alerts)
+	alerts = newAlertManager(util.AlertConfig{})
+	assert.Equal(t, http.StatusOK, sendAuthed(t, `{"Command":"Heartbeat","Data":{"MachineID":"plato"}}`, "machtok").Code)
+	rr := sendAuthed(t, `{"Command":"Heartbeat","Data":{"MachineID":"m-2","PausedSIDs":[7]}}`, "machtok")
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Contains(t, alerts.machines, "plato")
+	assert.NotContains(t, alerts.machines, "m-2")
+	assert.Empty(t, alerts.throttle)
+	assert.Equal(t, http.StatusForbidden, sendAuthed(t, `{"Command":"GetMachineQueue","Data":{"MachineID":"plato"}}`, "mach2tok").Code)
+}
+
+func TestAuthDisabled(t *testing.T) {
+	require.NoError(t, setAPITokens(nil))
+	d := HInfo{cmd: &proto.Command{Command: "Shutdown", Username: "bob"}}
+	require.NoError(t, authorize(httptest.NewRequest("POST", "/command", nil), &d, handlerTable["Shutdown"]))
+	assert.Equal(t, util.RoleAdmin, d.caller.Role)
+	assert.Equal(t, "bob", d.caller.Name)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stmansour/simq/client"
+	"github.com/stmansour/simq/proto"
+	"github.com/stmansour/simq/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestClient starts a dispatcher command server and returns a client for it
+// -----------------------------------------------------------------------------
+func newTestClient(t *testing.T) *client.Client {
+	srv := httptest.NewServer(http.HandlerFunc(commandDispatcher))
+	t.Cleanup(srv.Close)
+	c := client.New(srv.URL+"/command", "test-user")
+	c.HTTP = srv.Client()
+	return c
+}
+
+func TestClientResults(t *testing.T) {
+	makeTestResults(t, "42")
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	files, err := c.ListResults(ctx, 42)
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	assert.Equal(t, "finrep.csv", files[1].Name)
+
+	body, err := c.GetResults(ctx, 42, "finrep.csv")
+	require.NoError(t, err)
+	b, err := io.ReadAll(body)
+	body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "a,b,c\n1,2,3\n", string(b))
+
+	_, err = c.ListResults(ctx, 43)
+	assert.Equal(t, util.ErrNotFound, util.CodeOf(err))
+	_, err = c.GetResults(ctx, 42, "../../x")
+	assert.Error(t, err)
+}
+
+func TestClientPause(t *testing.T) {
+	defer app.paused.Store(false)
+	c := newTestClient(t)
+	ctx := client.WithCorrelationID(context.Background(), "test-corr")
+
+	st, err := c.Pause(ctx)
+	require.NoError(t, err)
+	assert.Contains(t, st.Message, "paused")
+	assert.True(t, app.paused.Load())
+
+	booking, err := c.Book(ctx, &proto.SimulationBookingRequest{MachineID: "m1"})
+	require.NoError(t, err)
+	assert.Equal(t, util.CodePaused, booking.Code)
+	assert.EqualValues(t, 0, booking.SID)
+
+	_, err = c.Resume(ctx)
+	require.NoError(t, err)
+	assert.False(t, app.paused.Load())
+}
+
+func TestClientRetry(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			util.SvcErrorReturn(w, util.Errorf(util.ErrInternal, "database is busy"))
+			return
+		}
+		util.SvcWriteResponse(w, &util.SvcStatus200{Status: "success", Message: "ok"})
+	}))
+	defer srv.Close()
+	c := client.New(srv.URL, "test-user")
+	c.Backoff = time.Millisecond
+
+	//-----------------------------------------------------
+	// idempotent commands are retried after server errors
+	//-----------------------------------------------------
+	st, err := c.Pause(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "ok", st.Message)
+	assert.EqualValues(t, 3, calls.Load())
+
+	//-----------------------------------------------------
+	// the others are not
+	//-----------------------------------------------------
+	calls.Store(0)
+	_, err = c.DeleteItem(context.Background(), 1)
+	assert.Equal(t, util.ErrInternal, util.CodeOf(err))
+	assert.EqualValues(t, 1, calls.Load())
+
+	//-----------------------------------------------------
+	// a dispatcher that is not running is retried, then
+	// the error is returned
+	//-----------------------------------------------------
+	srv.Close()
+	c.Retries = 1
+	_, err = c.DeleteItem(context.Background(), 1)
+	assert.Error(t, err)
+}
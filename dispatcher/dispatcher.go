@@ -1,12 +1,13 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"mime/multipart"
 	"net/http"
 	"os"
@@ -15,134 +16,94 @@ import (
 	"time"
 
 	"github.com/stmansour/simq/data"
+	"github.com/stmansour/simq/proto"
 	"github.com/stmansour/simq/util"
 )
 
-// Command represents the structure of a command
-type Command struct {
-	Command  string
-	Username string
-	Data     json.RawMessage
-}
-
-// CreateQueueEntryRequest represents the data for creating a queue entry
-type CreateQueueEntryRequest struct {
-	FileContent      string
-	Name             string
-	Priority         int
-	Description      string
-	URL              string
-	OriginalFilename string
-}
-
-// MachineQueueRequest represents the data for creating a machine queue
-type MachineQueueRequest struct {
-	MachineID string
-}
-
-// UpdateItemRequest represents the data for updating a queue item
-type UpdateItemRequest struct {
-	SID         int64
-	Priority    int
-	Description string
-	MachineID   string
-	URL         string
-	DtEstimate  string
-	DtCompleted string
-	CPUs        int
-	Memory      string
-}
-
-// EndSimulationRequest represents the data for ending a simulation
-type EndSimulationRequest struct {
-	Command  string
-	Username string
-	SID      int64  // simulation ID that has ended
-	Filename string // the tar.gz file that contains the results
-}
-
-// DeleteItemRequest represents the data for deleting a queue item
-type DeleteItemRequest struct {
-	SID int64
-}
-
 // HandlerTableEntry represents an entry in the handler table
 type HandlerTableEntry struct {
 	Handler func(w http.ResponseWriter, r *http.Request, h *HInfo)
-}
-
-// SimulationBookingRequest represents the data for booking a simulation
-type SimulationBookingRequest struct {
-	Command         string
-	Username        string
-	MachineID       string
-	CPUs            int
-	Memory          string
-	CPUArchitecture string
-	Availability    string
-}
-
-// GetSIDRequest represents the data for getting a simulation ID
-type GetSIDRequest struct {
-	SID int64
-}
-
-// SimulationRebookRequest represents the data for rebooking a simulation
-type SimulationRebookRequest struct {
-	SID       int64
-	MachineID string
-}
-
-// BookedResponse represents the response for booking a simulation
-type BookedResponse struct {
-	Status         string
-	Message        string
-	SID            int64
-	ConfigFilename string
+	Roles   roleSet // who besides admins may run the command
 }
 
 // HInfo holds information about the request
 type HInfo struct {
-	cmd       *Command
+	cmd       *proto.Command
 	BodyBytes []byte
+	log       *slog.Logger // logs with the request's correlation ID, command and user
+	caller    caller       // who sent the request
 }
 
 var handlerTable = map[string]HandlerTableEntry{
-	"Book":              {Handler: handleBook},
-	"DeleteItem":        {Handler: handleDeleteItem},
-	"EndSimulation":     {Handler: handleEndSimulation},
-	"GetActiveQueue":    {Handler: handleGetActiveQueue},
-	"GetCompletedQueue": {Handler: handleGetCompletedQueue},
-	"GetMachineQueue":   {Handler: handleGetMachineQueue},
-	"GetSID":            {Handler: handleGetSID},
-	"NewSimulation":     {Handler: handleNewSimulation},
-	"Priority":          {Handler: handlePriority},
-	"Rebook":            {Handler: handleBook},
-	"Redo":              {Handler: handleRedo},
+	"AckAlert":          {Handler: handleAckAlert, Roles: roleUser},
+	"AddWebhook":        {Handler: handleAddWebhook, Roles: roleUser},
+	"Book":              {Handler: handleBook, Roles: roleMachine},
+	"Capabilities":      {Handler: handleCapabilities, Roles: anyRole},
+	"DeleteItem":        {Handler: handleDeleteItem, Roles: roleUser},
+	"DeleteWebhook":     {Handler: handleDeleteWebhook, Roles: roleUser},
+	"EndSimulation":     {Handler: handleEndSimulation, Roles: roleMachine},
+	"Fsck":              {Handler: handleFsck},
+	"GetActiveQueue":    {Handler: handleGetActiveQueue, Roles: anyRole},
+	"GetAlerts":         {Handler: handleGetAlerts, Roles: roleUser},
+	"GetCompletedQueue": {Handler: handleGetCompletedQueue, Roles: anyRole},
+	"GetEmailPrefs":     {Handler: handleGetEmailPrefs, Roles: roleUser},
+	"GetMachineQueue":   {Handler: handleGetMachineQueue, Roles: roleMachine},
+	"GetProgress":       {Handler: handleGetProgress, Roles: anyRole},
+	"GetResults":        {Handler: handleGetResults, Roles: anyRole},
+	"GetSID":            {Handler: handleGetSID, Roles: anyRole},
+	"Heartbeat":         {Handler: handleHeartbeat, Roles: roleMachine},
+	"ListResults":       {Handler: handleListResults, Roles: anyRole},
+	"ListWebhooks":      {Handler: handleListWebhooks, Roles: roleUser},
+	"NewSimulation":     {Handler: handleNewSimulation, Roles: roleUser},
+	"Pause":             {Handler: handlePause},
+	"Priority":          {Handler: handlePriority, Roles: roleUser},
+	"Rebook":            {Handler: handleBook, Roles: roleMachine},
+	"Redo":              {Handler: handleRedo, Roles: roleUser},
+	"ReportProgress":    {Handler: handleReportProgress, Roles: roleMachine},
+	"Resume":            {Handler: handlePause},
+	"SetEmailPrefs":     {Handler: handleSetEmailPrefs, Roles: roleUser},
 	"Shutdown":          {Handler: handleShutdown},
-	"UpdateItem":        {Handler: handleUpdateItem},
+	"UpdateItem":        {Handler: handleUpdateItem, Roles: roleMachine},
 }
 
-// app.HTTPHdrsDbg = true
-// app.HexASCIIDbg = true
-
 // commandDispatcher dispatches commands to appropriate handlers
 // -----------------------------------------------------------------------------
 func commandDispatcher(w http.ResponseWriter, r *http.Request) {
-	var cmd Command
+	var cmd proto.Command
 	var ok bool
 	var d HInfo
 	h := HandlerTableEntry{}
 
-	app.HTTPHdrsDbg = true
-	app.HexASCIIDbg = true
+	//------------------------------------------------------------
+	// Measure every command for /metrics
+	//------------------------------------------------------------
+	start := time.Now()
+	mw := &metricsWriter{ResponseWriter: w}
+	w = mw
+	body := &countingReadCloser{ReadCloser: r.Body}
+	r.Body = body
+	defer func() {
+		recordRequest(cmd.Command, mw, body.n, time.Since(start))
+		logRequest(&d, mw, time.Since(start))
+	}()
+
+	//------------------------------------------------------------
+	// Every reply carries the caller's correlation ID, or a new
+	// one if the caller did not send one.
+	//------------------------------------------------------------
+	corr := r.Header.Get(util.CorrelationHeader)
+	if len(corr) == 0 {
+		corr = util.NewCorrelationID()
+	}
+	w.Header().Set(util.CorrelationHeader, corr)
+	d.log = slog.With("corr", corr)
 
 	//--------------------------------
 	// Check for Content-Type header
 	//-------------------------------
 	contentType := r.Header.Get("Content-Type")
 	if contentType == "" {
-		util.SvcErrorReturn(w, fmt.Errorf("commandDispatcher: missing Content-Type header in request"))
+		util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "commandDispatcher: missing Content-Type header in request"))
 		return
 	}
 
@@ -151,27 +112,27 @@ func commandDispatcher(w http.ResponseWriter, r *http.Request) {
 	//--------------------------------------------
 	if strings.Contains(contentType, "multipart/form-data") {
 		if err := r.ParseMultipartForm(10 << 20); err != nil {
-			util.SvcErrorReturn(w, fmt.Errorf("commandDispatcher: failed to parse multipart form: %v", err))
+			util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "commandDispatcher: failed to parse multipart form: %v", err))
 			return
 		}
 		dataField := r.FormValue("data") // Extract the data part
 		if dataField == "" {
-			util.SvcErrorReturn(w, fmt.Errorf("commandDispatcher: missing data field in multipart request"))
+			util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "commandDispatcher: missing data field in multipart request"))
 			return
 		}
 		d.BodyBytes = []byte(dataField)
 		if err := json.Unmarshal([]byte(dataField), &cmd); err != nil {
-			util.SvcErrorReturn(w, fmt.Errorf("commandDispatcher: invalid data payload in multipart request: %v", err))
+			util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "commandDispatcher: invalid data payload in multipart request: %v", err))
 			return
 		}
 	} else {
 		bodyBytes, err := io.ReadAll(r.Body) // Single-part request - unmarshal directly
 		if err != nil {
-			util.SvcErrorReturn(w, fmt.Errorf("commandDispatcher: failed to read request body: %v", err))
+			util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "commandDispatcher: failed to read request body: %v", err))
 			return
 		}
 		if err := json.Unmarshal(bodyBytes, &cmd); err != nil {
-			util.SvcErrorReturn(w, fmt.Errorf("commandDispatcher: invalid request payload: %v", err))
+			util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "commandDispatcher: invalid request payload: %v", err))
 			return
 		}
 
@@ -179,24 +140,56 @@ func commandDispatcher(w http.ResponseWriter, r *http.Request) {
 	}
 
 	d.cmd = &cmd // Define d with the unmarshalled cmd struct and BodyBytes (if applicable)
+	if len(r.Header.Get(util.CorrelationHeader)) == 0 && len(cmd.CorrelationID) > 0 {
+		corr = cmd.CorrelationID
+		w.Header().Set(util.CorrelationHeader, corr)
+	}
+	d.log = slog.With("corr", corr, "cmd", cmd.Command, "user", cmd.Username, "client", cmd.ClientVersion, "protocol", cmd.Version())
 
-	//--------------------
-	// DEBUGGING
-	//--------------------
-	// log.Printf("\tDispatcher: >>>> received command: %s, username: %s", cmd.Command, cmd.Username)
+	//---------------------------------------------------------------
+	// Refuse clients that speak a protocol version we do not
+	//---------------------------------------------------------------
+	if err := cmd.CheckVersion(); err != nil {
+		util.SvcErrorReturn(w, util.Errorf(util.ErrIncompatible, "commandDispatcher: %v", err))
+		return
+	}
 
 	//---------------------------------------------------------------
 	// Access the handler table without mutex since it's read-only
 	//---------------------------------------------------------------
 	h, ok = handlerTable[cmd.Command]
 	if !ok {
-		log.Printf("Internal Error: handler not found for command: %s", cmd.Command)
+		util.SvcErrorReturn(w, util.Errorf(util.ErrUnknownCommand, "commandDispatcher: unknown command: %q", cmd.Command))
+		return
+	}
+
+	//---------------------------------------------------------------
+	// Make sure the caller may run this command
+	//---------------------------------------------------------------
+	if err := authorize(r, &d, h); err != nil {
+		util.SvcErrorReturn(w, fmt.Errorf("commandDispatcher: %w", err))
 		return
 	}
+	d.log = d.log.With("user", cmd.Username)
 
 	h.Handler(w, r, &d)
 }
 
+// logRequest logs one line per command when it is done. Failed commands are
+// logged as warnings, the rest at debug level.
+// -----------------------------------------------------------------------------
+func logRequest(d *HInfo, mw *metricsWriter, elapsed time.Duration) {
+	status := mw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	level := slog.LevelDebug
+	if mw.failed || status >= 400 {
+		level = slog.LevelWarn
+	}
+	d.log.Log(context.Background(), level, "request done", "status", status, "failed", mw.failed, "ms", elapsed.Milliseconds())
+}
+
 // handleEndSimulation handles the EndSimulation command.
 //
 //	The request body contains:
@@ -209,72 +202,33 @@ func commandDispatcher(w http.ResponseWriter, r *http.Request) {
 //
 // ---------------------------------------------------------------------------
 func handleEndSimulation(w http.ResponseWriter, r *http.Request, d *HInfo) {
-	log.Printf("*** entered: handleEndSimulation\n")
-	var cmd EndSimulationRequest
+	var cmd proto.EndSimulationRequest
 
 	if err := json.Unmarshal(d.BodyBytes, &cmd); err != nil {
-		util.SvcErrorReturn(w, fmt.Errorf("handleEndSimulation: invalid end simulation request data"))
-		return
-	}
-
-	log.Printf("handleEndSimulation: SID: %d, Filename: %s\n", cmd.SID, cmd.Filename)
-
-	//----------------------------------------------------------------------------
-	// BUILD THE DESTINATION DIRECTORY
-	// /genome/simres/YYYY/MM/DD/SID/results.tar.gz
-	//
-	// for testing: /opt/testsimres
-	//----------------------------------------------------------------------------
-	now := time.Now()
-	year := now.Year()
-	month := now.Month()
-	day := now.Day()
-	dirPath := filepath.Join(app.SimResultsDir,
-		fmt.Sprintf("%d", year),
-		fmt.Sprintf("%d", month),
-		fmt.Sprintf("%d", day),
-		fmt.Sprintf("%d", cmd.SID),
-	)
-	filename := filepath.Join(dirPath, cmd.Filename)
-
-	//--------------------------------------------------------
-	// DO ALL THE FILE I/O IN A THREAD-SAFE FUNCTION...
-	//--------------------------------------------------------
-	if err := threadSafeFileIOEndSim(dirPath, filename, r); err != nil {
-		util.SvcErrorReturn(w, fmt.Errorf("handleEndSimulation: error from threadSafeFileIOForBook: %s", err.Error()))
+		util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "handleEndSimulation: invalid end simulation request data"))
 		return
 	}
 
-	//--------------------------------------------------------
-	// UPDATE THE STATE OF THIS ITEM - RESULTS SAVED
-	//--------------------------------------------------------
-	queueItem, err := app.qm.GetItemByID(cmd.SID)
+	d.log.Info("ending simulation", "sid", cmd.SID, "file", cmd.Filename)
+	item, err := app.qm.GetItemByID(cmd.SID)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			util.SvcErrorReturn(w, fmt.Errorf("handleEndSimulation: queue item %d not found", cmd.SID))
-		} else {
-			util.SvcErrorReturn(w, fmt.Errorf("handleEndSimulation: error in GetItemByID: %v", err))
-		}
+		util.SvcErrorReturn(w, util.Errorf(lookupCode(err), "handleEndSimulation: SID %d not found", cmd.SID))
 		return
 	}
-
-	queueItem.State = data.StateResultsSaved
-
-	if err := app.qm.UpdateItem(queueItem); err != nil {
-		util.SvcErrorReturn(w, fmt.Errorf("handleEndSimulation: error in UpdateItem: %v", err))
+	if err := checkMachine(d, item.MachineID); err != nil {
+		util.SvcErrorReturn(w, fmt.Errorf("handleEndSimulation: SID %d: %w", cmd.SID, err))
 		return
 	}
 
-	//---------------------------------------------------------------
-	// WE NO LONGER NEED THE CONFIG FILE IN QDCONFIGS, REMOVE IT...
-	//---------------------------------------------------------------
-	configDir := filepath.Join(app.QdConfigsDir, fmt.Sprintf("%d", queueItem.SID))
-	log.Printf("handleEndSimulation: removing config directory %s\n", configDir)
-	if err := threadSafeRemoveAll(configDir); err != nil {
-		util.SvcErrorReturn(w, fmt.Errorf("handleEndSimulation: error in removing %s: %v", configDir, err))
+	//--------------------------------------------------------------
+	// SAVE THE RESULTS AND UPDATE THE STATE TO RESULTS SAVED. THE
+	// CONFIG FILE IN QDCONFIGS IS NO LONGER NEEDED AND IS REMOVED.
+	//--------------------------------------------------------------
+	location, err := threadSafeEndSim(cmd.SID, r)
+	if err != nil {
+		util.SvcErrorReturn(w, fmt.Errorf("handleEndSimulation: %w", err))
 		return
 	}
-	log.Printf("handleEndSimulation: sucussfully removed %s\n", configDir)
 
 	//------------------------------
 	// SEND RESPONSE
@@ -285,10 +239,15 @@ func handleEndSimulation(w http.ResponseWriter, r *http.Request, d *HInfo) {
 		Message string
 	}{
 		Status:  "success",
-		Message: "Results stored in: " + dirPath,
+		Message: "Results stored in: " + location,
 	}
 	util.SvcWriteResponse(w, &resp)
-	log.Printf("*** handleEndSimulation:  SUCCESSFUL ***\n")
+	d.log.Info("results saved", "sid", cmd.SID, "location", location)
+	if item, err := app.qm.GetItemByID(cmd.SID); err == nil {
+		publishItem(proto.EventSaved, &item, "")
+	} else {
+		events.publish(proto.Event{Type: proto.EventSaved, SID: cmd.SID, State: data.StateResultsSaved})
+	}
 }
 
 // handleBook handles the Book command
@@ -299,22 +258,46 @@ func handleBook(w http.ResponseWriter, r *http.Request, d *HInfo) {
 	//---------------------------------------------------
 	// Decode the booking request
 	//---------------------------------------------------
-	var bookingRequest SimulationBookingRequest
-	var rebookRequest SimulationRebookRequest
+	var bookingRequest proto.SimulationBookingRequest
+	var rebookRequest proto.SimulationRebookRequest
 	switch d.cmd.Command {
 	case "Book":
 		if err := json.Unmarshal(d.cmd.Data, &bookingRequest); err != nil {
-			util.SvcErrorReturn(w, fmt.Errorf("handleBook: invalid booking request data"))
+			util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "handleBook: invalid booking request data"))
+			return
+		}
+		if err := checkMachine(d, bookingRequest.MachineID); err != nil {
+			util.SvcErrorReturn(w, fmt.Errorf("handleBook: %w", err))
+			return
+		}
+		alerts.seen(bookingRequest.MachineID, time.Now())
+		if p := bookingRequest.Profile; p != nil {
+			d.log.Debug("booking request", "machine", bookingRequest.MachineID, "profile", p.String())
+		}
+		//---------------------------------------------------
+		// While paused, nothing new is handed out
+		//---------------------------------------------------
+		if app.paused.Load() {
+			msg := proto.SvcStatus201{
+				Status:  "success",
+				Code:    util.CodePaused,
+				Message: "dispatcher is paused, no simulations are being booked",
+				ID:      0,
+			}
+			w.WriteHeader(http.StatusOK)
+			util.SvcWriteResponse(w, &msg)
 			return
 		}
 		//---------------------------------------------------
 		// Retrieve the highest priority job from the queue
+		// that the machine has an executor for
 		//---------------------------------------------------
-		queueItem, err = app.qm.GetHighestPriorityQueuedItem()
+		queueItem, err = app.qm.GetBookableItem(bookingRequest.Executors)
 		if err != nil {
-			if strings.Contains(err.Error(), "no queued items") {
-				msg := SvcStatus201{
+			if errors.Is(err, data.ErrNoQueuedItems) {
+				msg := proto.SvcStatus201{
 					Status:  "success",
+					Code:    util.CodeQueueEmpty,
 					Message: "no queued items need booking",
 					ID:      0,
 				}
@@ -322,32 +305,38 @@ func handleBook(w http.ResponseWriter, r *http.Request, d *HInfo) {
 				util.SvcWriteResponse(w, &msg)
 				return
 			}
-			util.SvcErrorReturn(w, fmt.Errorf("handleBook: err: %s", err.Error()))
+			util.SvcErrorReturn(w, util.Errorf(util.ErrInternal, "handleBook: err: %s", err.Error()))
 			return
 		}
 	case "Rebook":
-		log.Printf("handling Rebook command\n")
 		if err := json.Unmarshal(d.cmd.Data, &rebookRequest); err != nil {
-			util.SvcErrorReturn(w, fmt.Errorf("handleBook: invalid rebook request data"))
+			util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "handleBook: invalid rebook request data"))
 			return
 		}
 		queueItem, err = app.qm.GetItemByID(rebookRequest.SID)
 		if err != nil {
-			util.SvcErrorReturn(w, fmt.Errorf("handleBook: err: %s", err.Error()))
+			util.SvcErrorReturn(w, util.Errorf(lookupCode(err), "handleBook: err: %s", err.Error()))
+			return
+		}
+		if err := checkMachine(d, rebookRequest.MachineID); err != nil {
+			util.SvcErrorReturn(w, fmt.Errorf("handleBook: %w", err))
+			return
+		}
+		if err := checkMachine(d, queueItem.MachineID); err != nil {
+			util.SvcErrorReturn(w, fmt.Errorf("handleBook: SID %d: %w", rebookRequest.SID, err))
 			return
 		}
 		if queueItem.MachineID != rebookRequest.MachineID {
-			log.Printf("*** WARNING *** Granted MachineID %s rebooking for SID %d originally assigned to MachineID %s", rebookRequest.MachineID, rebookRequest.SID, queueItem.MachineID)
+			d.log.Warn("rebooking a simulation assigned to another machine", "sid", rebookRequest.SID, "machine", rebookRequest.MachineID, "assigned", queueItem.MachineID)
 		}
 	default:
-		util.SvcErrorReturn(w, fmt.Errorf("handleBook: invalid command"))
+		util.SvcErrorReturn(w, util.Errorf(util.ErrUnknownCommand, "handleBook: invalid command"))
 		return
 	}
 
 	//-----------------------------------------------------------------------------
 	// FIND THE CONFIG FILE FOR THIS JOB
 	//-----------------------------------------------------------------------------
-	log.Printf("handleBook: processing %s command\n", d.cmd.Command)
 
 	configDir := filepath.Join(app.QdConfigsDir, fmt.Sprintf("%d", queueItem.SID))
 	configFilename, err := findConfigFile(configDir)
@@ -359,11 +348,12 @@ func handleBook(w http.ResponseWriter, r *http.Request, d *HInfo) {
 	//-----------------------------------------------------------------------------
 	// Create the MULTIPART response
 	//-----------------------------------------------------------------------------
-	response := BookedResponse{
+	response := proto.BookedResponse{
 		Status:         "success",
 		Message:        "simulation booked",
 		SID:            queueItem.SID,
 		ConfigFilename: filepath.Base(configFilename),
+		Executor:       queueItem.Executor,
 	}
 	multipartWriter := multipart.NewWriter(w)
 	w.Header().Set("Content-Type", multipartWriter.FormDataContentType())
@@ -423,22 +413,22 @@ func handleBook(w http.ResponseWriter, r *http.Request, d *HInfo) {
 		util.SvcErrorReturn(w, fmt.Errorf("handleBook: failed to update queue item"))
 		return
 	}
-	log.Printf("*** handleBook:  SUCCESSFUL ***\n")
-
+	metrics.bookings.Inc(queueItem.MachineID)
+	publishItem(proto.EventBooked, &queueItem, "")
+	d.log.Info("simulation booked", "sid", queueItem.SID, "machine", queueItem.MachineID)
 }
 
 // handleNewSimulation handles the NewSimulation command
 // It creates a new entry in the queue
 // ---------------------------------------------------------------------------
 func handleNewSimulation(w http.ResponseWriter, r *http.Request, d *HInfo) {
-	log.Printf("*** entered: handleNewSimulation\n")
 
 	//-----------------------------------------------------------
 	// Unmarshal the command data into CreateQueueEntryRequest
 	//-----------------------------------------------------------
-	var req CreateQueueEntryRequest
+	var req proto.CreateQueueEntryRequest
 	if err := json.Unmarshal(d.cmd.Data, &req); err != nil {
-		util.SvcErrorReturn(w, fmt.Errorf("handleNewSimulation: failed to unmarshal request data"))
+		util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "handleNewSimulation: failed to unmarshal request data"))
 		return
 	}
 
@@ -447,13 +437,13 @@ func handleNewSimulation(w http.ResponseWriter, r *http.Request, d *HInfo) {
 	//------------------------------
 	file, _, err := r.FormFile("file")
 	if err != nil {
-		util.SvcErrorReturn(w, fmt.Errorf("handleNewSimulation: failed to get file from form"))
+		util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "handleNewSimulation: failed to get file from form"))
 		return
 	}
 	defer file.Close()
 	fileContent, err := io.ReadAll(file)
 	if err != nil {
-		util.SvcErrorReturn(w, fmt.Errorf("handleNewSimulation: failed to read file content"))
+		util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "handleNewSimulation: failed to read file content"))
 		return
 	}
 
@@ -467,30 +457,33 @@ func handleNewSimulation(w http.ResponseWriter, r *http.Request, d *HInfo) {
 		Priority:    req.Priority,
 		Description: req.Description,
 		URL:         req.URL,
+		Campaign:    req.Campaign,
+		Executor:    req.Executor,
 		State:       data.StateQueued,
 	}
 
 	var sid int64
 	if sid, err = threadSafeNewSim(fileContent, &queueItem, &req); err != nil {
-		util.SvcErrorReturn(w, fmt.Errorf("handleNewSimulation: %s", err.Error()))
+		util.SvcErrorReturn(w, fmt.Errorf("handleNewSimulation: %w", err))
 		return
 	}
 	//--------------------
 	// Send back SUCCESS
 	//--------------------
-	msg := SvcStatus201{
+	msg := proto.SvcStatus201{
 		Status:  "success",
 		Message: "Created queue item",
 		ID:      sid,
 	}
 	w.WriteHeader(http.StatusCreated)
 	util.SvcWriteResponse(w, &msg)
-	log.Printf("*** handleNewSimulation:  SUCCESSFUL ***\n")
+	d.log.Info("simulation queued", "sid", sid, "name", req.Name)
+	queueItem.SID = sid
+	publishItem(proto.EventCreated, &queueItem, "")
 }
 
 // handleShutdown handles the Shutdown command
 func handleShutdown(w http.ResponseWriter, r *http.Request, d *HInfo) {
-	log.Printf("*** entered: handleShutdown\n")
 	resp := util.SvcStatus200{
 		Status:  "success",
 		Message: "Shutting down",
@@ -505,7 +498,6 @@ func handleShutdown(w http.ResponseWriter, r *http.Request, d *HInfo) {
 // handleGetActiveQueue handles the GetActiveQueue command
 // -----------------------------------------------------------------------------
 func handleGetActiveQueue(w http.ResponseWriter, r *http.Request, d *HInfo) {
-	log.Printf("*** entered: handleGetActiveQueue\n")
 	items, err := app.qm.GetQueuedAndExecutingItems()
 	if err != nil {
 		util.SvcErrorReturn(w, fmt.Errorf("failed to get active queue items"))
@@ -527,13 +519,16 @@ func handleGetActiveQueue(w http.ResponseWriter, r *http.Request, d *HInfo) {
 // specified machine
 // -----------------------------------------------------------------------------
 func handleGetMachineQueue(w http.ResponseWriter, r *http.Request, d *HInfo) {
-	log.Printf("*** entered: handleGetMachineQueue\n")
 	//-----------------------------------------------------------
 	// Unmarshal the command data into MachineQueueRequest
 	//-----------------------------------------------------------
-	var req MachineQueueRequest
+	var req proto.MachineQueueRequest
 	if err := json.Unmarshal(d.cmd.Data, &req); err != nil {
-		util.SvcErrorReturn(w, fmt.Errorf("failed to unmarshal request data"))
+		util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "failed to unmarshal request data"))
+		return
+	}
+	if err := checkMachine(d, req.MachineID); err != nil {
+		util.SvcErrorReturn(w, fmt.Errorf("handleGetMachineQueue: %w", err))
 		return
 	}
 	items, err := app.qm.GetIncompleteItemsByMachineID(req.MachineID)
@@ -560,17 +555,16 @@ func handleGetMachineQueue(w http.ResponseWriter, r *http.Request, d *HInfo) {
 //
 // -----------------------------------------------------------------------------
 func handleGetSID(w http.ResponseWriter, r *http.Request, d *HInfo) {
-	log.Printf("*** entered: handleGetSID\n")
 
-	var req GetSIDRequest
+	var req proto.GetSIDRequest
 	if err := json.Unmarshal(d.cmd.Data, &req); err != nil {
-		util.SvcErrorReturn(w, fmt.Errorf("failed to unmarshal request data"))
+		util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "failed to unmarshal request data"))
 		return
 	}
 
 	item, err := app.qm.GetItemByID(req.SID)
 	if err != nil {
-		util.SvcErrorReturn(w, fmt.Errorf("failed to get completed queue item"))
+		util.SvcErrorReturn(w, util.Errorf(lookupCode(err), "handleGetSID: SID %d not found", req.SID))
 		return
 	}
 
@@ -588,7 +582,6 @@ func handleGetSID(w http.ResponseWriter, r *http.Request, d *HInfo) {
 // handleGetCompletedQueue handles the GetCompletedQueue command
 // -----------------------------------------------------------------------------
 func handleGetCompletedQueue(w http.ResponseWriter, r *http.Request, d *HInfo) {
-	log.Printf("*** entered: handleGetCompletedQueue\n")
 	items, err := app.qm.GetCompletedItems()
 	if err != nil {
 		util.SvcErrorReturn(w, fmt.Errorf("failed to get active queue items"))
@@ -609,8 +602,7 @@ func handleGetCompletedQueue(w http.ResponseWriter, r *http.Request, d *HInfo) {
 // handlePriorty handles sets the priority of the supplied sid
 // -----------------------------------------------------------------------------
 func handlePriority(w http.ResponseWriter, r *http.Request, d *HInfo) {
-	log.Printf("*** entered: handlePriority\n")
-	req := UpdateItemRequest{
+	req := proto.PriorityRequest{
 		Priority: -1,
 	}
 	//--------------------------------------------------------
@@ -618,7 +610,7 @@ func handlePriority(w http.ResponseWriter, r *http.Request, d *HInfo) {
 	// only set the fields supplied by the caller...
 	//--------------------------------------------------------
 	if err := json.Unmarshal(d.cmd.Data, &req); err != nil {
-		util.SvcErrorReturn(w, fmt.Errorf("handleUpdateItem: invalid request data"))
+		util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "handleUpdateItem: invalid request data"))
 		return
 	}
 
@@ -628,14 +620,18 @@ func handlePriority(w http.ResponseWriter, r *http.Request, d *HInfo) {
 	queueItem, err := app.qm.GetItemByID(req.SID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			util.SvcErrorReturn(w, fmt.Errorf("handleUpdateItem: queue item %d not found", req.SID))
+			util.SvcErrorReturn(w, util.Errorf(util.ErrNotFound, "handleUpdateItem: queue item %d not found", req.SID))
 		} else {
 			util.SvcErrorReturn(w, fmt.Errorf("handleUpdateItem: error in GetItemByID: %v", err))
 		}
 		return
 	}
+	if err := checkOwner(d, &queueItem); err != nil {
+		util.SvcErrorReturn(w, fmt.Errorf("handlePriority: %w", err))
+		return
+	}
 	if req.Priority < 0 {
-		util.SvcErrorReturn(w, fmt.Errorf("handleUpdateItem: invalid priority: %d", req.Priority))
+		util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "handleUpdateItem: invalid priority: %d", req.Priority))
 		return
 	}
 	//--------------------------------------------------------
@@ -648,7 +644,7 @@ func handlePriority(w http.ResponseWriter, r *http.Request, d *HInfo) {
 	}
 
 	w.WriteHeader(http.StatusOK)
-	msg := SvcStatus201{
+	msg := proto.SvcStatus201{
 		Status:  "success",
 		Message: "Updated",
 		ID:      queueItem.SID,
@@ -659,13 +655,12 @@ func handlePriority(w http.ResponseWriter, r *http.Request, d *HInfo) {
 // handleUpdateItem handles the UpdateItem command
 // -----------------------------------------------------------------------------
 func handleUpdateItem(w http.ResponseWriter, r *http.Request, d *HInfo) {
-	log.Printf("*** entered: handleUpdateItem\n")
 	z := string(rune(0x2026)) // the '...' character
 
 	//--------------------------------------------------------
 	// The values for req indicate that the field is not set
 	//--------------------------------------------------------
-	req := UpdateItemRequest{
+	req := proto.UpdateItemRequest{
 		Priority:    -1,
 		Description: z,
 		MachineID:   z,
@@ -674,6 +669,7 @@ func handleUpdateItem(w http.ResponseWriter, r *http.Request, d *HInfo) {
 		URL:         z,
 		DtEstimate:  z,
 		DtCompleted: z,
+		Error:       z,
 	}
 
 	//--------------------------------------------------------
@@ -681,7 +677,7 @@ func handleUpdateItem(w http.ResponseWriter, r *http.Request, d *HInfo) {
 	// only set the fields supplied by the caller...
 	//--------------------------------------------------------
 	if err := json.Unmarshal(d.cmd.Data, &req); err != nil {
-		util.SvcErrorReturn(w, fmt.Errorf("handleUpdateItem: invalid request data"))
+		util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "handleUpdateItem: invalid request data"))
 		return
 	}
 
@@ -691,12 +687,22 @@ func handleUpdateItem(w http.ResponseWriter, r *http.Request, d *HInfo) {
 	queueItem, err := app.qm.GetItemByID(req.SID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			util.SvcErrorReturn(w, fmt.Errorf("handleUpdateItem: queue item %d not found", req.SID))
+			util.SvcErrorReturn(w, util.Errorf(util.ErrNotFound, "handleUpdateItem: queue item %d not found", req.SID))
 		} else {
 			util.SvcErrorReturn(w, fmt.Errorf("handleUpdateItem: error in GetItemByID: %v", err))
 		}
 		return
 	}
+	if err := checkMachine(d, queueItem.MachineID); err != nil {
+		util.SvcErrorReturn(w, fmt.Errorf("handleUpdateItem: SID %d: %w", req.SID, err))
+		return
+	}
+	if req.MachineID != z {
+		if err := checkMachine(d, req.MachineID); err != nil {
+			util.SvcErrorReturn(w, fmt.Errorf("handleUpdateItem: SID %d: %w", req.SID, err))
+			return
+		}
+	}
 
 	//--------------------------------------------------------
 	// Update only the items that were supplied. The SID,
@@ -714,25 +720,33 @@ func handleUpdateItem(w http.ResponseWriter, r *http.Request, d *HInfo) {
 	if req.Description != z {
 		queueItem.Description = req.Description
 	}
+	var published []string // the events this update causes
 	if req.DtEstimate != z && len(req.DtEstimate) > 0 {
 		dt, err := util.StringToDate(req.DtEstimate)
 		if err != nil {
-			util.SvcErrorReturn(w, fmt.Errorf("handleUpdateItem: invalid date: %s", req.DtEstimate))
+			util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "handleUpdateItem: invalid date: %s", req.DtEstimate))
 			return
 		}
 		queueItem.DtEstimate.Time = dt
 		queueItem.DtEstimate.Valid = true
 		queueItem.State = data.StateExecuting
+		published = append(published, proto.EventEstimate)
 	}
 	if req.DtCompleted != z && len(req.DtCompleted) > 0 {
 		dt, err := util.StringToDate(req.DtCompleted)
 		if err != nil {
-			util.SvcErrorReturn(w, fmt.Errorf("handleUpdateItem: invalid date: %s", req.DtCompleted))
+			util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "handleUpdateItem: invalid date: %s", req.DtCompleted))
 			return
 		}
 		queueItem.DtCompleted.Time = dt
 		queueItem.DtCompleted.Valid = true
 		queueItem.State = data.StateCompleted
+		published = append(published, proto.EventCompleted)
+	}
+	if req.Error != z && len(req.Error) > 0 {
+		queueItem.State = data.StateError
+		published = append(published, proto.EventError)
+		d.log.Warn("simulation failed", "sid", queueItem.SID, "machine", queueItem.MachineID, "error", req.Error)
 	}
 
 	if err := app.qm.UpdateItem(queueItem); err != nil {
@@ -741,49 +755,57 @@ func handleUpdateItem(w http.ResponseWriter, r *http.Request, d *HInfo) {
 	}
 
 	w.WriteHeader(http.StatusOK)
-	msg := SvcStatus201{
+	msg := proto.SvcStatus201{
 		Status:  "success",
 		Message: "Updated",
 		ID:      queueItem.SID,
 	}
 	util.SvcWriteResponse(w, &msg)
+	for _, typ := range published {
+		if typ == proto.EventError {
+			publishItem(typ, &queueItem, req.Error)
+		} else {
+			publishItem(typ, &queueItem, "")
+		}
+	}
 }
 
 // handleDeleteItem handles the DeleteItem command
 // -----------------------------------------------------------------------------
 func handleDeleteItem(w http.ResponseWriter, r *http.Request, d *HInfo) {
-	log.Printf("*** entered: handleDeleteItem\n")
-	var req DeleteItemRequest
+	var req proto.DeleteItemRequest
 	if err := json.Unmarshal(d.cmd.Data, &req); err != nil {
-		util.SvcErrorReturn(w, fmt.Errorf("invalid request data"))
+		util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "invalid request data"))
 		return
 	}
 
-	// Retrieve the queue item to get the associated file path
-	_, err := app.qm.GetItemByID(req.SID)
+	item, err := app.qm.GetItemByID(req.SID)
 	if err != nil {
-		util.SvcErrorReturn(w, fmt.Errorf("item not found"))
+		util.SvcErrorReturn(w, util.Errorf(lookupCode(err), "item not found"))
 		return
 	}
-
-	// Delete the file and directory associated with the queue item
-	dirPath := filepath.Join(app.QdConfigsDir, fmt.Sprintf("%d", req.SID))
-	if err := threadSafeRemoveAll(dirPath); err != nil {
-		util.SvcErrorReturn(w, fmt.Errorf("failed to remove directory %s: %v", dirPath, err))
+	if err := checkOwner(d, &item); err != nil {
+		util.SvcErrorReturn(w, fmt.Errorf("handleDeleteItem: %w", err))
 		return
 	}
 
-	// Delete the queue item from the database
-	if err := app.qm.DeleteItem(req.SID); err != nil {
-		util.SvcErrorReturn(w, fmt.Errorf("failed to delete queue item %d: %v", req.SID, err))
+	//-------------------------------------------------------------
+	// Delete the config directory and the queue item together
+	//-------------------------------------------------------------
+	if err := threadSafeDeleteSim(req.SID); err != nil {
+		util.SvcErrorReturn(w, err)
 		return
 	}
+	if err := app.qm.DeleteProgress(req.SID); err != nil {
+		d.log.Warn("could not delete the progress samples", "sid", req.SID, "err", err)
+	}
 
 	w.WriteHeader(http.StatusOK)
-	msg := SvcStatus201{
+	msg := proto.SvcStatus201{
 		Status:  "success",
 		Message: "deleted",
 		ID:      req.SID,
 	}
 	util.SvcWriteResponse(w, &msg)
+	publishItem(proto.EventDeleted, &item, "")
 }
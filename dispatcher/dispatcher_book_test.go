@@ -14,6 +14,8 @@ import (
 	"testing"
 
 	"github.com/stmansour/simq/data"
+	"github.com/stmansour/simq/proto"
+	"github.com/stmansour/simq/util"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -31,11 +33,11 @@ var HTTPHdrsDbg = false
 // generateNewSimulation puts a new simulation in the database
 // -----------------------------------------------------------------------------
 func generateNewSimulation(t *testing.T) {
-	cmd := Command{
+	cmd := proto.Command{
 		Command:  "NewSimulation",
 		Username: "simd",
 	}
-	createReq := CreateQueueEntryRequest{
+	createReq := proto.CreateQueueEntryRequest{
 		OriginalFilename: "config.json5",
 		Name:             "Test Simulation",
 		Priority:         5,
@@ -94,7 +96,7 @@ func generateNewSimulation(t *testing.T) {
 	//---------------------------
 	// VALIDATE RESPONSE...
 	//---------------------------
-	var statResp SvcStatus201
+	var statResp proto.SvcStatus201
 	err = json.Unmarshal(bodyBytes, &statResp)
 	assert.NoError(t, err)
 	assert.Equal(t, "success", statResp.Status)
@@ -128,7 +130,7 @@ func TestBookCommand(t *testing.T) {
 	//------------------------------------
 	// CREATE STRUCTS FOR REQUEST
 	//------------------------------------
-	cmd := Command{
+	cmd := proto.Command{
 		Command:  "Book",
 		Username: "simd",
 	}
@@ -178,7 +180,7 @@ func TestBookCommand(t *testing.T) {
 	//---------------------------------------------------------
 	// MULTIPART RESPONSE EXPECTED OR SINGLE PART FOR ERROR
 	//---------------------------------------------------------
-	var bookResp BookedResponse
+	var bookResp proto.BookedResponse
 	contentType := resp.Header.Get("Content-Type")
 	if strings.HasPrefix(contentType, "multipart/") {
 		//------------
@@ -234,3 +236,36 @@ func TestBookCommand(t *testing.T) {
 	err = app.qm.UpdateItem(item)
 	assert.NoError(t, err)
 }
+
+// TestBookEmptyQueue checks that booking from an empty queue answers
+// QUEUE_EMPTY and that asking for a SID that does not exist answers NOT_FOUND
+func TestBookEmptyQueue(t *testing.T) {
+	var err error
+	app.qm, err = initTest(t)
+	if err != nil {
+		t.Fatalf("Failed to initialize test: %v", err)
+	}
+
+	post := func(command string, req any) (*http.Response, proto.SvcStatus201) {
+		b, err := json.Marshal(req)
+		assert.NoError(t, err)
+		cmd, err := json.Marshal(proto.Command{Command: command, Username: "simd", Data: json.RawMessage(b)})
+		assert.NoError(t, err)
+		r, err := http.NewRequest("POST", "/command", bytes.NewBuffer(cmd))
+		assert.NoError(t, err)
+		r.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		commandDispatcher(rr, r)
+		var status proto.SvcStatus201
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &status))
+		return rr.Result(), status
+	}
+
+	resp, status := post("Book", proto.SimulationBookingRequest{MachineID: "test-machine", CPUs: 4, Memory: "8GB"})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, util.CodeQueueEmpty, status.Code)
+
+	resp, status = post("GetSID", proto.GetSIDRequest{SID: 999999})
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, util.ErrNotFound, status.Code)
+}
@@ -14,6 +14,7 @@ import (
 	"time"
 
 	"github.com/stmansour/simq/data"
+	"github.com/stmansour/simq/proto"
 	"github.com/stmansour/simq/util"
 	"github.com/stretchr/testify/assert"
 )
@@ -34,6 +35,8 @@ func initTest(t *testing.T) (*data.QueueManager, error) {
 		return nil, err
 	}
 	app.QdConfigsDir = ex.DispatcherQueueDir
+	app.SimResultsDir = ex.SimResultsDir
+	app.store = NewFileResultStore(ex.SimResultsDir)
 
 	cmd := ex.GetSQLOpenString("simqtest")
 
@@ -69,7 +72,7 @@ func TestHandleShutdown(t *testing.T) {
 	}
 	app.qm = qm
 
-	cmd := Command{
+	cmd := proto.Command{
 		Command:  "Shutdown",
 		Username: "test-user",
 	}
@@ -137,7 +140,7 @@ func TestHandleGetActiveQueue(t *testing.T) {
 	//-------------------------------------
 	// MARSHAL CMD BYTES...
 	//-------------------------------------
-	cmd := Command{Command: "GetActiveQueue", Username: "test-user"}
+	cmd := proto.Command{Command: "GetActiveQueue", Username: "test-user"}
 	bookData, err := json.Marshal(cmd)
 	assert.NoError(t, err)
 
@@ -232,10 +235,10 @@ func TestHandleDeleteItem(t *testing.T) {
 	//-------------------------------------
 	// CREATE REQUEST DATA
 	//-------------------------------------
-	deleteRequest := DeleteItemRequest{
+	deleteRequest := proto.DeleteItemRequest{
 		SID: sid,
 	}
-	cmd := Command{
+	cmd := proto.Command{
 		Command:  "DeleteItem",
 		Username: "testuser",
 		Data:     json.RawMessage(mustMarshal(deleteRequest)),
@@ -264,7 +267,7 @@ func TestHandleDeleteItem(t *testing.T) {
 	//-------------------------------------
 	// VERIFY THE RESPONSE
 	//-------------------------------------
-	var resp SvcStatus201
+	var resp proto.SvcStatus201
 	err = json.Unmarshal(rr.Body.Bytes(), &resp)
 	assert.NoError(t, err)
 	assert.Equal(t, "success", resp.Status)
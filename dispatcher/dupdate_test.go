@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/stmansour/simq/data"
+	"github.com/stmansour/simq/proto"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -25,7 +26,7 @@ func createTestRequest(t *testing.T, data map[string]interface{}) (*httptest.Res
 	//-------------------------------------------------------------
 	// OUTER COMMAND SHELL -- specifies the command and user
 	//-------------------------------------------------------------
-	cmd := Command{
+	cmd := proto.Command{
 		Command:  "UpdateItem",
 		Username: "test-user",
 	}
@@ -115,7 +116,7 @@ func TestHandleUpdateItem(t *testing.T) {
 		req.Body.Close()
 		req.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
 		assert.Equal(t, http.StatusOK, rr.Code)
-		var response SvcStatus201
+		var response proto.SvcStatus201
 		err = json.Unmarshal(bodyBytes, &response)
 		assert.NoError(t, err)
 		assert.Equal(t, "success", response.Status)
@@ -149,7 +150,7 @@ func TestHandleUpdateItem(t *testing.T) {
 		req.Body.Close()
 		req.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
 		assert.Equal(t, http.StatusOK, rr.Code)
-		var response SvcStatus201
+		var response proto.SvcStatus201
 		err = json.Unmarshal(bodyBytes, &response)
 		assert.NoError(t, err)
 		assert.Equal(t, "success", response.Status)
@@ -178,7 +179,7 @@ func TestHandleUpdateItem(t *testing.T) {
 		require.NoError(t, err)
 		req.Body.Close()
 		req.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
-		var response SvcStatus201
+		var response proto.SvcStatus201
 		err = json.Unmarshal(bodyBytes, &response)
 		assert.NoError(t, err)
 		assert.Equal(t, response.Status, "error")
@@ -198,7 +199,7 @@ func TestHandleUpdateItem(t *testing.T) {
 		req.Body.Close()
 		req.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
 
-		var response SvcStatus201
+		var response proto.SvcStatus201
 		err = json.Unmarshal(bodyBytes, &response)
 		assert.NoError(t, err)
 		assert.Equal(t, response.Status, "error")
@@ -1,23 +1,26 @@
 package main
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"time"
 
 	"github.com/stmansour/simq/data"
+	"github.com/stmansour/simq/proto"
+	"github.com/stmansour/simq/util"
 )
 
-// SvcStatus201 is a simple status message for use when a new resource is created
-type SvcStatus201 struct {
-	Status  string
-	Message string
-	ID      int64
+// lookupCode returns the error code for a failed GetItemByID
+// -----------------------------------------------------------------------------
+func lookupCode(err error) util.ErrorCode {
+	if errors.Is(err, sql.ErrNoRows) {
+		return util.ErrNotFound
+	}
+	return util.ErrInternal
 }
 
 // findConfigFile finds the config file in the directory
@@ -38,163 +41,54 @@ func findConfigFile(configDir string) (string, error) {
 	return "", fmt.Errorf("no config file found in the directory")
 }
 
-func threadSafeFileIOEndSim(dirPath, filename string, r *http.Request) error {
-	//--------------------------------------------------
-	// CREATE THE FULL PATH
-	//--------------------------------------------------
-	app.mutex.Lock() // Lock the mutex before modifying app.sims
-	defer app.mutex.Unlock()
-
-	if err := os.MkdirAll(dirPath, os.ModePerm); err != nil {
-		app.mutex.Unlock() // Unlock the mutex after modification
-		return fmt.Errorf("handleEndSimulation: error from os.MkdirAll(%s): %s", dirPath, err.Error())
-	}
-
+// threadSafeEndSim saves the results archive sent with an EndSimulation
+// request, marks the simulation as ResultsSaved, and returns where the results
+// were stored. The mutex is held only while the row and the config directory
+// change, not while the results are uploaded.
+// -----------------------------------------------------------------------------
+func threadSafeEndSim(sid int64, r *http.Request) (string, error) {
 	//----------------------------------------------------
 	// EXTRACT THE FILE CONTENT
 	//----------------------------------------------------
 	file, _, err := r.FormFile("file")
 	if err != nil {
-		return fmt.Errorf("handleEndSimulation: failed to get file from form")
+		return "", fmt.Errorf("failed to get file from form")
 	}
 	defer file.Close()
-	fileContent, err := io.ReadAll(file)
-	if err != nil {
-		return fmt.Errorf("handleEndSimulation: failed to read file content")
-	}
-
-	//----------------------------------------------
-	// CREATE THE TAR.GZ FILE
-	//----------------------------------------------
-	tarz, err := os.Create(filename)
-	if err != nil {
-		return fmt.Errorf("handleEndSimulation: failed to create file %s: %v", filename, err)
-	}
-	defer tarz.Close()
-	if len(fileContent) == 0 {
-		return fmt.Errorf("handleEndSimulation: no file content. 0-length file")
-	}
-
-	//----------------------------------------------
-	// WRITE THE TAR.GZ FILE
-	//----------------------------------------------
-	if _, err := tarz.Write(fileContent); err != nil {
-		return fmt.Errorf("handleEndSimulation: failed to write to file %s: %v", filename, err)
-	}
-
-	//----------------------------------------------
-	// EXTRACT THE FILES FROM THE TAR.GZ FILE
-	//----------------------------------------------
-	originalDir, err := os.Getwd() // Save the current directory
-	if err != nil {
-		return fmt.Errorf("handleEndSimulation: failed to get current directory: %v", err)
-	}
-	err = os.Chdir(dirPath) // Change to the target directory
-	if err != nil {
-		return fmt.Errorf("handleEndSimulation: failed to change directory to %s: %v", dirPath, err)
-	}
-
-	//----------------------------------------------------------------------
-	// tar has actually failed here.  We'll implement retry logic...
-	//----------------------------------------------------------------------
-	const maxRetries = 3
-	const retryDelay = 2 * time.Second
-	for i := 0; i < maxRetries; i++ {
-		err = executeTarCommand()
-		if err == nil {
-			break
-		}
-		log.Printf("handleEndSimulation: failed to execute tar command (attempt %d/%d): %v", i+1, maxRetries, err)
-		time.Sleep(retryDelay)
-	}
-	if err != nil {
-		return fmt.Errorf("handleEndSimulation: failed to execute tar command after %d attempts: %v", maxRetries, err)
-	}
-
-	err = os.Chdir(originalDir) // Return back to the original directory
-	if err != nil {
-		return fmt.Errorf("handleEndSimulation: failed to change back to the original directory: %v", err)
-	}
 
-	//---------------------------------------------------------------------------------------
-	// After we have extracted the data files, we no longer need the tar.gz file. Delete it.
-	//---------------------------------------------------------------------------------------
-	if err := os.Remove(filename); err != nil {
-		return fmt.Errorf("handleEndSimulation: failed to remove config file")
-	}
-
-	return nil
-}
-
-func executeTarCommand() error {
-	tcmd := exec.Command("tar", "xzf", "results.tar.gz")
-	tcmd.Stdout = os.Stdout
-	tcmd.Stderr = os.Stderr
-	return tcmd.Run()
+	return endSimTxn(app.qm, app.store, app.QdConfigsDir, sid, file, &app.mutex)
 }
 
-func threadSafeRemoveAll(configDir string) error {
-	app.mutex.Lock() // Lock the mutex before modifying app.sims
+// threadSafeDeleteSim removes the config directory and the queue entry for sid
+// -----------------------------------------------------------------------------
+func threadSafeDeleteSim(sid int64) error {
+	app.mutex.Lock()
 	defer app.mutex.Unlock()
-	if err := os.RemoveAll(configDir); err != nil {
-		return fmt.Errorf("error in os.RemoveAll: %v", err)
-	}
-	return nil
+	return deleteSimTxn(app.qm, app.QdConfigsDir, sid)
 }
 
-func threadSafeNewSim(fileContent []byte, queueItem *data.QueueItem, req *CreateQueueEntryRequest) (int64, error) {
-	app.mutex.Lock() // Lock the mutex before modifying app.sims
+// threadSafeNewSim creates the queue entry and the config directory for a new
+// simulation and returns its SID.
+// -----------------------------------------------------------------------------
+func threadSafeNewSim(fileContent []byte, queueItem *data.QueueItem, req *proto.CreateQueueEntryRequest) (int64, error) {
+	app.mutex.Lock()
 	defer app.mutex.Unlock()
-	var err error
-
-	//----------------------------------------------
-	// Create the directory if it doesn't exist
-	//----------------------------------------------
-	err = os.MkdirAll(app.QdConfigsDir, os.ModePerm)
-	if err != nil {
-		return 0, fmt.Errorf("handleNewSimulation: failed to create directory: %v", err)
-	}
-
-	//----------------------------------------------
-	// Create a new file in the qdconfigs directory
-	//----------------------------------------------
-	tempFile, err := os.CreateTemp(app.QdConfigsDir, "config-*.json5")
+	sid, err := newSimTxn(app.qm, app.QdConfigsDir, fileContent, queueItem, req.OriginalFilename)
 	if err != nil {
-		return 0, fmt.Errorf("handleNewSimulation: failed to create temp file in directory %s: %v", app.QdConfigsDir, err)
-	}
-	defer tempFile.Close()
-	if len(fileContent) == 0 {
-		return 0, fmt.Errorf("handleNewSimulation: no file content. 0-length file")
-	}
-
-	//----------------------------------------------
-	// Write the file content to a TEMPORARY file
-	//----------------------------------------------
-	if _, err := tempFile.Write(fileContent); err != nil {
-		return 0, fmt.Errorf("handleNewSimulation: failed to write file content: %v", err)
-	}
-
-	sid, err := app.qm.InsertItem(*queueItem)
-	if err != nil {
-		return 0, fmt.Errorf("handleNewSimulation: failed to insert new item to database: %v", err)
-	}
-
-	//----------------------------------------------
-	// Make the new directory
-	//----------------------------------------------
-	fpath := filepath.Join(app.QdConfigsDir, fmt.Sprintf("%d", sid))
-	err = os.MkdirAll(fpath, os.ModePerm)
-	if err != nil {
-		return 0, fmt.Errorf("handleNewSimulation: failed to make directory %s: %v", fpath, err)
+		return 0, err
 	}
+	return sid, nil
+}
 
-	//---------------------------------------------------------------------
-	// Rename the file to include the queue item ID and original filename
-	//---------------------------------------------------------------------
-	newFilePath := filepath.Join(app.QdConfigsDir, fmt.Sprintf("%d", sid), req.OriginalFilename)
-	if err := os.Rename(tempFile.Name(), newFilePath); err != nil {
-		return 0, fmt.Errorf("handleNewSimulation: failed to rename %s to %s: %v", tempFile.Name(), newFilePath, err)
+// threadSafeRecover finishes or rolls back operations interrupted by a crash
+// -----------------------------------------------------------------------------
+func threadSafeRecover() {
+	app.mutex.Lock()
+	defer app.mutex.Unlock()
+	recoverQdConfigs(app.qm, app.QdConfigsDir)
+	if r, ok := app.store.(storeRecoverer); ok {
+		if err := r.Recover(); err != nil {
+			slog.Error("could not recover the result store", "err", err)
+		}
 	}
-
-	return sid, nil
 }
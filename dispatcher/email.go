@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/stmansour/simq/data"
+	"github.com/stmansour/simq/proto"
+	"github.com/stmansour/simq/util"
+)
+
+//----------------------------------------------------------------------------
+// EMAIL
+//
+// The email notifier listens on the event bus for the events in
+// proto.EmailEvents and mails the owners of the simulations who opted in
+// with SetEmailPrefs. Messages are rendered from text/templates: "subject"
+// and "body" for one simulation, "digest-subject" and "digest-body" for a
+// digest. SMTP.Templates may replace any of them.
+//
+// Users who ask for a digest get their completions ("saved" events) in one
+// message every SMTP.DigestMin minutes, which keeps a large campaign from
+// flooding their inbox. Failures and expired leases are always sent at once.
+//----------------------------------------------------------------------------
+
+const (
+	defaultDigestWindow = time.Hour
+	emailTimeout        = 30 * time.Second // limit for sending one message
+	emailQueueSize      = 256              // events waiting to be mailed
+)
+
+// defaultEmailTemplates are the built-in message templates
+const defaultEmailTemplates = `
+{{- define "subject"}}simq: {{with .Item.Name}}{{.}} {{end}}(SID {{.Item.SID}}) {{status .Event.Type}}{{end}}
+
+{{- define "body"}}Simulation {{.Item.SID}} {{status .Event.Type}}.
+
+SID:       {{.Item.SID}}
+Name:      {{.Item.Name}}
+{{- with .Item.Campaign}}
+Campaign:  {{.}}{{end}}
+Machine:   {{.Item.MachineID}}
+Runtime:   {{.Runtime}}
+{{- with .Results}}
+Results:   {{.}}{{end}}
+{{- with .Event.Message}}
+Message:   {{.}}{{end}}
+{{end}}
+
+{{- define "digest-subject"}}simq: {{len .Sims}} simulation{{if ne (len .Sims) 1}}s{{end}} finished{{end}}
+
+{{- define "digest-body"}}{{len .Sims}} of your simulations finished since {{.Since.Format "2006-01-02 15:04 MST"}}.
+{{range .Sims}}
+SID {{.Item.SID}}  {{.Item.Name}}
+{{- with .Item.Campaign}}
+    Campaign:  {{.}}{{end}}
+    Machine:   {{.Item.MachineID}}
+    Runtime:   {{.Runtime}}
+{{- with .Results}}
+    Results:   {{.}}{{end}}
+{{end}}{{end}}
+`
+
+// emailFuncs are the functions available to the templates
+var emailFuncs = template.FuncMap{
+	"status": func(typ string) string {
+		switch typ {
+		case proto.EventSaved:
+			return "finished"
+		case proto.EventError:
+			return "failed"
+		case proto.EventExpired:
+			return "lease expired"
+		}
+		return typ
+	},
+}
+
+// emailStore is the part of the QueueManager used by the email notifier
+type emailStore interface {
+	GetEmailPref(username string) (data.EmailPref, error)
+	GetItemByID(sid int64) (data.QueueItem, error)
+}
+
+// emailData is what the subject and body templates are executed with
+type emailData struct {
+	Event   proto.Event
+	Item    data.QueueItem
+	Runtime time.Duration // from when the simulation was queued until it completed
+	Results string        // where the results are stored, once they are saved
+}
+
+// digestData is what the digest templates are executed with
+type digestData struct {
+	Username string
+	To       string
+	Since    time.Time
+	Sims     []emailData // in campaign, then SID order
+}
+
+// emailNotifier mails events to the users who want them
+type emailNotifier struct {
+	store     emailStore
+	cfg       util.SMTPConfig
+	location  func(sid int64) (string, error) // where the results of sid are stored
+	templates *template.Template
+	window    time.Duration          // digests are sent this often
+	digests   map[string]*digestData // Username -> completions not mailed yet
+	events    chan proto.Event
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// newEmailNotifier returns a notifier that sends through the mail server in
+// cfg. location reports where a simulation's results are stored.
+// -----------------------------------------------------------------------------
+func newEmailNotifier(store emailStore, cfg util.SMTPConfig, location func(int64) (string, error)) (*emailNotifier, error) {
+	t, err := loadEmailTemplates(cfg.Templates)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.From) == 0 {
+		host, _ := os.Hostname()
+		cfg.From = "simq@" + host
+	}
+	window := time.Duration(cfg.DigestMin) * time.Minute
+	if window <= 0 {
+		window = defaultDigestWindow
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &emailNotifier{
+		store:     store,
+		cfg:       cfg,
+		location:  location,
+		templates: t,
+		window:    window,
+		digests:   map[string]*digestData{},
+		events:    make(chan proto.Event, emailQueueSize),
+		ctx:       ctx,
+		cancel:    cancel,
+	}, nil
+}
+
+// loadEmailTemplates returns the built-in templates, with the ones defined in
+// fname, if any, in their place
+// -----------------------------------------------------------------------------
+func loadEmailTemplates(fname string) (*template.Template, error) {
+	t := template.Must(template.New("email").Funcs(emailFuncs).Parse(defaultEmailTemplates))
+	if len(fname) == 0 {
+		return t, nil
+	}
+	if _, err := t.ParseFiles(fname); err != nil {
+		return nil, fmt.Errorf("email templates: %w", err)
+	}
+	return t, nil
+}
+
+// start subscribes the notifier to bus and starts mailing
+// -----------------------------------------------------------------------------
+func (n *emailNotifier) start(bus *eventBus) {
+	bus.listen(n.notify)
+	n.wg.Add(1)
+	go n.run()
+}
+
+// stop sends the pending digests and waits for the notifier to finish
+// -----------------------------------------------------------------------------
+func (n *emailNotifier) stop() {
+	n.cancel()
+	n.wg.Wait()
+}
+
+// notify is called by the event bus for every event. It must not block.
+// -----------------------------------------------------------------------------
+func (n *emailNotifier) notify(e *proto.Event) {
+	if !isEmailEvent(e.Type) {
+		return
+	}
+	select {
+	case n.events <- *e:
+	default:
+		metrics.emails.Inc("failed")
+		slog.Warn("email queue is full, event dropped", "sid", e.SID, "event", e.Type)
+	}
+}
+
+// isEmailEvent reports whether users may get email about events of type typ
+// -----------------------------------------------------------------------------
+func isEmailEvent(typ string) bool {
+	for _, t := range proto.EmailEvents {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// run mails events as they come and sends the digests when they are due
+// -----------------------------------------------------------------------------
+func (n *emailNotifier) run() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.ctx.Done():
+			n.flush()
+			return
+		case e := <-n.events:
+			n.handle(e)
+		case <-ticker.C:
+			n.flush()
+		}
+	}
+}
+
+// handle mails e to the owner of its simulation, or adds it to their digest
+// -----------------------------------------------------------------------------
+func (n *emailNotifier) handle(e proto.Event) {
+	item, err := n.store.GetItemByID(e.SID)
+	if err != nil {
+		item = data.QueueItem{SID: e.SID, Username: e.Username, Name: e.Name, Campaign: e.Campaign, MachineID: e.MachineID, State: e.State}
+	}
+	pref, err := n.store.GetEmailPref(item.Username)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			slog.Warn("email preferences", "user", item.Username, "err", err)
+		}
+		return
+	}
+	if !pref.Wants(e.Type) {
+		return
+	}
+
+	m := emailData{Event: e, Item: item, Runtime: simRuntime(&item, e.Time)}
+	if e.Type == proto.EventSaved {
+		if loc, err := n.location(item.SID); err == nil {
+			m.Results = loc
+		}
+		if pref.Digest {
+			d := n.digests[item.Username]
+			if d == nil {
+				d = &digestData{Username: item.Username, Since: e.Time}
+				n.digests[item.Username] = d
+			}
+			d.To = pref.Email
+			d.Sims = append(d.Sims, m)
+			return
+		}
+	}
+	n.send(pref.Email, "subject", "body", &m)
+}
+
+// simRuntime returns how long item took, from when it was queued until it
+// completed, or until end if it has not
+// -----------------------------------------------------------------------------
+func simRuntime(item *data.QueueItem, end time.Time) time.Duration {
+	if item.DtCompleted.Valid {
+		end = item.DtCompleted.Time
+	}
+	if item.Created.IsZero() || end.Before(item.Created) {
+		return 0
+	}
+	return end.Sub(item.Created).Round(time.Second)
+}
+
+// flush sends the pending digests
+// -----------------------------------------------------------------------------
+func (n *emailNotifier) flush() {
+	for user, d := range n.digests {
+		delete(n.digests, user)
+		sort.Slice(d.Sims, func(i, j int) bool {
+			a, b := &d.Sims[i].Item, &d.Sims[j].Item
+			if a.Campaign != b.Campaign {
+				return a.Campaign < b.Campaign
+			}
+			return a.SID < b.SID
+		})
+		n.send(d.To, "digest-subject", "digest-body", d)
+	}
+}
+
+// send renders the templates subject and body with v and mails the result
+// to to
+// -----------------------------------------------------------------------------
+func (n *emailNotifier) send(to, subject, body string, v interface{}) {
+	var s, b bytes.Buffer
+	err := n.templates.ExecuteTemplate(&s, subject, v)
+	if err == nil {
+		err = n.templates.ExecuteTemplate(&b, body, v)
+	}
+	if err == nil {
+		err = n.sendMail(to, message(n.cfg.From, to, s.String(), b.String()))
+	}
+	if err != nil {
+		metrics.emails.Inc("failed")
+		slog.Warn("email not sent", "to", to, "template", body, "err", err)
+		return
+	}
+	metrics.emails.Inc("sent")
+	slog.Debug("email sent", "to", to, "template", body)
+}
+
+// message returns an RFC 5322 message with a plain text body
+// -----------------------------------------------------------------------------
+func message(from, to, subject, body string) []byte {
+	subject = strings.Join(strings.Fields(subject), " ") // one line
+	var m bytes.Buffer
+	fmt.Fprintf(&m, "From: %s\r\n", from)
+	fmt.Fprintf(&m, "To: %s\r\n", to)
+	fmt.Fprintf(&m, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&m, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	m.WriteString("MIME-Version: 1.0\r\n")
+	m.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	m.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	m.WriteString(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n"))
+	return m.Bytes()
+}
+
+// sendMail sends msg to to through the mail server. Unlike smtp.SendMail it
+// gives up after emailTimeout.
+// -----------------------------------------------------------------------------
+func (n *emailNotifier) sendMail(to string, msg []byte) error {
+	conn, err := net.DialTimeout("tcp", n.cfg.Addr(), emailTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(emailTimeout))
+	c, err := smtp.NewClient(conn, n.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: n.cfg.Host}); err != nil {
+			return err
+		}
+	}
+	if len(n.cfg.Username) > 0 {
+		if err := c.Auth(smtp.PlainAuth("", n.cfg.Username, n.cfg.Password, n.cfg.Host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(n.cfg.From); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// handleSetEmailPrefs handles the SetEmailPrefs command. It sets the caller's
+// email preferences; an empty Email turns their email off.
+//
+//	Cmd
+//	    Command - SetEmailPrefs
+//	    Username - the person or process making this call
+//	    Data - proto.EmailPrefsRequest
+//
+// -----------------------------------------------------------------------------
+func handleSetEmailPrefs(w http.ResponseWriter, r *http.Request, d *HInfo) {
+	var req proto.EmailPrefsRequest
+	if err := json.Unmarshal(d.cmd.Data, &req); err != nil {
+		util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "handleSetEmailPrefs: invalid request data"))
+		return
+	}
+
+	msg := util.SvcStatus200{Status: "success"}
+	if len(req.Email) == 0 {
+		if err := app.qm.DeleteEmailPref(d.cmd.Username); err != nil {
+			util.SvcErrorReturn(w, fmt.Errorf("handleSetEmailPrefs: %v", err))
+			return
+		}
+		msg.Message = "email turned off"
+	} else {
+		pref, err := emailPref(d.cmd.Username, &req)
+		if err != nil {
+			util.SvcErrorReturn(w, fmt.Errorf("handleSetEmailPrefs: %w", err))
+			return
+		}
+		if err := app.qm.SetEmailPref(pref); err != nil {
+			util.SvcErrorReturn(w, fmt.Errorf("handleSetEmailPrefs: %v", err))
+			return
+		}
+		msg.Message = "email preferences saved"
+		if app.mailer == nil {
+			msg.Message += ", but this dispatcher has no mail server configured"
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	util.SvcWriteResponse(w, &msg)
+	d.log.Info("email preferences set", "email", req.Email, "digest", req.Digest)
+}
+
+// emailPref validates req and returns it as the preferences of username
+// -----------------------------------------------------------------------------
+func emailPref(username string, req *proto.EmailPrefsRequest) (data.EmailPref, error) {
+	addr, err := mail.ParseAddress(req.Email)
+	if err != nil {
+		return data.EmailPref{}, util.Errorf(util.ErrBadRequest, "invalid email address %q: %v", req.Email, err)
+	}
+	for _, e := range req.Events {
+		if !isEmailEvent(e) {
+			return data.EmailPref{}, util.Errorf(util.ErrBadRequest, "unknown email event %q, use one of %s", e, strings.Join(proto.EmailEvents, ", "))
+		}
+	}
+	return data.EmailPref{
+		Username: username,
+		Email:    addr.Address,
+		Events:   strings.Join(req.Events, ","),
+		Digest:   req.Digest,
+	}, nil
+}
+
+// handleGetEmailPrefs handles the GetEmailPrefs command. It returns the
+// caller's email preferences, with an empty Email if their email is off.
+// -----------------------------------------------------------------------------
+func handleGetEmailPrefs(w http.ResponseWriter, r *http.Request, d *HInfo) {
+	pref, err := app.qm.GetEmailPref(d.cmd.Username)
+	if err == sql.ErrNoRows {
+		pref, err = data.EmailPref{Username: d.cmd.Username}, nil
+	}
+	if err != nil {
+		util.SvcErrorReturn(w, fmt.Errorf("handleGetEmailPrefs: %v", err))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	resp := struct {
+		Status string
+		Data   data.EmailPref
+	}{
+		Status: "success",
+		Data:   pref,
+	}
+	util.SvcWriteResponse(w, &resp)
+}
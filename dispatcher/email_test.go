@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stmansour/simq/data"
+	"github.com/stmansour/simq/proto"
+	"github.com/stmansour/simq/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sentMail is one message received by the SMTP stand-in
+type sentMail struct {
+	From string
+	To   []string
+	Msg  *mail.Message
+	Body string
+}
+
+// newSMTPServer starts a minimal SMTP server on localhost and returns its
+// config and the channel it delivers the messages it receives on
+func newSMTPServer(t *testing.T) (util.SMTPConfig, chan sentMail) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	got := make(chan sentMail, 16)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, got)
+		}
+	}()
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	p, err := strconv.Atoi(port)
+	require.NoError(t, err)
+	return util.SMTPConfig{Host: host, Port: p, From: "simq@example.com"}, got
+}
+
+// serveSMTP speaks just enough SMTP for net/smtp to deliver a message
+func serveSMTP(conn net.Conn, got chan sentMail) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 localhost ESMTP test")
+	var m sentMail
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.Fields(line + " ")[0])
+		switch verb {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250-localhost")
+			tp.PrintfLine("250 8BITMIME")
+		case "MAIL":
+			m = sentMail{From: smtpPath(line)}
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			m.To = append(m.To, smtpPath(line))
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			b, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg, err := mail.ReadMessage(bytes.NewReader(b))
+			if err != nil {
+				tp.PrintfLine("554 bad message")
+				continue
+			}
+			body, _ := io.ReadAll(msg.Body)
+			m.Msg, m.Body = msg, string(body)
+			got <- m
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("250 OK")
+		}
+	}
+}
+
+// smtpPath returns the address in a MAIL FROM:<...> or RCPT TO:<...> line
+func smtpPath(line string) string {
+	i, j := strings.Index(line, "<"), strings.Index(line, ">")
+	if i < 0 || j < i {
+		return ""
+	}
+	return line[i+1 : j]
+}
+
+// fakeEmailStore is an emailStore that does not need a database
+type fakeEmailStore struct {
+	prefs map[string]data.EmailPref
+	items map[int64]data.QueueItem
+}
+
+func (f *fakeEmailStore) GetEmailPref(username string) (data.EmailPref, error) {
+	p, ok := f.prefs[username]
+	if !ok {
+		return p, sql.ErrNoRows
+	}
+	return p, nil
+}
+
+func (f *fakeEmailStore) GetItemByID(sid int64) (data.QueueItem, error) {
+	item, ok := f.items[sid]
+	if !ok {
+		return item, sql.ErrNoRows
+	}
+	return item, nil
+}
+
+func resultsAt(sid int64) (string, error) { return fmt.Sprintf("/opt/simres/%d", sid), nil }
+
+func waitMail(t *testing.T, got chan sentMail) sentMail {
+	select {
+	case m := <-got:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email was sent")
+	}
+	return sentMail{}
+}
+
+func TestEmailNotifier(t *testing.T) {
+	cfg, got := newSMTPServer(t)
+	created := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+	done := sql.NullTime{Time: created.Add(49*time.Hour + 30*time.Minute), Valid: true}
+	store := &fakeEmailStore{
+		prefs: map[string]data.EmailPref{
+			"alice": {Username: "alice", Email: "alice@example.com"},
+			"bob":   {Username: "bob", Email: "bob@example.com", Events: "error"},
+		},
+		items: map[int64]data.QueueItem{
+			1: {SID: 1, Username: "alice", Name: "Gold Run", Campaign: "q1", MachineID: "plato", Created: created, DtCompleted: done},
+			2: {SID: 2, Username: "bob", Name: "Silver"},
+			3: {SID: 3, Username: "carol", Name: "Bronze"},
+		},
+	}
+	n, err := newEmailNotifier(store, cfg, resultsAt)
+	require.NoError(t, err)
+	bus := newEventBus(8)
+	n.start(bus)
+	defer n.stop()
+
+	//-----------------------------------------------------
+	// alice gets her completion with all the details
+	//-----------------------------------------------------
+	bus.publish(proto.Event{Type: proto.EventBooked, SID: 1, Username: "alice"})
+	bus.publish(proto.Event{Type: proto.EventSaved, SID: 1, Username: "alice"})
+	m := waitMail(t, got)
+	assert.Equal(t, "simq@example.com", m.From)
+	assert.Equal(t, []string{"alice@example.com"}, m.To)
+	assert.Equal(t, "simq: Gold Run (SID 1) finished", m.Msg.Header.Get("Subject"))
+	assert.Contains(t, m.Body, "Campaign:  q1")
+	assert.Contains(t, m.Body, "Machine:   plato")
+	assert.Contains(t, m.Body, "Runtime:   49h30m0s")
+	assert.Contains(t, m.Body, "Results:   /opt/simres/1")
+
+	//-----------------------------------------------------
+	// bob only wants failures, carol has not opted in
+	//-----------------------------------------------------
+	bus.publish(proto.Event{Type: proto.EventSaved, SID: 2, Username: "bob"})
+	bus.publish(proto.Event{Type: proto.EventError, SID: 3, Username: "carol", Message: "x"})
+	bus.publish(proto.Event{Type: proto.EventError, SID: 2, Username: "bob", Message: "out of memory"})
+	m = waitMail(t, got)
+	assert.Equal(t, []string{"bob@example.com"}, m.To)
+	assert.Equal(t, "simq: Silver (SID 2) failed", m.Msg.Header.Get("Subject"))
+	assert.Contains(t, m.Body, "Message:   out of memory")
+	assert.NotContains(t, m.Body, "Results:")
+	select {
+	case m := <-got:
+		t.Fatalf("unexpected email to %v", m.To)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestEmailDigest(t *testing.T) {
+	cfg, got := newSMTPServer(t)
+	store := &fakeEmailStore{
+		prefs: map[string]data.EmailPref{
+			"alice": {Username: "alice", Email: "alice@example.com", Digest: true},
+		},
+		items: map[int64]data.QueueItem{
+			4: {SID: 4, Username: "alice", Name: "d", Campaign: "b"},
+			5: {SID: 5, Username: "alice", Name: "c", Campaign: "a"},
+			6: {SID: 6, Username: "alice", Name: "f", Campaign: "b"},
+		},
+	}
+	n, err := newEmailNotifier(store, cfg, resultsAt)
+	require.NoError(t, err)
+	n.window = 200 * time.Millisecond
+	bus := newEventBus(8)
+	n.start(bus)
+	defer n.stop()
+
+	//-----------------------------------------------------
+	// completions wait for the digest, failures do not
+	//-----------------------------------------------------
+	for _, sid := range []int64{6, 4, 5} {
+		bus.publish(proto.Event{Type: proto.EventSaved, SID: sid, Username: "alice"})
+	}
+	bus.publish(proto.Event{Type: proto.EventError, SID: 4, Username: "alice"})
+	m := waitMail(t, got)
+	assert.Equal(t, "simq: d (SID 4) failed", m.Msg.Header.Get("Subject"))
+
+	m = waitMail(t, got)
+	assert.Equal(t, "simq: 3 simulations finished", m.Msg.Header.Get("Subject"))
+	i5, i4, i6 := strings.Index(m.Body, "SID 5"), strings.Index(m.Body, "SID 4"), strings.Index(m.Body, "SID 6")
+	assert.True(t, i5 >= 0 && i5 < i4 && i4 < i6, "digest is sorted by campaign, then SID:\n%s", m.Body)
+	assert.Contains(t, m.Body, "Results:   /opt/simres/6")
+}
+
+func TestEmailTemplates(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "email.tmpl")
+	require.NoError(t, os.WriteFile(fname, []byte(`{{define "subject"}}[{{.Item.Campaign}}] {{.Item.SID}}{{end}}`), 0644))
+	tmpl, err := loadEmailTemplates(fname)
+	require.NoError(t, err)
+	var b strings.Builder
+	require.NoError(t, tmpl.ExecuteTemplate(&b, "subject", &emailData{Item: data.QueueItem{SID: 8, Campaign: "q2"}}))
+	assert.Equal(t, "[q2] 8", b.String())
+	assert.NotNil(t, tmpl.Lookup("body"), "templates that are not replaced are kept")
+
+	_, err = loadEmailTemplates(filepath.Join(t.TempDir(), "missing.tmpl"))
+	assert.Error(t, err)
+}
+
+func TestEmailPrefValidation(t *testing.T) {
+	p, err := emailPref("alice", &proto.EmailPrefsRequest{Email: "Alice <alice@example.com>", Events: []string{"saved"}, Digest: true})
+	require.NoError(t, err)
+	assert.Equal(t, data.EmailPref{Username: "alice", Email: "alice@example.com", Events: "saved", Digest: true}, p)
+
+	_, err = emailPref("alice", &proto.EmailPrefsRequest{Email: "not an address"})
+	assert.Equal(t, util.ErrBadRequest, util.CodeOf(err))
+	_, err = emailPref("alice", &proto.EmailPrefsRequest{Email: "alice@example.com", Events: []string{"booked"}})
+	assert.Equal(t, util.ErrBadRequest, util.CodeOf(err))
+}
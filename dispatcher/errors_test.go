@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stmansour/simq/data"
+	"github.com/stmansour/simq/proto"
+	"github.com/stmansour/simq/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorReplies(t *testing.T) {
+	makeTestResults(t, "42")
+	check := func(command string, req proto.ResultsRequest, status int, code util.ErrorCode) {
+		rr := sendResultsCommand(t, command, req)
+		assert.Equal(t, status, rr.Code, command)
+		var e util.SvcError
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &e))
+		assert.Equal(t, "error", e.Status)
+		assert.Equal(t, code, e.Code)
+		assert.Equal(t, code, util.CodeOf(util.DecodeError(rr.Body.Bytes())))
+	}
+	check("NoSuchCommand", proto.ResultsRequest{}, http.StatusBadRequest, util.ErrUnknownCommand)
+	check("ListResults", proto.ResultsRequest{SID: 43}, http.StatusNotFound, util.ErrNotFound)
+	check("GetResults", proto.ResultsRequest{SID: 42, Filename: "nothere.csv"}, http.StatusNotFound, util.ErrNotFound)
+	check("GetResults", proto.ResultsRequest{SID: 42, Filename: "../../x"}, http.StatusBadRequest, util.ErrBadRequest)
+
+	assert.Nil(t, util.DecodeError([]byte(`{"Status":"success","Message":"ok"}`)))
+	assert.Equal(t, util.ErrInternal, util.CodeOf(util.DecodeError([]byte(`{"Status":"error","Message":"old dispatcher"}`))))
+}
+
+func TestNewSimErrorCode(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		content  []byte
+		filename string
+	}{
+		{"empty config", nil, "config.json5"},
+		{"bad filename", []byte("{}"), ".hidden"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := threadSafeNewSim(tc.content, &data.QueueItem{}, &proto.CreateQueueEntryRequest{OriginalFilename: tc.filename})
+			assert.Equal(t, util.ErrBadRequest, util.CodeOf(err))
+			assert.Equal(t, util.ErrBadRequest, util.CodeOf(fmt.Errorf("handleNewSimulation: %w", err)), "as the handler returns it")
+		})
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/stmansour/simq/data"
+	"github.com/stmansour/simq/proto"
+	"github.com/stmansour/simq/util"
+)
+
+//----------------------------------------------------------------------------
+// QUEUE EVENTS
+//
+// The handlers publish every change to the queue on the event bus. GET
+// /events streams them to the subscribers as Server-Sent Events, optionally
+// filtered by SID, user or campaign.
+//
+// The bus keeps the most recent events so that a client that reconnects with
+// a Last-Event-ID header gets the ones it missed. Publishing never blocks: a
+// subscriber that falls too far behind is disconnected, and catches up from
+// the recent events when it reconnects.
+//
+// Listeners, such as the webhook notifier, are called for every event. They
+// must not block.
+//----------------------------------------------------------------------------
+
+const (
+	eventHistory    = 256 // number of recent events kept for reconnecting clients
+	eventBufferSize = 64  // events queued per subscriber before it is dropped
+)
+
+// eventHeartbeat is how often an idle stream sends a comment to keep proxies
+// from closing it
+var eventHeartbeat = 15 * time.Second
+
+// events is the dispatcher's event bus
+var events = newEventBus(eventHistory)
+
+// subscriber is one /events stream
+type subscriber struct {
+	filter proto.EventFilter
+	ch     chan proto.Event // closed when the subscriber is dropped
+}
+
+// eventBus fans queue events out to the subscribers
+type eventBus struct {
+	mu        sync.Mutex
+	lastID    int64
+	recent    []proto.Event // ring buffer of the last cap(recent) events
+	next      int           // where the next event goes in recent
+	subs      map[*subscriber]bool
+	listeners []func(*proto.Event)
+	closed    bool
+}
+
+// newEventBus returns a bus that remembers the last n events
+// -----------------------------------------------------------------------------
+func newEventBus(n int) *eventBus {
+	return &eventBus{
+		recent: make([]proto.Event, 0, n),
+		subs:   map[*subscriber]bool{},
+	}
+}
+
+// publish assigns e an ID and time and sends it to the subscribers whose
+// filter matches
+// -----------------------------------------------------------------------------
+func (b *eventBus) publish(e proto.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastID++
+	e.ID = b.lastID
+	e.Time = time.Now()
+	if len(b.recent) < cap(b.recent) {
+		b.recent = append(b.recent, e)
+	} else {
+		b.recent[b.next] = e
+	}
+	b.next = (b.next + 1) % cap(b.recent)
+
+	for s := range b.subs {
+		if !s.filter.Match(&e) {
+			continue
+		}
+		select {
+		case s.ch <- e:
+		default:
+			b.drop(s) // too slow, it will catch up when it reconnects
+		}
+	}
+	for _, fn := range b.listeners {
+		fn(&e)
+	}
+}
+
+// listen adds fn to the functions called for every event
+// -----------------------------------------------------------------------------
+func (b *eventBus) listen(fn func(*proto.Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.listeners = append(b.listeners, fn)
+}
+
+// subscribe adds a subscriber. It returns the recent events after lastID that
+// match filter, oldest first, and the subscriber for the events that follow.
+// -----------------------------------------------------------------------------
+func (b *eventBus) subscribe(filter proto.EventFilter, lastID int64) ([]proto.Event, *subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if lastID > b.lastID {
+		lastID = 0 // the client saw a dispatcher that has since restarted
+	}
+	var missed []proto.Event
+	n := len(b.recent)
+	for i := 0; i < n; i++ {
+		e := b.recent[(b.next-n+i+cap(b.recent))%cap(b.recent)]
+		if e.ID > lastID && filter.Match(&e) {
+			missed = append(missed, e)
+		}
+	}
+	s := &subscriber{filter: filter, ch: make(chan proto.Event, eventBufferSize)}
+	if b.closed {
+		close(s.ch)
+	} else {
+		b.subs[s] = true
+	}
+	return missed, s
+}
+
+// unsubscribe removes s if it is still subscribed
+// -----------------------------------------------------------------------------
+func (b *eventBus) unsubscribe(s *subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs[s] {
+		b.drop(s)
+	}
+}
+
+// drop removes s and closes its channel. b.mu must be held.
+// -----------------------------------------------------------------------------
+func (b *eventBus) drop(s *subscriber) {
+	delete(b.subs, s)
+	close(s.ch)
+}
+
+// close ends every stream. It is called when the server shuts down, which
+// would otherwise wait for the streams to end on their own.
+// -----------------------------------------------------------------------------
+func (b *eventBus) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for s := range b.subs {
+		b.drop(s)
+	}
+}
+
+// publishItem publishes an event of type typ for item
+// -----------------------------------------------------------------------------
+func publishItem(typ string, item *data.QueueItem, msg string) {
+	e := proto.Event{
+		Type:      typ,
+		SID:       item.SID,
+		Username:  item.Username,
+		Campaign:  item.Campaign,
+		Name:      item.Name,
+		State:     item.State,
+		MachineID: item.MachineID,
+		Message:   msg,
+	}
+	if typ == proto.EventEstimate && item.DtEstimate.Valid {
+		e.Estimate = item.DtEstimate.Time.Format(time.RFC3339)
+	}
+	events.publish(e)
+}
+
+// handleEvents serves GET /events, the queue events as Server-Sent Events.
+//
+//	Query parameters, all optional:
+//	    sid      - only this simulation
+//	    user     - only this user's simulations
+//	    campaign - only simulations in this campaign
+//
+// A Last-Event-ID header, or a lastEventId query parameter, replays the
+// recent events that followed that ID.
+// -----------------------------------------------------------------------------
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	d := HInfo{cmd: &proto.Command{Command: "Events", Username: r.Header.Get(UserHeader)}}
+	if err := authorize(r, &d, HandlerTableEntry{Roles: anyRole}); err != nil {
+		util.SvcErrorReturn(w, fmt.Errorf("handleEvents: %w", err))
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		util.SvcErrorReturn(w, fmt.Errorf("handleEvents: streaming is not supported"))
+		return
+	}
+
+	//-----------------------------------------------------------
+	// Filters and the point to resume from
+	//-----------------------------------------------------------
+	q := r.URL.Query()
+	filter := proto.EventFilter{Username: q.Get("user"), Campaign: q.Get("campaign")}
+	if s := q.Get("sid"); len(s) > 0 {
+		sid, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || sid <= 0 {
+			util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "handleEvents: invalid sid: %q", s))
+			return
+		}
+		filter.SID = sid
+	}
+	last := r.Header.Get("Last-Event-ID")
+	if len(last) == 0 {
+		last = q.Get("lastEventId")
+	}
+	var lastID int64
+	if len(last) > 0 {
+		var err error
+		if lastID, err = strconv.ParseInt(last, 10, 64); err != nil {
+			util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "handleEvents: invalid Last-Event-ID: %q", last))
+			return
+		}
+	}
+
+	missed, sub := events.subscribe(filter, lastID)
+	defer events.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // nginx would otherwise buffer the stream
+	w.WriteHeader(http.StatusOK)
+	for i := range missed {
+		if err := writeEvent(w, &missed[i]); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	//-----------------------------------------------------------
+	// Stream until the client goes away or the bus drops us
+	//-----------------------------------------------------------
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-sub.ch:
+			if !ok {
+				return
+			}
+			if err := writeEvent(w, &e); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// writeEvent writes e in the SSE wire format
+// -----------------------------------------------------------------------------
+func writeEvent(w http.ResponseWriter, e *proto.Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, b)
+	return err
+}
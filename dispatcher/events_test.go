@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stmansour/simq/client"
+	"github.com/stmansour/simq/data"
+	"github.com/stmansour/simq/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// useTestEventBus replaces the event bus for the length of the test
+func useTestEventBus(t *testing.T, n int) {
+	saved := events
+	events = newEventBus(n)
+	t.Cleanup(func() { events = saved })
+}
+
+// subscribers returns the number of open streams
+func subscribers() int {
+	events.mu.Lock()
+	defer events.mu.Unlock()
+	return len(events.subs)
+}
+
+func TestEventBus(t *testing.T) {
+	useTestEventBus(t, 4)
+
+	//-----------------------------------------------------
+	// replay keeps only the last 4 events and honors the
+	// filter and the last ID
+	//-----------------------------------------------------
+	for sid := int64(1); sid <= 6; sid++ {
+		publishItem(proto.EventCreated, &data.QueueItem{SID: sid, Username: "alice", Campaign: "c1"}, "")
+	}
+	missed, sub := events.subscribe(proto.EventFilter{}, 0)
+	require.Len(t, missed, 4)
+	assert.EqualValues(t, 3, missed[0].ID)
+	assert.EqualValues(t, 6, missed[3].SID)
+	events.unsubscribe(sub)
+
+	missed, sub = events.subscribe(proto.EventFilter{SID: 5}, 0)
+	require.Len(t, missed, 1)
+	assert.EqualValues(t, 5, missed[0].SID)
+	events.unsubscribe(sub)
+
+	missed, sub = events.subscribe(proto.EventFilter{}, 5)
+	require.Len(t, missed, 1)
+	assert.EqualValues(t, 6, missed[0].ID)
+	events.unsubscribe(sub)
+
+	//-----------------------------------------------------
+	// an ID from before a restart replays everything
+	//-----------------------------------------------------
+	missed, sub = events.subscribe(proto.EventFilter{}, 1000)
+	assert.Len(t, missed, 4)
+	events.unsubscribe(sub)
+
+	//-----------------------------------------------------
+	// live events are filtered
+	//-----------------------------------------------------
+	_, bob := events.subscribe(proto.EventFilter{Username: "bob"}, 0)
+	_, c1 := events.subscribe(proto.EventFilter{Campaign: "c1"}, 0)
+	publishItem(proto.EventBooked, &data.QueueItem{SID: 7, Username: "alice", Campaign: "c1", MachineID: "m1"}, "")
+	e := <-c1.ch
+	assert.Equal(t, proto.EventBooked, e.Type)
+	assert.Equal(t, "m1", e.MachineID)
+	assert.Empty(t, bob.ch)
+
+	//-----------------------------------------------------
+	// a subscriber that does not keep up is dropped
+	//-----------------------------------------------------
+	for i := 0; i <= eventBufferSize; i++ {
+		publishItem(proto.EventEstimate, &data.QueueItem{SID: 7, Campaign: "c1"}, "")
+	}
+	n := 0
+	for range c1.ch {
+		n++
+	}
+	assert.Equal(t, eventBufferSize, n)
+	events.unsubscribe(c1) // already gone, must not panic
+
+	//-----------------------------------------------------
+	// close ends the remaining streams
+	//-----------------------------------------------------
+	events.close()
+	_, ok := <-bob.ch
+	assert.False(t, ok)
+	_, late := events.subscribe(proto.EventFilter{}, 0)
+	_, ok = <-late.ch
+	assert.False(t, ok)
+}
+
+func TestWatchEvents(t *testing.T) {
+	useTestEventBus(t, eventHistory)
+	srv := httptest.NewServer(http.HandlerFunc(handleEvents))
+	defer srv.Close()
+	c := client.New(srv.URL+"/command", "test-user")
+	c.Backoff = time.Millisecond
+
+	//-----------------------------------------------------
+	// events published before Watch starts are replayed,
+	// later ones arrive live, and the filter applies
+	//-----------------------------------------------------
+	publishItem(proto.EventCreated, &data.QueueItem{SID: 1, Username: "alice"}, "")
+	publishItem(proto.EventCreated, &data.QueueItem{SID: 2, Username: "bob"}, "")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var got []proto.Event
+	done := errors.New("done")
+	go func() {
+		for subscribers() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		publishItem(proto.EventError, &data.QueueItem{SID: 2, Username: "bob", State: data.StateError}, "boom")
+		publishItem(proto.EventError, &data.QueueItem{SID: 1, Username: "alice", State: data.StateError}, "boom")
+	}()
+	err := c.Watch(ctx, &proto.EventFilter{Username: "alice"}, func(e *proto.Event) error {
+		got = append(got, *e)
+		if len(got) == 2 {
+			return done
+		}
+		return nil
+	})
+	assert.Equal(t, done, err)
+	require.Len(t, got, 2)
+	assert.Equal(t, proto.EventCreated, got[0].Type)
+	assert.Equal(t, proto.EventError, got[1].Type)
+	assert.Equal(t, "boom", got[1].Message)
+	assert.Equal(t, data.StateError, got[1].State)
+	assert.EqualValues(t, 4, got[1].ID)
+
+	//-----------------------------------------------------
+	// bad filters are refused, not retried
+	//-----------------------------------------------------
+	r, err := http.Get(srv.URL + "/events?sid=abc")
+	require.NoError(t, err)
+	r.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode)
+}
+
+func TestWatchReconnects(t *testing.T) {
+	useTestEventBus(t, eventHistory)
+	srv := httptest.NewServer(http.HandlerFunc(handleEvents))
+	defer srv.Close()
+	c := client.New(srv.URL+"/command", "test-user")
+	c.Backoff = time.Millisecond
+
+	//-----------------------------------------------------
+	// dropping the stream makes the client reconnect, and
+	// it gets the event it missed without repeats
+	//-----------------------------------------------------
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	publishItem(proto.EventCreated, &data.QueueItem{SID: 1}, "")
+	var ids []int64
+	err := c.Watch(ctx, nil, func(e *proto.Event) error {
+		ids = append(ids, e.ID)
+		if len(ids) == 1 {
+			events.mu.Lock()
+			for s := range events.subs {
+				events.drop(s)
+			}
+			events.mu.Unlock()
+			publishItem(proto.EventSaved, &data.QueueItem{SID: 1}, "")
+			return nil
+		}
+		cancel()
+		return nil
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, []int64{1, 2}, ids)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/stmansour/simq/data"
+	"github.com/stmansour/simq/proto"
+	"github.com/stmansour/simq/util"
+)
+
+//----------------------------------------------------------------------------
+// REPOSITORY CONSISTENCY CHECK
+//
+// A simulation is recorded in three places: the Queue table, its config
+// directory in qdconfigs, and its results in the result store. fsck
+// cross-checks the three and reports every SID that does not line up, by
+// category. With Repair, the inconsistencies that can be fixed without losing
+// anything are fixed; the rest are only reported.
+//----------------------------------------------------------------------------
+
+// Fsck categories
+const (
+	FsckMissingConfig  = "missing-config"  // row needs a config but qdconfigs has none
+	FsckOrphanConfig   = "orphan-config"   // qdconfigs directory with no row
+	FsckStaleConfig    = "stale-config"    // qdconfigs directory for a row whose results are saved
+	FsckOrphanResults  = "orphan-results"  // results with no row
+	FsckMissingResults = "missing-results" // row says results are saved but there are none
+	FsckUnfinishedOps  = "unfinished-ops"  // staging, trash or temp files left by an interrupted operation
+)
+
+// configNeeded reports whether a row in state should have a config directory
+// -----------------------------------------------------------------------------
+func configNeeded(state int) bool {
+	switch state {
+	case data.StateQueued, data.StateBooked, data.StateExecuting, data.StateCompleted:
+		return true
+	}
+	return false
+}
+
+// checkRepository cross-checks the Queue rows in items against qdDir and the
+// result store. If repair is true, the safe repairs are made: config
+// directories that no row needs are removed and interrupted operations are
+// finished or rolled back.
+// -----------------------------------------------------------------------------
+func checkRepository(items []data.QueueItem, qs queueStore, qdDir string, store ResultStore, repair bool) (proto.FsckReport, error) {
+	var report proto.FsckReport
+	rows := map[int64]data.QueueItem{}
+	for _, item := range items {
+		rows[item.SID] = item
+	}
+	report.Rows = len(rows)
+
+	//----------------------------------------------
+	// WHAT IS IN QDCONFIGS
+	//----------------------------------------------
+	configs := map[int64]bool{}
+	var unfinished []string
+	entries, err := os.ReadDir(qdDir)
+	if err != nil && !os.IsNotExist(err) {
+		return report, fmt.Errorf("cannot read %s: %v", qdDir, err)
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if sid, err := strconv.ParseInt(name, 10, 64); err == nil && e.IsDir() {
+			configs[sid] = true
+			continue
+		}
+		switch {
+		case name == stagingDirName || name == trashDirName:
+			sub, _ := os.ReadDir(filepath.Join(qdDir, name))
+			for _, s := range sub {
+				unfinished = append(unfinished, filepath.Join(qdDir, name, s.Name()))
+			}
+		case strings.HasPrefix(name, "config-") && strings.HasSuffix(name, ".json5"):
+			unfinished = append(unfinished, filepath.Join(qdDir, name))
+		}
+	}
+	report.Configs = len(configs)
+
+	//----------------------------------------------
+	// WHAT IS IN THE RESULT STORE
+	//----------------------------------------------
+	results := map[int64]bool{}
+	sids, err := store.ListSIDs()
+	if err != nil {
+		return report, fmt.Errorf("cannot list result store: %v", err)
+	}
+	for _, sid := range sids {
+		results[sid] = true
+	}
+	report.Results = len(results)
+
+	//----------------------------------------------
+	// CROSS-CHECK
+	//----------------------------------------------
+	var missingConfig, orphanConfig, staleConfig, orphanResults, missingResults []int64
+	for sid, item := range rows {
+		if configNeeded(item.State) && !configs[sid] {
+			missingConfig = append(missingConfig, sid)
+		}
+		if item.State == data.StateResultsSaved && !results[sid] {
+			missingResults = append(missingResults, sid)
+		}
+	}
+	for sid := range configs {
+		item, ok := rows[sid]
+		switch {
+		case !ok:
+			orphanConfig = append(orphanConfig, sid)
+		case item.State == data.StateResultsSaved:
+			staleConfig = append(staleConfig, sid)
+		}
+	}
+	for sid := range results {
+		if _, ok := rows[sid]; !ok {
+			orphanResults = append(orphanResults, sid)
+		}
+	}
+
+	//----------------------------------------------
+	// REPAIR AND REPORT
+	//----------------------------------------------
+	removeConfigs := func(list []int64) bool {
+		ok := true
+		for _, sid := range list {
+			if err := discardConfigDir(qdDir, sid); err != nil {
+				slog.Error("fsck could not remove a config directory", "sid", sid, "err", err)
+				ok = false
+			}
+		}
+		return ok
+	}
+	add := func(c proto.FsckCategory, fix func() bool) {
+		if len(c.SIDs)+len(c.Paths) == 0 {
+			return
+		}
+		sort.Slice(c.SIDs, func(i, j int) bool { return c.SIDs[i] < c.SIDs[j] })
+		if repair && fix != nil {
+			c.Repaired = fix()
+		}
+		c.Repairable = fix != nil
+		report.Categories = append(report.Categories, c)
+	}
+
+	add(proto.FsckCategory{Name: FsckUnfinishedOps, Description: "left behind by an interrupted operation", Paths: unfinished},
+		func() bool { recoverQdConfigs(qs, qdDir); return true })
+	add(proto.FsckCategory{Name: FsckMissingConfig, Description: "Queue row with no config directory", SIDs: missingConfig}, nil)
+	add(proto.FsckCategory{Name: FsckOrphanConfig, Description: "config directory with no Queue row", SIDs: orphanConfig},
+		func() bool { return removeConfigs(orphanConfig) })
+	add(proto.FsckCategory{Name: FsckStaleConfig, Description: "config directory for a simulation whose results are saved", SIDs: staleConfig},
+		func() bool { return removeConfigs(staleConfig) })
+	add(proto.FsckCategory{Name: FsckOrphanResults, Description: "results with no Queue row", SIDs: orphanResults}, nil)
+	add(proto.FsckCategory{Name: FsckMissingResults, Description: "results are saved according to the Queue row but the result store has none", SIDs: missingResults}, nil)
+
+	return report, nil
+}
+
+// threadSafeFsck checks the repository while holding the mutex so that no
+// new, deleted or ending simulation changes it underneath the check.
+// -----------------------------------------------------------------------------
+func threadSafeFsck(repair bool) (proto.FsckReport, error) {
+	app.mutex.Lock()
+	defer app.mutex.Unlock()
+	items, err := app.qm.GetAllItems()
+	if err != nil {
+		return proto.FsckReport{}, fmt.Errorf("cannot read the Queue table: %v", err)
+	}
+	return checkRepository(items, app.qm, app.QdConfigsDir, app.store, repair)
+}
+
+// handleFsck handles the Fsck command. It runs a consistency check of the
+// Queue table, qdconfigs and the result store and returns the report.
+//
+//	Cmd
+//	    Command - Fsck
+//	    Username - the person or process making this call
+//	    Data
+//	        Repair - if true, repair the inconsistencies that are safe to fix
+//
+// -----------------------------------------------------------------------------
+func handleFsck(w http.ResponseWriter, r *http.Request, d *HInfo) {
+	var req proto.FsckRequest
+	if len(d.cmd.Data) > 0 {
+		if err := json.Unmarshal(d.cmd.Data, &req); err != nil {
+			util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "handleFsck: invalid request data"))
+			return
+		}
+	}
+	d.log.Info("fsck", "repair", req.Repair)
+
+	report, err := threadSafeFsck(req.Repair)
+	if err != nil {
+		util.SvcErrorReturn(w, fmt.Errorf("handleFsck: %w", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	resp := struct {
+		Status string
+		Data   proto.FsckReport
+	}{
+		Status: "success",
+		Data:   report,
+	}
+	util.SvcWriteResponse(w, &resp)
+}
+
+// doFsck runs the check from the command line and prints the report. It
+// returns the process exit status: 0 if the repository is consistent.
+// -----------------------------------------------------------------------------
+func doFsck() int {
+	report, err := threadSafeFsck(app.repair)
+	if err != nil {
+		fmt.Printf("fsck: %v\n", err)
+		return 2
+	}
+	report.Print(os.Stdout)
+	if report.Problems() > 0 {
+		return 1
+	}
+	return 0
+}
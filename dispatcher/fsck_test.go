@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stmansour/simq/data"
+	"github.com/stmansour/simq/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func findCategory(r proto.FsckReport, name string) *proto.FsckCategory {
+	for i := range r.Categories {
+		if r.Categories[i].Name == name {
+			return &r.Categories[i]
+		}
+	}
+	return nil
+}
+
+func TestCheckRepository(t *testing.T) {
+	qdDir := t.TempDir()
+	store := NewFileResultStore(t.TempDir())
+	qs := newFakeQueue()
+	mkconfig := func(sid int64) {
+		dir := sidDir(qdDir, sid)
+		require.NoError(t, os.MkdirAll(dir, os.ModePerm))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "sim.json5"), []byte("{}"), 0644))
+	}
+	archive := makeTestArchive(t, map[string]string{"finrep.csv": "x\n"})
+
+	items := []data.QueueItem{
+		{SID: 1, State: data.StateQueued},       // consistent
+		{SID: 2, State: data.StateQueued},       // missing config
+		{SID: 3, State: data.StateResultsSaved}, // consistent
+		{SID: 4, State: data.StateResultsSaved}, // stale config
+		{SID: 5, State: data.StateResultsSaved}, // missing results
+	}
+	for _, item := range items {
+		qs.items[item.SID] = item
+	}
+	mkconfig(1)
+	mkconfig(4)
+	mkconfig(9) // orphan config
+	for _, sid := range []int64{3, 4, 8} {
+		_, err := store.Save(sid, bytes.NewReader(archive)) // 8 is an orphan
+		require.NoError(t, err)
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(qdDir, "config-1.json5"), []byte("{}"), 0644))
+
+	//-----------------------------------------
+	// REPORT ONLY
+	//-----------------------------------------
+	report, err := checkRepository(items, qs, qdDir, store, false)
+	require.NoError(t, err)
+	assert.Equal(t, 5, report.Rows)
+	assert.Equal(t, 3, report.Configs)
+	assert.Equal(t, 3, report.Results)
+	assert.Equal(t, []int64{2}, findCategory(report, FsckMissingConfig).SIDs)
+	assert.Equal(t, []int64{9}, findCategory(report, FsckOrphanConfig).SIDs)
+	assert.Equal(t, []int64{4}, findCategory(report, FsckStaleConfig).SIDs)
+	assert.Equal(t, []int64{8}, findCategory(report, FsckOrphanResults).SIDs)
+	assert.Equal(t, []int64{5}, findCategory(report, FsckMissingResults).SIDs)
+	assert.Len(t, findCategory(report, FsckUnfinishedOps).Paths, 1)
+	assert.Equal(t, 6, report.Problems())
+	assert.DirExists(t, sidDir(qdDir, 9))
+
+	//-----------------------------------------
+	// REPAIR
+	//-----------------------------------------
+	report, err = checkRepository(items, qs, qdDir, store, true)
+	require.NoError(t, err)
+	assert.True(t, findCategory(report, FsckOrphanConfig).Repaired)
+	assert.True(t, findCategory(report, FsckStaleConfig).Repaired)
+	assert.False(t, findCategory(report, FsckMissingConfig).Repaired)
+	assert.NoDirExists(t, sidDir(qdDir, 9))
+	assert.NoDirExists(t, sidDir(qdDir, 4))
+	assert.DirExists(t, sidDir(qdDir, 1))
+	assert.NoFileExists(t, filepath.Join(qdDir, "config-1.json5"))
+
+	//-----------------------------------------------------
+	// only the unrepairable categories are left
+	//-----------------------------------------------------
+	report, err = checkRepository(items, qs, qdDir, store, false)
+	require.NoError(t, err)
+	assert.Nil(t, findCategory(report, FsckOrphanConfig))
+	assert.Nil(t, findCategory(report, FsckStaleConfig))
+	assert.Nil(t, findCategory(report, FsckUnfinishedOps))
+	assert.Equal(t, 3, report.Problems())
+
+	var b bytes.Buffer
+	report.Print(&b)
+	assert.Contains(t, b.String(), "orphan-results (1)")
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/stmansour/simq/util"
+)
+
+//----------------------------------------------------------------------------
+// HEALTH AND READINESS
+//
+// /healthz reports whether the dispatcher can do its job: the database
+// answers and the data directories are writable and have free space.
+// /readyz makes the same checks and also requires that the dispatcher is not
+// paused, i.e. that it is handing out work. Both return 200 when every check
+// passes and 503 otherwise, with a JSON body describing each check.
+//----------------------------------------------------------------------------
+
+const (
+	healthOK   = "ok"
+	healthWarn = "warn"
+	healthFail = "fail"
+
+	dbPingTimeout        = 2 * time.Second
+	defaultMinFreeDiskMB = 1024
+)
+
+// HealthCheck is the outcome of one check
+type HealthCheck struct {
+	Name       string
+	Status     string // ok, warn or fail
+	Message    string `json:",omitempty"`
+	DurationMs float64
+}
+
+// HealthResponse is the body returned by /healthz and /readyz
+type HealthResponse struct {
+	Status string // ok or fail
+	Time   time.Time
+	Checks []HealthCheck
+}
+
+// handleHealthz serves /healthz
+// -----------------------------------------------------------------------------
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, runHealthChecks(r.Context(), false))
+}
+
+// handleReadyz serves /readyz
+// -----------------------------------------------------------------------------
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, runHealthChecks(r.Context(), true))
+}
+
+func writeHealth(w http.ResponseWriter, resp HealthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if resp.Status != healthOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		slog.Warn("could not write the health response", "err", err)
+	}
+}
+
+// runHealthChecks runs all the checks. If readiness is true, being paused is
+// a failure rather than a warning.
+// -----------------------------------------------------------------------------
+func runHealthChecks(ctx context.Context, readiness bool) HealthResponse {
+	resp := HealthResponse{Status: healthOK, Time: time.Now()}
+	add := func(name string, f func() (string, string)) {
+		start := time.Now()
+		status, msg := f()
+		resp.Checks = append(resp.Checks, HealthCheck{
+			Name:       name,
+			Status:     status,
+			Message:    msg,
+			DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+		})
+		if status == healthFail {
+			resp.Status = healthFail
+		}
+	}
+
+	add("database", func() (string, string) { return checkDatabase(ctx) })
+	add("qdconfigs", func() (string, string) { return checkDirectory(app.QdConfigsDir) })
+	if _, ok := app.store.(*FileResultStore); ok {
+		add("simresults", func() (string, string) { return checkDirectory(app.SimResultsDir) })
+	}
+	add("paused", func() (string, string) {
+		if !app.paused.Load() {
+			return healthOK, ""
+		}
+		if readiness {
+			return healthFail, "dispatcher is paused"
+		}
+		return healthWarn, "dispatcher is paused"
+	})
+	return resp
+}
+
+// checkDatabase pings the database with a timeout
+// -----------------------------------------------------------------------------
+func checkDatabase(ctx context.Context) (string, string) {
+	if app.qm == nil {
+		return healthFail, "no database connection"
+	}
+	ctx, cancel := context.WithTimeout(ctx, dbPingTimeout)
+	defer cancel()
+	if err := app.qm.Ping(ctx); err != nil {
+		return healthFail, err.Error()
+	}
+	return healthOK, ""
+}
+
+// checkDirectory verifies that dir exists, can be written, and has at least
+// app.minFreeDiskMB of free space where that can be checked.
+// -----------------------------------------------------------------------------
+func checkDirectory(dir string) (string, string) {
+	if len(dir) == 0 {
+		return healthFail, "directory is not configured"
+	}
+	f, err := os.CreateTemp(dir, ".healthz-*")
+	if err != nil {
+		return healthFail, fmt.Sprintf("%s is not writable: %v", dir, err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	freeMB, err := freeDiskMB(dir)
+	if err != nil {
+		return healthFail, fmt.Sprintf("statfs %s: %v", dir, err)
+	}
+	if freeMB < 0 {
+		return healthOK, "free space is not checked on this platform"
+	}
+	if freeMB < app.minFreeDiskMB {
+		return healthFail, fmt.Sprintf("%s has %d MB free, minimum is %d MB", dir, freeMB, app.minFreeDiskMB)
+	}
+	return healthOK, fmt.Sprintf("%d MB free", freeMB)
+}
+
+// handlePause handles the Pause and Resume commands. While the dispatcher is
+// paused, Book requests get no simulation; everything else works as usual.
+//
+//	Cmd
+//	    Command - Pause or Resume
+//	    Username - the person or process making this call
+//
+// -----------------------------------------------------------------------------
+func handlePause(w http.ResponseWriter, r *http.Request, d *HInfo) {
+	var msg string
+	pause := d.cmd.Command == "Pause"
+	if app.paused.Swap(pause) == pause {
+		if pause {
+			msg = "Dispatcher was already paused."
+		} else {
+			msg = "Dispatcher was not paused."
+		}
+	} else if pause {
+		msg = fmt.Sprintf("Booking paused at %s", time.Now().Format("2006-01-02 15:04:05"))
+	} else {
+		msg = fmt.Sprintf("Booking resumed at %s", time.Now().Format("2006-01-02 15:04:05"))
+	}
+	d.log.Info(msg)
+
+	w.WriteHeader(http.StatusOK)
+	resp := util.SvcStatus200{
+		Status:  "success",
+		Message: msg,
+	}
+	util.SvcWriteResponse(w, &resp)
+}
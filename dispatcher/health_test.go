@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stmansour/simq/proto"
+	"github.com/stmansour/simq/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getHealth(t *testing.T, h http.HandlerFunc, url string) (int, map[string]HealthCheck) {
+	rr := httptest.NewRecorder()
+	r, err := http.NewRequest("GET", url, nil)
+	require.NoError(t, err)
+	h(rr, r)
+	var resp HealthResponse
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	checks := map[string]HealthCheck{}
+	for _, c := range resp.Checks {
+		checks[c.Name] = c
+	}
+	return rr.Code, checks
+}
+
+func TestHealthChecks(t *testing.T) {
+	app.QdConfigsDir = t.TempDir()
+	app.SimResultsDir = t.TempDir()
+	app.store = NewFileResultStore(app.SimResultsDir)
+	app.minFreeDiskMB = 1
+	defer app.paused.Store(false)
+
+	_, checks := getHealth(t, handleHealthz, "/healthz")
+	assert.Equal(t, healthOK, checks["qdconfigs"].Status)
+	assert.Equal(t, healthOK, checks["simresults"].Status)
+	assert.Equal(t, healthOK, checks["paused"].Status)
+	assert.Contains(t, checks, "database")
+
+	//-----------------------------------------------------
+	// paused: a warning for health, a failure for ready
+	//-----------------------------------------------------
+	app.paused.Store(true)
+	_, checks = getHealth(t, handleHealthz, "/healthz")
+	assert.Equal(t, healthWarn, checks["paused"].Status)
+	code, checks := getHealth(t, handleReadyz, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, healthFail, checks["paused"].Status)
+
+	//-----------------------------------------------------
+	// missing directory, not enough space
+	//-----------------------------------------------------
+	app.QdConfigsDir = "/nonexistent/qdconfigs"
+	app.minFreeDiskMB = 1 << 40
+	code, checks = getHealth(t, handleHealthz, "/healthz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, healthFail, checks["qdconfigs"].Status)
+	assert.Equal(t, healthFail, checks["simresults"].Status)
+	assert.Contains(t, checks["simresults"].Message, "MB free")
+}
+
+func TestPauseStopsBooking(t *testing.T) {
+	defer app.paused.Store(false)
+	rr := sendResultsCommand(t, "Pause", proto.ResultsRequest{})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.True(t, app.paused.Load())
+
+	rr = sendResultsCommand(t, "Book", proto.ResultsRequest{})
+	var resp proto.SvcStatus201
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	assert.Equal(t, "success", resp.Status)
+	assert.EqualValues(t, 0, resp.ID)
+	assert.Contains(t, resp.Message, "paused")
+	assert.Equal(t, util.CodePaused, resp.Code)
+
+	sendResultsCommand(t, "Resume", proto.ResultsRequest{})
+	assert.False(t, app.paused.Load())
+}
@@ -0,0 +1,15 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+// freeDiskMB returns the free space, in MB, of the file system dir is on
+// -----------------------------------------------------------------------------
+func freeDiskMB(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(uint64(st.Bavail) * uint64(st.Bsize) / (1024 * 1024)), nil
+}
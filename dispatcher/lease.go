@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/stmansour/simq/data"
+	"github.com/stmansour/simq/proto"
+)
+
+//----------------------------------------------------------------------------
+// LEASES
+//
+// A machine that books a simulation holds a lease on it, which is renewed
+// every time the machine updates the queue item. If a booked or executing
+// simulation is not updated for the lease timeout, its machine may be gone.
+// The dispatcher publishes an "expired" event for it, once per lease, and
+// leaves the simulation alone: the machine may still come back.
+//----------------------------------------------------------------------------
+
+const defaultLeaseTimeout = 24 * time.Hour
+
+// leaseChecker finds the leases that have run out
+type leaseChecker struct {
+	timeout  time.Duration
+	reported map[int64]time.Time // SID -> the Modified time of the lease that was reported
+}
+
+// newLeaseChecker returns a checker for leases of the supplied length
+// -----------------------------------------------------------------------------
+func newLeaseChecker(timeout time.Duration) *leaseChecker {
+	if timeout <= 0 {
+		timeout = defaultLeaseTimeout
+	}
+	return &leaseChecker{timeout: timeout, reported: map[int64]time.Time{}}
+}
+
+// check returns the items whose lease ran out since the last check
+// -----------------------------------------------------------------------------
+func (l *leaseChecker) check(items []data.QueueItem, now time.Time) []data.QueueItem {
+	var expired []data.QueueItem
+	held := map[int64]bool{}
+	for _, item := range items {
+		if item.State != data.StateBooked && item.State != data.StateExecuting {
+			continue
+		}
+		held[item.SID] = true
+		if now.Sub(item.Modified) < l.timeout {
+			continue
+		}
+		if t, ok := l.reported[item.SID]; ok && t.Equal(item.Modified) {
+			continue // already reported this lease
+		}
+		l.reported[item.SID] = item.Modified
+		expired = append(expired, item)
+	}
+
+	//------------------------------------------------------
+	// forget the simulations that are no longer booked
+	//------------------------------------------------------
+	for sid := range l.reported {
+		if !held[sid] {
+			delete(l.reported, sid)
+		}
+	}
+	return expired
+}
+
+// run checks the leases periodically until ctx is done
+// -----------------------------------------------------------------------------
+func (l *leaseChecker) run(ctx context.Context) {
+	interval := time.Minute
+	if l.timeout/4 < interval {
+		interval = l.timeout / 4
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		items, err := app.qm.GetQueuedAndExecutingItems()
+		if err != nil {
+			slog.Warn("lease check failed", "err", err)
+			continue
+		}
+		now := time.Now()
+		for _, item := range l.check(items, now) {
+			msg := fmt.Sprintf("no update from machine %q for %s", item.MachineID, now.Sub(item.Modified).Round(time.Minute))
+			slog.Warn("lease expired", "sid", item.SID, "machine", item.MachineID, "modified", item.Modified)
+			publishItem(proto.EventExpired, &item, msg)
+		}
+	}
+}
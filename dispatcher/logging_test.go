@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stmansour/simq/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sendCorrelated(t *testing.T, body, header string) string {
+	r, err := http.NewRequest("POST", "/command", bytes.NewBufferString(body))
+	require.NoError(t, err)
+	r.Header.Set("Content-Type", "application/json")
+	if len(header) > 0 {
+		r.Header.Set(util.CorrelationHeader, header)
+	}
+	rr := httptest.NewRecorder()
+	commandDispatcher(rr, r)
+	return rr.Header().Get(util.CorrelationHeader)
+}
+
+func TestCorrelationID(t *testing.T) {
+	// the header wins over the body
+	assert.Equal(t, "abc123", sendCorrelated(t, `{"Command":"Pause","CorrelationID":"body"}`, "abc123"))
+	assert.Equal(t, "body", sendCorrelated(t, `{"Command":"Resume","CorrelationID":"body"}`, ""))
+
+	// a new ID is made if the caller did not send one, even for bad requests
+	id := sendCorrelated(t, `not json`, "")
+	assert.Len(t, id, 16)
+	assert.NotEqual(t, id, sendCorrelated(t, `not json`, ""))
+}
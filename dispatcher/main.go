@@ -5,12 +5,14 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/stmansour/simq/data"
@@ -29,15 +31,33 @@ var app struct {
 	HTTPHdrsDbg   bool // if true print HTTP headers
 	SimResultsDir string
 	QdConfigsDir  string
+	store         ResultStore // the simulation results repository
+	fsck          bool        // run the consistency check and exit
+	repair        bool        // with fsck, repair what is safe to repair
+	exitCode      int
+	paused        atomic.Bool     // when true, Book hands out no simulations
+	minFreeDiskMB int64           // health checks fail below this much free space
+	tokens        []util.APIToken // API tokens; none means authentication is off
+	mailer        *emailNotifier  // nil when no mail server is configured
 	mutex         sync.Mutex
 }
 
 func readCommandLineArgs() {
 	flag.BoolVar(&app.version, "v", false, "print the program version string")
 	flag.Parse()
+
+	//--------------------------------------------------------
+	// dispatcher fsck [-repair]  checks the repository
+	//--------------------------------------------------------
+	if flag.Arg(0) == "fsck" {
+		app.fsck = true
+		fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+		fs.BoolVar(&app.repair, "repair", false, "repair the inconsistencies that are safe to fix")
+		fs.Parse(flag.Args()[1:])
+	}
 }
 
-func setMyNetworkAddress() {
+func setMyNetworkAddress(scheme string) {
 	app.port = 8250
 	naddrs, err := util.GetNetworkInfo()
 	if err != nil {
@@ -47,7 +67,7 @@ func setMyNetworkAddress() {
 		if strings.Contains(naddrs[i].IPAddress, "127.0.0.1") {
 			continue
 		}
-		app.DispatcherURL = fmt.Sprintf("http://%s:%d/", naddrs[i].IPAddress, app.port)
+		app.DispatcherURL = fmt.Sprintf("%s://%s:%d/", scheme, naddrs[i].IPAddress, app.port)
 	}
 }
 
@@ -56,24 +76,6 @@ func doMain() {
 		fmt.Println("dispatcher version:", util.Version())
 		return
 	}
-	//-----------------------------------------
-	// OUTPUT MESSAGES TO A LOGFILE
-	//-----------------------------------------
-	exdir, err := util.GetExecutableDir()
-	if err != nil {
-		log.Fatalf("Failed to get executable directory: %v", err)
-	}
-	fname := filepath.Join(exdir, "dispatcher.log")
-	logFile, err := os.OpenFile(fname, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
-	if err != nil {
-		log.Fatalf("Failed to open log file: %v", err)
-	}
-	defer logFile.Close()
-	log.SetOutput(logFile)
-	log.Printf("---------------------------------------------------------------------\n")
-	log.Printf("Dispatcher version: %s\n", util.Version())
-	log.Printf("Initiated: %s\n", time.Now().Format(time.RFC3339))
-
 	//-----------------------------------------
 	// READ IN CONFIGURATION
 	//-----------------------------------------
@@ -85,9 +87,27 @@ func doMain() {
 	if ex, err = util.LoadConfig(ex, "dispatcher.json5"); err != nil {
 		log.Fatalf("Failed to load config: %v", err)
 	}
+
+	//-----------------------------------------
+	// OUTPUT MESSAGES TO A LOGFILE
+	//-----------------------------------------
+	exdir, err := util.GetExecutableDir()
+	if err != nil {
+		log.Fatalf("Failed to get executable directory: %v", err)
+	}
+	logFile, err := util.SetupLogging(filepath.Join(exdir, "dispatcher.log"), ex.Log)
+	if err != nil {
+		log.Fatalf("Failed to set up logging: %v", err)
+	}
+	defer logFile.Close()
+	slog.Info("dispatcher started", "version", util.Version())
 	log.Printf("Database: %s\n", ex.DbName)
 	cmd := ex.GetSQLOpenString(ex.DbName)
-	setMyNetworkAddress()
+	scheme := "http"
+	if ex.TLS.Enabled() {
+		scheme = "https"
+	}
+	setMyNetworkAddress(scheme)
 	log.Printf("Dispatcher Network Address: %s\n", app.DispatcherURL)
 
 	//-----------------------------------------
@@ -97,12 +117,37 @@ func doMain() {
 	if err != nil {
 		log.Fatalf("Failed to initialize queue manager: %v", err)
 	}
+	app.qm.ErrorHook = func(op string, err error) { metrics.dbErrors.Inc(op) }
 
 	//-----------------------------------------
 	// INFLOW AND OUTFLOW DIRECTORIES
 	//-----------------------------------------
 	app.SimResultsDir = ex.SimResultsDir
 	app.QdConfigsDir = ex.DispatcherQueueDir
+	app.minFreeDiskMB = ex.MinFreeDiskMB
+	if app.minFreeDiskMB <= 0 {
+		app.minFreeDiskMB = defaultMinFreeDiskMB
+	}
+	if app.store, err = newResultStore(ex); err != nil {
+		log.Fatalf("Failed to initialize result store: %v", err)
+	}
+	log.Printf("Result store: %T\n", app.store)
+	if err = setAPITokens(ex.APITokens); err != nil {
+		log.Fatalf("Failed to load API tokens: %v", err)
+	}
+	if len(app.tokens) == 0 {
+		slog.Warn("no APITokens configured, authentication is off")
+	}
+
+	if app.fsck {
+		app.exitCode = doFsck()
+		return
+	}
+
+	//-----------------------------------------
+	// FINISH OR UNDO INTERRUPTED OPERATIONS
+	//-----------------------------------------
+	threadSafeRecover()
 
 	//-----------------------------------------
 	// SET UP HTTP LISTENER
@@ -110,17 +155,75 @@ func doMain() {
 	srvAddr := fmt.Sprintf(":%d", app.port)
 	mux := http.NewServeMux()
 	mux.HandleFunc("/command", commandDispatcher)
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
+	registerREST(mux)
 	app.server = &http.Server{
 		Addr:    srvAddr,
 		Handler: mux,
 	}
+	app.server.RegisterOnShutdown(events.close)
+
+	//-----------------------------------------
+	// WEBHOOKS AND LEASE EXPIRY
+	//-----------------------------------------
+	deadLetter := ex.WebhookDeadLetter
+	if len(deadLetter) == 0 {
+		deadLetter = filepath.Join(exdir, "webhook-deadletter.log")
+	}
+	notifier := newWebhookNotifier(app.qm, ex.WebhookRetries, deadLetter)
+	notifier.start(events)
+	app.server.RegisterOnShutdown(notifier.stop)
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	go newLeaseChecker(time.Duration(ex.LeaseTimeoutMin) * time.Minute).run(bgCtx)
+	app.server.RegisterOnShutdown(stopBackground)
+
+	//-----------------------------------------
+	// ALERTS
+	//-----------------------------------------
+	alerts = newAlertManager(ex.Alerts)
+	alerts.start(bgCtx, events)
+
+	//-----------------------------------------
+	// SIMULATOR POLLING
+	//-----------------------------------------
+	if ex.PollMin >= 0 {
+		simPoller = newPoller(time.Duration(ex.PollMin)*time.Minute, ex.PollConcurrency)
+		go simPoller.run(bgCtx)
+		slog.Info("polling simulators", "interval", simPoller.interval, "concurrency", simPoller.workers)
+	}
+
+	//-----------------------------------------
+	// EMAIL
+	//-----------------------------------------
+	if ex.SMTP.Enabled() {
+		if app.mailer, err = newEmailNotifier(app.qm, ex.SMTP, app.store.Location); err != nil {
+			log.Fatalf("Failed to set up email: %v", err)
+		}
+		app.mailer.start(events)
+		app.server.RegisterOnShutdown(app.mailer.stop)
+		log.Printf("Email: %s\n", ex.SMTP.Addr())
+	}
+	if ex.TLS.Enabled() {
+		if app.server.TLSConfig, err = util.ServerTLSConfig(&ex.TLS); err != nil {
+			log.Fatalf("Failed to set up TLS: %v", err)
+		}
+		slog.Info("serving https", "clientCerts", len(ex.TLS.CAFile) > 0)
+	}
 
 	//-----------------------------------------
 	// START THE HTTP LISTENER
 	//-----------------------------------------
 	app.shutdownwait = 5
 	go func() {
-		if err := app.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if app.server.TLSConfig != nil {
+			err = app.server.ListenAndServeTLS("", "") // the certificate is in TLSConfig
+		} else {
+			err = app.server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatalf("ListenAndServe(): %v", err)
 		}
 	}()
@@ -145,4 +248,5 @@ func doMain() {
 func main() {
 	readCommandLineArgs()
 	doMain()
+	os.Exit(app.exitCode)
 }
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stmansour/simq/data"
+)
+
+//----------------------------------------------------------------------------
+// METRICS
+//
+// The dispatcher keeps a handful of counters and histograms in memory and
+// serves them at /metrics in the Prometheus text exposition format (0.0.4).
+// Queue depth is read from the database when /metrics is scraped.
+//----------------------------------------------------------------------------
+
+// handlerBuckets are the upper bounds, in seconds, for handler latency
+var handlerBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// extractBuckets are the upper bounds, in seconds, for unpacking results
+var extractBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+var metrics = struct {
+	requests          *counterVec
+	requestErrors     *counterVec
+	requestDuration   *histogramVec
+	uploadBytes       *counterVec
+	bookings          *counterVec
+	completions       *counterVec
+	extractDuration   *histogramVec
+	dbErrors          *counterVec
+	webhookDeliveries *counterVec
+	emails            *counterVec
+	alerts            *counterVec
+}{
+	requests:          newCounterVec("simq_dispatcher_requests_total", "Commands handled, by command.", "command"),
+	requestErrors:     newCounterVec("simq_dispatcher_request_errors_total", "Commands that returned an error, by command.", "command"),
+	requestDuration:   newHistogramVec("simq_dispatcher_request_duration_seconds", "Time to handle a command, by command.", handlerBuckets, "command"),
+	uploadBytes:       newCounterVec("simq_dispatcher_upload_bytes_total", "Request body bytes received, by command.", "command"),
+	bookings:          newCounterVec("simq_dispatcher_bookings_total", "Simulations booked, by machine.", "machine"),
+	completions:       newCounterVec("simq_dispatcher_completions_total", "Simulations whose results were saved, by machine.", "machine"),
+	extractDuration:   newHistogramVec("simq_dispatcher_results_extract_duration_seconds", "Time to unpack a results archive into the result store.", extractBuckets, "store"),
+	dbErrors:          newCounterVec("simq_dispatcher_db_errors_total", "Failed database operations, by operation.", "op"),
+	webhookDeliveries: newCounterVec("simq_dispatcher_webhook_deliveries_total", "Webhook deliveries, by result: delivered, failed, or dropped because the queue was full.", "result"),
+	emails:            newCounterVec("simq_dispatcher_emails_total", "Notification emails, by result: sent or failed.", "result"),
+	alerts:            newCounterVec("simq_dispatcher_alerts_total", "Alerts raised, by rule.", "rule"),
+}
+
+// queueStates names the states for the queue depth gauge
+var queueStates = []struct {
+	state int
+	name  string
+}{
+	{data.StateQueued, "queued"},
+	{data.StateBooked, "booked"},
+	{data.StateExecuting, "executing"},
+	{data.StateCompleted, "completed"},
+	{data.StateResultsSaved, "results_saved"},
+	{data.StateError, "error"},
+}
+
+// handleMetrics serves the metrics in the Prometheus text format
+// -----------------------------------------------------------------------------
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeQueueDepth(w)
+	metrics.requests.writeTo(w)
+	metrics.requestErrors.writeTo(w)
+	metrics.requestDuration.writeTo(w)
+	metrics.uploadBytes.writeTo(w)
+	metrics.bookings.writeTo(w)
+	metrics.completions.writeTo(w)
+	metrics.extractDuration.writeTo(w)
+	metrics.dbErrors.writeTo(w)
+	metrics.webhookDeliveries.writeTo(w)
+	metrics.emails.writeTo(w)
+	metrics.alerts.writeTo(w)
+}
+
+// writeQueueDepth writes the number of queue items in each state
+// -----------------------------------------------------------------------------
+func writeQueueDepth(w io.Writer) {
+	if app.qm == nil {
+		return
+	}
+	counts, err := app.qm.GetStateCounts()
+	if err != nil {
+		slog.Error("could not count the queue items", "err", err)
+		return
+	}
+	fmt.Fprintf(w, "# HELP simq_queue_depth Queue items, by state.\n# TYPE simq_queue_depth gauge\n")
+	for _, s := range queueStates {
+		fmt.Fprintf(w, "simq_queue_depth{state=%q} %d\n", s.name, counts[s.state])
+	}
+}
+
+// recordRequest updates the per-command metrics once a command is handled
+// -----------------------------------------------------------------------------
+func recordRequest(command string, mw *metricsWriter, bodyBytes int64, elapsed time.Duration) {
+	if _, ok := handlerTable[command]; !ok {
+		command = "unknown" // don't let callers create label values at will
+		mw.failed = true
+	}
+	metrics.requests.Inc(command)
+	metrics.requestDuration.Observe(elapsed.Seconds(), command)
+	metrics.uploadBytes.Add(float64(bodyBytes), command)
+	if mw.failed || mw.status >= 400 {
+		metrics.requestErrors.Inc(command)
+	}
+}
+
+// metricsWriter records whether a response was an error. It keeps the first
+// status written, which misses an error reported after a handler already
+// sent its 200, so it also implements util.ErrorMarker.
+type metricsWriter struct {
+	http.ResponseWriter
+	status int
+	failed bool
+}
+
+func (m *metricsWriter) WriteHeader(status int) {
+	if m.status == 0 {
+		m.status = status
+	}
+	m.ResponseWriter.WriteHeader(status)
+}
+
+func (m *metricsWriter) MarkError(err error) {
+	m.failed = true
+}
+
+// countingReadCloser counts the bytes read from a request body
+type countingReadCloser struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+//----------------------------------------------------------------------------
+// counterVec and histogramVec are minimal labeled metric types. Series are
+// keyed by their label values joined with a separator that cannot appear in
+// a label value we use.
+//----------------------------------------------------------------------------
+
+const labelSep = "\xff"
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+// Inc adds 1 to the series for the label values lv
+func (c *counterVec) Inc(lv ...string) {
+	c.Add(1, lv...)
+}
+
+// Add adds v to the series for the label values lv
+func (c *counterVec) Add(v float64, lv ...string) {
+	c.mu.Lock()
+	c.values[strings.Join(lv, labelSep)] += v
+	c.mu.Unlock()
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, key, ""), formatValue(c.values[key]))
+	}
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogram{}}
+}
+
+// Observe records the value v in the series for the label values lv
+func (h *histogramVec) Observe(v float64, lv ...string) {
+	key := strings.Join(lv, labelSep)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, ub := range h.buckets {
+		if v <= ub {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		var cum uint64
+		for i, ub := range h.buckets {
+			cum += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, formatValue(ub)), cum)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, ""), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, ""), s.count)
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatLabels returns {name="value",...} for the series key. If le is not
+// empty, it is added as the histogram bucket label.
+func formatLabels(names []string, key, le string) string {
+	var parts []string
+	if len(names) > 0 {
+		values := strings.Split(key, labelSep)
+		for i, n := range names {
+			v := ""
+			if i < len(values) {
+				v = values[i]
+			}
+			parts = append(parts, fmt.Sprintf("%s=\"%s\"", n, escapeLabel(v)))
+		}
+	}
+	if len(le) > 0 {
+		parts = append(parts, fmt.Sprintf("le=\"%s\"", le))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return fmt.Sprintf("%g", v)
+}
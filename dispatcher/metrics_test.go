@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stmansour/simq/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func scrapeMetrics(t *testing.T) string {
+	rr := httptest.NewRecorder()
+	r, err := http.NewRequest("GET", "/metrics", nil)
+	require.NoError(t, err)
+	handleMetrics(rr, r)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rr.Header().Get("Content-Type"))
+	return rr.Body.String()
+}
+
+func TestMetricsCountRequests(t *testing.T) {
+	makeTestResults(t, "42")
+	sendResultsCommand(t, "ListResults", proto.ResultsRequest{SID: 42})
+	sendResultsCommand(t, "ListResults", proto.ResultsRequest{SID: 43}) // error
+	r, err := http.NewRequest("POST", "/command", bytes.NewBufferString(`{"Command":"NoSuchCommand"}`))
+	require.NoError(t, err)
+	r.Header.Set("Content-Type", "application/json")
+	commandDispatcher(httptest.NewRecorder(), r)
+
+	text := scrapeMetrics(t)
+	assert.Contains(t, text, "# TYPE simq_dispatcher_requests_total counter\n")
+	assert.Contains(t, text, `simq_dispatcher_requests_total{command="ListResults"} `)
+	assert.Contains(t, text, `simq_dispatcher_request_errors_total{command="ListResults"} `)
+	assert.Contains(t, text, `simq_dispatcher_request_errors_total{command="unknown"} `)
+	assert.Contains(t, text, `simq_dispatcher_request_duration_seconds_bucket{command="ListResults",le="+Inf"} `)
+	assert.Contains(t, text, `simq_dispatcher_upload_bytes_total{command="ListResults"} `)
+	assert.NotContains(t, text, "NoSuchCommand")
+}
+
+func TestHistogramFormat(t *testing.T) {
+	h := newHistogramVec("test_seconds", "A test.", []float64{0.5, 1}, "op")
+	h.Observe(0.25, "a")
+	h.Observe(0.75, "a")
+	h.Observe(3, "a")
+	var b strings.Builder
+	h.writeTo(&b)
+	assert.Equal(t, `# HELP test_seconds A test.
+# TYPE test_seconds histogram
+test_seconds_bucket{op="a",le="0.5"} 1
+test_seconds_bucket{op="a",le="1"} 2
+test_seconds_bucket{op="a",le="+Inf"} 3
+test_seconds_sum{op="a"} 4
+test_seconds_count{op="a"} 3
+`, b.String())
+
+	c := newCounterVec("test_total", "A test.", "machine")
+	c.Inc(`odd"name`)
+	b.Reset()
+	c.writeTo(&b)
+	assert.Contains(t, b.String(), `test_total{machine="odd\"name"} 1`)
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stmansour/simq/data"
+	"github.com/stmansour/simq/proto"
+)
+
+//----------------------------------------------------------------------------
+// POLLER
+//
+// The poller contacts every running simulator at its simtalk URL, the URL
+// that simd reports for the simulation, and asks for its status. At most
+// PollConcurrency simulators are polled at once. An answer, like a status
+// that simd sends with ReportProgress, refreshes the simulation's progress,
+// adds a sample to its Progress time series if the simulator moved on and,
+// if the simulator's EstimatedCompletion moved, updates its DtEstimate. A
+// simulator that does not answer pollFailures times in a row is flagged as
+// unreachable, which raises an alert.
+//----------------------------------------------------------------------------
+
+const (
+	defaultPollInterval    = 5 * time.Minute
+	defaultPollConcurrency = 8
+	pollTimeout            = 10 * time.Second // limit for each poll
+	pollFailures           = 3                // polls in a row without an answer before a simulator is unreachable
+	estimateSlack          = time.Minute      // smaller changes to DtEstimate are not saved
+)
+
+// poller polls running simulators for their status
+type poller struct {
+	interval    time.Duration
+	workers     int
+	client      *http.Client
+	setEstimate func(sid int64, est time.Time) error // saves a new DtEstimate
+	saveSample  func(s data.ProgressSample) error    // stores a progress sample
+	mu          sync.Mutex
+	progress    map[int64]*proto.Progress // SID -> what the last polls found
+}
+
+var simPoller = newPoller(0, 0)
+
+// newPoller returns a poller that polls every interval, workers at a time.
+// Zero values mean the defaults.
+// -----------------------------------------------------------------------------
+func newPoller(interval time.Duration, workers int) *poller {
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	if workers <= 0 {
+		workers = defaultPollConcurrency
+	}
+	p := &poller{
+		interval: interval,
+		workers:  workers,
+		client:   &http.Client{Timeout: pollTimeout},
+		progress: map[int64]*proto.Progress{},
+	}
+	p.setEstimate = saveEstimate
+	p.saveSample = func(s data.ProgressSample) error {
+		_, err := app.qm.InsertProgress(s)
+		return err
+	}
+	return p
+}
+
+// statusURL returns the simtalk status endpoint of the simulator at u
+// -----------------------------------------------------------------------------
+func statusURL(u string) string {
+	u = strings.TrimSuffix(u, "/")
+	if strings.HasSuffix(u, "/status") {
+		return u
+	}
+	return u + "/status"
+}
+
+// run polls the simulators periodically until ctx is done
+// -----------------------------------------------------------------------------
+func (p *poller) run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		items, err := app.qm.GetQueuedAndExecutingItems()
+		if err != nil {
+			slog.Warn("poll failed", "err", err)
+			continue
+		}
+		p.pollAll(ctx, items)
+	}
+}
+
+// pollAll polls the simulators of the booked and executing items that have
+// a URL, and forgets the progress of the simulations that are not in items.
+// Simulators their machine paused cannot answer and are not polled.
+// -----------------------------------------------------------------------------
+func (p *poller) pollAll(ctx context.Context, items []data.QueueItem) {
+	running := map[int64]bool{}
+	sem := make(chan struct{}, p.workers)
+	var wg sync.WaitGroup
+	for _, item := range items {
+		if item.State != data.StateBooked && item.State != data.StateExecuting {
+			continue
+		}
+		running[item.SID] = true
+		if len(item.URL) == 0 {
+			continue
+		}
+		if _, paused := alerts.throttled(item.SID); paused {
+			p.mu.Lock()
+			if pr := p.progress[item.SID]; pr != nil {
+				pr.Failures, pr.Error = 0, ""
+			}
+			p.mu.Unlock()
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		}
+		wg.Add(1)
+		go func(item data.QueueItem) {
+			defer func() { <-sem; wg.Done() }()
+			p.poll(ctx, &item)
+		}(item)
+	}
+	wg.Wait()
+
+	p.mu.Lock()
+	for sid := range p.progress {
+		if !running[sid] {
+			delete(p.progress, sid)
+		}
+	}
+	p.mu.Unlock()
+	alerts.forgetUnreachable(running)
+}
+
+// poll asks the simulator of item for its status and records the answer
+// -----------------------------------------------------------------------------
+func (p *poller) poll(ctx context.Context, item *data.QueueItem) {
+	st, err := p.status(ctx, item.URL)
+	if err == nil {
+		p.record(item, st, "poll", time.Now())
+		return
+	}
+
+	p.mu.Lock()
+	pr := p.entry(item.SID)
+	pr.Failures++
+	pr.Error = err.Error()
+	failures := pr.Failures
+	p.mu.Unlock()
+
+	slog.Debug("poll failed", "sid", item.SID, "url", item.URL, "failures", failures, "err", err)
+	if failures == pollFailures {
+		slog.Warn("simulator is unreachable", "sid", item.SID, "machine", item.MachineID, "url", item.URL, "err", err)
+	}
+	if failures >= pollFailures {
+		alerts.setUnreachable(item.SID, fmt.Sprintf("the simulator of SID %d on %s at %s did not answer %d polls: %v", item.SID, item.MachineID, item.URL, failures, err))
+	}
+}
+
+// entry returns the progress of sid, adding it if needed. p.mu must be held.
+// -----------------------------------------------------------------------------
+func (p *poller) entry(sid int64) *proto.Progress {
+	pr := p.progress[sid]
+	if pr == nil {
+		pr = &proto.Progress{SID: sid, Percent: -1}
+		p.progress[sid] = pr
+	}
+	return pr
+}
+
+// record notes st, a status of the simulator of item that source got at now.
+// It refreshes the progress, stores a sample if the simulator moved on, and
+// saves the simulator's estimate if it moved.
+// -----------------------------------------------------------------------------
+func (p *poller) record(item *data.QueueItem, st *proto.SimulatorStatus, source string, now time.Time) {
+	p.mu.Lock()
+	pr := p.entry(item.SID)
+	moved := pr.Polled.IsZero() || !sameProgress(&pr.Status, st)
+	pr.Failures, pr.Error = 0, ""
+	pr.Status, pr.Polled, pr.Percent = *st, now, st.Percent()
+	p.mu.Unlock()
+
+	alerts.setUnreachable(item.SID, "")
+	alerts.seen(item.MachineID, now)
+	if moved {
+		if err := p.saveSample(progressSample(item.SID, st, source, now)); err != nil {
+			slog.Warn("could not save the progress", "sid", item.SID, "err", err)
+		}
+	}
+
+	//------------------------------------------------------
+	// Save the simulator's estimate if it moved
+	//------------------------------------------------------
+	if len(st.EstimatedCompletion) == 0 {
+		return
+	}
+	est, err := st.Estimate()
+	if err != nil {
+		slog.Debug("unreadable EstimatedCompletion", "sid", item.SID, "value", st.EstimatedCompletion)
+		return
+	}
+	if item.DtEstimate.Valid && absDuration(est.Sub(item.DtEstimate.Time)) < estimateSlack {
+		return
+	}
+	if err := p.setEstimate(item.SID, est); err != nil {
+		slog.Warn("could not save the estimate", "sid", item.SID, "err", err)
+	}
+}
+
+// sameProgress reports whether a and b show the same progress. The fields
+// that change with every status, like RunDuration, are ignored.
+// -----------------------------------------------------------------------------
+func sameProgress(a, b *proto.SimulatorStatus) bool {
+	return a.LoopCount == b.LoopCount &&
+		a.GenerationsRequested == b.GenerationsRequested &&
+		a.CompletedLoops == b.CompletedLoops &&
+		a.CompletedGenerations == b.CompletedGenerations &&
+		a.EstimatedCompletion == b.EstimatedCompletion
+}
+
+// status fetches the status of the simulator at u
+// -----------------------------------------------------------------------------
+func (p *poller) status(ctx context.Context, u string) (*proto.SimulatorStatus, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", statusURL(u), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("simulator answered %s", resp.Status)
+	}
+	var st proto.SimulatorStatus
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		return nil, fmt.Errorf("invalid status: %v", err)
+	}
+	return &st, nil
+}
+
+// get returns the progress recorded for sid
+// -----------------------------------------------------------------------------
+func (p *poller) get(sid int64) (proto.Progress, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pr, ok := p.progress[sid]
+	if !ok {
+		return proto.Progress{}, false
+	}
+	return *pr, true
+}
+
+// saveEstimate sets the DtEstimate of sid to est, the way UpdateItem does
+// -----------------------------------------------------------------------------
+func saveEstimate(sid int64, est time.Time) error {
+	app.mutex.Lock()
+	item, err := app.qm.GetItemByID(sid)
+	if err == nil && item.State != data.StateBooked && item.State != data.StateExecuting {
+		app.mutex.Unlock()
+		return nil // it finished while we polled
+	}
+	if err == nil {
+		item.DtEstimate = sql.NullTime{Time: est, Valid: true}
+		item.State = data.StateExecuting
+		err = app.qm.UpdateItem(item)
+	}
+	app.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	publishItem(proto.EventEstimate, &item, "estimate from the simulator")
+	return nil
+}
+
+// absDuration returns the absolute value of d
+// -----------------------------------------------------------------------------
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stmansour/simq/data"
+	"github.com/stmansour/simq/proto"
+	"github.com/stmansour/simq/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusURL(t *testing.T) {
+	assert.Equal(t, "http://m1:8090/status", statusURL("http://m1:8090"))
+	assert.Equal(t, "http://m1:8090/status", statusURL("http://m1:8090/"))
+	assert.Equal(t, "http://m1:8090/status", statusURL("http://m1:8090/status"))
+}
+
+func TestSimulatorPercent(t *testing.T) {
+	st := proto.SimulatorStatus{CompletedLoops: 1, LoopCount: 4, CompletedGenerations: 5, GenerationsRequested: 10}
+	assert.InDelta(t, 37.5, st.Percent(), 0.001)
+	assert.Equal(t, -1.0, (&proto.SimulatorStatus{}).Percent())
+}
+
+func TestPoller(t *testing.T) {
+	est := time.Now().Add(2 * time.Hour).Truncate(time.Second)
+	var inFlight, maxInFlight int32
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			m := atomic.LoadInt32(&maxInFlight)
+			if n <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(t, "/status", r.URL.Path)
+		json.NewEncoder(w).Encode(proto.SimulatorStatus{
+			CompletedLoops:       1,
+			LoopCount:            2,
+			GenerationsRequested: 10,
+			EstimatedCompletion:  est.Format(time.RFC3339),
+		})
+	}))
+	defer healthy.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no", http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	saved := map[int64]time.Time{}
+	samples := map[int64]int{}
+	var mu sync.Mutex
+	p := newPoller(time.Minute, 2)
+	p.setEstimate = func(sid int64, t time.Time) error {
+		mu.Lock()
+		defer mu.Unlock()
+		saved[sid] = t
+		return nil
+	}
+	p.saveSample = func(s data.ProgressSample) error {
+		mu.Lock()
+		defer mu.Unlock()
+		samples[s.SID]++
+		assert.Equal(t, "poll", s.Source)
+		return nil
+	}
+	defer func(a *alertManager) { alerts = a }(alerts)
+	alerts = newAlertManager(util.AlertConfig{})
+
+	items := []data.QueueItem{
+		{SID: 1, State: data.StateBooked, MachineID: "m1", URL: healthy.URL, Modified: time.Now()},
+		{SID: 2, State: data.StateExecuting, MachineID: "m1", URL: healthy.URL, Modified: time.Now(), DtEstimate: sql.NullTime{Time: est.Add(10 * time.Second), Valid: true}},
+		{SID: 3, State: data.StateExecuting, MachineID: "m1", URL: healthy.URL, Modified: time.Now()},
+		{SID: 4, State: data.StateExecuting, MachineID: "m1", URL: healthy.URL, Modified: time.Now()},
+		{SID: 5, State: data.StateExecuting, MachineID: "m2", URL: broken.URL, Modified: time.Now()},
+		{SID: 6, State: data.StateExecuting, MachineID: "m3", Modified: time.Now()}, // no URL yet
+		{SID: 7, State: data.StateQueued, URL: healthy.URL},
+	}
+	p.pollAll(context.Background(), items)
+	assert.LessOrEqual(t, atomic.LoadInt32(&maxInFlight), int32(2), "polls are bounded by the concurrency")
+
+	pr, ok := p.get(1)
+	require.True(t, ok)
+	assert.Equal(t, 50.0, pr.Percent)
+	assert.Zero(t, pr.Failures)
+	assert.False(t, pr.Polled.IsZero())
+	_, ok = p.get(6)
+	assert.False(t, ok)
+	_, ok = p.get(7)
+	assert.False(t, ok)
+
+	//-----------------------------------------------------
+	// estimates are saved when they move by a minute or
+	// more
+	//-----------------------------------------------------
+	assert.Len(t, saved, 3)
+	assert.True(t, est.Equal(saved[1]))
+	assert.NotContains(t, saved, int64(2))
+	assert.Equal(t, map[int64]int{1: 1, 2: 1, 3: 1, 4: 1}, samples)
+
+	//-----------------------------------------------------
+	// a simulator that keeps failing becomes unreachable,
+	// and reachable again when it answers
+	//-----------------------------------------------------
+	pr, _ = p.get(5)
+	assert.Equal(t, 1, pr.Failures)
+	assert.Contains(t, pr.Error, "500")
+	assert.NotContains(t, rules(alerts.evaluate(items, time.Now())), "SID 5 unreachable")
+	p.pollAll(context.Background(), items)
+	p.pollAll(context.Background(), items)
+	assert.Contains(t, rules(alerts.evaluate(items, time.Now())), "SID 5 unreachable")
+
+	items[4].URL = healthy.URL
+	p.pollAll(context.Background(), items)
+	assert.NotContains(t, rules(alerts.evaluate(items, time.Now())), "SID 5 unreachable")
+
+	//-----------------------------------------------------
+	// a sample is stored only when the simulator moved on
+	//-----------------------------------------------------
+	assert.Equal(t, map[int64]int{1: 1, 2: 1, 3: 1, 4: 1, 5: 1}, samples)
+	p.record(&items[0], &proto.SimulatorStatus{CompletedLoops: 1, LoopCount: 2, GenerationsRequested: 10, CompletedGenerations: 1}, "poll", time.Now())
+	assert.Equal(t, 2, samples[1])
+
+	//-----------------------------------------------------
+	// a simulator its machine paused is not polled, so it
+	// does not become unreachable
+	//-----------------------------------------------------
+	items[4].URL = broken.URL
+	for i := 0; i < pollFailures; i++ {
+		p.pollAll(context.Background(), items)
+	}
+	assert.Contains(t, rules(alerts.evaluate(items, time.Now())), "SID 5 unreachable")
+	alerts.setThrottled("m2", []int64{5}, nil)
+	p.pollAll(context.Background(), items)
+	pr, _ = p.get(5)
+	assert.Zero(t, pr.Failures)
+	assert.NotContains(t, rules(alerts.evaluate(items, time.Now())), "SID 5 unreachable")
+	alerts.setThrottled("m2", nil, nil)
+
+	//-----------------------------------------------------
+	// finished simulations are forgotten
+	//-----------------------------------------------------
+	for i := 0; i < pollFailures; i++ {
+		p.pollAll(context.Background(), items)
+	}
+	p.pollAll(context.Background(), items[:4])
+	_, ok = p.get(5)
+	assert.False(t, ok)
+	assert.Empty(t, alerts.unreach)
+}
+
+func TestProgressReport(t *testing.T) {
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	sample := func(min, loops, gens int, est string) data.ProgressSample {
+		return data.ProgressSample{
+			SID:                  9,
+			Source:               "simd",
+			LoopCount:            2,
+			GenerationsRequested: 10,
+			CompletedLoops:       loops,
+			CompletedGenerations: gens,
+			EstimatedCompletion:  est,
+			Recorded:             start.Add(time.Duration(min) * time.Minute),
+		}
+	}
+
+	rpt := progressReport(9, nil)
+	assert.Equal(t, -1.0, rpt.Percent)
+	assert.Zero(t, rpt.GensPerHour)
+	assert.Zero(t, rpt.Drift())
+	assert.NotNil(t, rpt.Samples)
+
+	rpt = progressReport(9, []data.ProgressSample{
+		sample(0, 0, 2, ""),
+		sample(30, 0, 6, "2026-03-01T15:00:00Z"),
+		sample(60, 1, 2, "2026-03-01T15:45:00Z"),
+	})
+	require.Len(t, rpt.Samples, 3)
+	assert.Equal(t, 60.0, rpt.Percent)
+	assert.InDelta(t, 10.0, rpt.GensPerHour, 0.001)
+	assert.Equal(t, 45*time.Minute, rpt.Drift())
+	assert.Equal(t, "simd", rpt.Samples[2].Source)
+	assert.Equal(t, 12, rpt.Samples[2].Generations())
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/stmansour/simq/data"
+	"github.com/stmansour/simq/proto"
+	"github.com/stmansour/simq/util"
+)
+
+// progressSample returns the sample of st that source got at t for sid
+// -----------------------------------------------------------------------------
+func progressSample(sid int64, st *proto.SimulatorStatus, source string, t time.Time) data.ProgressSample {
+	return data.ProgressSample{
+		SID:                    sid,
+		Source:                 source,
+		LoopCount:              st.LoopCount,
+		GenerationsRequested:   st.GenerationsRequested,
+		CompletedLoops:         st.CompletedLoops,
+		CompletedGenerations:   st.CompletedGenerations,
+		ElapsedTimeLastGen:     st.ElapsedTimeLastGen,
+		EstimatedTimeRemaining: st.EstimatedTimeRemaining,
+		EstimatedCompletion:    st.EstimatedCompletion,
+		Recorded:               t,
+	}
+}
+
+// progressReport sums up the progress samples of sid
+// -----------------------------------------------------------------------------
+func progressReport(sid int64, samples []data.ProgressSample) proto.ProgressReport {
+	rpt := proto.ProgressReport{SID: sid, Percent: -1, Samples: []proto.ProgressSample{}}
+	for _, s := range samples {
+		ps := proto.ProgressSample{
+			SimulatorStatus: proto.SimulatorStatus{
+				LoopCount:              s.LoopCount,
+				GenerationsRequested:   s.GenerationsRequested,
+				CompletedLoops:         s.CompletedLoops,
+				CompletedGenerations:   s.CompletedGenerations,
+				ElapsedTimeLastGen:     s.ElapsedTimeLastGen,
+				EstimatedTimeRemaining: s.EstimatedTimeRemaining,
+				EstimatedCompletion:    s.EstimatedCompletion,
+			},
+			Recorded: s.Recorded,
+			Source:   s.Source,
+		}
+		if est, err := ps.Estimate(); err == nil {
+			if rpt.FirstEstimate.IsZero() {
+				rpt.FirstEstimate = est
+			}
+			rpt.Estimate = est
+		}
+		rpt.Samples = append(rpt.Samples, ps)
+	}
+	if len(rpt.Samples) == 0 {
+		return rpt
+	}
+	first, last := &rpt.Samples[0], &rpt.Samples[len(rpt.Samples)-1]
+	rpt.Percent = last.Percent()
+	if d := last.Recorded.Sub(first.Recorded); d > 0 && last.GenerationsRequested > 0 {
+		rpt.GensPerHour = float64(last.Generations()-first.Generations()) / d.Hours()
+	}
+	return rpt
+}
+
+// handleReportProgress handles the ReportProgress command, which simd sends
+// with each new status of a simulator it runs
+// -----------------------------------------------------------------------------
+func handleReportProgress(w http.ResponseWriter, r *http.Request, d *HInfo) {
+	var req proto.ReportProgressRequest
+	if err := json.Unmarshal(d.cmd.Data, &req); err != nil || req.SID <= 0 {
+		util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "handleReportProgress: invalid request data"))
+		return
+	}
+	item, err := app.qm.GetItemByID(req.SID)
+	if err != nil {
+		util.SvcErrorReturn(w, util.Errorf(lookupCode(err), "handleReportProgress: SID %d not found", req.SID))
+		return
+	}
+	if err := checkMachine(d, item.MachineID); err != nil {
+		util.SvcErrorReturn(w, fmt.Errorf("handleReportProgress: SID %d: %w", req.SID, err))
+		return
+	}
+	if item.State != data.StateBooked && item.State != data.StateExecuting {
+		util.SvcErrorReturn(w, util.Errorf(util.ErrConflict, "handleReportProgress: SID %d is not running", req.SID))
+		return
+	}
+	simPoller.record(&item, &req.Status, "simd", time.Now())
+	w.WriteHeader(http.StatusOK)
+	msg := util.SvcStatus200{Status: "success", Message: "ok"}
+	util.SvcWriteResponse(w, &msg)
+	d.log.Debug("progress", "sid", req.SID, "loops", req.Status.CompletedLoops, "generations", req.Status.CompletedGenerations)
+}
+
+// handleGetProgress handles the GetProgress command
+// -----------------------------------------------------------------------------
+func handleGetProgress(w http.ResponseWriter, r *http.Request, d *HInfo) {
+	var req proto.ProgressRequest
+	if err := json.Unmarshal(d.cmd.Data, &req); err != nil {
+		util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "handleGetProgress: invalid request data"))
+		return
+	}
+	if _, err := app.qm.GetItemByID(req.SID); err != nil {
+		util.SvcErrorReturn(w, util.Errorf(lookupCode(err), "handleGetProgress: SID %d not found", req.SID))
+		return
+	}
+	samples, err := app.qm.GetProgress(req.SID)
+	if err != nil {
+		util.SvcErrorReturn(w, fmt.Errorf("handleGetProgress: %v", err))
+		return
+	}
+	rpt := progressReport(req.SID, samples)
+	if pr, ok := simPoller.get(req.SID); ok {
+		rpt.Latest = &pr
+	}
+
+	w.WriteHeader(http.StatusOK)
+	resp := struct {
+		Status string
+		Data   proto.ProgressReport
+	}{
+		Status: "success",
+		Data:   rpt,
+	}
+	util.SvcWriteResponse(w, &resp)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/stmansour/simq/proto"
+	"github.com/stmansour/simq/util"
+)
+
+// commandNames is the sorted list of commands in handlerTable
+var commandNames []string
+
+func init() {
+	for name := range handlerTable {
+		commandNames = append(commandNames, name)
+	}
+	sort.Strings(commandNames)
+}
+
+// features returns the optional features that are turned on
+// -----------------------------------------------------------------------------
+func features() []string {
+	f := []string{"rest"}
+	if len(app.tokens) > 0 {
+		f = append(f, "auth")
+	}
+	if app.server != nil && app.server.TLSConfig != nil {
+		f = append(f, "tls")
+	}
+	if _, ok := app.store.(*S3ResultStore); ok {
+		f = append(f, "s3")
+	}
+	if app.mailer != nil {
+		f = append(f, "email")
+	}
+	return f
+}
+
+// handleCapabilities tells the client which protocol versions, commands and
+// features this dispatcher supports
+// -----------------------------------------------------------------------------
+func handleCapabilities(w http.ResponseWriter, r *http.Request, d *HInfo) {
+	w.WriteHeader(http.StatusOK)
+	resp := struct {
+		Status string
+		Data   proto.Capabilities
+	}{
+		Status: "success",
+		Data: proto.Capabilities{
+			ProtocolVersion:    proto.ProtocolVersion,
+			MinProtocolVersion: proto.MinProtocolVersion,
+			Version:            util.Version(),
+			Commands:           commandNames,
+			Features:           features(),
+		},
+	}
+	util.SvcWriteResponse(w, &resp)
+}
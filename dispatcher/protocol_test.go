@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stmansour/simq/proto"
+	"github.com/stmansour/simq/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sendVersioned(t *testing.T, cmd proto.Command) *httptest.ResponseRecorder {
+	r, err := http.NewRequest("POST", "/command", bytes.NewBuffer(mustMarshal(cmd)))
+	require.NoError(t, err)
+	r.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	commandDispatcher(rr, r)
+	return rr
+}
+
+func TestProtocolVersion(t *testing.T) {
+	defer app.paused.Store(false)
+
+	//-----------------------------------------------------
+	// unversioned and current clients are served
+	//-----------------------------------------------------
+	rr := sendVersioned(t, proto.Command{Command: "Pause", Username: "test-user"})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = sendVersioned(t, proto.Command{Command: "Resume", Protocol: proto.ProtocolVersion, ClientVersion: "test"})
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	//-----------------------------------------------------
+	// newer clients are refused, even for unknown commands
+	//-----------------------------------------------------
+	for _, command := range []string{"Pause", "SomeFutureCommand"} {
+		rr = sendVersioned(t, proto.Command{Command: command, Protocol: proto.ProtocolVersion + 1, ClientVersion: "9.9.9"})
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+		err := util.DecodeError(rr.Body.Bytes())
+		assert.Equal(t, util.ErrIncompatible, util.CodeOf(err))
+		assert.Contains(t, err.Error(), "9.9.9")
+	}
+	assert.False(t, app.paused.Load())
+}
+
+func TestCapabilities(t *testing.T) {
+	c := newTestClient(t)
+	caps, err := c.Capabilities(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, proto.ProtocolVersion, caps.ProtocolVersion)
+	assert.True(t, caps.Has("Book"))
+	assert.True(t, caps.Has("Capabilities"))
+	assert.False(t, caps.Has("NoSuchCommand"))
+	assert.NoError(t, caps.Compatible())
+
+	caps.MinProtocolVersion = proto.ProtocolVersion + 1
+	caps.ProtocolVersion = proto.ProtocolVersion + 1
+	assert.Error(t, caps.Compatible())
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/stmansour/simq/data"
+	"github.com/stmansour/simq/util"
+)
+
+//----------------------------------------------------------------------------
+// FILE + DATABASE OPERATIONS
+//
+// A simulation lives in two places: its row in the Queue table and its
+// config directory in qdconfigs (later, its results in the result store).
+// The operations below change both. They are arranged so that an error part
+// way through is undone, and a crash part way through is finished or rolled
+// back by recoverQdConfigs the next time the dispatcher starts.
+//
+// Two hidden directories in QdConfigsDir hold work in progress:
+//
+//	.staging/new-XXXX/         config dir of a new simulation, not yet named
+//	.staging/new-XXXX.intent   the SID it was given (0 until the insert is done)
+//	.trash/SID/                config dir of a simulation being removed
+//
+// The final step of every operation is a rename, so a SID directory in
+// qdconfigs is always complete.
+//----------------------------------------------------------------------------
+
+const (
+	stagingDirName = ".staging"
+	trashDirName   = ".trash"
+	intentSuffix   = ".intent"
+)
+
+// queueStore is the part of the QueueManager used by the file+DB operations
+type queueStore interface {
+	GetItemByID(SID int64) (data.QueueItem, error)
+	GetQueuedAndExecutingItems() ([]data.QueueItem, error)
+	InsertItem(item data.QueueItem) (int64, error)
+	UpdateItem(item data.QueueItem) error
+	DeleteItem(SID int64) error
+}
+
+// newSimIntent is recorded next to a staged config directory before the row
+// is inserted, and again with the SID once the new simulation has one. Abort
+// is set if the operation failed and the row could not be removed at the
+// time.
+type newSimIntent struct {
+	SID   int64
+	Abort bool
+}
+
+// newSimTxn adds a new simulation: a row in the Queue table and a config
+// directory in qdDir holding filename. It returns the SID of the new row.
+// -----------------------------------------------------------------------------
+func newSimTxn(qs queueStore, qdDir string, fileContent []byte, queueItem *data.QueueItem, filename string) (int64, error) {
+	if len(fileContent) == 0 {
+		return 0, util.Errorf(util.ErrBadRequest, "no file content. 0-length file")
+	}
+	filename = filepath.Base(filename)
+	if filename == string(os.PathSeparator) || strings.HasPrefix(filename, ".") {
+		return 0, util.Errorf(util.ErrBadRequest, "invalid config filename: %q", filename)
+	}
+
+	//----------------------------------------------
+	// STAGE THE CONFIG FILE
+	//----------------------------------------------
+	stagingDir := filepath.Join(qdDir, stagingDirName)
+	if err := os.MkdirAll(stagingDir, os.ModePerm); err != nil {
+		return 0, fmt.Errorf("failed to create directory: %v", err)
+	}
+	stage, err := os.MkdirTemp(stagingDir, "new-*")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create staging directory in %s: %v", stagingDir, err)
+	}
+	if err := os.WriteFile(filepath.Join(stage, filename), fileContent, 0644); err != nil {
+		os.RemoveAll(stage)
+		return 0, fmt.Errorf("failed to write file content: %v", err)
+	}
+
+	//----------------------------------------------
+	// INSERT THE ROW. The intent is written first so
+	// that a crash during the insert is not mistaken
+	// for one before it.
+	//----------------------------------------------
+	intent := stage + intentSuffix
+	if err := writeIntent(intent, newSimIntent{}); err != nil {
+		os.RemoveAll(stage)
+		return 0, fmt.Errorf("failed to record staged config: %v", err)
+	}
+	sid, err := qs.InsertItem(*queueItem)
+	if err != nil {
+		os.RemoveAll(stage)
+		os.Remove(intent)
+		return 0, fmt.Errorf("failed to insert new item to database: %v", err)
+	}
+	if err := writeIntent(intent, newSimIntent{SID: sid}); err != nil {
+		rollbackNewSim(qs, sid, stage)
+		return 0, fmt.Errorf("failed to record staged SID %d: %v", sid, err)
+	}
+
+	//----------------------------------------------
+	// MOVE THE CONFIG DIRECTORY INTO PLACE
+	//----------------------------------------------
+	dest := filepath.Join(qdDir, fmt.Sprintf("%d", sid))
+	if err := os.Rename(stage, dest); err != nil {
+		rollbackNewSim(qs, sid, stage)
+		return 0, fmt.Errorf("failed to rename %s to %s: %v", stage, dest, err)
+	}
+	if err := os.Remove(intent); err != nil {
+		slog.Warn("newSimTxn: could not remove intent", "sid", sid, "file", intent, "err", err)
+	}
+	return sid, nil
+}
+
+// rollbackNewSim undoes a new simulation that failed after its row was
+// inserted. If the row cannot be deleted now, the intent is marked as aborted
+// so that the recovery pass deletes it later.
+// -----------------------------------------------------------------------------
+func rollbackNewSim(qs queueStore, sid int64, stage string) {
+	intent := stage + intentSuffix
+	if err := qs.DeleteItem(sid); err != nil {
+		slog.Warn("rollbackNewSim: could not delete row", "sid", sid, "err", err)
+		if err := writeIntent(intent, newSimIntent{SID: sid, Abort: true}); err != nil {
+			slog.Error("rollbackNewSim: row has no config file and must be deleted by hand", "sid", sid, "err", err)
+		}
+		return
+	}
+	os.RemoveAll(stage)
+	os.Remove(intent)
+}
+
+// deleteSimTxn removes the config directory and the Queue row for sid. If the
+// row cannot be deleted, the config directory is put back.
+// -----------------------------------------------------------------------------
+func deleteSimTxn(qs queueStore, qdDir string, sid int64) error {
+	trash, moved, err := moveToTrash(qdDir, sid)
+	if err != nil {
+		return err
+	}
+	if err := qs.DeleteItem(sid); err != nil {
+		if moved {
+			dirPath := filepath.Join(qdDir, fmt.Sprintf("%d", sid))
+			if rerr := os.Rename(trash, dirPath); rerr != nil {
+				slog.Warn("deleteSimTxn: could not restore config directory", "sid", sid, "dir", dirPath, "err", rerr)
+			}
+		}
+		return fmt.Errorf("failed to delete queue item %d: %v", sid, err)
+	}
+	emptyTrash(trash)
+	return nil
+}
+
+// endSimTxn saves the results archive for sid and marks the simulation as
+// ResultsSaved. If the row cannot be updated, the saved results are removed
+// again. The config directory is removed last; failing to remove it does not
+// fail the operation because the recovery pass will finish the job. mu is
+// held while the row and the config directory change, but not during the
+// upload, which can take a long time.
+// -----------------------------------------------------------------------------
+func endSimTxn(qs queueStore, store ResultStore, qdDir string, sid int64, archive io.Reader, mu sync.Locker) (string, error) {
+	getItem := func() (data.QueueItem, error) {
+		queueItem, err := qs.GetItemByID(sid)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return queueItem, util.Errorf(util.ErrNotFound, "queue item %d not found", sid)
+			}
+			return queueItem, fmt.Errorf("error in GetItemByID: %v", err)
+		}
+		return queueItem, nil
+	}
+	mu.Lock()
+	_, err := getItem()
+	mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	location, err := store.Save(sid, archive)
+	if err != nil {
+		return "", err
+	}
+
+	//----------------------------------------------------
+	// The row may have changed during the upload, e.g.
+	// the simulation was deleted, so read it again
+	//----------------------------------------------------
+	mu.Lock()
+	defer mu.Unlock()
+	queueItem, err := getItem()
+	if err == nil {
+		queueItem.State = data.StateResultsSaved
+		if err = qs.UpdateItem(queueItem); err != nil {
+			err = fmt.Errorf("error in UpdateItem: %v", err)
+		}
+	}
+	if err != nil {
+		if rerr := store.Remove(sid); rerr != nil {
+			slog.Warn("endSimTxn: could not remove results", "sid", sid, "location", location, "err", rerr)
+		}
+		return "", err
+	}
+	metrics.completions.Inc(queueItem.MachineID)
+
+	if err := discardConfigDir(qdDir, sid); err != nil {
+		slog.Warn("endSimTxn: could not remove config directory", "sid", sid, "err", err)
+	}
+	return location, nil
+}
+
+// discardConfigDir removes the config directory for sid. It is used once the
+// row no longer needs it. A directory that cannot be removed now is left in
+// the trash for the recovery pass.
+// -----------------------------------------------------------------------------
+func discardConfigDir(qdDir string, sid int64) error {
+	trash, moved, err := moveToTrash(qdDir, sid)
+	if err != nil {
+		return err
+	}
+	if moved {
+		emptyTrash(trash)
+	}
+	return nil
+}
+
+// moveToTrash renames the config directory for sid into the trash. moved is
+// false if there was no config directory.
+// -----------------------------------------------------------------------------
+func moveToTrash(qdDir string, sid int64) (trash string, moved bool, err error) {
+	trashDir := filepath.Join(qdDir, trashDirName)
+	if err := os.MkdirAll(trashDir, os.ModePerm); err != nil {
+		return "", false, fmt.Errorf("failed to create directory: %v", err)
+	}
+	trash = filepath.Join(trashDir, fmt.Sprintf("%d", sid))
+	if err := os.RemoveAll(trash); err != nil {
+		return "", false, fmt.Errorf("failed to clear %s: %v", trash, err)
+	}
+	dirPath := filepath.Join(qdDir, fmt.Sprintf("%d", sid))
+	if err := os.Rename(dirPath, trash); err != nil {
+		if os.IsNotExist(err) {
+			return trash, false, nil
+		}
+		return "", false, fmt.Errorf("failed to move %s to %s: %v", dirPath, trash, err)
+	}
+	return trash, true, nil
+}
+
+func emptyTrash(trash string) {
+	if err := os.RemoveAll(trash); err != nil {
+		slog.Warn("emptyTrash: could not remove trash, it will be removed at the next startup", "dir", trash, "err", err)
+	}
+}
+
+func writeIntent(fname string, intent newSimIntent) error {
+	b, err := json.Marshal(&intent)
+	if err != nil {
+		return err
+	}
+	tmp := fname + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fname)
+}
+
+func readIntent(fname string) (newSimIntent, error) {
+	var intent newSimIntent
+	b, err := os.ReadFile(fname)
+	if err != nil {
+		return intent, err
+	}
+	err = json.Unmarshal(b, &intent)
+	return intent, err
+}
+
+// recoverQdConfigs finishes or rolls back file+DB operations that were
+// interrupted by a crash. It is called at startup, before any requests are
+// accepted. Problems are logged; an item that cannot be resolved now is left
+// for the next startup.
+// -----------------------------------------------------------------------------
+func recoverQdConfigs(qs queueStore, qdDir string) {
+	recoverStrayTempFiles(qdDir)
+	recoverStaging(qs, qdDir)
+	recoverTrash(qs, qdDir)
+	recoverSavedConfigs(qs, qdDir)
+}
+
+// recoverStrayTempFiles removes the config-*.json5 temp files that older
+// versions of the dispatcher could leave at the top of qdconfigs.
+// -----------------------------------------------------------------------------
+func recoverStrayTempFiles(qdDir string) {
+	matches, _ := filepath.Glob(filepath.Join(qdDir, "config-*.json5"))
+	for _, m := range matches {
+		slog.Info("recovery: removing stray temp file", "file", m)
+		if err := os.Remove(m); err != nil {
+			slog.Warn("recovery: could not remove stray temp file", "file", m, "err", err)
+		}
+	}
+}
+
+// recoverStaging resolves new simulations that never made it into place.
+// A staged directory with no intent never got a row, so it is removed. With
+// an intent, the move is finished if the row exists and rolled back if not.
+// An intent without a SID means the crash came during the insert; the
+// staged directory goes to the queued row that has no config directory and
+// the same config file, if there is one.
+// -----------------------------------------------------------------------------
+func recoverStaging(qs queueStore, qdDir string) {
+	stagingDir := filepath.Join(qdDir, stagingDirName)
+	entries, err := os.ReadDir(stagingDir)
+	if err != nil {
+		return
+	}
+	var unclaimed []data.QueueItem // read only if needed
+	unclaimedRead := false
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		stage := filepath.Join(stagingDir, e.Name())
+		intent, err := readIntent(stage + intentSuffix)
+		if err != nil {
+			slog.Info("recovery: removing staged directory with no SID", "dir", stage)
+			os.RemoveAll(stage)
+			os.Remove(stage + intentSuffix)
+			continue
+		}
+		if intent.SID == 0 {
+			if !unclaimedRead {
+				if unclaimed, err = unclaimedRows(qs, qdDir); err != nil {
+					slog.Warn("recovery: could not read queued rows", "err", err)
+					continue
+				}
+				unclaimedRead = true
+			}
+			i := claimRow(unclaimed, stage)
+			if i < 0 {
+				slog.Info("recovery: removing staged directory that never got a row", "dir", stage)
+				os.RemoveAll(stage)
+				os.Remove(stage + intentSuffix)
+				continue
+			}
+			intent.SID = unclaimed[i].SID
+			unclaimed = append(unclaimed[:i], unclaimed[i+1:]...)
+			slog.Info("recovery: found the row of a staged directory", "sid", intent.SID, "dir", stage)
+		}
+		dest := filepath.Join(qdDir, fmt.Sprintf("%d", intent.SID))
+		if intent.Abort {
+			if err := qs.DeleteItem(intent.SID); err != nil {
+				slog.Warn("recovery: could not delete aborted row", "sid", intent.SID, "err", err)
+				continue
+			}
+			slog.Info("recovery: rolled back aborted new simulation", "sid", intent.SID)
+			os.RemoveAll(stage)
+			os.Remove(stage + intentSuffix)
+			continue
+		}
+		_, err = qs.GetItemByID(intent.SID)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			slog.Info("recovery: row is gone, removing staged directory", "sid", intent.SID, "dir", stage)
+			os.RemoveAll(stage)
+		case err != nil:
+			slog.Warn("recovery: could not read row", "sid", intent.SID, "err", err)
+			continue
+		default:
+			if _, err := os.Stat(dest); err == nil {
+				os.RemoveAll(stage)
+				break
+			}
+			if err := os.Rename(stage, dest); err != nil {
+				slog.Warn("recovery: could not move staged directory into place", "sid", intent.SID, "from", stage, "to", dest, "err", err)
+				continue
+			}
+			slog.Info("recovery: finished new simulation", "sid", intent.SID)
+		}
+		os.Remove(stage + intentSuffix)
+	}
+
+	//------------------------------------------------------------
+	// Intents whose staged directory was already moved into place
+	//------------------------------------------------------------
+	leftovers, _ := filepath.Glob(filepath.Join(stagingDir, "*"+intentSuffix))
+	for _, intent := range leftovers {
+		if _, err := os.Stat(strings.TrimSuffix(intent, intentSuffix)); os.IsNotExist(err) {
+			os.Remove(intent)
+		}
+	}
+}
+
+// unclaimedRows returns the queued rows that have no config directory in
+// qdDir, in SID order
+// -----------------------------------------------------------------------------
+func unclaimedRows(qs queueStore, qdDir string) ([]data.QueueItem, error) {
+	items, err := qs.GetQueuedAndExecutingItems()
+	if err != nil {
+		return nil, err
+	}
+	var rows []data.QueueItem
+	for _, item := range items {
+		if item.State != data.StateQueued {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(qdDir, fmt.Sprintf("%d", item.SID))); os.IsNotExist(err) {
+			rows = append(rows, item)
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].SID < rows[j].SID })
+	return rows, nil
+}
+
+// claimRow returns the index of the row in rows whose config file is the one
+// in the staged directory stage, or -1 if there is none
+// -----------------------------------------------------------------------------
+func claimRow(rows []data.QueueItem, stage string) int {
+	files, err := os.ReadDir(stage)
+	if err != nil || len(files) != 1 {
+		return -1
+	}
+	for i, item := range rows {
+		if filepath.Base(item.File) == files[0].Name() {
+			return i
+		}
+	}
+	return -1
+}
+
+// recoverTrash resolves config directories that were being removed. If the
+// row is gone, or the results are saved, the directory is no longer needed.
+// Otherwise the delete failed and the directory is put back.
+// -----------------------------------------------------------------------------
+func recoverTrash(qs queueStore, qdDir string) {
+	trashDir := filepath.Join(qdDir, trashDirName)
+	entries, err := os.ReadDir(trashDir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		trash := filepath.Join(trashDir, e.Name())
+		sid, err := strconv.ParseInt(e.Name(), 10, 64)
+		if err != nil {
+			os.RemoveAll(trash)
+			continue
+		}
+		item, err := qs.GetItemByID(sid)
+		switch {
+		case errors.Is(err, sql.ErrNoRows) || (err == nil && item.State == data.StateResultsSaved):
+			slog.Info("recovery: removing trash", "sid", sid, "dir", trash)
+			os.RemoveAll(trash)
+		case err != nil:
+			slog.Warn("recovery: could not read row", "sid", sid, "err", err)
+		default:
+			dirPath := filepath.Join(qdDir, e.Name())
+			if _, err := os.Stat(dirPath); err == nil {
+				os.RemoveAll(trash)
+				continue
+			}
+			if err := os.Rename(trash, dirPath); err != nil {
+				slog.Warn("recovery: could not restore config directory", "sid", sid, "dir", dirPath, "err", err)
+				continue
+			}
+			slog.Info("recovery: restored config directory", "sid", sid, "dir", dirPath)
+		}
+	}
+}
+
+// recoverSavedConfigs removes config directories for simulations whose
+// results have been saved. EndSimulation removes them, but a failure after
+// the results were recorded can leave one behind.
+// -----------------------------------------------------------------------------
+func recoverSavedConfigs(qs queueStore, qdDir string) {
+	entries, err := os.ReadDir(qdDir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		sid, err := strconv.ParseInt(e.Name(), 10, 64)
+		if err != nil || !e.IsDir() {
+			continue
+		}
+		item, err := qs.GetItemByID(sid)
+		if err != nil || item.State != data.StateResultsSaved {
+			continue
+		}
+		slog.Info("recovery: results are saved, removing config directory", "sid", sid)
+		if err := discardConfigDir(qdDir, sid); err != nil {
+			slog.Warn("recovery: could not remove config directory", "sid", sid, "err", err)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stmansour/simq/data"
+	"github.com/stmansour/simq/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeQueue is an in-memory queueStore. Setting failInsert, failUpdate or
+// failDelete makes the corresponding call return an error.
+type fakeQueue struct {
+	items      map[int64]data.QueueItem
+	nextSID    int64
+	failInsert bool
+	failUpdate bool
+	failDelete bool
+}
+
+func newFakeQueue() *fakeQueue {
+	return &fakeQueue{items: map[int64]data.QueueItem{}, nextSID: 1}
+}
+
+func (f *fakeQueue) GetItemByID(sid int64) (data.QueueItem, error) {
+	item, ok := f.items[sid]
+	if !ok {
+		return item, sql.ErrNoRows
+	}
+	return item, nil
+}
+
+func (f *fakeQueue) GetQueuedAndExecutingItems() ([]data.QueueItem, error) {
+	var items []data.QueueItem
+	for _, item := range f.items {
+		if item.State <= data.StateExecuting {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+func (f *fakeQueue) InsertItem(item data.QueueItem) (int64, error) {
+	if f.failInsert {
+		return 0, fmt.Errorf("insert failed")
+	}
+	item.SID = f.nextSID
+	f.items[item.SID] = item
+	f.nextSID++
+	return item.SID, nil
+}
+
+func (f *fakeQueue) UpdateItem(item data.QueueItem) error {
+	if f.failUpdate {
+		return fmt.Errorf("update failed")
+	}
+	f.items[item.SID] = item
+	return nil
+}
+
+func (f *fakeQueue) DeleteItem(sid int64) error {
+	if f.failDelete {
+		return fmt.Errorf("delete failed")
+	}
+	delete(f.items, sid)
+	return nil
+}
+
+func sidDir(qdDir string, sid int64) string {
+	return filepath.Join(qdDir, fmt.Sprintf("%d", sid))
+}
+
+func assertEmptyDir(t *testing.T, dir string) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return
+	}
+	require.NoError(t, err)
+	assert.Empty(t, entries, dir)
+}
+
+func TestNewSimTxn(t *testing.T) {
+	qdDir := t.TempDir()
+	qs := newFakeQueue()
+
+	sid, err := newSimTxn(qs, qdDir, []byte("{}"), &data.QueueItem{Name: "a"}, "sim.json5")
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(sidDir(qdDir, sid), "sim.json5"))
+	assert.Contains(t, qs.items, sid)
+	assertEmptyDir(t, filepath.Join(qdDir, stagingDirName))
+
+	//-------------------------------------------
+	// a failed insert leaves nothing behind
+	//-------------------------------------------
+	qs.failInsert = true
+	_, err = newSimTxn(qs, qdDir, []byte("{}"), &data.QueueItem{Name: "b"}, "sim.json5")
+	assert.Error(t, err)
+	assertEmptyDir(t, filepath.Join(qdDir, stagingDirName))
+	qs.failInsert = false
+
+	//-------------------------------------------------------------
+	// a failed rename removes the row. Block the rename with a
+	// plain file where the SID directory would go.
+	//-------------------------------------------------------------
+	require.NoError(t, os.WriteFile(sidDir(qdDir, qs.nextSID), []byte("x"), 0644))
+	blocked := qs.nextSID
+	_, err = newSimTxn(qs, qdDir, []byte("{}"), &data.QueueItem{Name: "c"}, "sim.json5")
+	assert.Error(t, err)
+	assert.NotContains(t, qs.items, blocked)
+	assertEmptyDir(t, filepath.Join(qdDir, stagingDirName))
+
+	//-------------------------------------------------------------
+	// if the row can't be removed either, recovery removes it
+	//-------------------------------------------------------------
+	blocked = qs.nextSID
+	require.NoError(t, os.WriteFile(sidDir(qdDir, blocked), []byte("x"), 0644))
+	qs.failDelete = true
+	_, err = newSimTxn(qs, qdDir, []byte("{}"), &data.QueueItem{Name: "d"}, "sim.json5")
+	assert.Error(t, err)
+	assert.Contains(t, qs.items, blocked)
+	qs.failDelete = false
+	recoverQdConfigs(qs, qdDir)
+	assert.NotContains(t, qs.items, blocked)
+	assertEmptyDir(t, filepath.Join(qdDir, stagingDirName))
+
+	_, err = newSimTxn(qs, qdDir, []byte("{}"), &data.QueueItem{}, "../x.json5")
+	assert.NoError(t, err) // reduced to its base name
+	_, err = newSimTxn(qs, qdDir, []byte("{}"), &data.QueueItem{}, ".staging")
+	assert.Error(t, err)
+	_, err = newSimTxn(qs, qdDir, []byte{}, &data.QueueItem{}, "sim.json5")
+	assert.Error(t, err)
+}
+
+func TestDeleteSimTxn(t *testing.T) {
+	qdDir := t.TempDir()
+	qs := newFakeQueue()
+	sid, err := newSimTxn(qs, qdDir, []byte("{}"), &data.QueueItem{}, "sim.json5")
+	require.NoError(t, err)
+
+	//-------------------------------------------
+	// a failed delete puts the config back
+	//-------------------------------------------
+	qs.failDelete = true
+	assert.Error(t, deleteSimTxn(qs, qdDir, sid))
+	assert.FileExists(t, filepath.Join(sidDir(qdDir, sid), "sim.json5"))
+	assert.Contains(t, qs.items, sid)
+
+	qs.failDelete = false
+	require.NoError(t, deleteSimTxn(qs, qdDir, sid))
+	assert.NoDirExists(t, sidDir(qdDir, sid))
+	assert.NotContains(t, qs.items, sid)
+	assertEmptyDir(t, filepath.Join(qdDir, trashDirName))
+}
+
+func TestEndSimTxn(t *testing.T) {
+	qdDir := t.TempDir()
+	qs := newFakeQueue()
+	store := NewFileResultStore(t.TempDir())
+	sid, err := newSimTxn(qs, qdDir, []byte("{}"), &data.QueueItem{}, "sim.json5")
+	require.NoError(t, err)
+	archive := makeTestArchive(t, map[string]string{"finrep.csv": "x\n"})
+
+	//---------------------------------------------------
+	// a failed update removes the results just saved
+	//---------------------------------------------------
+	qs.failUpdate = true
+	_, err = endSimTxn(qs, store, qdDir, sid, bytes.NewReader(archive), &sync.Mutex{})
+	assert.Error(t, err)
+	_, err = store.Location(sid)
+	assert.Error(t, err)
+	assert.DirExists(t, sidDir(qdDir, sid))
+
+	qs.failUpdate = false
+	loc, err := endSimTxn(qs, store, qdDir, sid, bytes.NewReader(archive), &sync.Mutex{})
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(loc, "finrep.csv"))
+	assert.Equal(t, data.StateResultsSaved, qs.items[sid].State)
+	assert.NoDirExists(t, sidDir(qdDir, sid))
+	assertEmptyDir(t, filepath.Join(store.BaseDir, resultStagingDir))
+
+	_, err = endSimTxn(qs, store, qdDir, 999, bytes.NewReader(archive), &sync.Mutex{})
+	assert.Error(t, err)
+
+	//---------------------------------------------------
+	// a simulation deleted during the upload does not
+	// keep its results
+	//---------------------------------------------------
+	sid, err = newSimTxn(qs, qdDir, []byte("{}"), &data.QueueItem{}, "sim.json5")
+	require.NoError(t, err)
+	_, err = endSimTxn(qs, deletingStore{store, qs}, qdDir, sid, bytes.NewReader(archive), &sync.Mutex{})
+	assert.Equal(t, util.ErrNotFound, util.CodeOf(err))
+	_, err = store.Location(sid)
+	assert.Error(t, err)
+}
+
+// deletingStore deletes the row of a simulation while its results are saved
+type deletingStore struct {
+	ResultStore
+	qs *fakeQueue
+}
+
+func (s deletingStore) Save(sid int64, archive io.Reader) (string, error) {
+	s.qs.DeleteItem(sid)
+	return s.ResultStore.Save(sid, archive)
+}
+
+func TestRecoverQdConfigs(t *testing.T) {
+	qdDir := t.TempDir()
+	qs := newFakeQueue()
+	staging := filepath.Join(qdDir, stagingDirName)
+	trash := filepath.Join(qdDir, trashDirName)
+	require.NoError(t, os.MkdirAll(staging, os.ModePerm))
+	require.NoError(t, os.MkdirAll(trash, os.ModePerm))
+	mkdir := func(dir string) {
+		require.NoError(t, os.MkdirAll(dir, os.ModePerm))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "sim.json5"), []byte("{}"), 0644))
+	}
+
+	// stray temp file from an older dispatcher
+	require.NoError(t, os.WriteFile(filepath.Join(qdDir, "config-123.json5"), []byte("{}"), 0644))
+
+	// staged with no SID: the insert never happened
+	mkdir(filepath.Join(staging, "new-1"))
+
+	// staged with a SID whose row exists: finish the move
+	qs.items[10] = data.QueueItem{SID: 10}
+	mkdir(filepath.Join(staging, "new-2"))
+	require.NoError(t, writeIntent(filepath.Join(staging, "new-2"+intentSuffix), newSimIntent{SID: 10}))
+
+	// staged with a SID whose row is gone: roll back
+	mkdir(filepath.Join(staging, "new-3"))
+	require.NoError(t, writeIntent(filepath.Join(staging, "new-3"+intentSuffix), newSimIntent{SID: 11}))
+
+	// crashed during the insert, which happened: the queued row with no
+	// config directory gets it
+	qs.items[12] = data.QueueItem{SID: 12, File: "sim.json5", State: data.StateQueued}
+	mkdir(filepath.Join(staging, "new-4"))
+	require.NoError(t, writeIntent(filepath.Join(staging, "new-4"+intentSuffix), newSimIntent{}))
+
+	// crashed during the insert, which did not happen: roll back
+	mkdir(filepath.Join(staging, "new-5"))
+	require.NoError(t, writeIntent(filepath.Join(staging, "new-5"+intentSuffix), newSimIntent{}))
+
+	// trashed, row still there and not finished: the delete failed, restore it
+	qs.items[20] = data.QueueItem{SID: 20, State: data.StateQueued}
+	mkdir(filepath.Join(trash, "20"))
+
+	// trashed, row gone: finish the delete
+	mkdir(filepath.Join(trash, "21"))
+
+	// results saved but config dir still present: remove it
+	qs.items[30] = data.QueueItem{SID: 30, State: data.StateResultsSaved}
+	mkdir(sidDir(qdDir, 30))
+
+	recoverQdConfigs(qs, qdDir)
+
+	assert.NoFileExists(t, filepath.Join(qdDir, "config-123.json5"))
+	assertEmptyDir(t, staging)
+	assert.FileExists(t, filepath.Join(sidDir(qdDir, 10), "sim.json5"))
+	assert.NoDirExists(t, sidDir(qdDir, 11))
+	assert.FileExists(t, filepath.Join(sidDir(qdDir, 12), "sim.json5"))
+	assert.FileExists(t, filepath.Join(sidDir(qdDir, 20), "sim.json5"))
+	assert.NoDirExists(t, sidDir(qdDir, 30))
+	assertEmptyDir(t, trash)
+}
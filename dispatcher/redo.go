@@ -4,14 +4,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/stmansour/simq/data"
+	"github.com/stmansour/simq/proto"
 	"github.com/stmansour/simq/util"
 )
 
@@ -38,38 +39,32 @@ func handleRedo(w http.ResponseWriter, r *http.Request, d *HInfo) {
 	//     Username: "whoever"
 	//     Data:  {"SID": 1234, "MachineID": "A7B8C9"}
 	//---------------------------------------------------
-	var rebookRequest SimulationRebookRequest
-	log.Printf("handling REDO command\n")
+	var rebookRequest proto.SimulationRebookRequest
 	if err := json.Unmarshal(d.cmd.Data, &rebookRequest); err != nil {
-		util.SvcErrorReturn(w, fmt.Errorf("handleRedo: invalid rebook request data"))
+		util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "handleRedo: invalid rebook request data"))
 		return
 	}
-	log.Printf("handleRedo: SID %d, MachineID %s\n", rebookRequest.SID, rebookRequest.MachineID)
+	d.log.Info("redo", "sid", rebookRequest.SID, "machine", rebookRequest.MachineID)
 	queueItem, err = app.qm.GetItemByID(rebookRequest.SID)
 	if err != nil {
-		util.SvcErrorReturn(w, fmt.Errorf("handleRedo: could not getItemByID SID %d:  %s", rebookRequest.SID, err.Error()))
+		util.SvcErrorReturn(w, util.Errorf(lookupCode(err), "handleRedo: could not getItemByID SID %d:  %s", rebookRequest.SID, err.Error()))
+		return
+	}
+	if err := checkOwner(d, &queueItem); err != nil {
+		util.SvcErrorReturn(w, fmt.Errorf("handleRedo: %w", err))
 		return
 	}
 	if queueItem.MachineID != rebookRequest.MachineID {
-		log.Printf("*** WARNING *** Granted MachineID %s rebooking for SID %d originally assigned to MachineID %s", rebookRequest.MachineID, rebookRequest.SID, queueItem.MachineID)
+		d.log.Warn("redoing a simulation assigned to another machine", "sid", rebookRequest.SID, "machine", rebookRequest.MachineID, "assigned", queueItem.MachineID)
 	}
 
 	//-----------------------------------------------------------------------------
-	// THE CONFIG FOR THIS JOB IS IN /GENOME/SIMRES.  We need to find it first.
+	// THE CONFIG FOR THIS JOB IS IN THE RESULT STORE.  We need to find it first.
 	//-----------------------------------------------------------------------------
-	log.Printf("handleRedo: processing %s command\n", d.cmd.Command)
-	simresDir, err := findSimulationDirectory(queueItem.SID)
-	if err != nil {
-		util.SvcErrorReturn(w, fmt.Errorf("handleRedo: error finding simulation results directory for SID %d: %s", queueItem.SID, err.Error()))
-	}
 	qdconfigDir := filepath.Join(app.QdConfigsDir, fmt.Sprintf("%d", queueItem.SID))
-
-	//-----------------------------------------------------------------------------
-	// Determine the config filename
-	//-----------------------------------------------------------------------------
-	configFilename, err := findConfigFile(simresDir)
+	configFilename, err := findStoredConfigFile(queueItem.SID)
 	if err != nil {
-		util.SvcErrorReturn(w, fmt.Errorf("handleRedo: error finding config file: %s", err.Error()))
+		d.log.Warn("config file is not in the result store", "sid", queueItem.SID, "err", err)
 		archiveMissing = true // it might still be in qdconfigs
 	}
 
@@ -77,15 +72,22 @@ func handleRedo(w http.ResponseWriter, r *http.Request, d *HInfo) {
 		// It might be in qdconfigDir. Check to see if it is...
 		configFilename, err = findConfigFile(qdconfigDir)
 		if err != nil {
-			util.SvcErrorReturn(w, fmt.Errorf("handleRedo: error finding config file: %s. Could not find the config file for SID %d, no way to redo", err.Error(), queueItem.SID))
+			util.SvcErrorReturn(w, util.Errorf(util.ErrNotFound, "handleRedo: error finding config file: %s. Could not find the config file for SID %d, no way to redo", err.Error(), queueItem.SID))
 			return
 		}
-		log.Printf("handleRedo: found config file %s in %s. Continuing with redo.\n", configFilename, qdconfigDir)
+		d.log.Info("config file found in qdconfigs", "sid", queueItem.SID, "file", configFilename, "dir", qdconfigDir)
 	} else {
 		//-----------------------------------------------------------------------------
 		// Copy the config file to qdconfigs
 		//-----------------------------------------------------------------------------
-		if err := copyFile(configFilename, filepath.Join(qdconfigDir, filepath.Base(configFilename))); err != nil {
+		src, err := app.store.Open(queueItem.SID, configFilename)
+		if err != nil {
+			util.SvcErrorReturn(w, fmt.Errorf("handleRedo: error opening config file: %s", err.Error()))
+			return
+		}
+		err = copyFile(src, filepath.Join(qdconfigDir, path.Base(configFilename)))
+		src.Close()
+		if err != nil {
 			util.SvcErrorReturn(w, fmt.Errorf("handleRedo: error copying config file: %s", err.Error()))
 			return
 		}
@@ -106,10 +108,10 @@ func handleRedo(w http.ResponseWriter, r *http.Request, d *HInfo) {
 	}
 
 	//-----------------------------------------------------------------------------
-	// Now remove the simulation results directory
+	// Now remove the simulation results
 	//-----------------------------------------------------------------------------
 	if !archiveMissing {
-		if err := os.RemoveAll(simresDir); err != nil {
+		if err := app.store.Remove(queueItem.SID); err != nil {
 			util.SvcErrorReturn(w, fmt.Errorf("handleRedo: failed to remove simulation results directory: %s", err.Error()))
 			return
 		}
@@ -119,66 +121,41 @@ func handleRedo(w http.ResponseWriter, r *http.Request, d *HInfo) {
 	// Send the simple response
 	//-----------------------------------------------------------------------------
 	w.WriteHeader(http.StatusOK)
-	msg := SvcStatus201{
+	msg := proto.SvcStatus201{
 		Status:  "success",
 		Message: "Re-queued",
 		ID:      queueItem.SID,
 	}
 	util.SvcWriteResponse(w, &msg)
-
-	log.Printf("*** handleRedo:  SUCCESSFUL ***\n")
+	d.log.Info("simulation re-queued", "sid", queueItem.SID)
+	publishItem(proto.EventRequeued, &queueItem, "")
 }
 
-// findSimulationDirectory finds the SID in the simulation results repo
+// findStoredConfigFile returns the name of the config file in the result
+// store for sid. The config file is the .json5 file at the top level.
 // -----------------------------------------------------------------------------
-func findSimulationDirectory(sid int64) (string, error) {
-	baseDir := app.SimResultsDir
-	sidStr := fmt.Sprintf("%d", sid)
-	var resultPath string
-
-	baseDirComponents := len(strings.Split(baseDir, string(os.PathSeparator))) // Count the number of components in baseDir
-	expectedDepth := baseDirComponents + 4                                     // Add 4 for YYYY/MM/DD/SID
-	err := filepath.Walk(baseDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if info.IsDir() {
-			components := strings.Split(path, string(os.PathSeparator)) // Split the path into components
-
-			//-----------------------------------------------------------------------------
-			// Check if we're at the correct depth and the last component matches the SID
-			//-----------------------------------------------------------------------------
-			if len(components) == expectedDepth && components[len(components)-1] == sidStr {
-				resultPath = path
-				return filepath.SkipAll // terminate the filepath.Walk
-			}
-		}
-		return nil
-	})
-
+func findStoredConfigFile(sid int64) (string, error) {
+	files, err := app.store.List(sid)
 	if err != nil {
-		return "", fmt.Errorf("error walking the path %s: %v", baseDir, err)
+		return "", err
 	}
-	if resultPath == "" {
-		return "", fmt.Errorf("simulation directory for SID %d not found", sid)
+	for _, f := range files {
+		if !strings.Contains(f.Name, "/") && path.Ext(f.Name) == ".json5" {
+			return f.Name, nil
+		}
 	}
-	return resultPath, nil
+	return "", fmt.Errorf("no config file found for SID %d", sid)
 }
 
-func copyFile(src, dst string) error {
+// copyFile copies the contents of src to the file dst
+// -----------------------------------------------------------------------------
+func copyFile(src io.Reader, dst string) error {
 	// Ensure the destination directory exists
 	dstDir := filepath.Dir(dst)
 	if err := os.MkdirAll(dstDir, 0755); err != nil {
 		return fmt.Errorf("failed to create destination directory: %w", err)
 	}
 
-	// Open the source file
-	sourceFile, err := os.Open(src)
-	if err != nil {
-		return fmt.Errorf("failed to open source file: %w", err)
-	}
-	defer sourceFile.Close()
-
 	// Create the destination file
 	destFile, err := os.Create(dst)
 	if err != nil {
@@ -187,7 +164,7 @@ func copyFile(src, dst string) error {
 	defer destFile.Close()
 
 	// Copy the contents
-	_, err = io.Copy(destFile, sourceFile)
+	_, err = io.Copy(destFile, src)
 	if err != nil {
 		return fmt.Errorf("failed to copy file contents: %w", err)
 	}
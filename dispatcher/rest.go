@@ -0,0 +1,719 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stmansour/simq/data"
+	"github.com/stmansour/simq/proto"
+	"github.com/stmansour/simq/util"
+)
+
+//----------------------------------------------------------------------------
+// REST API
+//
+// The routes below are a resource-oriented front end to the /command
+// endpoint. Each one turns the HTTP request into a Command and runs it
+// through commandDispatcher, so REST calls get exactly the same handlers,
+// authorization, logging and metrics as /command. Replies are the same
+// JSON envelopes and carry the same HTTP status codes.
+//
+// restRoutes drives both the mux registration and the OpenAPI document
+// served at /openapi.json, so the two cannot drift apart.
+//----------------------------------------------------------------------------
+
+// UserHeader names the caller when API tokens are not in use. With tokens,
+// the token's name is used instead.
+const UserHeader = proto.UserHeader
+
+// restParam describes a path or query parameter
+type restParam struct {
+	Name        string
+	In          string // path or query
+	Type        string // integer, string or boolean
+	Description string
+}
+
+// restRoute is one REST endpoint
+type restRoute struct {
+	Method   string
+	Path     string // ServeMux pattern path, e.g. /sims/{sid}
+	Summary  string
+	Commands []string // the commands it may run, for the document
+	Params   []restParam
+	Body     interface{} // JSON request body, nil if none
+	Form     bool        // multipart request body with a "file" part
+	Status   int         // status of a successful reply
+	Reply    interface{} // JSON reply on success
+	Download bool        // the reply can also be a file
+	Stream   bool        // the reply is a stream of Reply as Server-Sent Events
+	Handler  http.HandlerFunc
+}
+
+// queueReply is the reply to the commands that return queue items
+type queueReply struct {
+	Status string
+	Data   []data.QueueItem
+}
+
+// sidReply is the reply to GetSID
+type sidReply struct {
+	Status string
+	Data   data.QueueItem
+}
+
+// resultsReply is the reply to ListResults
+type resultsReply struct {
+	Status string
+	Data   []proto.ResultFileInfo
+}
+
+// webhooksReply is the reply to ListWebhooks
+type webhooksReply struct {
+	Status string
+	Data   []data.Webhook
+}
+
+// emailPrefsReply is the reply to GetEmailPrefs
+type emailPrefsReply struct {
+	Status string
+	Data   data.EmailPref
+}
+
+// progressReply is the reply to GetProgress
+type progressReply struct {
+	Status string
+	Data   proto.ProgressReport
+}
+
+// alertsReply is the reply to GetAlerts
+type alertsReply struct {
+	Status string
+	Data   []proto.Alert
+}
+
+// PatchSimRequest is the body of PATCH /sims/{sid}. Fields that are left out
+// are not changed.
+type PatchSimRequest struct {
+	Priority    *int    `json:",omitempty"`
+	Description *string `json:",omitempty"`
+	MachineID   *string `json:",omitempty"`
+	URL         *string `json:",omitempty"`
+	DtEstimate  *string `json:",omitempty"`
+	DtCompleted *string `json:",omitempty"`
+}
+
+var sidParam = restParam{Name: "sid", In: "path", Type: "integer", Description: "simulation ID"}
+var widParam = restParam{Name: "wid", In: "path", Type: "integer", Description: "webhook ID"}
+var aidParam = restParam{Name: "aid", In: "path", Type: "integer", Description: "alert ID"}
+
+var restRoutes = []restRoute{
+	{
+		Method:   "GET",
+		Path:     "/queue",
+		Summary:  "List the active queue, the completed simulations, or the simulations booked by a machine",
+		Commands: []string{"GetActiveQueue", "GetCompletedQueue", "GetMachineQueue"},
+		Params: []restParam{
+			{Name: "state", In: "query", Type: "string", Description: "active (default) or completed"},
+			{Name: "machine", In: "query", Type: "string", Description: "list the unfinished simulations of this machine"},
+		},
+		Reply:   queueReply{},
+		Handler: restGetQueue,
+	},
+	{
+		Method:   "POST",
+		Path:     "/sims",
+		Summary:  "Add a simulation to the queue. The form has fields Name, Priority, Description, URL, Campaign and Executor, and the config file as \"file\".",
+		Commands: []string{"NewSimulation"},
+		Form:     true,
+		Status:   http.StatusCreated,
+		Reply:    proto.SvcStatus201{},
+		Handler:  restPostSim,
+	},
+	{
+		Method:   "GET",
+		Path:     "/sims/{sid}",
+		Summary:  "Get a simulation's queue entry",
+		Commands: []string{"GetSID"},
+		Params:   []restParam{sidParam},
+		Reply:    sidReply{},
+		Handler:  restGetSim,
+	},
+	{
+		Method:   "PATCH",
+		Path:     "/sims/{sid}",
+		Summary:  "Change a simulation. A body with only Priority runs Priority, anything else runs UpdateItem.",
+		Commands: []string{"Priority", "UpdateItem"},
+		Params:   []restParam{sidParam},
+		Body:     PatchSimRequest{},
+		Reply:    proto.SvcStatus201{},
+		Handler:  restPatchSim,
+	},
+	{
+		Method:   "DELETE",
+		Path:     "/sims/{sid}",
+		Summary:  "Remove a simulation from the queue",
+		Commands: []string{"DeleteItem"},
+		Params:   []restParam{sidParam},
+		Reply:    proto.SvcStatus201{},
+		Handler:  restDeleteSim,
+	},
+	{
+		Method:   "GET",
+		Path:     "/sims/{sid}/results",
+		Summary:  "List a simulation's result files, or download one of them or all of them as a tar.gz",
+		Commands: []string{"ListResults", "GetResults"},
+		Params: []restParam{
+			sidParam,
+			{Name: "file", In: "query", Type: "string", Description: "download this result file"},
+			{Name: "archive", In: "query", Type: "boolean", Description: "download all result files as a tar.gz"},
+		},
+		Reply:    resultsReply{},
+		Download: true,
+		Handler:  restGetResults,
+	},
+	{
+		Method:   "GET",
+		Path:     "/sims/{sid}/progress",
+		Summary:  "Get a simulation's progress samples, percent complete, generation rate and estimate drift",
+		Commands: []string{"GetProgress"},
+		Params:   []restParam{sidParam},
+		Reply:    progressReply{},
+		Handler:  restGetProgress,
+	},
+	{
+		Method:  "GET",
+		Path:    "/events",
+		Summary: "Stream queue events as Server-Sent Events. A Last-Event-ID header replays the recent events after that ID.",
+		Params: []restParam{
+			{Name: "sid", In: "query", Type: "integer", Description: "only events for this simulation"},
+			{Name: "user", In: "query", Type: "string", Description: "only events for this user's simulations"},
+			{Name: "campaign", In: "query", Type: "string", Description: "only events for simulations in this campaign"},
+		},
+		Reply:   proto.Event{},
+		Stream:  true,
+		Handler: handleEvents,
+	},
+	{
+		Method:   "GET",
+		Path:     "/webhooks",
+		Summary:  "List your webhooks, or every webhook for an admin",
+		Commands: []string{"ListWebhooks"},
+		Reply:    webhooksReply{},
+		Handler:  restGetWebhooks,
+	},
+	{
+		Method:   "POST",
+		Path:     "/webhooks",
+		Summary:  "Add a webhook for your simulations, one simulation, or every simulation (admins only)",
+		Commands: []string{"AddWebhook"},
+		Body:     proto.AddWebhookRequest{},
+		Status:   http.StatusCreated,
+		Reply:    proto.SvcStatus201{},
+		Handler:  restPostWebhook,
+	},
+	{
+		Method:   "DELETE",
+		Path:     "/webhooks/{wid}",
+		Summary:  "Remove a webhook",
+		Commands: []string{"DeleteWebhook"},
+		Params:   []restParam{widParam},
+		Reply:    proto.SvcStatus201{},
+		Handler:  restDeleteWebhook,
+	},
+	{
+		Method:   "GET",
+		Path:     "/email",
+		Summary:  "Get your email preferences. Email is off if Email is empty.",
+		Commands: []string{"GetEmailPrefs"},
+		Reply:    emailPrefsReply{},
+		Handler:  restGetEmail,
+	},
+	{
+		Method:   "PUT",
+		Path:     "/email",
+		Summary:  "Set your email preferences. An empty Email turns email off.",
+		Commands: []string{"SetEmailPrefs"},
+		Body:     proto.EmailPrefsRequest{},
+		Reply:    util.SvcStatus200{},
+		Handler:  restPutEmail,
+	},
+	{
+		Method:   "GET",
+		Path:     "/alerts",
+		Summary:  "List the open alerts",
+		Commands: []string{"GetAlerts"},
+		Params: []restParam{
+			{Name: "all", In: "query", Type: "boolean", Description: "include acknowledged alerts"},
+		},
+		Reply:   alertsReply{},
+		Handler: restGetAlerts,
+	},
+	{
+		Method:   "POST",
+		Path:     "/alerts/{aid}/ack",
+		Summary:  "Acknowledge an alert",
+		Commands: []string{"AckAlert"},
+		Params:   []restParam{aidParam},
+		Reply:    proto.SvcStatus201{},
+		Handler:  restAckAlert,
+	},
+}
+
+// registerREST adds the REST routes and /openapi.json to mux
+// -----------------------------------------------------------------------------
+func registerREST(mux *http.ServeMux) {
+	for _, rt := range restRoutes {
+		mux.HandleFunc(rt.Method+" "+rt.Path, rt.Handler)
+	}
+	mux.HandleFunc("GET /openapi.json", handleOpenAPI)
+}
+
+// restCommand runs command with data through commandDispatcher
+// -----------------------------------------------------------------------------
+func restCommand(w http.ResponseWriter, r *http.Request, command string, data interface{}) {
+	body, err := restCommandBody(r, command, data)
+	if err != nil {
+		util.SvcErrorReturn(w, err)
+		return
+	}
+	r2 := r.Clone(r.Context())
+	r2.Method = "POST"
+	r2.Body = io.NopCloser(bytes.NewReader(body))
+	r2.ContentLength = int64(len(body))
+	r2.Header.Set("Content-Type", "application/json")
+	commandDispatcher(w, r2)
+}
+
+// restCommandBody returns the JSON encoded Command for command with data
+// -----------------------------------------------------------------------------
+func restCommandBody(r *http.Request, command string, data interface{}) ([]byte, error) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: failed to marshal request data: %v", command, err)
+	}
+	cmd := proto.Command{
+		Command:  command,
+		Username: r.Header.Get(UserHeader),
+		Data:     json.RawMessage(b),
+		Protocol: proto.ProtocolVersion,
+	}
+	return json.Marshal(&cmd)
+}
+
+// pathSID returns the {sid} in the request path
+// -----------------------------------------------------------------------------
+func pathSID(r *http.Request) (int64, error) {
+	sid, err := strconv.ParseInt(r.PathValue("sid"), 10, 64)
+	if err != nil || sid <= 0 {
+		return 0, util.Errorf(util.ErrBadRequest, "invalid simulation ID: %q", r.PathValue("sid"))
+	}
+	return sid, nil
+}
+
+// restGetQueue serves GET /queue
+// -----------------------------------------------------------------------------
+func restGetQueue(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if m := q.Get("machine"); len(m) > 0 {
+		restCommand(w, r, "GetMachineQueue", &proto.MachineQueueRequest{MachineID: m})
+		return
+	}
+	switch q.Get("state") {
+	case "", "active":
+		restCommand(w, r, "GetActiveQueue", nil)
+	case "completed":
+		restCommand(w, r, "GetCompletedQueue", nil)
+	default:
+		util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "invalid state: %q", q.Get("state")))
+	}
+}
+
+// restGetSim serves GET /sims/{sid}
+// -----------------------------------------------------------------------------
+func restGetSim(w http.ResponseWriter, r *http.Request) {
+	sid, err := pathSID(r)
+	if err != nil {
+		util.SvcErrorReturn(w, err)
+		return
+	}
+	restCommand(w, r, "GetSID", &proto.GetSIDRequest{SID: sid})
+}
+
+// restGetProgress serves GET /sims/{sid}/progress
+// -----------------------------------------------------------------------------
+func restGetProgress(w http.ResponseWriter, r *http.Request) {
+	sid, err := pathSID(r)
+	if err != nil {
+		util.SvcErrorReturn(w, err)
+		return
+	}
+	restCommand(w, r, "GetProgress", &proto.ProgressRequest{SID: sid})
+}
+
+// restPatchSim serves PATCH /sims/{sid}
+// -----------------------------------------------------------------------------
+func restPatchSim(w http.ResponseWriter, r *http.Request) {
+	sid, err := pathSID(r)
+	if err != nil {
+		util.SvcErrorReturn(w, err)
+		return
+	}
+	var req PatchSimRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "invalid request body: %v", err))
+		return
+	}
+
+	//-----------------------------------------------------------
+	// Users may only change the priority, which is its own
+	// command. Everything else is an UpdateItem.
+	//-----------------------------------------------------------
+	onlyPriority := req.Priority != nil && req.Description == nil && req.MachineID == nil &&
+		req.URL == nil && req.DtEstimate == nil && req.DtCompleted == nil
+	if onlyPriority {
+		restCommand(w, r, "Priority", &proto.PriorityRequest{SID: sid, Priority: *req.Priority})
+		return
+	}
+
+	//-----------------------------------------------------------
+	// handleUpdateItem only changes the fields that are present
+	//-----------------------------------------------------------
+	upd := map[string]interface{}{}
+	b, _ := json.Marshal(&req)
+	if err := json.Unmarshal(b, &upd); err != nil {
+		util.SvcErrorReturn(w, err)
+		return
+	}
+	upd["SID"] = sid
+	restCommand(w, r, "UpdateItem", upd)
+}
+
+// restDeleteSim serves DELETE /sims/{sid}
+// -----------------------------------------------------------------------------
+func restDeleteSim(w http.ResponseWriter, r *http.Request) {
+	sid, err := pathSID(r)
+	if err != nil {
+		util.SvcErrorReturn(w, err)
+		return
+	}
+	restCommand(w, r, "DeleteItem", &proto.DeleteItemRequest{SID: sid})
+}
+
+// restGetResults serves GET /sims/{sid}/results
+// -----------------------------------------------------------------------------
+func restGetResults(w http.ResponseWriter, r *http.Request) {
+	sid, err := pathSID(r)
+	if err != nil {
+		util.SvcErrorReturn(w, err)
+		return
+	}
+	q := r.URL.Query()
+	archive, _ := strconv.ParseBool(q.Get("archive"))
+	switch {
+	case len(q.Get("file")) > 0:
+		restCommand(w, r, "GetResults", &proto.ResultsRequest{SID: sid, Filename: q.Get("file")})
+	case archive:
+		restCommand(w, r, "GetResults", &proto.ResultsRequest{SID: sid})
+	default:
+		restCommand(w, r, "ListResults", &proto.ResultsRequest{SID: sid})
+	}
+}
+
+// restGetWebhooks serves GET /webhooks
+// -----------------------------------------------------------------------------
+func restGetWebhooks(w http.ResponseWriter, r *http.Request) {
+	restCommand(w, r, "ListWebhooks", nil)
+}
+
+// restPostWebhook serves POST /webhooks
+// -----------------------------------------------------------------------------
+func restPostWebhook(w http.ResponseWriter, r *http.Request) {
+	var req proto.AddWebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "invalid request body: %v", err))
+		return
+	}
+	restCommand(w, r, "AddWebhook", &req)
+}
+
+// restDeleteWebhook serves DELETE /webhooks/{wid}
+// -----------------------------------------------------------------------------
+func restDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	wid, err := strconv.ParseInt(r.PathValue("wid"), 10, 64)
+	if err != nil || wid <= 0 {
+		util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "invalid webhook ID: %q", r.PathValue("wid")))
+		return
+	}
+	restCommand(w, r, "DeleteWebhook", &proto.WebhookRequest{WID: wid})
+}
+
+// restGetEmail serves GET /email
+// -----------------------------------------------------------------------------
+func restGetEmail(w http.ResponseWriter, r *http.Request) {
+	restCommand(w, r, "GetEmailPrefs", nil)
+}
+
+// restPutEmail serves PUT /email
+// -----------------------------------------------------------------------------
+func restPutEmail(w http.ResponseWriter, r *http.Request) {
+	var req proto.EmailPrefsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "invalid request body: %v", err))
+		return
+	}
+	restCommand(w, r, "SetEmailPrefs", &req)
+}
+
+// restGetAlerts serves GET /alerts
+// -----------------------------------------------------------------------------
+func restGetAlerts(w http.ResponseWriter, r *http.Request) {
+	all, _ := strconv.ParseBool(r.URL.Query().Get("all"))
+	restCommand(w, r, "GetAlerts", &proto.AlertsRequest{All: all})
+}
+
+// restAckAlert serves POST /alerts/{aid}/ack
+// -----------------------------------------------------------------------------
+func restAckAlert(w http.ResponseWriter, r *http.Request) {
+	aid, err := strconv.ParseInt(r.PathValue("aid"), 10, 64)
+	if err != nil || aid <= 0 {
+		util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "invalid alert ID: %q", r.PathValue("aid")))
+		return
+	}
+	restCommand(w, r, "AckAlert", &proto.AckAlertRequest{AID: aid})
+}
+
+// restPostSim serves POST /sims. The form fields become the data of a
+// NewSimulation command, which is added to the parsed form as "data" the way
+// the /command endpoint expects it.
+// -----------------------------------------------------------------------------
+func restPostSim(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(10 << 20); err != nil {
+		util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "failed to parse multipart form: %v", err))
+		return
+	}
+	_, hdr, err := r.FormFile("file")
+	if err != nil {
+		util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "missing config file in the \"file\" part"))
+		return
+	}
+	req := proto.CreateQueueEntryRequest{
+		Name:             r.FormValue("Name"),
+		Description:      r.FormValue("Description"),
+		URL:              r.FormValue("URL"),
+		Campaign:         r.FormValue("Campaign"),
+		Executor:         r.FormValue("Executor"),
+		OriginalFilename: hdr.Filename,
+	}
+	if p := r.FormValue("Priority"); len(p) > 0 {
+		if req.Priority, err = strconv.Atoi(p); err != nil {
+			util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "invalid priority: %q", p))
+			return
+		}
+	}
+	body, err := restCommandBody(r, "NewSimulation", &req)
+	if err != nil {
+		util.SvcErrorReturn(w, err)
+		return
+	}
+	r2 := r.Clone(r.Context())
+	r2.Form.Set("data", string(body))
+	r2.MultipartForm.Value["data"] = []string{string(body)}
+	commandDispatcher(w, r2)
+}
+
+//----------------------------------------------------------------------------
+// OPENAPI DOCUMENT
+//----------------------------------------------------------------------------
+
+// handleOpenAPI serves /openapi.json
+// -----------------------------------------------------------------------------
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	util.SvcWriteResponse(w, openAPIDocument())
+}
+
+// openAPIDocument builds an OpenAPI 3.0 document from restRoutes
+// -----------------------------------------------------------------------------
+func openAPIDocument() map[string]interface{} {
+	schemas := map[string]interface{}{
+		"SvcError": schemaOf(reflect.TypeOf(util.SvcError{}), nil),
+	}
+	errorReply := map[string]interface{}{
+		"description": "error",
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{
+				"schema": map[string]interface{}{"$ref": "#/components/schemas/SvcError"},
+			},
+		},
+	}
+
+	paths := map[string]interface{}{}
+	for _, rt := range restRoutes {
+		op := map[string]interface{}{
+			"summary":     rt.Summary,
+			"operationId": strings.ToLower(rt.Method) + strings.ReplaceAll(strings.ReplaceAll(rt.Path, "{", ""), "}", ""),
+		}
+		if len(rt.Commands) > 0 {
+			op["description"] = "Runs the " + strings.Join(rt.Commands, ", ") + " command(s)."
+		}
+		var params []interface{}
+		for _, p := range rt.Params {
+			params = append(params, map[string]interface{}{
+				"name":        p.Name,
+				"in":          p.In,
+				"required":    p.In == "path",
+				"description": p.Description,
+				"schema":      map[string]interface{}{"type": p.Type},
+			})
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+		if rt.Body != nil {
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": schemaOf(reflect.TypeOf(rt.Body), schemas)},
+				},
+			}
+		}
+		if rt.Form {
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"multipart/form-data": map[string]interface{}{
+						"schema": map[string]interface{}{
+							"type":     "object",
+							"required": []string{"file"},
+							"properties": map[string]interface{}{
+								"Name":        map[string]interface{}{"type": "string"},
+								"Priority":    map[string]interface{}{"type": "integer"},
+								"Description": map[string]interface{}{"type": "string"},
+								"URL":         map[string]interface{}{"type": "string"},
+								"Campaign":    map[string]interface{}{"type": "string"},
+								"Executor":    map[string]interface{}{"type": "string"},
+								"file":        map[string]interface{}{"type": "string", "format": "binary"},
+							},
+						},
+					},
+				},
+			}
+		}
+		status := rt.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		ok := map[string]interface{}{
+			"description": "success",
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": schemaOf(reflect.TypeOf(rt.Reply), schemas)},
+			},
+		}
+		if rt.Stream {
+			ok["content"] = map[string]interface{}{
+				"text/event-stream": map[string]interface{}{"schema": schemaOf(reflect.TypeOf(rt.Reply), schemas)},
+			}
+		}
+		if rt.Download {
+			file := map[string]interface{}{"schema": map[string]interface{}{"type": "string", "format": "binary"}}
+			ok["content"].(map[string]interface{})["application/octet-stream"] = file
+			ok["content"].(map[string]interface{})["application/gzip"] = file
+		}
+		op["responses"] = map[string]interface{}{
+			strconv.Itoa(status): ok,
+			"default":            errorReply,
+		}
+		if _, found := paths[rt.Path]; !found {
+			paths[rt.Path] = map[string]interface{}{}
+		}
+		paths[rt.Path].(map[string]interface{})[strings.ToLower(rt.Method)] = op
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "simq dispatcher",
+			"version": util.Version(),
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+		"security": []interface{}{map[string]interface{}{"bearer": []string{}}},
+	}
+}
+
+// schemaOf returns the OpenAPI schema for t. Named structs are added to
+// schemas and referenced; if schemas is nil they are inlined.
+// -----------------------------------------------------------------------------
+func schemaOf(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case reflect.TypeOf(sql.NullTime{}):
+		return map[string]interface{}{
+			"type":       "object",
+			"properties": map[string]interface{}{"Time": map[string]interface{}{"type": "string", "format": "date-time"}, "Valid": map[string]interface{}{"type": "boolean"}},
+		}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case reflect.Struct:
+	default:
+		return map[string]interface{}{}
+	}
+
+	if schemas != nil && len(t.Name()) > 0 && t.Name()[0] >= 'A' && t.Name()[0] <= 'Z' {
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+		if _, found := schemas[t.Name()]; !found {
+			schemas[t.Name()] = map[string]interface{}{} // placeholder, stops recursion
+			schemas[t.Name()] = structSchema(t, schemas)
+		}
+		return ref
+	}
+	return structSchema(t, schemas)
+}
+
+// structSchema returns the OpenAPI object schema for the struct type t
+// -----------------------------------------------------------------------------
+func structSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	props := map[string]interface{}{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name := f.Name
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if len(tag) > 0 {
+			name = tag
+		}
+		props[name] = schemaOf(f.Type, schemas)
+	}
+	return map[string]interface{}{"type": "object", "properties": props}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stmansour/simq/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sendREST(t *testing.T, method, url, body string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	registerREST(mux)
+	r, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.NoError(t, err)
+	r.Header.Set(UserHeader, "test-user")
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, r)
+	return rr
+}
+
+func TestRESTResults(t *testing.T) {
+	makeTestResults(t, "42")
+
+	rr := sendREST(t, "GET", "/sims/42/results", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var resp resultsReply
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	require.Len(t, resp.Data, 2)
+	assert.Equal(t, "finrep.csv", resp.Data[1].Name)
+
+	rr = sendREST(t, "GET", "/sims/42/results?file=finrep.csv", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "a,b,c\n1,2,3\n", rr.Body.String())
+
+	rr = sendREST(t, "GET", "/sims/42/results?archive=true", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/gzip", rr.Header().Get("Content-Type"))
+
+	rr = sendREST(t, "GET", "/sims/43/results", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestRESTBadRequests(t *testing.T) {
+	for _, tc := range []struct{ method, url, body string }{
+		{"GET", "/sims/abc", ""},
+		{"DELETE", "/sims/0", ""},
+		{"PATCH", "/sims/1", "not json"},
+		{"GET", "/queue?state=sideways", ""},
+	} {
+		rr := sendREST(t, tc.method, tc.url, tc.body)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, tc.method+" "+tc.url)
+		assert.Equal(t, util.ErrBadRequest, util.CodeOf(util.DecodeError(rr.Body.Bytes())))
+	}
+	rr := sendREST(t, "PUT", "/sims/1", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+}
+
+func TestOpenAPI(t *testing.T) {
+	rr := sendREST(t, "GET", "/openapi.json", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var doc struct {
+		OpenAPI    string `json:"openapi"`
+		Paths      map[string]map[string]interface{}
+		Components struct {
+			Schemas map[string]interface{}
+		}
+	}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &doc))
+	assert.Equal(t, "3.0.3", doc.OpenAPI)
+	for _, rt := range restRoutes {
+		assert.Contains(t, doc.Paths[rt.Path], strings.ToLower(rt.Method), rt.Path)
+	}
+	assert.Contains(t, doc.Components.Schemas, "QueueItem")
+	assert.Contains(t, doc.Components.Schemas, "SvcError")
+	assert.Contains(t, doc.Components.Schemas, "Event")
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+
+	"github.com/stmansour/simq/proto"
+	"github.com/stmansour/simq/util"
+)
+
+// handleListResults returns the list of files stored for a SID in the
+// simulation results repository.
+//
+//	Cmd
+//	    Command - ListResults
+//	    Username - the person or process making this call
+//	    Data
+//	        SID - the ID of the simulation
+//
+// -----------------------------------------------------------------------------
+func handleListResults(w http.ResponseWriter, r *http.Request, d *HInfo) {
+	var req proto.ResultsRequest
+	if err := json.Unmarshal(d.cmd.Data, &req); err != nil {
+		util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "handleListResults: invalid request data"))
+		return
+	}
+
+	files, err := app.store.List(req.SID)
+	if err != nil {
+		util.SvcErrorReturn(w, fmt.Errorf("handleListResults: SID %d: %w", req.SID, err))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	resp := struct {
+		Status string
+		Data   []proto.ResultFileInfo
+	}{
+		Status: "success",
+		Data:   files,
+	}
+	util.SvcWriteResponse(w, &resp)
+}
+
+// handleGetResults streams the results for a SID back to the caller. If a
+// Filename is supplied, only that file is sent. Otherwise, all the files for
+// the SID are sent as a tar.gz archive.
+//
+//	Cmd
+//	    Command - GetResults
+//	    Username - the person or process making this call
+//	    Data
+//	        SID - the ID of the simulation
+//	        Filename - (optional) the name of a single file to return
+//
+// -----------------------------------------------------------------------------
+func handleGetResults(w http.ResponseWriter, r *http.Request, d *HInfo) {
+	var req proto.ResultsRequest
+	if err := json.Unmarshal(d.cmd.Data, &req); err != nil {
+		util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "handleGetResults: invalid request data"))
+		return
+	}
+
+	//-----------------------------------------------------
+	// NO FILENAME: SEND EVERYTHING AS A TAR.GZ ARCHIVE
+	//-----------------------------------------------------
+	if len(req.Filename) == 0 {
+		files, err := app.store.List(req.SID)
+		if err != nil {
+			util.SvcErrorReturn(w, fmt.Errorf("handleGetResults: %w", err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("%d-results.tar.gz", req.SID)))
+		w.WriteHeader(http.StatusOK)
+		if err := writeResultsArchive(w, app.store, req.SID, files); err != nil {
+			// headers are already on the wire, all we can do is log it
+			d.log.Warn("could not write the results archive", "sid", req.SID, "err", err)
+		}
+		return
+	}
+
+	//-----------------------------------------------------
+	// SINGLE FILE
+	//-----------------------------------------------------
+	f, err := app.store.Open(req.SID, req.Filename)
+	if err != nil {
+		util.SvcErrorReturn(w, fmt.Errorf("handleGetResults: %w", err))
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(req.Filename)))
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(w, f); err != nil {
+		d.log.Warn("could not send the result file", "sid", req.SID, "file", req.Filename, "err", err)
+	}
+}
+
+// writeResultsArchive writes the listed result files for sid to w as a tar.gz
+// archive. File names in the archive are relative to the SID.
+// -----------------------------------------------------------------------------
+func writeResultsArchive(w io.Writer, store ResultStore, sid int64, files []proto.ResultFileInfo) error {
+	gzWriter := gzip.NewWriter(w)
+	tarWriter := tar.NewWriter(gzWriter)
+
+	for _, f := range files {
+		if err := addResultFileToTar(tarWriter, store, sid, f); err != nil {
+			return err
+		}
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+	return gzWriter.Close()
+}
+
+// addResultFileToTar adds the result file f to the archive
+// -----------------------------------------------------------------------------
+func addResultFileToTar(tarWriter *tar.Writer, store ResultStore, sid int64, f proto.ResultFileInfo) error {
+	file, err := store.Open(sid, f.Name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     f.Name,
+		Size:     f.Size,
+		Mode:     0644,
+		ModTime:  f.Modified,
+	}
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tarWriter, file)
+	return err
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stmansour/simq/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// makeTestResults creates a results directory for sid under a temporary
+// SimResultsDir using the YYYY/MM/DD/SID layout
+// -----------------------------------------------------------------------------
+func makeTestResults(t *testing.T, sid string) string {
+	app.SimResultsDir = t.TempDir()
+	app.store = NewFileResultStore(app.SimResultsDir)
+	dir := filepath.Join(app.SimResultsDir, "2024", "7", "4", sid)
+	require.NoError(t, os.MkdirAll(dir, os.ModePerm))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "finrep.csv"), []byte("a,b,c\n1,2,3\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "config.json5"), []byte("{}"), 0644))
+	return dir
+}
+
+func sendResultsCommand(t *testing.T, command string, req proto.ResultsRequest) *httptest.ResponseRecorder {
+	cmd := proto.Command{
+		Command:  command,
+		Username: "test-user",
+		Data:     json.RawMessage(mustMarshal(req)),
+	}
+	r, err := http.NewRequest("POST", "/command", bytes.NewBuffer(mustMarshal(cmd)))
+	require.NoError(t, err)
+	r.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	commandDispatcher(rr, r)
+	return rr
+}
+
+func TestListResults(t *testing.T) {
+	makeTestResults(t, "42")
+
+	rr := sendResultsCommand(t, "ListResults", proto.ResultsRequest{SID: 42})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var resp struct {
+		Status string
+		Data   []proto.ResultFileInfo
+	}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	assert.Equal(t, "success", resp.Status)
+	require.Len(t, resp.Data, 2)
+	assert.Equal(t, "config.json5", resp.Data[0].Name)
+	assert.Equal(t, "finrep.csv", resp.Data[1].Name)
+	assert.EqualValues(t, 12, resp.Data[1].Size)
+
+	rr = sendResultsCommand(t, "ListResults", proto.ResultsRequest{SID: 43})
+	var errResp proto.SvcStatus201
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &errResp))
+	assert.Equal(t, "error", errResp.Status)
+}
+
+func TestGetResultsFile(t *testing.T) {
+	makeTestResults(t, "42")
+
+	rr := sendResultsCommand(t, "GetResults", proto.ResultsRequest{SID: 42, Filename: "finrep.csv"})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/octet-stream", rr.Header().Get("Content-Type"))
+	assert.Equal(t, "a,b,c\n1,2,3\n", rr.Body.String())
+
+	//-------------------------------------------
+	// names that escape the SID dir are refused
+	//-------------------------------------------
+	rr = sendResultsCommand(t, "GetResults", proto.ResultsRequest{SID: 42, Filename: "../../x"})
+	var errResp proto.SvcStatus201
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &errResp))
+	assert.Equal(t, "error", errResp.Status)
+}
+
+func TestGetResultsArchive(t *testing.T) {
+	makeTestResults(t, "42")
+
+	rr := sendResultsCommand(t, "GetResults", proto.ResultsRequest{SID: 42})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/gzip", rr.Header().Get("Content-Type"))
+
+	gz, err := gzip.NewReader(rr.Body)
+	require.NoError(t, err)
+	tr := tar.NewReader(gz)
+	found := map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		b, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		found[hdr.Name] = string(b)
+	}
+	assert.Equal(t, map[string]string{"config.json5": "{}", "finrep.csv": "a,b,c\n1,2,3\n"}, found)
+}
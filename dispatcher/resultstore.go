@@ -0,0 +1,346 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stmansour/simq/proto"
+	"github.com/stmansour/simq/util"
+)
+
+// ResultStore is the simulation results repository. The dispatcher stores the
+// results that simd sends back for each SID and serves them to analysts. All
+// names passed to and returned by a ResultStore are relative to the SID, using
+// forward slashes.
+type ResultStore interface {
+	// Save unpacks the tar.gz archive of results for sid into the store
+	// and returns a description of where they were stored.
+	Save(sid int64, archive io.Reader) (string, error)
+
+	// Location returns where the results for sid are stored. It returns
+	// an error if the store has no results for sid.
+	Location(sid int64) (string, error)
+
+	// List returns the files stored for sid, sorted by name.
+	List(sid int64) ([]proto.ResultFileInfo, error)
+
+	// Open returns a reader for the result file name of sid.
+	Open(sid int64, name string) (io.ReadCloser, error)
+
+	// Remove deletes all the results stored for sid.
+	Remove(sid int64) error
+
+	// ListSIDs returns the SIDs that have results in the store, sorted.
+	ListSIDs() ([]int64, error)
+}
+
+// storeRecoverer is implemented by result stores that may need to clean up
+// after a Save that was interrupted by a crash.
+type storeRecoverer interface {
+	Recover() error
+}
+
+// newResultStore creates the result store selected by the configuration.
+// -----------------------------------------------------------------------------
+func newResultStore(ex *util.ExternalResources) (ResultStore, error) {
+	switch strings.ToLower(ex.ResultStore) {
+	case "", "fs", "filesystem":
+		return NewFileResultStore(ex.SimResultsDir), nil
+	case "s3":
+		return NewS3ResultStore(S3Config{
+			Endpoint:        ex.S3Endpoint,
+			Region:          ex.S3Region,
+			Bucket:          ex.S3Bucket,
+			Prefix:          ex.S3Prefix,
+			AccessKeyID:     ex.S3AccessKeyID,
+			SecretAccessKey: ex.S3SecretAccessKey,
+		})
+	default:
+		return nil, fmt.Errorf("unknown ResultStore: %q", ex.ResultStore)
+	}
+}
+
+// FileResultStore keeps results in the local filesystem, organized by the
+// date the results were received and the SID:
+//
+//	BaseDir/YYYY/MM/DD/SID/(result files)
+type FileResultStore struct {
+	BaseDir string
+}
+
+// NewFileResultStore returns a result store rooted at baseDir
+// -----------------------------------------------------------------------------
+func NewFileResultStore(baseDir string) *FileResultStore {
+	return &FileResultStore{BaseDir: baseDir}
+}
+
+// resultStagingDir is where FileResultStore unpacks an archive, and where
+// S3ResultStore uploads one, before moving it into place
+const resultStagingDir = ".staging"
+
+// Save unpacks the archive in a staging directory and then moves it into
+// today's directory for sid. Results that are already stored under that
+// name are replaced.
+// -----------------------------------------------------------------------------
+func (s *FileResultStore) Save(sid int64, archive io.Reader) (string, error) {
+	//----------------------------------------------------------------------------
+	// BUILD THE DESTINATION DIRECTORY
+	// /genome/simres/YYYY/MM/DD/SID/
+	//
+	// for testing: /opt/testsimres
+	//----------------------------------------------------------------------------
+	now := time.Now()
+	dirPath := filepath.Join(s.BaseDir,
+		fmt.Sprintf("%d", now.Year()),
+		fmt.Sprintf("%d", now.Month()),
+		fmt.Sprintf("%d", now.Day()),
+		fmt.Sprintf("%d", sid),
+	)
+
+	//----------------------------------------------
+	// WRITE THE TAR.GZ FILE TO A STAGING DIRECTORY
+	//----------------------------------------------
+	stagingDir := filepath.Join(s.BaseDir, resultStagingDir)
+	if err := os.MkdirAll(stagingDir, os.ModePerm); err != nil {
+		return "", fmt.Errorf("error from os.MkdirAll(%s): %s", stagingDir, err.Error())
+	}
+	stage, err := os.MkdirTemp(stagingDir, fmt.Sprintf("%d-*", sid))
+	if err != nil {
+		return "", fmt.Errorf("failed to create staging directory: %v", err)
+	}
+	defer os.RemoveAll(stage)
+
+	filename := filepath.Join(stage, "results.tar.gz")
+	tarz, err := os.Create(filename)
+	if err != nil {
+		return "", fmt.Errorf("failed to create file %s: %v", filename, err)
+	}
+	n, err := io.Copy(tarz, archive)
+	tarz.Close()
+	if err != nil {
+		return "", fmt.Errorf("failed to write to file %s: %v", filename, err)
+	}
+	if n == 0 {
+		return "", fmt.Errorf("no file content. 0-length file")
+	}
+
+	//----------------------------------------------------------------------
+	// tar has actually failed here.  We'll implement retry logic...
+	//----------------------------------------------------------------------
+	outDir := filepath.Join(stage, "out")
+	if err := os.Mkdir(outDir, os.ModePerm); err != nil {
+		return "", err
+	}
+	const maxRetries = 3
+	const retryDelay = 2 * time.Second
+	start := time.Now()
+	for i := 0; i < maxRetries; i++ {
+		err = executeTarCommand(outDir, filename)
+		if err == nil {
+			break
+		}
+		slog.Warn("failed to execute tar command", "sid", sid, "attempt", i+1, "of", maxRetries, "err", err)
+		time.Sleep(retryDelay)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to execute tar command after %d attempts: %v", maxRetries, err)
+	}
+	metrics.extractDuration.Observe(time.Since(start).Seconds(), "fs")
+
+	//---------------------------------------------------------------------------
+	// MOVE THE RESULTS INTO PLACE. Any earlier results for this SID stored
+	// today are moved into the staging directory and removed along with it.
+	//---------------------------------------------------------------------------
+	if err := os.MkdirAll(filepath.Dir(dirPath), os.ModePerm); err != nil {
+		return "", fmt.Errorf("error from os.MkdirAll(%s): %s", filepath.Dir(dirPath), err.Error())
+	}
+	old := filepath.Join(stage, "old")
+	replaced := os.Rename(dirPath, old) == nil
+	if err := os.Rename(outDir, dirPath); err != nil {
+		if replaced {
+			os.Rename(old, dirPath)
+		}
+		return "", fmt.Errorf("failed to move results into %s: %v", dirPath, err)
+	}
+	return dirPath, nil
+}
+
+// Recover removes anything left in the staging directory by a Save that did
+// not finish.
+// -----------------------------------------------------------------------------
+func (s *FileResultStore) Recover() error {
+	return os.RemoveAll(filepath.Join(s.BaseDir, resultStagingDir))
+}
+
+func executeTarCommand(dir, archive string) error {
+	tcmd := exec.Command("tar", "xzf", archive, "-C", dir)
+	tcmd.Stdout = os.Stdout
+	tcmd.Stderr = os.Stderr
+	return tcmd.Run()
+}
+
+// Location returns the directory holding the results for sid
+// -----------------------------------------------------------------------------
+func (s *FileResultStore) Location(sid int64) (string, error) {
+	return s.findSimulationDirectory(sid)
+}
+
+// List returns the files stored for sid
+// -----------------------------------------------------------------------------
+func (s *FileResultStore) List(sid int64) ([]proto.ResultFileInfo, error) {
+	dir, err := s.findSimulationDirectory(sid)
+	if err != nil {
+		return nil, err
+	}
+	return listResultFiles(dir)
+}
+
+// Open returns a reader for one of the result files for sid
+// -----------------------------------------------------------------------------
+func (s *FileResultStore) Open(sid int64, name string) (io.ReadCloser, error) {
+	dir, err := s.findSimulationDirectory(sid)
+	if err != nil {
+		return nil, err
+	}
+	fname, err := resultFilePath(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, util.Errorf(util.ErrNotFound, "SID %d: file %s not found", sid, name)
+	}
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		f.Close()
+		return nil, fmt.Errorf("SID %d: %s is not a regular file", sid, name)
+	}
+	return f, nil
+}
+
+// Remove deletes the results directory for sid
+// -----------------------------------------------------------------------------
+func (s *FileResultStore) Remove(sid int64) error {
+	dir, err := s.findSimulationDirectory(sid)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// ListSIDs returns the SIDs of all the YYYY/MM/DD/SID directories
+// -----------------------------------------------------------------------------
+func (s *FileResultStore) ListSIDs() ([]int64, error) {
+	dirs, err := filepath.Glob(filepath.Join(s.BaseDir, "*", "*", "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+	seen := map[int64]bool{}
+	sids := []int64{}
+	for _, d := range dirs {
+		sid, err := strconv.ParseInt(filepath.Base(d), 10, 64)
+		if err != nil || seen[sid] {
+			continue
+		}
+		if info, err := os.Stat(d); err != nil || !info.IsDir() {
+			continue
+		}
+		seen[sid] = true
+		sids = append(sids, sid)
+	}
+	sort.Slice(sids, func(i, j int) bool { return sids[i] < sids[j] })
+	return sids, nil
+}
+
+// listResultFiles returns information about every regular file in dir. Names
+// are relative to dir and the list is sorted by name.
+// -----------------------------------------------------------------------------
+func listResultFiles(dir string) ([]proto.ResultFileInfo, error) {
+	files := []proto.ResultFileInfo{}
+	err := filepath.WalkDir(dir, func(path string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !de.Type().IsRegular() {
+			return nil
+		}
+		info, err := de.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, proto.ResultFileInfo{
+			Name:     filepath.ToSlash(rel),
+			Size:     info.Size(),
+			Modified: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+// resultFilePath validates the caller-supplied name and returns the full path
+// of the file within dir. Names that would escape dir are rejected.
+// -----------------------------------------------------------------------------
+func resultFilePath(dir, name string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, ".."+string(os.PathSeparator)) {
+		return "", util.Errorf(util.ErrBadRequest, "invalid filename: %s", name)
+	}
+	return filepath.Join(dir, clean), nil
+}
+
+// findSimulationDirectory finds the SID in the simulation results repo
+// -----------------------------------------------------------------------------
+func (s *FileResultStore) findSimulationDirectory(sid int64) (string, error) {
+	baseDir := s.BaseDir
+	sidStr := fmt.Sprintf("%d", sid)
+	var resultPath string
+
+	baseDirComponents := len(strings.Split(baseDir, string(os.PathSeparator))) // Count the number of components in baseDir
+	expectedDepth := baseDirComponents + 4                                     // Add 4 for YYYY/MM/DD/SID
+	err := filepath.Walk(baseDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != baseDir && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir // staging, not results
+			}
+			components := strings.Split(path, string(os.PathSeparator)) // Split the path into components
+
+			//-----------------------------------------------------------------------------
+			// Check if we're at the correct depth and the last component matches the SID
+			//-----------------------------------------------------------------------------
+			if len(components) == expectedDepth && components[len(components)-1] == sidStr {
+				resultPath = path
+				return filepath.SkipAll // terminate the filepath.Walk
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return "", fmt.Errorf("error walking the path %s: %v", baseDir, err)
+	}
+	if resultPath == "" {
+		return "", util.Errorf(util.ErrNotFound, "simulation directory for SID %d not found", sid)
+	}
+	return resultPath, nil
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stmansour/simq/proto"
+	"github.com/stmansour/simq/util"
+)
+
+// S3Config holds the settings needed to reach an S3-compatible object store
+type S3Config struct {
+	Endpoint        string // e.g. https://s3.us-west-2.amazonaws.com or http://minio:9000
+	Region          string // e.g. us-west-2
+	Bucket          string
+	Prefix          string // optional key prefix, e.g. "simres"
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// S3ResultStore keeps results in an S3-compatible object store. Requests use
+// path-style addressing and AWS Signature Version 4, which is understood by
+// AWS S3 as well as MinIO, Ceph and the other S3-compatible servers. Objects
+// are stored as:
+//
+//	Bucket/Prefix/SID/(result files)
+//	Bucket/Prefix/.staging/SID-N/(result files)   while they are uploaded
+type S3ResultStore struct {
+	cfg    S3Config
+	client *http.Client
+	now    func() time.Time // replaced in tests
+}
+
+// NewS3ResultStore returns a result store that uses the supplied bucket
+// -----------------------------------------------------------------------------
+func NewS3ResultStore(cfg S3Config) (*S3ResultStore, error) {
+	if len(cfg.Endpoint) == 0 || len(cfg.Bucket) == 0 {
+		return nil, fmt.Errorf("NewS3ResultStore: S3Endpoint and S3Bucket are required")
+	}
+	if len(cfg.Region) == 0 {
+		cfg.Region = "us-east-1"
+	}
+	cfg.Endpoint = strings.TrimSuffix(cfg.Endpoint, "/")
+	cfg.Prefix = strings.Trim(cfg.Prefix, "/")
+	s := S3ResultStore{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 5 * time.Minute},
+		now:    time.Now,
+	}
+	return &s, nil
+}
+
+// basePrefix returns the key prefix for all of the objects of the store
+// -----------------------------------------------------------------------------
+func (s *S3ResultStore) basePrefix() string {
+	if len(s.cfg.Prefix) == 0 {
+		return ""
+	}
+	return s.cfg.Prefix + "/"
+}
+
+// sidPrefix returns the key prefix for all of the objects belonging to sid
+// -----------------------------------------------------------------------------
+func (s *S3ResultStore) sidPrefix(sid int64) string {
+	return fmt.Sprintf("%s%d/", s.basePrefix(), sid)
+}
+
+// Save unpacks the tar.gz archive and stores each file as an object. The
+// files are uploaded to a staging prefix first and copied into place once
+// they are all there, so a failed upload leaves the earlier results for sid,
+// if any, as they were. Earlier results that the archive does not replace
+// are removed.
+// -----------------------------------------------------------------------------
+func (s *S3ResultStore) Save(sid int64, archive io.Reader) (string, error) {
+	gzReader, err := gzip.NewReader(archive)
+	if err != nil {
+		return "", fmt.Errorf("S3ResultStore.Save: SID %d: %v", sid, err)
+	}
+	defer gzReader.Close()
+
+	//----------------------------------------------------------------------
+	// The staged objects are removed whether or not the Save succeeds
+	//----------------------------------------------------------------------
+	stage := fmt.Sprintf("%s%s/%d-%d/", s.basePrefix(), resultStagingDir, sid, s.now().UnixNano())
+	var names []string
+	defer func() {
+		for _, name := range names {
+			s.deleteObject(stage + name)
+		}
+	}()
+
+	start := time.Now()
+	tarReader := tar.NewReader(gzReader)
+	for {
+		hdr, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("S3ResultStore.Save: SID %d: error reading archive: %v", sid, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		if strings.HasPrefix(name, "../") || name == ".." || path.IsAbs(name) {
+			return "", fmt.Errorf("S3ResultStore.Save: SID %d: invalid filename in archive: %s", sid, hdr.Name)
+		}
+		if err := s.putObject(stage+name, tarReader, hdr.Size); err != nil {
+			return "", fmt.Errorf("S3ResultStore.Save: SID %d: %v", sid, err)
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("S3ResultStore.Save: SID %d: no files in archive", sid)
+	}
+
+	//----------------------------------------------------------------------
+	// MOVE THE RESULTS INTO PLACE, then remove the earlier results that
+	// were not replaced
+	//----------------------------------------------------------------------
+	prefix := s.sidPrefix(sid)
+	old, err := s.listObjects(prefix)
+	if err != nil {
+		return "", fmt.Errorf("S3ResultStore.Save: SID %d: %v", sid, err)
+	}
+	saved := map[string]bool{}
+	for _, name := range names {
+		if err := s.copyObject(stage+name, prefix+name); err != nil {
+			return "", fmt.Errorf("S3ResultStore.Save: SID %d: %v", sid, err)
+		}
+		saved[prefix+name] = true
+	}
+	for _, o := range old {
+		if !saved[o.Key] {
+			s.deleteObject(o.Key)
+		}
+	}
+	metrics.extractDuration.Observe(time.Since(start).Seconds(), "s3")
+	return s.location(sid), nil
+}
+
+func (s *S3ResultStore) location(sid int64) string {
+	return fmt.Sprintf("s3://%s/%s", s.cfg.Bucket, s.sidPrefix(sid))
+}
+
+// Location returns the s3:// URL of the results for sid
+// -----------------------------------------------------------------------------
+func (s *S3ResultStore) Location(sid int64) (string, error) {
+	if _, err := s.List(sid); err != nil {
+		return "", err
+	}
+	return s.location(sid), nil
+}
+
+// List returns the objects stored for sid
+// -----------------------------------------------------------------------------
+func (s *S3ResultStore) List(sid int64) ([]proto.ResultFileInfo, error) {
+	prefix := s.sidPrefix(sid)
+	objects, err := s.listObjects(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if len(objects) == 0 {
+		return nil, util.Errorf(util.ErrNotFound, "simulation results for SID %d not found", sid)
+	}
+	files := make([]proto.ResultFileInfo, 0, len(objects))
+	for _, o := range objects {
+		files = append(files, proto.ResultFileInfo{
+			Name:     strings.TrimPrefix(o.Key, prefix),
+			Size:     o.Size,
+			Modified: o.LastModified,
+		})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+// Open returns a reader for one of the objects stored for sid
+// -----------------------------------------------------------------------------
+func (s *S3ResultStore) Open(sid int64, name string) (io.ReadCloser, error) {
+	clean := path.Clean(name)
+	if path.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return nil, util.Errorf(util.ErrBadRequest, "invalid filename: %s", name)
+	}
+	resp, err := s.do("GET", s.sidPrefix(sid)+clean, nil, nil, -1)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, util.Errorf(util.ErrNotFound, "SID %d: file %s not found", sid, name)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, s3Error(resp)
+	}
+	return resp.Body, nil
+}
+
+// Remove deletes every object stored for sid
+// -----------------------------------------------------------------------------
+func (s *S3ResultStore) Remove(sid int64) error {
+	objects, err := s.listObjects(s.sidPrefix(sid))
+	if err != nil {
+		return err
+	}
+	for _, o := range objects {
+		if err := s.deleteObject(o.Key); err != nil {
+			return fmt.Errorf("S3ResultStore.Remove: %v", err)
+		}
+	}
+	return nil
+}
+
+// ListSIDs returns the SIDs that have objects under the configured prefix
+// -----------------------------------------------------------------------------
+func (s *S3ResultStore) ListSIDs() ([]int64, error) {
+	prefix := s.basePrefix()
+	objects, err := s.listObjects(prefix)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[int64]bool{}
+	sids := []int64{}
+	for _, o := range objects {
+		first, _, found := strings.Cut(strings.TrimPrefix(o.Key, prefix), "/")
+		if !found {
+			continue
+		}
+		sid, err := strconv.ParseInt(first, 10, 64)
+		if err != nil || seen[sid] {
+			continue
+		}
+		seen[sid] = true
+		sids = append(sids, sid)
+	}
+	sort.Slice(sids, func(i, j int) bool { return sids[i] < sids[j] })
+	return sids, nil
+}
+
+// s3Object is one entry in a ListObjectsV2 reply
+type s3Object struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// listBucketResult is the ListObjectsV2 reply
+type listBucketResult struct {
+	Contents              []s3Object `xml:"Contents"`
+	IsTruncated           bool       `xml:"IsTruncated"`
+	NextContinuationToken string     `xml:"NextContinuationToken"`
+}
+
+// listObjects returns all of the objects whose keys begin with prefix
+// -----------------------------------------------------------------------------
+func (s *S3ResultStore) listObjects(prefix string) ([]s3Object, error) {
+	var objects []s3Object
+	token := ""
+	for {
+		q := url.Values{}
+		q.Set("list-type", "2")
+		q.Set("prefix", prefix)
+		if len(token) > 0 {
+			q.Set("continuation-token", token)
+		}
+		resp, err := s.do("GET", "", q, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = s3Error(resp)
+			resp.Body.Close()
+			return nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("S3ResultStore: error decoding list reply: %v", err)
+		}
+		objects = append(objects, result.Contents...)
+		if !result.IsTruncated || len(result.NextContinuationToken) == 0 {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	return objects, nil
+}
+
+// putObject uploads size bytes from body as key
+// -----------------------------------------------------------------------------
+func (s *S3ResultStore) putObject(key string, body io.Reader, size int64) error {
+	var r io.Reader = http.NoBody // an empty file must not be sent chunked
+	if size > 0 {
+		r = io.LimitReader(body, size)
+	}
+	resp, err := s.do("PUT", key, nil, r, size)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+// copyObject copies the object src to dst on the server
+// -----------------------------------------------------------------------------
+func (s *S3ResultStore) copyObject(src, dst string) error {
+	hdr := http.Header{}
+	hdr.Set("X-Amz-Copy-Source", s3EscapePath("/"+s.cfg.Bucket+"/"+src))
+	resp, err := s.doHeader("PUT", dst, nil, hdr, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+// deleteObject deletes key. Deleting a key that does not exist succeeds.
+// -----------------------------------------------------------------------------
+func (s *S3ResultStore) deleteObject(key string) error {
+	resp, err := s.do("DELETE", key, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("delete %s: %s", key, resp.Status)
+	}
+	return nil
+}
+
+// do builds, signs and sends a request for key (or for the bucket when key
+// is empty). contentLength < 0 means no body.
+// -----------------------------------------------------------------------------
+func (s *S3ResultStore) do(method, key string, query url.Values, body io.Reader, contentLength int64) (*http.Response, error) {
+	return s.doHeader(method, key, query, nil, body, contentLength)
+}
+
+// doHeader is do with extra request headers, which are signed
+// -----------------------------------------------------------------------------
+func (s *S3ResultStore) doHeader(method, key string, query url.Values, hdr http.Header, body io.Reader, contentLength int64) (*http.Response, error) {
+	u, err := url.Parse(s.cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("S3ResultStore: invalid endpoint %s: %v", s.cfg.Endpoint, err)
+	}
+	u.Path = "/" + s.cfg.Bucket
+	if len(key) > 0 {
+		u.Path += "/" + key
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = s3CanonicalQuery(query)
+
+	if contentLength == 0 {
+		body = http.NoBody // with any other body, ContentLength 0 means unknown and it is sent chunked
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if contentLength >= 0 && body != nil {
+		req.ContentLength = contentLength
+	}
+	for k, v := range hdr {
+		req.Header[k] = v
+	}
+	s.sign(req)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("S3ResultStore: %s %s: %v", method, u.Path, err)
+	}
+	return resp, nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req. Every
+// header req has is signed. Unless req has an X-Amz-Content-Sha256 header,
+// the payload is not hashed (UNSIGNED-PAYLOAD) so that result files can be
+// streamed straight out of the archive.
+// -----------------------------------------------------------------------------
+func (s *S3ResultStore) sign(req *http.Request) {
+	t := s.now().UTC()
+	if len(req.Header.Get("X-Amz-Content-Sha256")) == 0 {
+		req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	}
+	req.Header.Set("X-Amz-Date", t.Format("20060102T150405Z"))
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.Join(v, ",")
+	}
+	scope := t.Format("20060102") + "/" + s.cfg.Region + "/s3/aws4_request"
+	signedHeaders, signature := sigV4(s.cfg.SecretAccessKey, scope, req.Method, req.URL.EscapedPath(), req.URL.RawQuery, headers)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// sigV4 returns the SignedHeaders and the Signature of a request signed with
+// secret for scope (date/region/service/aws4_request). headers maps the
+// lower-case names of the headers to sign to their values and must include
+// host, x-amz-date and x-amz-content-sha256.
+// -----------------------------------------------------------------------------
+func sigV4(secret, scope, method, escapedPath, rawQuery string, headers map[string]string) (string, string) {
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + strings.TrimSpace(headers[k]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		method,
+		escapedPath,
+		rawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		headers["x-amz-content-sha256"],
+	}, "\n")
+	stringToSign := "AWS4-HMAC-SHA256\n" + headers["x-amz-date"] + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	parts := strings.Split(scope, "/") // date, region, service, aws4_request
+	key := []byte("AWS4" + secret)
+	for _, p := range parts {
+		key = hmacSHA256(key, p)
+	}
+	return signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// s3Escape percent-encodes s the way SigV4 requires: everything except the
+// unreserved characters A-Z a-z 0-9 - _ . ~ is encoded.
+// -----------------------------------------------------------------------------
+func s3Escape(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+// s3EscapePath encodes each segment of p, leaving the slashes alone
+func s3EscapePath(p string) string {
+	segs := strings.Split(p, "/")
+	for i := range segs {
+		segs[i] = s3Escape(segs[i])
+	}
+	return strings.Join(segs, "/")
+}
+
+// s3CanonicalQuery returns the query string sorted by key with SigV4 encoding
+func s3CanonicalQuery(q url.Values) string {
+	if len(q) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range q[k] {
+			parts = append(parts, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Error turns an S3 error reply into an error
+func s3Error(resp *http.Response) error {
+	var e struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err := xml.Unmarshal(b, &e); err == nil && len(e.Code) > 0 {
+		return fmt.Errorf("S3ResultStore: %s: %s: %s", resp.Status, e.Code, e.Message)
+	}
+	return fmt.Errorf("S3ResultStore: %s", resp.Status)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stmansour/simq/client"
+	"github.com/stmansour/simq/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCert creates a certificate signed by parent (self-signed if parent is
+// nil) and writes it and its key to dir as name.crt and name.key.
+func testCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	kb, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0600))
+	return cert, key
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	f := func(name string) string { return filepath.Join(dir, name) }
+	ca, caKey := testCert(t, dir, "ca", nil, nil)
+	testCert(t, dir, "server", ca, caKey)
+	testCert(t, dir, "client", ca, caKey)
+	testCert(t, dir, "other", nil, nil) // a CA we do not trust
+
+	srvCfg, err := util.ServerTLSConfig(&util.TLSConfig{CertFile: f("server.crt"), KeyFile: f("server.key"), CAFile: f("ca.crt")})
+	require.NoError(t, err)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		util.SvcWriteResponse(w, &util.SvcStatus200{Status: "success", Message: r.TLS.PeerCertificates[0].Subject.CommonName})
+	}))
+	srv.TLS = srvCfg
+	srv.StartTLS()
+	defer srv.Close()
+	defer util.SetClientTLS(&util.TLSConfig{})
+
+	c := client.New(srv.URL, "test-user")
+	c.Retries = -1
+	ctx := context.Background()
+
+	// pinned to our CA, with a client certificate
+	require.NoError(t, util.SetClientTLS(&util.TLSConfig{CAFile: f("ca.crt"), CertFile: f("client.crt"), KeyFile: f("client.key")}))
+	st, err := c.Pause(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "client", st.Message)
+
+	// no client certificate
+	require.NoError(t, util.SetClientTLS(&util.TLSConfig{CAFile: f("ca.crt")}))
+	_, err = c.Pause(ctx)
+	assert.Error(t, err)
+
+	// pinned to a CA that did not sign the server's certificate
+	require.NoError(t, util.SetClientTLS(&util.TLSConfig{CAFile: f("other.crt"), CertFile: f("client.crt"), KeyFile: f("client.key")}))
+	_, err = c.Pause(ctx)
+	assert.Error(t, err)
+
+	_, err = util.ServerTLSConfig(&util.TLSConfig{CertFile: f("server.crt")})
+	assert.Error(t, err)
+}
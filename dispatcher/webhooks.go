@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stmansour/simq/data"
+	"github.com/stmansour/simq/proto"
+	"github.com/stmansour/simq/util"
+)
+
+//----------------------------------------------------------------------------
+// WEBHOOKS
+//
+// The webhook notifier listens on the event bus for the lifecycle events in
+// proto.WebhookEvents and POSTs a proto.WebhookPayload to every webhook that
+// covers the simulation. If the webhook has a secret, the body is signed with
+// HMAC-SHA256 in the X-Simq-Signature header.
+//
+// A delivery is retried with exponential backoff until the receiver answers
+// with a 2xx status or the retries run out. A 4xx answer, other than 408 and
+// 429, is final. Deliveries that fail are appended to the dead-letter log, a
+// file of JSON lines, so that nothing is lost silently.
+//----------------------------------------------------------------------------
+
+const (
+	defaultWebhookRetries = 5
+	webhookBackoff        = 2 * time.Second // wait before the first retry, doubled for each one after
+	webhookMaxBackoff     = 5 * time.Minute
+	webhookTimeout        = 10 * time.Second // limit for each attempt
+	webhookQueueSize      = 256              // events waiting to be matched to webhooks
+)
+
+// hookStore is the part of the QueueManager used by the webhook notifier
+type hookStore interface {
+	GetWebhooks() ([]data.Webhook, error)
+}
+
+// webhookNotifier delivers events to webhooks
+type webhookNotifier struct {
+	store      hookStore
+	client     *http.Client
+	retries    int           // attempts after the first
+	backoff    time.Duration // wait before the first retry
+	deadLetter string        // dead-letter log, empty = log only
+	events     chan proto.Event
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+	mu         sync.Mutex // serializes writes to the dead-letter log
+
+	dropMu  sync.Mutex
+	dropped []proto.Event // did not fit in events, for run to dead-letter
+	dropc   chan struct{} // tells run there are dropped events
+}
+
+// deadLetter is one line of the dead-letter log
+type deadLetter struct {
+	Time     time.Time
+	WID      int64
+	URL      string
+	Attempts int
+	Error    string
+	Payload  proto.WebhookPayload
+}
+
+// newWebhookNotifier returns a notifier for the webhooks in store. retries
+// of 0 means defaultWebhookRetries, < 0 means none.
+// -----------------------------------------------------------------------------
+func newWebhookNotifier(store hookStore, retries int, deadLetter string) *webhookNotifier {
+	if retries == 0 {
+		retries = defaultWebhookRetries
+	} else if retries < 0 {
+		retries = 0
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &webhookNotifier{
+		store:      store,
+		client:     &http.Client{Timeout: webhookTimeout},
+		retries:    retries,
+		backoff:    webhookBackoff,
+		deadLetter: deadLetter,
+		events:     make(chan proto.Event, webhookQueueSize),
+		dropc:      make(chan struct{}, 1),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+// start subscribes the notifier to bus and starts delivering
+// -----------------------------------------------------------------------------
+func (n *webhookNotifier) start(bus *eventBus) {
+	bus.listen(n.notify)
+	n.wg.Add(1)
+	go n.run()
+}
+
+// stop abandons the pending deliveries and the events not yet matched to
+// webhooks, which go to the dead-letter log, and waits for the notifier to
+// finish
+// -----------------------------------------------------------------------------
+func (n *webhookNotifier) stop() {
+	n.cancel()
+	n.wg.Wait()
+	n.failQueued()
+}
+
+// notify is called by the event bus for every event, with the bus locked. It
+// must not block, so an event that does not fit in the queue is counted and
+// left for run to write to the dead-letter log.
+// -----------------------------------------------------------------------------
+func (n *webhookNotifier) notify(e *proto.Event) {
+	if !isWebhookEvent(e.Type) {
+		return
+	}
+	select {
+	case n.events <- *e:
+		return
+	default:
+	}
+	metrics.webhookDeliveries.Inc("dropped")
+	n.dropMu.Lock()
+	if len(n.dropped) < webhookQueueSize {
+		n.dropped = append(n.dropped, *e)
+	}
+	n.dropMu.Unlock()
+	select {
+	case n.dropc <- struct{}{}:
+	default:
+	}
+}
+
+// isWebhookEvent reports whether webhooks may subscribe to events of type typ
+// -----------------------------------------------------------------------------
+func isWebhookEvent(typ string) bool {
+	for _, t := range proto.WebhookEvents {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// run matches events to webhooks and starts a delivery for each match
+// -----------------------------------------------------------------------------
+func (n *webhookNotifier) run() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-n.dropc:
+			n.failDropped()
+		case e := <-n.events:
+			hooks, err := n.store.GetWebhooks()
+			if err != nil {
+				n.fail(data.Webhook{}, proto.WebhookPayload{Event: e}, 0, fmt.Errorf("cannot read webhooks: %v", err))
+				continue
+			}
+			for _, h := range hooks {
+				if !h.Wants(e.Type) || !h.Covers(e.SID, e.Username) {
+					continue
+				}
+				p := proto.WebhookPayload{Delivery: util.NewCorrelationID(), WID: h.WID, Event: e}
+				n.wg.Add(1)
+				go n.deliver(h, p)
+			}
+		}
+	}
+}
+
+// failQueued sends the events still in the queue, and those dropped, to the
+// dead-letter log
+// -----------------------------------------------------------------------------
+func (n *webhookNotifier) failQueued() {
+	n.failDropped()
+	for {
+		select {
+		case e := <-n.events:
+			n.fail(data.Webhook{}, proto.WebhookPayload{Event: e}, 0, fmt.Errorf("dispatcher shut down"))
+		default:
+			return
+		}
+	}
+}
+
+// failDropped sends the events that did not fit in the queue to the
+// dead-letter log
+// -----------------------------------------------------------------------------
+func (n *webhookNotifier) failDropped() {
+	n.dropMu.Lock()
+	dropped := n.dropped
+	n.dropped = nil
+	n.dropMu.Unlock()
+	for _, e := range dropped {
+		n.record(data.Webhook{}, proto.WebhookPayload{Event: e}, 0, fmt.Errorf("webhook queue is full"))
+	}
+}
+
+// deliver sends p to h, retrying as allowed
+// -----------------------------------------------------------------------------
+func (n *webhookNotifier) deliver(h data.Webhook, p proto.WebhookPayload) {
+	defer n.wg.Done()
+	body, err := json.Marshal(&p)
+	if err != nil {
+		n.fail(h, p, 0, err)
+		return
+	}
+	wait := n.backoff
+	attempts := 0
+	for {
+		attempts++
+		final, err := n.post(h, &p, body)
+		if err == nil {
+			metrics.webhookDeliveries.Inc("delivered")
+			slog.Debug("webhook delivered", "wid", h.WID, "sid", p.Event.SID, "event", p.Event.Type, "delivery", p.Delivery)
+			return
+		}
+		if final || attempts > n.retries {
+			n.fail(h, p, attempts, err)
+			return
+		}
+		select {
+		case <-time.After(wait):
+		case <-n.ctx.Done():
+			n.fail(h, p, attempts, fmt.Errorf("dispatcher shut down, last error: %v", err))
+			return
+		}
+		if wait *= 2; wait > webhookMaxBackoff {
+			wait = webhookMaxBackoff
+		}
+	}
+}
+
+// post makes one delivery attempt. final is true if retrying cannot help.
+// -----------------------------------------------------------------------------
+func (n *webhookNotifier) post(h data.Webhook, p *proto.WebhookPayload, body []byte) (final bool, err error) {
+	req, err := http.NewRequestWithContext(n.ctx, "POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "simq-dispatcher/"+util.Version())
+	req.Header.Set(proto.WebhookEventHeader, p.Event.Type)
+	req.Header.Set(proto.WebhookDeliveryHeader, p.Delivery)
+	if len(h.Secret) > 0 {
+		req.Header.Set(proto.WebhookSignatureHeader, proto.SignWebhook(h.Secret, body))
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10)) // lets the connection be reused
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests:
+		return false, fmt.Errorf("receiver answered %s", resp.Status)
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return true, fmt.Errorf("receiver answered %s", resp.Status)
+	default:
+		return false, fmt.Errorf("receiver answered %s", resp.Status)
+	}
+}
+
+// fail counts a delivery that did not succeed and records it
+// -----------------------------------------------------------------------------
+func (n *webhookNotifier) fail(h data.Webhook, p proto.WebhookPayload, attempts int, err error) {
+	metrics.webhookDeliveries.Inc("failed")
+	n.record(h, p, attempts, err)
+}
+
+// record logs a delivery that did not succeed and appends it to the
+// dead-letter log
+// -----------------------------------------------------------------------------
+func (n *webhookNotifier) record(h data.Webhook, p proto.WebhookPayload, attempts int, err error) {
+	slog.Warn("webhook delivery failed", "wid", h.WID, "url", h.URL, "sid", p.Event.SID, "event", p.Event.Type, "attempts", attempts, "err", err)
+	if len(n.deadLetter) == 0 {
+		return
+	}
+	rec := deadLetter{Time: time.Now(), WID: h.WID, URL: h.URL, Attempts: attempts, Error: err.Error(), Payload: p}
+	b, jerr := json.Marshal(&rec)
+	if jerr != nil {
+		slog.Error("webhook dead letter", "err", jerr)
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	f, ferr := os.OpenFile(n.deadLetter, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if ferr != nil {
+		slog.Error("webhook dead letter", "file", n.deadLetter, "err", ferr)
+		return
+	}
+	defer f.Close()
+	if _, ferr := f.Write(append(b, '\n')); ferr != nil {
+		slog.Error("webhook dead letter", "file", n.deadLetter, "err", ferr)
+	}
+}
+
+// checkWebhookRequest returns an error if req cannot be added by d's caller
+// -----------------------------------------------------------------------------
+func checkWebhookRequest(d *HInfo, req *proto.AddWebhookRequest) error {
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return util.Errorf(util.ErrBadRequest, "invalid webhook URL: %q", req.URL)
+	}
+	for _, e := range req.Events {
+		if !isWebhookEvent(e) {
+			return util.Errorf(util.ErrBadRequest, "unknown webhook event %q, use one of %s", e, strings.Join(proto.WebhookEvents, ", "))
+		}
+	}
+	if req.Global && req.SID > 0 {
+		return util.Errorf(util.ErrBadRequest, "a webhook is either Global or for one SID")
+	}
+	if req.Global && d.caller.Role != util.RoleAdmin {
+		return util.Errorf(util.ErrForbidden, "only admins may add global webhooks")
+	}
+	return nil
+}
+
+// handleAddWebhook handles the AddWebhook command. The caller owns the new
+// webhook.
+//
+//	Cmd
+//	    Command - AddWebhook
+//	    Username - the person or process making this call
+//	    Data - proto.AddWebhookRequest
+//
+// -----------------------------------------------------------------------------
+func handleAddWebhook(w http.ResponseWriter, r *http.Request, d *HInfo) {
+	var req proto.AddWebhookRequest
+	if err := json.Unmarshal(d.cmd.Data, &req); err != nil {
+		util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "handleAddWebhook: invalid request data"))
+		return
+	}
+	if err := checkWebhookRequest(d, &req); err != nil {
+		util.SvcErrorReturn(w, fmt.Errorf("handleAddWebhook: %w", err))
+		return
+	}
+	if req.SID > 0 {
+		item, err := app.qm.GetItemByID(req.SID)
+		if err != nil {
+			util.SvcErrorReturn(w, util.Errorf(lookupCode(err), "handleAddWebhook: SID %d: %v", req.SID, err))
+			return
+		}
+		if err := checkOwner(d, &item); err != nil {
+			util.SvcErrorReturn(w, fmt.Errorf("handleAddWebhook: %w", err))
+			return
+		}
+	}
+
+	hook := data.Webhook{
+		Username: d.cmd.Username,
+		SID:      req.SID,
+		Global:   req.Global,
+		URL:      req.URL,
+		Secret:   req.Secret,
+		Events:   strings.Join(req.Events, ","),
+	}
+	wid, err := app.qm.InsertWebhook(hook)
+	if err != nil {
+		util.SvcErrorReturn(w, fmt.Errorf("handleAddWebhook: %v", err))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	msg := proto.SvcStatus201{
+		Status:  "success",
+		Message: "webhook added",
+		ID:      wid,
+	}
+	util.SvcWriteResponse(w, &msg)
+	d.log.Info("webhook added", "wid", wid, "sid", req.SID, "global", req.Global)
+}
+
+// handleListWebhooks handles the ListWebhooks command. Admins see every
+// webhook, others only their own. Secrets are never returned.
+// -----------------------------------------------------------------------------
+func handleListWebhooks(w http.ResponseWriter, r *http.Request, d *HInfo) {
+	hooks, err := app.qm.GetWebhooks()
+	if err != nil {
+		util.SvcErrorReturn(w, fmt.Errorf("handleListWebhooks: %v", err))
+		return
+	}
+	list := []data.Webhook{}
+	for _, h := range hooks {
+		if d.caller.Role != util.RoleAdmin && h.Username != d.caller.Name {
+			continue
+		}
+		h.Secret = ""
+		list = append(list, h)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	resp := struct {
+		Status string
+		Data   []data.Webhook
+	}{
+		Status: "success",
+		Data:   list,
+	}
+	util.SvcWriteResponse(w, &resp)
+}
+
+// handleDeleteWebhook handles the DeleteWebhook command. Users may only
+// delete their own webhooks.
+// -----------------------------------------------------------------------------
+func handleDeleteWebhook(w http.ResponseWriter, r *http.Request, d *HInfo) {
+	var req proto.WebhookRequest
+	if err := json.Unmarshal(d.cmd.Data, &req); err != nil {
+		util.SvcErrorReturn(w, util.Errorf(util.ErrBadRequest, "handleDeleteWebhook: invalid request data"))
+		return
+	}
+	hook, err := app.qm.GetWebhook(req.WID)
+	if err != nil {
+		util.SvcErrorReturn(w, util.Errorf(lookupCode(err), "handleDeleteWebhook: webhook %d not found", req.WID))
+		return
+	}
+	if d.caller.Role != util.RoleAdmin && hook.Username != d.caller.Name {
+		util.SvcErrorReturn(w, util.Errorf(util.ErrForbidden, "handleDeleteWebhook: webhook %d belongs to %s", req.WID, hook.Username))
+		return
+	}
+	if err := app.qm.DeleteWebhook(req.WID); err != nil {
+		util.SvcErrorReturn(w, fmt.Errorf("handleDeleteWebhook: %v", err))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	msg := proto.SvcStatus201{
+		Status:  "success",
+		Message: "webhook deleted",
+		ID:      req.WID,
+	}
+	util.SvcWriteResponse(w, &msg)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stmansour/simq/data"
+	"github.com/stmansour/simq/proto"
+	"github.com/stmansour/simq/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeHookStore is a hookStore that does not need a database
+type fakeHookStore []data.Webhook
+
+func (f fakeHookStore) GetWebhooks() ([]data.Webhook, error) { return f, nil }
+
+// receiver is a local stand-in for a webhook endpoint. It answers with the
+// statuses in replies, then 200.
+type receiver struct {
+	mu      sync.Mutex
+	replies []int
+	got     []*http.Request
+	bodies  [][]byte
+	done    chan struct{} // receives once per successful delivery
+}
+
+func newReceiver(t *testing.T, replies ...int) (*receiver, string) {
+	rc := &receiver{replies: replies, done: make(chan struct{}, 16)}
+	srv := httptest.NewServer(rc)
+	t.Cleanup(srv.Close)
+	return rc, srv.URL
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rc.mu.Lock()
+	rc.got = append(rc.got, r)
+	rc.bodies = append(rc.bodies, body)
+	status := http.StatusOK
+	if len(rc.replies) > 0 {
+		status, rc.replies = rc.replies[0], rc.replies[1:]
+	}
+	rc.mu.Unlock()
+	w.WriteHeader(status)
+	if status == http.StatusOK {
+		rc.done <- struct{}{}
+	}
+}
+
+// deliveries returns the number of webhook deliveries with result
+func deliveries(result string) float64 {
+	c := metrics.webhookDeliveries
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[result]
+}
+
+// readDeadLetters returns the records in the dead-letter log fname
+func readDeadLetters(t *testing.T, fname string) []deadLetter {
+	f, err := os.Open(fname)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	require.NoError(t, err)
+	defer f.Close()
+	var recs []deadLetter
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var rec deadLetter
+		require.NoError(t, json.Unmarshal(sc.Bytes(), &rec))
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	alice, aliceURL := newReceiver(t, http.StatusServiceUnavailable) // fails once, then works
+	sid7, sid7URL := newReceiver(t)
+	gone, goneURL := newReceiver(t, http.StatusGone)
+	hooks := fakeHookStore{
+		{WID: 1, Username: "alice", URL: aliceURL, Secret: "s3cret"},
+		{WID: 2, Username: "bob", SID: 7, URL: sid7URL, Events: "error"},
+		{WID: 3, Username: "bob", URL: goneURL},
+	}
+	dead := filepath.Join(t.TempDir(), "dead.log")
+	delivered, failed := deliveries("delivered"), deliveries("failed")
+	bus := newEventBus(8)
+	n := newWebhookNotifier(hooks, 3, dead)
+	n.backoff = time.Millisecond
+	n.start(bus)
+
+	//-----------------------------------------------------
+	// alice's completed simulation: her webhook only, after
+	// one retry. Events that webhooks ignore are skipped.
+	//-----------------------------------------------------
+	bus.publish(proto.Event{Type: proto.EventBooked, SID: 7, Username: "alice"})
+	bus.publish(proto.Event{Type: proto.EventCompleted, SID: 7, Username: "alice"})
+	select {
+	case <-alice.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("alice's webhook was not delivered")
+	}
+	alice.mu.Lock()
+	require.Len(t, alice.got, 2)
+	r, body := alice.got[1], alice.bodies[1]
+	alice.mu.Unlock()
+	assert.Equal(t, proto.EventCompleted, r.Header.Get(proto.WebhookEventHeader))
+	assert.Equal(t, alice.got[0].Header.Get(proto.WebhookDeliveryHeader), r.Header.Get(proto.WebhookDeliveryHeader))
+	assert.True(t, proto.VerifyWebhook("s3cret", body, r.Header.Get(proto.WebhookSignatureHeader)))
+	assert.False(t, proto.VerifyWebhook("wrong", body, r.Header.Get(proto.WebhookSignatureHeader)))
+	var p proto.WebhookPayload
+	require.NoError(t, json.Unmarshal(body, &p))
+	assert.EqualValues(t, 1, p.WID)
+	assert.EqualValues(t, 7, p.Event.SID)
+
+	//-----------------------------------------------------
+	// bob's SID 7 failed: the SID webhook gets it, and the
+	// webhook answering 410 is dead-lettered at once
+	//-----------------------------------------------------
+	bus.publish(proto.Event{Type: proto.EventError, SID: 7, Username: "bob", Message: "boom"})
+	require.Eventually(t, func() bool {
+		return deliveries("delivered") == delivered+2 && deliveries("failed") == failed+1
+	}, 5*time.Second, 10*time.Millisecond)
+	n.stop()
+	require.Len(t, sid7.got, 1)
+	assert.Empty(t, sid7.got[0].Header.Get(proto.WebhookSignatureHeader))
+	gone.mu.Lock()
+	assert.Len(t, gone.got, 1)
+	gone.mu.Unlock()
+	recs := readDeadLetters(t, dead)
+	require.Len(t, recs, 1)
+	assert.EqualValues(t, 3, recs[0].WID)
+	assert.Equal(t, 1, recs[0].Attempts)
+	assert.Contains(t, recs[0].Error, "410")
+	assert.Equal(t, "boom", recs[0].Payload.Event.Message)
+}
+
+func TestWebhookRetriesExhausted(t *testing.T) {
+	down, downURL := newReceiver(t, 500, 500, 500, 500)
+	dead := filepath.Join(t.TempDir(), "dead.log")
+	bus := newEventBus(8)
+	n := newWebhookNotifier(fakeHookStore{{WID: 9, Global: true, URL: downURL}}, 2, dead)
+	n.backoff = time.Millisecond
+	n.start(bus)
+
+	bus.publish(proto.Event{Type: proto.EventSaved, SID: 3, Username: "carol"})
+	require.Eventually(t, func() bool { return len(readDeadLetters(t, dead)) == 1 }, 5*time.Second, 10*time.Millisecond)
+	n.stop()
+	recs := readDeadLetters(t, dead)
+	assert.Equal(t, 3, recs[0].Attempts)
+	assert.Equal(t, proto.EventSaved, recs[0].Payload.Event.Type)
+	down.mu.Lock()
+	assert.Len(t, down.got, 3)
+	down.mu.Unlock()
+}
+
+func TestCheckWebhookRequest(t *testing.T) {
+	user := &HInfo{caller: caller{Name: "alice", Role: util.RoleUser}}
+	admin := &HInfo{caller: caller{Name: "root", Role: util.RoleAdmin}}
+	tests := []struct {
+		d    *HInfo
+		req  proto.AddWebhookRequest
+		code util.ErrorCode
+	}{
+		{user, proto.AddWebhookRequest{URL: "https://example.com/hook"}, ""},
+		{user, proto.AddWebhookRequest{URL: "https://example.com/hook", Events: []string{"completed", "expired"}}, ""},
+		{user, proto.AddWebhookRequest{URL: "ftp://example.com/hook"}, util.ErrBadRequest},
+		{user, proto.AddWebhookRequest{URL: "/hook"}, util.ErrBadRequest},
+		{user, proto.AddWebhookRequest{URL: "http://x", Events: []string{"booked"}}, util.ErrBadRequest},
+		{user, proto.AddWebhookRequest{URL: "http://x", Global: true}, util.ErrForbidden},
+		{admin, proto.AddWebhookRequest{URL: "http://x", Global: true}, ""},
+		{admin, proto.AddWebhookRequest{URL: "http://x", Global: true, SID: 4}, util.ErrBadRequest},
+	}
+	for i, tt := range tests {
+		err := checkWebhookRequest(tt.d, &tt.req)
+		if tt.code == "" {
+			assert.NoError(t, err, i)
+		} else {
+			assert.Equal(t, tt.code, util.CodeOf(err), i)
+		}
+	}
+}
+
+func TestLeaseChecker(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-2 * time.Hour)
+	l := newLeaseChecker(time.Hour)
+	items := []data.QueueItem{
+		{SID: 1, State: data.StateBooked, Modified: old},
+		{SID: 2, State: data.StateExecuting, Modified: now},
+		{SID: 3, State: data.StateQueued, Modified: old},
+		{SID: 4, State: data.StateExecuting, Modified: old},
+	}
+	expired := l.check(items, now)
+	require.Len(t, expired, 2)
+	assert.EqualValues(t, 1, expired[0].SID)
+	assert.EqualValues(t, 4, expired[1].SID)
+
+	//-----------------------------------------------------
+	// each lease is reported once; a renewed lease that
+	// runs out again is reported again
+	//-----------------------------------------------------
+	assert.Empty(t, l.check(items, now))
+	items[0].Modified = old.Add(time.Minute)
+	expired = l.check(items, now)
+	require.Len(t, expired, 1)
+	assert.EqualValues(t, 1, expired[0].SID)
+
+	//-----------------------------------------------------
+	// finished simulations are forgotten
+	//-----------------------------------------------------
+	l.check(items[:1], now)
+	assert.NotContains(t, l.reported, int64(4))
+}
+
+func TestWebhookQueueFull(t *testing.T) {
+	dead := filepath.Join(t.TempDir(), "dead.log")
+	dropped := deliveries("dropped")
+	n := newWebhookNotifier(fakeHookStore{}, 0, dead)
+
+	//-----------------------------------------------------
+	// with nothing taking events off the queue, the ones
+	// that do not fit are counted but not yet written
+	//-----------------------------------------------------
+	for i := 0; i < webhookQueueSize+2; i++ {
+		n.notify(&proto.Event{Type: proto.EventCompleted, SID: int64(i)})
+	}
+	assert.Equal(t, dropped+2, deliveries("dropped"))
+	assert.Empty(t, readDeadLetters(t, dead))
+
+	n.start(newEventBus(8))
+	require.Eventually(t, func() bool { return len(readDeadLetters(t, dead)) == 2 }, 5*time.Second, 10*time.Millisecond)
+	n.stop()
+	recs := readDeadLetters(t, dead)
+	require.Len(t, recs, 2)
+	assert.Contains(t, recs[0].Error, "queue is full")
+	assert.EqualValues(t, webhookQueueSize, recs[0].Payload.Event.SID)
+}
+
+func TestWebhookStopDrainsQueue(t *testing.T) {
+	dead := filepath.Join(t.TempDir(), "dead.log")
+	n := newWebhookNotifier(fakeHookStore{}, 0, dead)
+	for i := 0; i < 3; i++ {
+		n.notify(&proto.Event{Type: proto.EventCompleted, SID: int64(i)})
+	}
+	n.stop()
+	recs := readDeadLetters(t, dead)
+	require.Len(t, recs, 3)
+	assert.Contains(t, recs[0].Error, "shut down")
+}
@@ -0,0 +1,48 @@
+package proto
+
+import "time"
+
+// Alert rules
+const (
+	AlertOverdue     = "overdue"     // a simulation's DtEstimate passed without it completing
+	AlertStalled     = "stalled"     // a booked simulation has not been updated for a while
+	AlertSilent      = "silent"      // a machine has not been heard from for a while
+	AlertErrorRate   = "error-rate"  // too many of the recent simulations failed
+	AlertUnreachable = "unreachable" // the dispatcher cannot poll a running simulator
+)
+
+// Alert is a rule match that someone should look at. An alert stays open
+// while its condition holds and is raised again only after the condition
+// clears and comes back. Acknowledging it just marks it as seen.
+type Alert struct {
+	AID       int64
+	Rule      string
+	Subject   string    // what the alert is about: "SID 12", a machine ID, or "queue"
+	SID       int64     `json:",omitempty"`
+	MachineID string    `json:",omitempty"`
+	Message   string    // the latest description of the condition
+	Raised    time.Time // when the condition was first seen
+	LastSeen  time.Time // when the condition was last seen
+	AckedBy   string    `json:",omitempty"` // who acknowledged it, empty = not yet
+	AckedAt   time.Time `json:",omitempty"`
+}
+
+// AlertsRequest represents the data for the GetAlerts command
+type AlertsRequest struct {
+	All bool `json:",omitempty"` // include acknowledged alerts
+}
+
+// AckAlertRequest represents the data for the AckAlert command
+type AckAlertRequest struct {
+	AID int64
+}
+
+// HeartbeatRequest tells the dispatcher that a machine is alive
+type HeartbeatRequest struct {
+	MachineID   string
+	SIDs        []int64         `json:",omitempty"` // the simulations it is running
+	PausedSIDs  []int64         `json:",omitempty"` // those of SIDs whose simulators it stopped
+	RenicedSIDs []int64         `json:",omitempty"` // those of SIDs whose simulators it runs at a lower priority
+	Paused      bool            `json:",omitempty"` // it is not booking simulations
+	Profile     *MachineProfile `json:",omitempty"` // the machine's hardware
+}
@@ -0,0 +1,12 @@
+package proto
+
+// EmailEvents are the event types that users can get email about
+var EmailEvents = []string{EventSaved, EventError, EventExpired}
+
+// EmailPrefsRequest sets the caller's email preferences. An empty Email
+// turns their email off.
+type EmailPrefsRequest struct {
+	Email  string
+	Events []string `json:",omitempty"` // a subset of EmailEvents, empty = all
+	Digest bool     `json:",omitempty"` // send completions in a periodic digest
+}
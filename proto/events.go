@@ -0,0 +1,51 @@
+package proto
+
+import "time"
+
+// UserHeader names the caller of the REST routes and /events when API tokens
+// are not in use. With tokens, the token's name is used instead.
+const UserHeader = "X-Simq-User"
+
+// Queue event types
+const (
+	EventCreated   = "created"   // a simulation was added to the queue
+	EventBooked    = "booked"    // a machine booked a simulation
+	EventEstimate  = "estimate"  // the estimated completion time changed
+	EventCompleted = "completed" // the simulation finished running
+	EventSaved     = "saved"     // the results were stored
+	EventError     = "error"     // the simulation failed
+	EventDeleted   = "deleted"   // the simulation was removed from the queue
+	EventRequeued  = "requeued"  // a finished simulation was queued to run again
+	EventExpired   = "expired"   // a booked simulation's lease ran out, its machine may be gone
+)
+
+// Event is one change to the queue. The dispatcher streams events as
+// Server-Sent Events from /events, with the event's ID as the SSE id and its
+// Type as the SSE event name.
+type Event struct {
+	ID        int64 // increases by one per event, starting at 1 when the dispatcher starts
+	Type      string
+	Time      time.Time
+	SID       int64
+	Username  string `json:",omitempty"`
+	Campaign  string `json:",omitempty"`
+	Name      string `json:",omitempty"`
+	State     int    // the queue item's state after the change
+	MachineID string `json:",omitempty"`
+	Estimate  string `json:",omitempty"` // EventEstimate: the new estimated completion time
+	Message   string `json:",omitempty"` // EventError: what went wrong
+}
+
+// EventFilter selects events. Empty fields match everything.
+type EventFilter struct {
+	SID      int64
+	Username string
+	Campaign string
+}
+
+// Match reports whether e passes the filter
+func (f *EventFilter) Match(e *Event) bool {
+	return (f.SID == 0 || f.SID == e.SID) &&
+		(len(f.Username) == 0 || f.Username == e.Username) &&
+		(len(f.Campaign) == 0 || f.Campaign == e.Campaign)
+}
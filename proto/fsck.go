@@ -0,0 +1,66 @@
+package proto
+
+import (
+	"fmt"
+	"io"
+)
+
+// FsckRequest represents the data for the Fsck command
+type FsckRequest struct {
+	Repair bool
+}
+
+// FsckCategory lists the inconsistencies of one kind
+type FsckCategory struct {
+	Name        string
+	Description string
+	SIDs        []int64  `json:",omitempty"`
+	Paths       []string `json:",omitempty"`
+	Repairable  bool     // fsck -repair can fix these
+	Repaired    bool     // these were fixed
+}
+
+// FsckReport is the result of a consistency check
+type FsckReport struct {
+	Rows       int // number of rows in the Queue table
+	Configs    int // number of SID directories in qdconfigs
+	Results    int // number of SIDs in the result store
+	Categories []FsckCategory
+}
+
+// Problems returns the number of inconsistencies that remain
+// -----------------------------------------------------------------------------
+func (r *FsckReport) Problems() int {
+	n := 0
+	for _, c := range r.Categories {
+		if !c.Repaired {
+			n += len(c.SIDs) + len(c.Paths)
+		}
+	}
+	return n
+}
+
+// Print writes a human readable version of the report to w
+// -----------------------------------------------------------------------------
+func (r *FsckReport) Print(w io.Writer) {
+	fmt.Fprintf(w, "Queue rows: %d   qdconfigs: %d   results: %d\n", r.Rows, r.Configs, r.Results)
+	if len(r.Categories) == 0 {
+		fmt.Fprintf(w, "No inconsistencies found\n")
+		return
+	}
+	for _, c := range r.Categories {
+		status := "not repairable"
+		if c.Repaired {
+			status = "REPAIRED"
+		} else if c.Repairable {
+			status = "repairable with -repair"
+		}
+		fmt.Fprintf(w, "\n%s (%d) - %s [%s]\n", c.Name, len(c.SIDs)+len(c.Paths), c.Description, status)
+		for _, sid := range c.SIDs {
+			fmt.Fprintf(w, "    %d\n", sid)
+		}
+		for _, p := range c.Paths {
+			fmt.Fprintf(w, "    %s\n", p)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package proto
+
+import (
+	"fmt"
+	"time"
+)
+
+// MachineProfile describes the hardware of a machine that runs simulations.
+// simd detects it and sends it with every Book and Heartbeat.
+type MachineProfile struct {
+	CPUs              int    // logical CPUs
+	PhysicalCPUs      int    `json:",omitempty"` // CPU cores, 0 = unknown
+	MemoryMB          int64  // total memory
+	AvailableMemoryMB int64  `json:",omitempty"` // memory available without swapping, 0 = unknown
+	CPUArchitecture   string // Go's name for it: amd64, arm64, ...
+	OS                string // Go's name for it: linux, darwin, ...
+}
+
+// Memory returns the total memory in the form of
+// SimulationBookingRequest.Memory, e.g. "64GB", rounded to the nearest GB
+func (p *MachineProfile) Memory() string {
+	if p.MemoryMB >= 1024 {
+		return fmt.Sprintf("%dGB", (p.MemoryMB+512)/1024)
+	}
+	return fmt.Sprintf("%dMB", p.MemoryMB)
+}
+
+// String returns a one line summary of p
+func (p *MachineProfile) String() string {
+	cpus := fmt.Sprintf("%d CPUs", p.CPUs)
+	if p.PhysicalCPUs > 0 && p.PhysicalCPUs != p.CPUs {
+		cpus = fmt.Sprintf("%d CPUs (%d cores)", p.CPUs, p.PhysicalCPUs)
+	}
+	mem := p.Memory()
+	if p.AvailableMemoryMB > 0 {
+		mem = fmt.Sprintf("%s (%dMB available)", mem, p.AvailableMemoryMB)
+	}
+	return fmt.Sprintf("%s %s, %s, %s", p.OS, p.CPUArchitecture, cpus, mem)
+}
+
+// LoadStatus is what simd last measured of its machine's load, and what it
+// decided from it
+type LoadStatus struct {
+	Sampled           time.Time
+	Load1             float64  // 1-minute load average
+	CPUPercent        float64  // CPU utilization of the whole machine
+	OtherCPUPercent   float64  // CPU utilization of everything but simd's simulators
+	AvailableMemoryMB int64    // memory available without swapping
+	CanBook           bool     // the load allows booking another simulation
+	Reasons           []string `json:",omitempty"` // why booking is held back
+	UserActive        bool     // someone else is using the machine
+	Yield             string   `json:",omitempty"` // what is done to the simulators while they are
+}
@@ -0,0 +1,118 @@
+package proto
+
+import (
+	"time"
+
+	"github.com/stmansour/simq/util"
+)
+
+// SvcStatus201 is a simple status message for use when a new resource is
+// created, and the reply to the commands that act on one queue item
+type SvcStatus201 struct {
+	Status  string
+	Code    util.ErrorCode `json:",omitempty"` // set when a success needs explaining, e.g. QUEUE_EMPTY
+	Message string
+	ID      int64
+}
+
+// CreateQueueEntryRequest represents the data for creating a queue entry. The
+// config file is sent as the "file" part of a multipart request.
+type CreateQueueEntryRequest struct {
+	FileContent      string `json:",omitempty"`
+	Name             string
+	Priority         int
+	Description      string
+	URL              string
+	Campaign         string `json:",omitempty"` // groups related simulations, e.g. for psq watch -campaign
+	Executor         string `json:",omitempty"` // the simd executor to run it with, e.g. "v3"
+	OriginalFilename string
+}
+
+// MachineQueueRequest represents the data for getting a machine's queue
+type MachineQueueRequest struct {
+	MachineID string
+}
+
+// GetSIDRequest represents the data for getting a simulation ID
+type GetSIDRequest struct {
+	SID int64
+}
+
+// DeleteItemRequest represents the data for deleting a queue item, and for
+// redoing one
+type DeleteItemRequest struct {
+	SID int64
+}
+
+// PriorityRequest represents the data for setting the priority of a queue item
+type PriorityRequest struct {
+	SID      int64
+	Priority int
+}
+
+// UpdateItemRequest represents the data for updating a queue item. Fields
+// that are left out of the message are not changed, so senders leave zero
+// values out.
+type UpdateItemRequest struct {
+	SID         int64
+	Priority    int    `json:",omitempty"`
+	Description string `json:",omitempty"`
+	MachineID   string `json:",omitempty"`
+	URL         string `json:",omitempty"`
+	DtEstimate  string `json:",omitempty"`
+	DtCompleted string `json:",omitempty"`
+	CPUs        int    `json:",omitempty"`
+	Memory      string `json:",omitempty"`
+	Error       string `json:",omitempty"` // the simulation failed with this message
+}
+
+// SimulationBookingRequest represents the data for booking a simulation.
+// CPUs, Memory and CPUArchitecture repeat what is in Profile for older
+// dispatchers.
+type SimulationBookingRequest struct {
+	MachineID       string
+	CPUs            int
+	Memory          string
+	CPUArchitecture string
+	Availability    string
+	Profile         *MachineProfile `json:",omitempty"` // the machine's hardware
+	Executors       []string        `json:",omitempty"` // the executors the machine has. Without them it only gets jobs that name none.
+}
+
+// SimulationRebookRequest represents the data for rebooking a simulation
+type SimulationRebookRequest struct {
+	SID       int64
+	MachineID string
+}
+
+// BookedResponse is the "json" part of the multipart reply to Book and
+// Rebook. The "file" part is the simulation's config file.
+type BookedResponse struct {
+	Status         string
+	Message        string
+	SID            int64
+	ConfigFilename string
+	Executor       string `json:",omitempty"` // the executor the job asked for, empty = the machine's default
+}
+
+// EndSimulationRequest is the request for ending a simulation. Unlike the
+// other commands its arguments are next to Command rather than in Data. The
+// results archive is sent as the "file" part of a multipart request.
+type EndSimulationRequest struct {
+	Command
+	SID      int64  // simulation ID that has ended
+	Filename string // the tar.gz file that contains the results
+}
+
+// ResultsRequest represents the data for the ListResults and GetResults commands
+type ResultsRequest struct {
+	SID      int64
+	Filename string `json:",omitempty"` // GetResults only. Empty means "all files as a tar.gz"
+}
+
+// ResultFileInfo describes one file stored in the results repository for a SID
+type ResultFileInfo struct {
+	Name     string // path relative to the SID directory
+	Size     int64
+	Modified time.Time
+}
@@ -0,0 +1,91 @@
+// Package proto holds the messages exchanged by psq, simd and the dispatcher,
+// and the version of the protocol they speak. Both ends of a connection use
+// these types so that they cannot drift apart.
+package proto
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Protocol versions. A request carries the ProtocolVersion of the program
+// that sent it. The dispatcher serves requests from MinProtocolVersion up to
+// its own ProtocolVersion and refuses the rest. Requests without a version
+// come from programs built before versioning and are treated as version 1.
+//
+// Bump ProtocolVersion whenever a message changes in a way an older peer
+// would misread, and raise MinProtocolVersion when support for an old
+// version is dropped.
+const (
+	ProtocolVersion    = 2
+	MinProtocolVersion = 1
+)
+
+// Command is the envelope of every request sent to the dispatcher's /command
+// endpoint. Data holds the command's own request message.
+type Command struct {
+	Command       string
+	Username      string
+	Data          json.RawMessage
+	CorrelationID string `json:",omitempty"` // used if the X-Correlation-ID header is missing
+	Protocol      int    `json:",omitempty"` // ProtocolVersion of the sender
+	ClientVersion string `json:",omitempty"` // util.Version() of the sender
+}
+
+// Version returns the protocol version of cmd
+// -----------------------------------------------------------------------------
+func (cmd *Command) Version() int {
+	if cmd.Protocol == 0 {
+		return 1
+	}
+	return cmd.Protocol
+}
+
+// CheckVersion returns an error if the dispatcher cannot serve cmd's
+// protocol version
+// -----------------------------------------------------------------------------
+func (cmd *Command) CheckVersion() error {
+	v := cmd.Version()
+	if v < MinProtocolVersion || v > ProtocolVersion {
+		who := "client"
+		if len(cmd.ClientVersion) > 0 {
+			who = "client " + cmd.ClientVersion
+		}
+		return fmt.Errorf("%s speaks protocol version %d, the dispatcher supports versions %d to %d; upgrade the older program",
+			who, v, MinProtocolVersion, ProtocolVersion)
+	}
+	return nil
+}
+
+// Capabilities is the reply data of the Capabilities command. It tells a
+// client which protocol versions, commands and optional features the
+// dispatcher supports.
+type Capabilities struct {
+	ProtocolVersion    int
+	MinProtocolVersion int
+	Version            string   // util.Version() of the dispatcher
+	Commands           []string // the commands in the handler table, sorted
+	Features           []string // optional features that are turned on, e.g. auth, tls, s3
+}
+
+// Has reports whether the dispatcher supports command
+// -----------------------------------------------------------------------------
+func (c *Capabilities) Has(command string) bool {
+	for _, s := range c.Commands {
+		if s == command {
+			return true
+		}
+	}
+	return false
+}
+
+// Compatible returns an error if a client speaking ProtocolVersion cannot
+// talk to the dispatcher that sent c
+// -----------------------------------------------------------------------------
+func (c *Capabilities) Compatible() error {
+	if ProtocolVersion < c.MinProtocolVersion || ProtocolVersion > c.ProtocolVersion {
+		return fmt.Errorf("this program speaks protocol version %d, dispatcher %s supports versions %d to %d",
+			ProtocolVersion, c.Version, c.MinProtocolVersion, c.ProtocolVersion)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package proto
+
+import (
+	"time"
+
+	"github.com/stmansour/simq/util"
+)
+
+// SimulatorStatus is the reply of a simulator's simtalk /status endpoint
+type SimulatorStatus struct {
+	ProgramStarted         string
+	RunDuration            string
+	ConfigFile             string
+	SimulationDateRange    string
+	LoopCount              int
+	GenerationsRequested   int
+	CompletedLoops         int
+	CompletedGenerations   int // generations done in the current loop
+	ElapsedTimeLastGen     string
+	EstimatedTimeRemaining string
+	EstimatedCompletion    string
+}
+
+// Generations returns the number of generations done so far, over all loops
+func (s *SimulatorStatus) Generations() int {
+	return s.CompletedLoops*s.GenerationsRequested + s.CompletedGenerations
+}
+
+// Estimate returns the EstimatedCompletion as a time
+func (s *SimulatorStatus) Estimate() (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, s.EstimatedCompletion)
+	if err != nil {
+		t, err = util.StringToDate(s.EstimatedCompletion)
+	}
+	return t, err
+}
+
+// Percent returns how much of the simulation is done, from 0 to 100, or -1
+// if the status does not tell
+func (s *SimulatorStatus) Percent() float64 {
+	if s.LoopCount <= 0 || s.GenerationsRequested <= 0 {
+		return -1
+	}
+	total := s.LoopCount * s.GenerationsRequested
+	done := s.Generations()
+	if done >= total {
+		return 100
+	}
+	return 100 * float64(done) / float64(total)
+}
+
+// Progress is what the dispatcher knows about how far along a running
+// simulation is
+type Progress struct {
+	SID      int64
+	Percent  float64         // 0 to 100, -1 if unknown
+	Status   SimulatorStatus // the simulator's latest status
+	Polled   time.Time       // when the simulator last answered
+	Failures int             `json:",omitempty"` // polls in a row that the simulator did not answer
+	Error    string          `json:",omitempty"` // why the last poll failed
+}
+
+// ProgressSample is a status snapshot of a simulator, as stored by the
+// dispatcher. Only the fields that describe progress are kept.
+type ProgressSample struct {
+	SimulatorStatus
+	Recorded time.Time // when it was taken
+	Source   string    // who took it: "simd" or "poll"
+}
+
+// ReportProgressRequest is sent by simd with each new status snapshot of a
+// running simulator
+type ReportProgressRequest struct {
+	SID    int64
+	Status SimulatorStatus
+}
+
+// ProgressRequest represents the data for the GetProgress command
+type ProgressRequest struct {
+	SID int64
+}
+
+// ProgressReport is the reply to GetProgress: the progress samples of a
+// simulation and what they add up to
+type ProgressReport struct {
+	SID           int64
+	Percent       float64   // from the latest sample, -1 if unknown
+	GensPerHour   float64   // generations per hour over the samples, 0 if unknown
+	FirstEstimate time.Time // the estimated completion in the first sample that had one
+	Estimate      time.Time // the latest estimated completion
+	Latest        *Progress `json:",omitempty"` // the latest poll, while the simulation runs
+	Samples       []ProgressSample
+}
+
+// Drift returns how far the estimated completion moved since the first
+// estimate; positive means later. It is 0 without two estimates.
+func (r *ProgressReport) Drift() time.Duration {
+	if r.FirstEstimate.IsZero() || r.Estimate.IsZero() {
+		return 0
+	}
+	return r.Estimate.Sub(r.FirstEstimate)
+}
@@ -0,0 +1,56 @@
+package proto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// Headers sent with every webhook delivery
+const (
+	WebhookEventHeader     = "X-Simq-Event"     // the event type
+	WebhookDeliveryHeader  = "X-Simq-Delivery"  // unique per delivery, the same for its retries
+	WebhookSignatureHeader = "X-Simq-Signature" // "sha256=" + hex HMAC-SHA256 of the body, if the webhook has a secret
+)
+
+// WebhookEvents are the event types that webhooks can subscribe to
+var WebhookEvents = []string{EventCompleted, EventSaved, EventError, EventExpired}
+
+// AddWebhookRequest represents the data for adding a webhook. Users may add
+// webhooks for their own simulations; only admins may add Global ones.
+type AddWebhookRequest struct {
+	URL    string
+	Secret string   `json:",omitempty"`
+	SID    int64    `json:",omitempty"` // only this simulation
+	Global bool     `json:",omitempty"` // every simulation
+	Events []string `json:",omitempty"` // a subset of WebhookEvents, empty = all
+}
+
+// WebhookRequest represents the data for deleting a webhook
+type WebhookRequest struct {
+	WID int64
+}
+
+// WebhookPayload is the body of a webhook delivery
+type WebhookPayload struct {
+	Delivery string // same as the WebhookDeliveryHeader
+	WID      int64  // the webhook being delivered to
+	Event    Event
+}
+
+// SignWebhook returns the signature header value for body
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook reports whether sig, the signature header of a delivery, is
+// valid for body. Receivers should call it before trusting a payload.
+func VerifyWebhook(secret string, body []byte, sig string) bool {
+	if !strings.HasPrefix(sig, "sha256=") {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(SignWebhook(secret, body)))
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// listAlerts prints the open alerts.
+//
+//	alerts [-all]
+//
+// --------------------------------------------------------------------
+func listAlerts(cmd *CmdData, args []string) {
+	fs := flag.NewFlagSet("alerts", flag.ContinueOnError)
+	all := fs.Bool("all", false, "include acknowledged alerts")
+	fs.SetOutput(os.Stdout)
+	if err := fs.Parse(args); err != nil {
+		return
+	}
+	if fs.NArg() > 0 {
+		fmt.Println("Error: usage: alerts [-all]")
+		return
+	}
+	list, err := dispatcher(cmd).GetAlerts(context.Background(), *all)
+	if err != nil {
+		printError(err)
+		return
+	}
+	if len(list) == 0 {
+		fmt.Println("No open alerts")
+		return
+	}
+	fmt.Printf("%5s  %-10s  %-16s  %-16s  %-10s  %s\n", "AID", "Rule", "Subject", "Raised", "Acked", "Message")
+	for _, a := range list {
+		acked := a.AckedBy
+		if len(acked) == 0 {
+			acked = "-"
+		}
+		fmt.Printf("%5d  %-10s  %-16s  %-16s  %-10s  %s\n", a.AID, a.Rule, truncateMiddle(a.Subject, 16),
+			a.Raised.Local().Format("2006-01-02 15:04"), truncateMiddle(acked, 10), a.Message)
+	}
+}
+
+// ackAlert acknowledges an alert
+// --------------------------------------------------------------------
+func ackAlert(cmd *CmdData, args []string) {
+	aid, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		fmt.Printf("Error: invalid alert ID: %s\n", args[0])
+		return
+	}
+	st, err := dispatcher(cmd).AckAlert(context.Background(), aid)
+	if err != nil {
+		printError(err)
+		return
+	}
+	fmt.Printf("Alert %d: %s\n", st.ID, st.Message)
+}
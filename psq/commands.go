@@ -1,8 +1,8 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -11,35 +11,18 @@ import (
 	"time"
 	"unicode/utf8"
 
+	"github.com/stmansour/simq/client"
 	"github.com/stmansour/simq/data"
+	"github.com/stmansour/simq/proto"
 	"github.com/stmansour/simq/util"
 	"github.com/yosuke-furukawa/json5/encoding/json5"
 )
 
-// CreateQueueEntryRequest represents the data for creating a queue entry
-type CreateQueueEntryRequest struct {
-	FileContent      string
-	OriginalFilename string
-	Name             string
-	Priority         int
-	Description      string
-	URL              string
-}
-
-// CmdGetSID represents the structure of a command
-type CmdGetSID struct {
-	SID int64
-}
-
-// CmdSetPriority represents the structure of a command
-type CmdSetPriority struct {
-	SID      int64
-	Priority int
-}
-
 // Config represents the structure of a config
 type Config struct {
 	SimulationName string
+	Campaign       string // optional, groups related simulations
+	Executor       string // optional, the simd executor to run it with, e.g. "v3"
 	Username       string
 	Data           []byte
 }
@@ -51,85 +34,39 @@ const (
 // setPriority sets the priority for the specified simulation ID
 // --------------------------------------------------------------------
 func setPriority(cmd *CmdData, args []string) {
-	var err error
-	var csp CmdSetPriority
-	csp.SID, err = strconv.ParseInt(args[0], 10, 64)
+	sid, err := strconv.ParseInt(args[0], 10, 64)
 	if err != nil {
 		fmt.Printf("Error: invalid simulation ID: %s\n.", args[0])
 		return
 	}
 
 	// convert arg[1] to an int
-	csp.Priority, err = strconv.Atoi(args[1])
+	priority, err := strconv.Atoi(args[1])
 	if err != nil {
 		fmt.Printf("Error: invalid priority: %s\n.", args[01])
 		return
 	}
 
-	dataBytes, _ := json.Marshal(&csp)
-
-	command := util.Command{
-		Command:  "Priority",
-		Username: cmd.Username,
-		Data:     json.RawMessage(dataBytes),
-	}
-
-	respBytes := util.SendRequest(app.DispatcherURL, &command)
-	var resp struct {
-		Status string
-	}
-	err = json.Unmarshal(respBytes, &resp)
-	if err != nil {
-		fmt.Printf("Error unmarshaling response: %s\n", err.Error())
-		return
-	}
-	if resp.Status != "success" {
-		fmt.Printf("Error: Response status: %s\n", resp.Status)
-		return
+	if _, err := dispatcher(cmd).SetPriority(context.Background(), sid, priority); err != nil {
+		printError(err)
 	}
-
 }
 
 // getSID reads the queue details for the specified simulation ID
 // --------------------------------------------------------------------
 func getSID(cmd *CmdData, args []string) {
-	var err error
-	var databt CmdGetSID
-	databt.SID, err = strconv.ParseInt(args[0], 10, 64)
+	sid, err := strconv.ParseInt(args[0], 10, 64)
 	if err != nil {
 		fmt.Printf("Error: invalid simulation ID: %s\n.", args[0])
 		return
 	}
 
-	dataBytes, err := json.Marshal(databt)
-	if err != nil {
-		fmt.Printf("Error marshaling ID: %s\n.", err.Error())
-		return
-	}
-	command := util.Command{
-		Command:  "GetSID",
-		Username: cmd.Username,
-		Data:     json.RawMessage(dataBytes),
-	}
-
-	respBytes := util.SendRequest(app.DispatcherURL, &command)
-	var resp struct {
-		Status string
-		Data   data.QueueItem
-	}
-
-	err = json.Unmarshal(respBytes, &resp)
+	item, err := dispatcher(cmd).GetSID(context.Background(), sid)
 	if err != nil {
-		fmt.Printf("Error unmarshaling response: %s\n", err.Error())
+		printError(err)
 		return
 	}
-
-	if resp.Status != "success" {
-		fmt.Printf("Error: Response status: %s\n", resp.Status)
-		return
-	}
-
-	printSimulationStatus(&resp.Data)
+	printSimulationStatus(item)
 }
 
 func addJob(cmd *CmdData, args []string) {
@@ -140,28 +77,19 @@ func addJob(cmd *CmdData, args []string) {
 		return
 	}
 
-	data := CreateQueueEntryRequest{
+	req := proto.CreateQueueEntryRequest{
 		OriginalFilename: filepath.Base(file),
 		Name:             config.SimulationName,
+		Campaign:         config.Campaign,
+		Executor:         config.Executor,
 		Priority:         defaultPriority,
-		Description:      "",
-		URL:              "",
 	}
-
-	dataBytes, _ := json.Marshal(data)
-	command := util.Command{
-		Command:  "NewSimulation",
-		Username: cmd.Username,
-		Data:     json.RawMessage(dataBytes),
-	}
-
-	resp, err := util.SendMultipartRequest(app.DispatcherURL, &command, file)
+	sid, err := dispatcher(cmd).NewSimulation(context.Background(), &req, file)
 	if err != nil {
-		fmt.Printf("Error sending request: %v\n", err)
-	}
-	if resp != nil {
-		fmt.Printf("Add Job Response: %s\n", string(resp))
+		printError(err)
+		return
 	}
+	fmt.Printf("Added simulation %q as SID %d\n", config.SimulationName, sid)
 }
 
 func readConfig(file string) (Config, error) {
@@ -176,19 +104,13 @@ func readConfig(file string) (Config, error) {
 }
 
 func listJobs(cmd *CmdData, args []string) {
-	command := util.Command{
-		Command:  "GetActiveQueue",
-		Username: cmd.Username,
-	}
-	listCore(&command)
+	items, err := dispatcher(cmd).GetActiveQueue(context.Background())
+	listCore(items, err, true)
 }
 
 func listDoneJobs(cmd *CmdData, args []string) {
-	command := util.Command{
-		Command:  "GetCompletedQueue",
-		Username: cmd.Username,
-	}
-	listCore(&command)
+	items, err := dispatcher(cmd).GetCompletedQueue(context.Background())
+	listCore(items, err, false)
 }
 
 // QueueItem is an item in the queue
@@ -219,27 +141,19 @@ const (
 	nameWidth      = 25
 )
 
-// listCore is the core function for listing jobs
-func listCore(command *util.Command) {
-	body := util.SendRequest(app.DispatcherURL, command)
-
-	resp := struct {
-		Status string
-		Data   []data.QueueItem
-	}{}
-
-	err := json.Unmarshal(body, &resp)
+// listCore prints the queue items returned by GetActiveQueue (DtIsEstimate)
+// or GetCompletedQueue
+func listCore(items []data.QueueItem, err error, DtIsEstimate bool) {
 	if err != nil {
-		if strings.Contains(err.Error(), "unexpected end of JSON input") {
-			fmt.Printf("No jobs found\n")
-			return
-		}
-		fmt.Printf("Error unmarshalling response: %v\n", err)
+		printError(err)
+		return
+	}
+	if len(items) == 0 {
+		fmt.Printf("No jobs found\n")
 		return
 	}
 	states := []string{"Qd", "Bk", "Ex", "Fn", "Ar", "Er"}
 
-	DtIsEstimate := command.Command == "GetActiveQueue"
 	DtCN := "Estimate"
 	if !DtIsEstimate {
 		DtCN = "Completed"
@@ -283,7 +197,7 @@ func listCore(command *util.Command) {
 	fmt.Print(rightT + "\n")
 
 	// Print data rows
-	for _, item := range resp.Data {
+	for _, item := range items {
 		dt := ""
 		if DtIsEstimate {
 			if item.DtEstimate.Valid {
@@ -333,30 +247,12 @@ func deleteJob(cmd *CmdData, args []string) {
 	}
 	cmd.SID = sid
 
-	data := struct {
-		SID int64
-	}{
-		SID: cmd.SID,
-	}
-
-	dataBytes, _ := json.Marshal(data)
-	command := util.Command{
-		Command:  "DeleteItem",
-		Username: cmd.Username,
-		Data:     json.RawMessage(dataBytes),
-	}
-
-	resp := util.SendRequest(app.DispatcherURL, &command)
-	if resp != nil {
-		var msg struct {
-			Status  string
-			Message string
-			ID      int64
-		}
-		json.Unmarshal(resp, &msg)
-		fmt.Printf("SID %d: %s\n", msg.ID, msg.Message)
+	st, err := dispatcher(cmd).DeleteItem(context.Background(), cmd.SID)
+	if err != nil {
+		printError(err)
+		return
 	}
-
+	fmt.Printf("SID %d: %s\n", st.ID, st.Message)
 }
 
 func handleRedo(cmd *CmdData, args []string) {
@@ -367,27 +263,31 @@ func handleRedo(cmd *CmdData, args []string) {
 	}
 	cmd.SID = sid
 
-	data := struct {
-		SID int64
-	}{
-		SID: cmd.SID,
+	st, err := dispatcher(cmd).Redo(context.Background(), cmd.SID)
+	if err != nil {
+		printError(err)
+		return
 	}
+	fmt.Printf("SID %d: %s\n", st.ID, st.Message)
+}
 
-	dataBytes, _ := json.Marshal(data)
-	command := util.Command{
-		Command:  "Redo",
-		Username: cmd.Username,
-		Data:     json.RawMessage(dataBytes),
-	}
+// dispatcher returns a client for the current dispatcher URL
+// --------------------------------------------------------------------
+func dispatcher(cmd *CmdData) *client.Client {
+	return client.New(app.DispatcherURL, cmd.Username)
+}
 
-	resp := util.SendRequest(app.DispatcherURL, &command)
-	if resp != nil {
-		var msg struct {
-			Status  string
-			Message string
-			ID      int64
-		}
-		json.Unmarshal(resp, &msg)
-		fmt.Printf("SID %d: %s\n", msg.ID, msg.Message)
+// printError prints an error returned by the dispatcher client
+// --------------------------------------------------------------------
+func printError(err error) {
+	switch util.CodeOf(err) {
+	case util.ErrUnauthorized:
+		fmt.Printf("Error: %s. Put your APIToken in ~/.psqrc\n", err.Error())
+	case util.ErrForbidden:
+		fmt.Printf("Permission denied: %s\n", err.Error())
+	case util.ErrNotFound:
+		fmt.Printf("Not found: %s\n", err.Error())
+	default:
+		fmt.Printf("Error: %s\n", err.Error())
 	}
 }
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/stmansour/simq/proto"
+)
+
+const emailUsage = "Error: usage: email [<address> [-events e1,e2] [-digest] | off]"
+
+// handleEmail shows or sets the user's email preferences.
+//
+//	email                                 show the current settings
+//	email <address> [-events saved,error,expired] [-digest]
+//	email off
+//
+// --------------------------------------------------------------------
+func handleEmail(cmd *CmdData, args []string) {
+	ctx := context.Background()
+	if len(args) == 0 {
+		pref, err := dispatcher(cmd).GetEmailPrefs(ctx)
+		if err != nil {
+			printError(err)
+			return
+		}
+		if len(pref.Email) == 0 {
+			fmt.Println("Email is off")
+			return
+		}
+		events := pref.Events
+		if len(events) == 0 {
+			events = strings.Join(proto.EmailEvents, ",")
+		}
+		fmt.Printf("Email:  %s\nEvents: %s\nDigest: %v\n", pref.Email, events, pref.Digest)
+		return
+	}
+
+	var req proto.EmailPrefsRequest
+	if args[0] != "off" {
+		fs := flag.NewFlagSet("email", flag.ContinueOnError)
+		evts := fs.String("events", "", "comma separated events: "+strings.Join(proto.EmailEvents, ","))
+		digest := fs.Bool("digest", false, "send completions in a periodic digest")
+		fs.SetOutput(os.Stdout)
+		if strings.HasPrefix(args[0], "-") {
+			fmt.Println(emailUsage)
+			return
+		}
+		if err := fs.Parse(args[1:]); err != nil {
+			return
+		}
+		req.Email = args[0]
+		req.Digest = *digest
+		if len(*evts) > 0 {
+			req.Events = strings.Split(*evts, ",")
+		}
+	} else if len(args) > 1 {
+		fmt.Println(emailUsage)
+		return
+	}
+	st, err := dispatcher(cmd).SetEmailPrefs(ctx, &req)
+	if err != nil {
+		printError(err)
+		return
+	}
+	fmt.Println(st.Message)
+}
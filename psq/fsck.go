@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// runFsck asks the dispatcher to cross-check the Queue table, qdconfigs and
+// the result store, and prints the report.
+//
+//	fsck [-repair]
+//
+// --------------------------------------------------------------------
+func runFsck(cmd *CmdData, args []string) {
+	repair := false
+	for _, a := range args {
+		switch a {
+		case "-repair", "--repair":
+			repair = true
+		default:
+			fmt.Println("Error: usage: fsck [-repair]")
+			return
+		}
+	}
+	r, err := dispatcher(cmd).Fsck(context.Background(), repair)
+	if err != nil {
+		printError(err)
+		return
+	}
+
+	r.Print(os.Stdout)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/stmansour/simq/proto"
+)
+
+const hookUsage = "Error: usage: hook add <url> [-sid N] [-secret S] [-events e1,e2] [-global] | hook list | hook delete <wid>"
+
+// handleHooks manages webhooks.
+//
+//	hook add <url> [-sid N] [-secret S] [-events completed,saved,error,expired] [-global]
+//	hook list
+//	hook delete <wid>
+//
+// --------------------------------------------------------------------
+func handleHooks(cmd *CmdData, args []string) {
+	if len(args) == 0 {
+		fmt.Println(hookUsage)
+		return
+	}
+	switch args[0] {
+	case "add":
+		addHook(cmd, args[1:])
+	case "list", "ls":
+		listHooks(cmd)
+	case "delete", "del", "rm":
+		if len(args) != 2 {
+			fmt.Println(hookUsage)
+			return
+		}
+		wid, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			fmt.Printf("Error: invalid webhook ID: %s\n", args[1])
+			return
+		}
+		st, err := dispatcher(cmd).DeleteWebhook(context.Background(), wid)
+		if err != nil {
+			printError(err)
+			return
+		}
+		fmt.Printf("Webhook %d: %s\n", st.ID, st.Message)
+	default:
+		fmt.Println(hookUsage)
+	}
+}
+
+// addHook adds a webhook
+// --------------------------------------------------------------------
+func addHook(cmd *CmdData, args []string) {
+	fs := flag.NewFlagSet("hook add", flag.ContinueOnError)
+	sid := fs.Int64("sid", 0, "only this simulation")
+	secret := fs.String("secret", "", "sign deliveries with this HMAC key")
+	evts := fs.String("events", "", "comma separated events: "+strings.Join(proto.WebhookEvents, ","))
+	global := fs.Bool("global", false, "every simulation (admins only)")
+	fs.SetOutput(os.Stdout)
+
+	//-------------------------------------------------------------
+	// the url may come before or after the options
+	//-------------------------------------------------------------
+	var u string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		u = args[0]
+		args = args[1:]
+	}
+	if err := fs.Parse(args); err != nil {
+		return
+	}
+	if len(u) == 0 && fs.NArg() > 0 {
+		u = fs.Arg(0)
+	}
+	if len(u) == 0 {
+		fmt.Println(hookUsage)
+		return
+	}
+
+	req := proto.AddWebhookRequest{URL: u, Secret: *secret, SID: *sid, Global: *global}
+	if len(*evts) > 0 {
+		req.Events = strings.Split(*evts, ",")
+	}
+	wid, err := dispatcher(cmd).AddWebhook(context.Background(), &req)
+	if err != nil {
+		printError(err)
+		return
+	}
+	fmt.Printf("Added webhook %d\n", wid)
+}
+
+// listHooks prints the caller's webhooks
+// --------------------------------------------------------------------
+func listHooks(cmd *CmdData) {
+	hooks, err := dispatcher(cmd).ListWebhooks(context.Background())
+	if err != nil {
+		printError(err)
+		return
+	}
+	if len(hooks) == 0 {
+		fmt.Println("No webhooks")
+		return
+	}
+	fmt.Printf("%6s  %-12s  %-10s  %-24s  %s\n", "WID", "Owner", "Covers", "Events", "URL")
+	for _, h := range hooks {
+		covers := "mine"
+		switch {
+		case h.Global:
+			covers = "all"
+		case h.SID > 0:
+			covers = fmt.Sprintf("SID %d", h.SID)
+		}
+		events := h.Events
+		if len(events) == 0 {
+			events = "all"
+		}
+		fmt.Printf("%6d  %-12s  %-10s  %-24s  %s\n", h.WID, truncateMiddle(h.Username, 12), covers, events, h.URL)
+	}
+}
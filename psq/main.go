@@ -1,8 +1,10 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"log"
 	"net/url"
 	"os"
@@ -25,7 +27,7 @@ type CmdData struct {
 // DCommand represents the structure of a command
 type DCommand struct {
 	Command  string
-	ArgCount int
+	ArgCount int // number of arguments required, -1 means the handler checks them
 	Handler  func(*CmdData, []string)
 	Help     string
 }
@@ -39,6 +41,8 @@ var app struct {
 	cwd            string
 	version        bool
 	SimdURL        string
+	APIToken       string         // sent to the dispatcher to identify this user
+	TLS            util.TLSConfig // CA pin and client certificate for https
 }
 
 // Commands represents the list of commands
@@ -47,21 +51,31 @@ var Commands []DCommand
 func init() {
 	Commands = []DCommand{
 		{Command: "a|add", ArgCount: 1, Handler: addJob, Help: "add <filename> - add a simulation to the queue"},
+		{Command: "ack", ArgCount: 1, Handler: ackAlert, Help: "ack <aid> - acknowledge an alert"},
+		{Command: "alerts", ArgCount: -1, Handler: listAlerts, Help: "alerts [-all] - list the open alerts"},
 		{Command: "delete", ArgCount: 1, Handler: deleteJob, Help: "delete <sid> - delete a simulation from the queue"},
 		{Command: "disp|dispatcher", ArgCount: 1, Handler: setDispatcherURL, Help: "dispatcher <url> - Set the URL for the dispatcher"},
+		{Command: "dp|d-pause|dispatcher-pause", ArgCount: 0, Handler: PauseDispatcher, Help: "tell the dispatcher to stop handing out simulations"},
+		{Command: "dr|d-resume|dispatcher-resume", ArgCount: 0, Handler: ResumeDispatcher, Help: "tell the dispatcher to resume handing out simulations"},
 		{Command: "d|done", ArgCount: 0, Handler: listDoneJobs, Help: "List completed simulations"},
+		{Command: "email", ArgCount: -1, Handler: handleEmail, Help: "email [<address> [-events e1,e2] [-digest] | off] - show or set email about your simulations"},
 		{Command: "e|exit|q|quit", ArgCount: 0, Handler: handleExit, Help: "Exit the program"},
+		{Command: "fsck", ArgCount: -1, Handler: runFsck, Help: "fsck [-repair] - check the dispatcher's queue, configs and results for inconsistencies"},
+		{Command: "hook|webhook", ArgCount: -1, Handler: handleHooks, Help: "hook add <url> [-sid N] [-secret S] [-events e1,e2] [-global] | hook list | hook delete <wid> - manage webhooks"},
 		{Command: "help|?", ArgCount: 0, Handler: handleHelp, Help: "Show this help message"},
 		{Command: "i|info", ArgCount: 0, Handler: handleInfo, Help: "Show psq's internal settings"},
 		{Command: "l|list", ArgCount: 0, Handler: listJobs, Help: "List pending simulations"},
 		{Command: "loc|local", ArgCount: 0, Handler: handleLocal, Help: "switch to a local dispatcher (for development testing only)"},
 		{Command: "p|pri|priority", ArgCount: 2, Handler: setPriority, Help: "priority <sid> <priority> - set the priority for <sid> to <priority>"},
+		{Command: "prog|progress", ArgCount: -1, Handler: showProgress, Help: "progress <sid> [-samples] - show how far along a simulation is, its generation rate and estimate drift"},
 		{Command: "q|quit", ArgCount: 0, Handler: handleExit, Help: "Exit the program"},
 		{Command: "r|redo", ArgCount: 1, Handler: handleRedo, Help: "redo <sid> - redo simulation <sid>"},
+		{Command: "res|results", ArgCount: -1, Handler: getResults, Help: "results <sid> [-o dir] [--file name] [--list] - download the results for <sid>"},
 		{Command: "sp|s-pause|simd-pause", ArgCount: 0, Handler: PauseBooking, Help: "tell simd to stop booking simulations"},
 		{Command: "sr|s-resume|simd-resume", ArgCount: 0, Handler: ResumeBooking, Help: "tell simd to stop booking simulations"},
 		{Command: "ss|s-status|simd-status", ArgCount: 0, Handler: GetSimdStatus, Help: "contact simd and show its status"},
 		{Command: "sid", ArgCount: 1, Handler: getSID, Help: "sid <sid> - list details for a simulation ID. Also works with just <sid>."},
+		{Command: "w|watch", ArgCount: -1, Handler: watchQueue, Help: "watch [-sid N] [-user name] [-campaign name] [-mine] - show queue changes as they happen"},
 	}
 }
 
@@ -81,13 +95,18 @@ func main() {
 	flag.BoolVar(&app.version, "v", false, "print the program version string")
 
 	if err := util.LoadHomeDirConfig(".psqrc", &app); err != nil {
-		if !strings.Contains(err.Error(), "no such file or directory") {
+		if !errors.Is(err, fs.ErrNotExist) {
 			fmt.Printf("Error loading config file: %v\n", err)
 			return
 		}
 	}
 
 	flag.Parse()
+	util.SetAuthToken(app.APIToken)
+	if err := util.SetClientTLS(&app.TLS); err != nil {
+		fmt.Printf("Error setting up TLS: %v\n", err)
+		return
+	}
 	if app.version {
 		fmt.Println("psq version:", util.Version())
 		return
@@ -191,7 +210,7 @@ func handleCmd(line string, cmd *CmdData) {
 		ss := strings.Split(dcmd.Command, "|")
 		for j := 0; j < len(ss); j++ {
 			if ss[j] == command {
-				if len(args)-1 != dcmd.ArgCount {
+				if dcmd.ArgCount >= 0 && len(args)-1 != dcmd.ArgCount {
 					fmt.Printf("%s requires %d argument(s).\n", dcmd.Command, dcmd.ArgCount)
 					return
 				}
@@ -257,6 +276,8 @@ func handleInfo(cmd *CmdData, args []string) {
 	fmt.Printf("       PSQ version: %s\n", util.Version())
 	fmt.Printf("dispatcher address: %s\n", app.DispatcherHost)
 	fmt.Printf("      simd address: %s\n", app.SimdURL)
+	fmt.Printf("         API token: %v\n", len(app.APIToken) > 0)
+	fmt.Printf("       TLS CA file: %s\n", app.TLS.CAFile)
 }
 
 // handleInfo displays info about this running psq instance
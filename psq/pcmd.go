@@ -1,13 +1,16 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/stmansour/simq/proto"
 	"github.com/stmansour/simq/util"
 )
 
@@ -17,6 +20,12 @@ type SimdStatus struct {
 	SimulationsInProgress int
 	Paused                bool
 	MaxSimulations        int
+	Machine               proto.MachineProfile
+	Availability          string
+	Open                  bool
+	Load                  *proto.LoadStatus
+	Executors             []string
+	DefaultExecutor       string
 }
 
 // StatusResponse is a generic status reply to a query
@@ -42,7 +51,7 @@ func sendSimpleSimdCommand(cmd string) {
 		return
 	}
 	// Make the HTTP GET request
-	resp, err := http.Get(fullURL)
+	resp, err := util.HTTPClient().Get(fullURL)
 	if err != nil {
 		fmt.Printf("Failed to contact simd @ %s: %v", fullURL, err)
 		return
@@ -81,7 +90,7 @@ func GetSimdStatus(dcmd *CmdData, args []string) {
 		return
 	}
 	// Make the HTTP GET request
-	resp, err := http.Get(fullURL)
+	resp, err := util.HTTPClient().Get(fullURL)
 	if err != nil {
 		fmt.Printf("Failed to contact simd @ %s: %v", fullURL, err)
 		return
@@ -110,6 +119,31 @@ func GetSimdStatus(dcmd *CmdData, args []string) {
 
 	fmt.Printf("   simd was started: %s\n", status.ProgramStarted.Format("2006-01-02 15:04:05"))
 	fmt.Printf("             uptime: %v\n", time.Since(status.ProgramStarted))
+	if status.Machine.CPUs > 0 {
+		fmt.Printf("            machine: %s\n", status.Machine.String())
+	}
+	if len(status.Availability) > 0 {
+		open := "closed, not booking now"
+		if status.Open {
+			open = "open"
+		}
+		fmt.Printf("       availability: %s (%s)\n", status.Availability, open)
+	}
+	if len(status.Executors) > 0 {
+		fmt.Printf("          executors: %s (default %s)\n", strings.Join(status.Executors, ", "), status.DefaultExecutor)
+	}
+	if l := status.Load; l != nil {
+		fmt.Printf("               load: %.2f, CPU %.0f%% (others %.0f%%), %dMB free at %s\n", l.Load1, l.CPUPercent,
+			l.OtherCPUPercent, l.AvailableMemoryMB, l.Sampled.Format("15:04:05"))
+		if l.CanBook {
+			fmt.Println("          load gate: open")
+		} else {
+			fmt.Printf("          load gate: closed, %s\n", strings.Join(l.Reasons, "; "))
+		}
+		if l.UserActive && len(l.Yield) > 0 {
+			fmt.Printf("              yield: someone is using the machine, simulators are %sd\n", l.Yield)
+		}
+	}
 	fmt.Printf("running simulations: in progress: %d\n", status.SimulationsInProgress)
 	if status.Paused {
 		fmt.Println("             status: simd is paused and will not start new simulations until it is unpaused")
@@ -118,3 +152,23 @@ func GetSimdStatus(dcmd *CmdData, args []string) {
 	}
 
 }
+
+// PauseDispatcher tells the dispatcher to stop handing out simulations to
+// every simd.
+func PauseDispatcher(dcmd *CmdData, args []string) {
+	printStatus(dispatcher(dcmd).Pause(context.Background()))
+}
+
+// ResumeDispatcher tells the dispatcher to resume handing out simulations.
+func ResumeDispatcher(dcmd *CmdData, args []string) {
+	printStatus(dispatcher(dcmd).Resume(context.Background()))
+}
+
+// printStatus prints the message of a dispatcher reply, or its error
+func printStatus(st *proto.SvcStatus201, err error) {
+	if err != nil {
+		printError(err)
+		return
+	}
+	fmt.Println(st.Message)
+}
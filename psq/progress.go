@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// showProgress prints how far along a simulation is, how fast it goes and
+// how its estimated completion moved.
+//
+//	progress <sid> [-samples]
+//
+// --------------------------------------------------------------------
+func showProgress(cmd *CmdData, args []string) {
+	fs := flag.NewFlagSet("progress", flag.ContinueOnError)
+	all := fs.Bool("samples", false, "list every progress sample")
+	fs.SetOutput(os.Stdout)
+
+	//-------------------------------------------------------------
+	// the sid may come before or after the options
+	//-------------------------------------------------------------
+	var sidArg string
+	if len(args) > 0 && len(args[0]) > 0 && args[0][0] != '-' {
+		sidArg = args[0]
+		args = args[1:]
+	}
+	if err := fs.Parse(args); err != nil {
+		return
+	}
+	if len(sidArg) == 0 && fs.NArg() > 0 {
+		sidArg = fs.Arg(0)
+	}
+	sid, err := strconv.ParseInt(sidArg, 10, 64)
+	if err != nil {
+		fmt.Println("Error: usage: progress <sid> [-samples]")
+		return
+	}
+
+	rpt, err := dispatcher(cmd).GetProgress(context.Background(), sid)
+	if err != nil {
+		printError(err)
+		return
+	}
+	if len(rpt.Samples) == 0 && rpt.Latest == nil {
+		fmt.Printf("SID %d: no progress reported yet\n", sid)
+		return
+	}
+
+	fmt.Printf("SID %d\n", sid)
+	fmt.Printf("    Complete:     %s\n", percent(rpt.Percent))
+	if n := len(rpt.Samples); n > 0 {
+		s := &rpt.Samples[n-1]
+		fmt.Printf("    Loops:        %d of %d\n", s.CompletedLoops, s.LoopCount)
+		fmt.Printf("    Generations:  %d of %d in this loop\n", s.CompletedGenerations, s.GenerationsRequested)
+		fmt.Printf("    Last sample:  %s (%s)\n", s.Recorded.Local().Format("2006-01-02 15:04:05"), s.Source)
+	}
+	if rpt.GensPerHour > 0 {
+		fmt.Printf("    Rate:         %.1f generations/hour\n", rpt.GensPerHour)
+	}
+	if !rpt.Estimate.IsZero() {
+		fmt.Printf("    Estimate:     %s\n", rpt.Estimate.Local().Format("2006-01-02 15:04"))
+		fmt.Printf("    First:        %s (drift %s)\n", rpt.FirstEstimate.Local().Format("2006-01-02 15:04"), drift(rpt.Drift()))
+	}
+	if p := rpt.Latest; p != nil && p.Failures > 0 {
+		fmt.Printf("    Unanswered:   %d polls, %s\n", p.Failures, p.Error)
+	}
+
+	if !*all {
+		return
+	}
+	fmt.Printf("\n%-19s  %-6s  %7s  %9s  %-17s  %s\n", "Recorded", "Source", "Percent", "Loop/Gen", "Estimate", "Remaining")
+	for _, s := range rpt.Samples {
+		est := "-"
+		if t, err := s.Estimate(); err == nil {
+			est = t.Local().Format("2006-01-02 15:04")
+		}
+		fmt.Printf("%-19s  %-6s  %7s  %4d/%-4d  %-17s  %s\n", s.Recorded.Local().Format("2006-01-02 15:04:05"), s.Source,
+			percent(s.Percent()), s.CompletedLoops, s.CompletedGenerations, est, s.EstimatedTimeRemaining)
+	}
+}
+
+// percent formats p, which is -1 when unknown
+// --------------------------------------------------------------------
+func percent(p float64) string {
+	if p < 0 {
+		return "unknown"
+	}
+	return fmt.Sprintf("%.1f%%", p)
+}
+
+// drift formats how far an estimate moved
+// --------------------------------------------------------------------
+func drift(d time.Duration) string {
+	switch {
+	case d == 0:
+		return "none"
+	case d > 0:
+		return d.Round(time.Minute).String() + " later"
+	default:
+		return (-d).Round(time.Minute).String() + " earlier"
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/stmansour/simq/proto"
+)
+
+// getResults downloads the results for a simulation.
+//
+//	results <sid> [-o dir] [--file name] [--list]
+//
+// With no options, all the result files are downloaded as <sid>-results.tar.gz
+// into the current directory.
+// --------------------------------------------------------------------
+func getResults(cmd *CmdData, args []string) {
+	fs := flag.NewFlagSet("results", flag.ContinueOnError)
+	outDir := fs.String("o", ".", "directory where the results will be written")
+	fname := fs.String("file", "", "download only this file")
+	list := fs.Bool("list", false, "list the result files, do not download")
+	fs.SetOutput(os.Stdout)
+
+	//-------------------------------------------------------------
+	// the sid may come before or after the options
+	//-------------------------------------------------------------
+	var sidArg string
+	if len(args) > 0 && len(args[0]) > 0 && args[0][0] != '-' {
+		sidArg = args[0]
+		args = args[1:]
+	}
+	if err := fs.Parse(args); err != nil {
+		return
+	}
+	if len(sidArg) == 0 && fs.NArg() > 0 {
+		sidArg = fs.Arg(0)
+	}
+	sid, err := strconv.ParseInt(sidArg, 10, 64)
+	if err != nil {
+		fmt.Println("Error: usage: results <sid> [-o dir] [--file name] [--list]")
+		return
+	}
+
+	files, err := listResults(cmd, sid)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err.Error())
+		return
+	}
+	if *list {
+		printResultFiles(files)
+		return
+	}
+
+	//-------------------------------------------------------------
+	// Decide where the download goes
+	//-------------------------------------------------------------
+	if err := os.MkdirAll(*outDir, os.ModePerm); err != nil {
+		fmt.Printf("Error creating directory %s: %v\n", *outDir, err)
+		return
+	}
+	dest := filepath.Join(*outDir, fmt.Sprintf("%d-results.tar.gz", sid))
+	if len(*fname) > 0 {
+		dest = filepath.Join(*outDir, filepath.Base(*fname))
+	}
+
+	n, err := downloadResults(cmd, sid, *fname, dest)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err.Error())
+		return
+	}
+	fmt.Printf("SID %d: wrote %d bytes to %s\n", sid, n, dest)
+}
+
+// listResults asks the dispatcher for the list of result files for sid
+// --------------------------------------------------------------------
+func listResults(cmd *CmdData, sid int64) ([]proto.ResultFileInfo, error) {
+	return dispatcher(cmd).ListResults(context.Background(), sid)
+}
+
+// downloadResults streams the result file (or the tar.gz of all result files
+// if fname is empty) for sid into dest. It returns the number of bytes written.
+// --------------------------------------------------------------------
+func downloadResults(cmd *CmdData, sid int64, fname, dest string) (int64, error) {
+	body, err := dispatcher(cmd).GetResults(context.Background(), sid, fname)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	//-------------------------------------------------------------
+	// Write to a temp file first so that an interrupted download
+	// does not leave a partial file with the final name
+	//-------------------------------------------------------------
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".psq-download-*")
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(tmp, body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+	return n, nil
+}
+
+func printResultFiles(files []proto.ResultFileInfo) {
+	if len(files) == 0 {
+		fmt.Println("No result files found")
+		return
+	}
+	for _, f := range files {
+		fmt.Printf("%12d  %s  %s\n", f.Size, f.Modified.In(time.Local).Format("Jan 02, 2006 03:04pm"), f.Name)
+	}
+}
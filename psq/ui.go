@@ -120,7 +120,11 @@ func printSimulationStatus(s *data.QueueItem) {
 	//--------------------------------------------------------------------------
 	printTwoColumnRow(fmt.Sprintf("        SID: %d", s.SID), fmt.Sprintf(" Created: %s", s.Created.Format("Jan 02, 2006 03:04pm")), width)
 	printTwoColumnRow(fmt.Sprintf("   Username: %s", s.Username), fmt.Sprintf("Modified: %s", s.Modified.Format("Jan 02, 2006 03:04pm")), width)
-	printTwoColumnRow(fmt.Sprintf("   Priority: %d", s.Priority), "", width)
+	executor := s.Executor
+	if len(executor) == 0 {
+		executor = "default"
+	}
+	printTwoColumnRow(fmt.Sprintf("   Priority: %d", s.Priority), fmt.Sprintf("Executor: %s", executor), width)
 	printBorder("┣", "━", "┫", width)
 
 	//--------------------------------------------------------------------------
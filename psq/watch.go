@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/stmansour/simq/proto"
+)
+
+// watchQueue prints the dispatcher's queue events as they happen, until the
+// user presses Ctrl-C.
+//
+//	watch [-sid N] [-user name] [-campaign name] [-mine]
+//
+// --------------------------------------------------------------------
+func watchQueue(cmd *CmdData, args []string) {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	sid := fs.Int64("sid", 0, "only this simulation")
+	user := fs.String("user", "", "only this user's simulations")
+	campaign := fs.String("campaign", "", "only simulations in this campaign")
+	mine := fs.Bool("mine", false, "only my simulations")
+	fs.SetOutput(os.Stdout)
+	if err := fs.Parse(args); err != nil {
+		return
+	}
+	if fs.NArg() > 0 {
+		fmt.Println("Error: usage: watch [-sid N] [-user name] [-campaign name] [-mine]")
+		return
+	}
+	filter := proto.EventFilter{SID: *sid, Username: *user, Campaign: *campaign}
+	if *mine {
+		filter.Username = cmd.Username
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	fmt.Println("Watching the queue, press Ctrl-C to stop")
+	err := dispatcher(cmd).Watch(ctx, &filter, func(e *proto.Event) error {
+		printEvent(e)
+		return nil
+	})
+	if err != nil && !errors.Is(err, context.Canceled) {
+		printError(err)
+	}
+}
+
+// printEvent prints one queue event on one line
+// --------------------------------------------------------------------
+func printEvent(e *proto.Event) {
+	detail := ""
+	switch e.Type {
+	case proto.EventBooked:
+		detail = "on " + e.MachineID
+	case proto.EventEstimate:
+		if t, err := time.Parse(time.RFC3339, e.Estimate); err == nil {
+			detail = "done by " + t.Local().Format("Jan 02 03:04pm")
+		}
+	case proto.EventError:
+		detail = e.Message
+	}
+	fmt.Printf("%s  %6d  %-9s  %-9s  %-12s  %-24s  %s\n",
+		e.Time.Local().Format("15:04:05"), e.SID, e.Type, getStateName(e.State),
+		truncateMiddle(e.Username, 12), truncateMiddle(e.Name, 24), detail)
+}
@@ -1,38 +1,18 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
-	"io"
 	"log"
-	"mime/multipart"
-	"net/http"
+	"log/slog"
 	"os"
 	"path/filepath"
-	"strings"
 
+	"github.com/stmansour/simq/client"
+	"github.com/stmansour/simq/proto"
 	"github.com/stmansour/simq/util"
 )
 
-// SimulationBookingRequest represents the data for booking a simulation
-type SimulationBookingRequest struct {
-	Command         string
-	Username        string
-	MachineID       string
-	CPUs            int
-	Memory          string
-	CPUArchitecture string
-	Availability    string
-}
-
-// BookedResponse represents the response from the book command
-type BookedResponse struct {
-	Status         string
-	SID            int64
-	ConfigFilename string
-}
-
 // SvcStatus200 is a simple status message
 type SvcStatus200 struct {
 	Status  string
@@ -42,13 +22,11 @@ type SvcStatus200 struct {
 // bookAndRunSimulation books a simulation and runs it
 func bookAndRunSimulation(bkcmd string, sid int64) error {
 	var err error
-	var dataBytes []byte
 	var machineID string
+	var booking *client.Booking
 
-	cmd := util.Command{
-		Command:  bkcmd,
-		Username: "simd",
-	}
+	corr := util.NewCorrelationID()
+	ctx := client.WithCorrelationID(context.Background(), corr)
 	machineID, err = util.GetMachineUUID()
 	if err != nil {
 		return fmt.Errorf("bookAndRunSimulation: failed to get machine ID: %v", err)
@@ -58,175 +36,69 @@ func bookAndRunSimulation(bkcmd string, sid int64) error {
 		return fmt.Errorf("bookAndRunSimulation: booking is paused")
 	}
 
-	if bkcmd == "Book" {
-		cmdDataStruct := struct {
-			MachineID       string
-			CPUs            int
-			Memory          string
-			CPUArchitecture string
-			Availability    string
-		}{
+	switch bkcmd {
+	case "Book":
+		profile := machineProfile()
+		req := proto.SimulationBookingRequest{
 			MachineID:       machineID,
-			CPUs:            10,
-			Memory:          "64GB",
-			CPUArchitecture: "ARM64",
-			Availability:    "always",
-		}
-		dataBytes, err = json.Marshal(cmdDataStruct)
-		if err != nil {
-			return fmt.Errorf("bookAndRunSimulation: failed to marshal book request: %v", err)
-		}
-	} else if bkcmd == "Rebook" {
-		cmdDataStruct := struct {
-			MachineID string
-			SID       int64
-		}{
-			MachineID: machineID,
-			SID:       sid,
-		}
-		dataBytes, err = json.Marshal(cmdDataStruct)
-		if err != nil {
-			return fmt.Errorf("bookAndRunSimulation: failed to marshal book request: %v", err)
+			CPUs:            profile.CPUs,
+			Memory:          profile.Memory(),
+			CPUArchitecture: profile.CPUArchitecture,
+			Availability:    app.sched.summary,
+			Profile:         &profile,
+			Executors:       executorNames(),
 		}
+		booking, err = app.dispatcher.Book(ctx, &req)
+	case "Rebook":
+		booking, err = app.dispatcher.Rebook(ctx, machineID, sid)
+	default:
+		return fmt.Errorf("bookAndRunSimulation: unknown booking command: %s", bkcmd)
 	}
-	cmd.Data = json.RawMessage(dataBytes)
-	bookData, err := json.Marshal(cmd)
 	if err != nil {
-		return fmt.Errorf("bookAndRunSimulation: failed to marshal book request: %v", err)
+		return fmt.Errorf("bookAndRunSimulation: %w", err)
 	}
 
-	if app.HTTPHdrsDbg {
-		PrintHexAndASCII(bookData, len(bookData))
+	//-----------------------------------------------------------
+	// Nothing booked: the queue is empty or the dispatcher is
+	// paused. Both are expected.
+	//-----------------------------------------------------------
+	switch booking.Code {
+	case util.CodeQueueEmpty:
+		slog.Debug("dispatcher has no items in the queue")
+		return nil
+	case util.CodePaused:
+		slog.Debug("dispatcher is paused")
+		return nil
 	}
-
-	//----------------------------------------
-	// Create the URL to the dispatcher
-	//----------------------------------------
-	req, err := http.NewRequest("POST", app.cfg.FQDispatcherURL, bytes.NewBuffer(bookData))
-	if err != nil {
-		return fmt.Errorf("bookAndRunSimulation: failed to create request: %v", err)
+	if booking.SID == 0 {
+		log.Printf("**** ERROR **** bookAndRunSimulation: Failed to book simulation: %s", booking.Message)
+		return nil
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	//----------------------------------------
-	// DEBUG:Print request headers
-	//----------------------------------------
-	if app.HTTPHdrsDbg {
-		log.Println("Request Headers:")
-		for k, v := range req.Header {
-			log.Printf("%s: %s\n", k, v)
+	//-----------------------------------------------------------
+	// The dispatcher only books jobs whose executor we have,
+	// but an older dispatcher or a Rebook may not know that
+	//-----------------------------------------------------------
+	if _, err := findExecutor(booking.Executor); err != nil {
+		sim := Simulation{SID: booking.SID, CorrelationID: corr}
+		if err2 := ErrorEndThisSimulation(&sim, err.Error()); err2 != nil {
+			sim.logger().Error("ErrorEndThisSimulation failed", "err", err2)
 		}
-	}
-
-	//----------------------------------------
-	// Send the request
-	//----------------------------------------
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("bookAndRunSimulation: failed to send book request: %v", err)
-	}
-	defer resp.Body.Close()
-
-	//----------------------------------------
-	// Read the response
-	//----------------------------------------
-	var bookResp struct {
-		Status         string
-		Message        string
-		SID            int64
-		ConfigFilename string
-	}
-	bodyBytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Println("Error reading response body:", err)
-		return err
-	}
-
-	//----------------------------------------
-	// DEBUG:
-	//----------------------------------------
-	if app.HTTPHdrsDbg {
-		PrintHexAndASCII(bodyBytes, len(bodyBytes))
-	}
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("bookAndRunSimulation: unexpected status code: %v, body: %s", resp.StatusCode, string(bodyBytes))
+		return fmt.Errorf("bookAndRunSimulation: SID=%d: %v", booking.SID, err)
 	}
 
 	//-----------------------------------------------------------
-	// Determine whether the response is multipart or just JSON
+	// Save the config file where the simulator will find it
 	//-----------------------------------------------------------
-	contentType := resp.Header.Get("Content-Type")
-	if app.HTTPHdrsDbg {
-		log.Println("Response Content-Type:", contentType) // Debugging
-	}
-
-	var FQConfigFileName string
-	if strings.HasPrefix(contentType, "multipart/") {
-		//=========================================================
-		// MULTIPART
-		//=========================================================
-		boundary := strings.Split(contentType, "boundary=")[1]
-		if app.HTTPHdrsDbg {
-			log.Println("Multipart boundary:", boundary) // Debugging
-		}
-		multipartReader := multipart.NewReader(bytes.NewReader(bodyBytes), boundary)
-
-		for {
-			part, err := multipartReader.NextPart()
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				return fmt.Errorf("bookAndRunSimulation: error reading multipart response: %v", err) // Debugging
-			}
-
-			switch part.FormName() {
-			case "json":
-				if err := json.NewDecoder(part).Decode(&bookResp); err != nil {
-					return fmt.Errorf("bookAndRunSimulation: failed to unmarshal book response: %v", err)
-				}
-			case "file":
-				configDir := filepath.Join(app.cfg.SimdSimulationsDir, "simulations", fmt.Sprintf("%d", bookResp.SID))
-				log.Printf("BOOK CMD:  configDir = %s\n", configDir)
-				os.MkdirAll(configDir, os.ModePerm)
-				FQConfigFileName = filepath.Join(configDir, bookResp.ConfigFilename)
-
-				out, err := os.Create(FQConfigFileName)
-				if err != nil {
-					log.Printf("Error creating config file: %v\n", err)
-					return fmt.Errorf("bookAndRunSimulation: failed to create config file: %v", err)
-				}
-				defer out.Close()
-				if _, err := io.Copy(out, part); err != nil {
-					return fmt.Errorf("bookAndRunSimulation: failed to write config file: %v", err)
-				}
-				log.Printf("BOOK CMD: config file written: %s\n", FQConfigFileName)
-			}
-		}
-		return startSimulator(bookResp.SID, FQConfigFileName)
-	} else if strings.HasPrefix(contentType, "application/json") {
-		//=========================================================
-		// SINGLE-PART
-		//=========================================================
-		var respMessage struct {
-			Status  string
-			Message string
-		}
-		if err := json.Unmarshal(bodyBytes, &respMessage); err != nil {
-			return fmt.Errorf(">>>> bookAndRunSimulation: failed to unmarshal response: %v", err)
-		}
-		if respMessage.Message == "no items in queue" {
-			log.Printf(">>>> bookAndRunSimulation: dispatcher has no items in the queue\n")
-			return nil // This is an expected response
-		} else if respMessage.Status != "success" {
-			if strings.Contains(respMessage.Message, "no items in queue") {
-				log.Printf(">>>> bookAndRunSimulation: dispatcher has no items in the queue\n")
-				return nil
-			}
-			log.Printf("**** ERROR **** bookAndRunSimulation: Failed to book simulation: %s", respMessage.Message)
-		}
+	configDir := filepath.Join(app.cfg.SimdSimulationsDir, "simulations", fmt.Sprintf("%d", booking.SID))
+	log.Printf("BOOK CMD:  configDir = %s\n", configDir)
+	os.MkdirAll(configDir, os.ModePerm)
+	FQConfigFileName := filepath.Join(configDir, filepath.Base(booking.ConfigFilename))
+	if err := os.WriteFile(FQConfigFileName, booking.Config, 0644); err != nil {
+		return fmt.Errorf("bookAndRunSimulation: failed to write config file: %v", err)
 	}
+	log.Printf("BOOK CMD: config file written: %s\n", FQConfigFileName)
 
-	return nil
+	slog.Info("simulation booked", "sid", booking.SID, "corr", corr, "cmd", bkcmd, "executor", booking.Executor)
+	return startSimulator(booking.SID, FQConfigFileName, corr, booking.Executor)
 }
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/stmansour/simq/proto"
 	"github.com/stmansour/simq/util"
 )
 
@@ -15,6 +16,12 @@ type SimdStatus struct {
 	SimulationsInProgress int
 	Paused                bool
 	MaxSimulations        int
+	Machine               proto.MachineProfile // the hardware simd reports to the dispatcher
+	Availability          string               // the availability schedule
+	Open                  bool                 // whether the schedule allows booking now
+	Load                  *proto.LoadStatus    `json:",omitempty"` // the latest load sample and what simd decided from it
+	Executors             []string             // the executors simd can run jobs with
+	DefaultExecutor       string               // the executor of jobs that name none
 }
 
 // StatusResponse is a generic status reply to a query
@@ -32,7 +39,13 @@ func StatusHandler(w http.ResponseWriter, r *http.Request) {
 		SimulationsInProgress: len(app.sims),
 		Paused:                app.Paused,
 		MaxSimulations:        app.cfg.MaxSimulations,
+		Machine:               machineProfile(),
+		Availability:          app.sched.summary,
+		Load:                  app.load.snapshot(),
+		Executors:             executorNames(),
+		DefaultExecutor:       app.cfg.DefaultExecutor,
 	}
+	resp.Open, _ = app.sched.open(time.Now())
 	util.SvcWriteResponse(w, &resp)
 }
 
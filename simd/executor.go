@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// DefaultExecutorName is the executor of jobs that name none when
+// simdconf.json5 does not set DefaultExecutor. Unless Executors has one by
+// this name, it runs simwrapper the way simd always has.
+const DefaultExecutorName = "simwrapper"
+
+// Executor says how simd runs a simulator. Path, Args, Env and WorkDir are
+// text/templates that can use:
+//
+//	{{.SID}}        the simulation ID
+//	{{.Config}}     the config file, fully qualified
+//	{{.Dir}}        the simulation directory, where simd keeps the config
+//	                file and the results
+//	{{.Dispatcher}} the dispatcher's base URL
+//	{{.Executor}}   the executor's name
+//	{{.MachineID}}  this machine's ID
+type Executor struct {
+	Path    string            // the program to run
+	Args    []string          // its arguments
+	Env     map[string]string // added to simd's environment
+	WorkDir string            // working directory inside {{.Dir}}, e.g. "run", default {{.Dir}} itself
+	Log     string            // file in {{.Dir}} for the simulator's output, default sim.log
+}
+
+// builtinExecutor is the simwrapper executor
+var builtinExecutor = Executor{
+	Path: "/usr/local/plato/bin/simwrapper",
+	Args: []string{"-c", "{{.Config}}", "-SID", "{{.SID}}", "-DISPATCHER", "{{.Dispatcher}}"}, // the base url, not the fully qualified url
+}
+
+// execData is what the Executor templates can use
+type execData struct {
+	SID        int64
+	Config     string
+	Dir        string
+	Dispatcher string
+	Executor   string
+	MachineID  string
+}
+
+// executor is a compiled Executor
+type executor struct {
+	name    string
+	path    *template.Template
+	args    []*template.Template
+	env     []*template.Template // "NAME=value", sorted by name
+	workDir *template.Template   // nil = the simulation directory
+	log     string
+}
+
+// compile checks e and returns the executor named name
+// ------------------------------------------------------------------------------
+func (e *Executor) compile(name string) (*executor, error) {
+	if len(e.Path) == 0 {
+		return nil, fmt.Errorf("executor %s has no Path", name)
+	}
+	x := &executor{name: name, log: e.Log}
+	if len(x.log) == 0 {
+		x.log = "sim.log"
+	}
+	if filepath.Base(x.log) != x.log {
+		return nil, fmt.Errorf("executor %s: Log must be a file name, not %q", name, e.Log)
+	}
+	parse := func(what, text string) (*template.Template, error) {
+		t, err := template.New(what).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("executor %s: invalid %s: %v", name, what, err)
+		}
+		return t, nil
+	}
+	var err error
+	if x.path, err = parse("Path", e.Path); err != nil {
+		return nil, err
+	}
+	for i, a := range e.Args {
+		t, err := parse(fmt.Sprintf("Args[%d]", i), a)
+		if err != nil {
+			return nil, err
+		}
+		x.args = append(x.args, t)
+	}
+	keys := make([]string, 0, len(e.Env))
+	for k := range e.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		t, err := parse("Env "+k, k+"="+e.Env[k])
+		if err != nil {
+			return nil, err
+		}
+		x.env = append(x.env, t)
+	}
+	if len(e.WorkDir) > 0 {
+		if x.workDir, err = parse("WorkDir", e.WorkDir); err != nil {
+			return nil, err
+		}
+	}
+	return x, nil
+}
+
+// setupExecutors compiles the executors of simdconf.json5 into app.executors
+// and adds the built-in simwrapper executor if it is the default and is not
+// configured
+// ------------------------------------------------------------------------------
+func setupExecutors() error {
+	if len(app.cfg.DefaultExecutor) == 0 {
+		app.cfg.DefaultExecutor = DefaultExecutorName
+	}
+	cfgs := map[string]Executor{}
+	for name, e := range app.cfg.Executors {
+		cfgs[name] = e
+	}
+	if _, ok := cfgs[DefaultExecutorName]; !ok && app.cfg.DefaultExecutor == DefaultExecutorName {
+		cfgs[DefaultExecutorName] = builtinExecutor
+	}
+	if _, ok := cfgs[app.cfg.DefaultExecutor]; !ok {
+		return fmt.Errorf("DefaultExecutor %q is not in Executors", app.cfg.DefaultExecutor)
+	}
+	app.executors = map[string]*executor{}
+	for name, e := range cfgs {
+		x, err := e.compile(name)
+		if err != nil {
+			return err
+		}
+		app.executors[name] = x
+		if _, err := os.Stat(e.Path); err != nil && filepath.IsAbs(e.Path) {
+			slog.Warn("executor program not found", "executor", name, "path", e.Path, "err", err)
+		}
+	}
+	return nil
+}
+
+// executorNames returns the names of the executors, which simd sends with
+// Book so that it is only given jobs it can run
+// ------------------------------------------------------------------------------
+func executorNames() []string {
+	names := make([]string, 0, len(app.executors))
+	for name := range app.executors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// findExecutor returns the executor named name, or the default executor if
+// name is empty
+// ------------------------------------------------------------------------------
+func findExecutor(name string) (*executor, error) {
+	if len(name) == 0 {
+		name = app.cfg.DefaultExecutor
+	}
+	x, ok := app.executors[name]
+	if !ok {
+		return nil, fmt.Errorf("this machine has no executor %q", name)
+	}
+	return x, nil
+}
+
+// expand executes t with d
+// ------------------------------------------------------------------------------
+func expand(t *template.Template, d *execData) (string, error) {
+	var b bytes.Buffer
+	if err := t.Execute(&b, d); err != nil {
+		return "", fmt.Errorf("%s: %v", t.Name(), err)
+	}
+	return b.String(), nil
+}
+
+// dir returns the working directory of the simulator of the simulation in
+// the directory d.Dir
+// ------------------------------------------------------------------------------
+func (x *executor) dir(d *execData) (string, error) {
+	if x.workDir == nil {
+		return d.Dir, nil
+	}
+	wd, err := expand(x.workDir, d)
+	if err != nil {
+		return "", err
+	}
+	//----------------------------------------------------------
+	// simd archives the results it finds in the directory, so
+	// it must be inside the simulation directory
+	//----------------------------------------------------------
+	if rel := filepath.Clean(wd); filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("WorkDir %q is not inside the simulation directory", wd)
+	}
+	return filepath.Join(d.Dir, wd), nil
+}
+
+// command returns the command that runs the simulator described by d. Its
+// working directory is created if needed.
+// ------------------------------------------------------------------------------
+func (x *executor) command(d *execData) (*exec.Cmd, error) {
+	d.Executor = x.name
+	path, err := expand(x.path, d)
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, len(x.args))
+	for _, t := range x.args {
+		a, err := expand(t, d)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, a)
+	}
+	cmd := exec.Command(path, args...)
+	if len(x.env) > 0 {
+		cmd.Env = os.Environ()
+		for _, t := range x.env {
+			kv, err := expand(t, d)
+			if err != nil {
+				return nil, err
+			}
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	if cmd.Dir, err = x.dir(d); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(cmd.Dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
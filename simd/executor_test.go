@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExecutorCommand(t *testing.T) {
+	dir := t.TempDir()
+	e := Executor{
+		Path:    "{{.Dir}}/bin/{{.Executor}}",
+		Args:    []string{"-c", "{{.Config}}", "-SID", "{{.SID}}", "-DISPATCHER", "{{.Dispatcher}}", "{{.MachineID}}"},
+		Env:     map[string]string{"B": "{{.SID}}", "A": "x"},
+		WorkDir: "run/{{.SID}}",
+	}
+	x, err := e.compile("fake")
+	require.NoError(t, err)
+	assert.Equal(t, "sim.log", x.log)
+
+	d := &execData{SID: 7, Config: "/q/7/job.json5", Dir: dir, Dispatcher: "http://d:8250", MachineID: "m1"}
+	cmd, err := x.command(d)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "bin", "fake"), cmd.Path)
+	assert.Equal(t, []string{cmd.Path, "-c", "/q/7/job.json5", "-SID", "7", "-DISPATCHER", "http://d:8250", "m1"}, cmd.Args)
+	assert.Equal(t, []string{"A=x", "B=7"}, cmd.Env[len(cmd.Env)-2:], "added after simd's environment, sorted by name")
+	assert.Equal(t, filepath.Join(dir, "run", "7"), cmd.Dir)
+	assert.DirExists(t, cmd.Dir)
+
+	//-----------------------------------------------------
+	// unknown fields are errors, not empty strings
+	//-----------------------------------------------------
+	bad, err := (&Executor{Path: "sim", Args: []string{"{{.Nope}}"}}).compile("bad")
+	require.NoError(t, err)
+	_, err = bad.command(d)
+	assert.Error(t, err)
+}
+
+func TestExecutorCompile(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		e    Executor
+		ok   bool
+	}{
+		{"minimal", Executor{Path: "/bin/sim"}, true},
+		{"no path", Executor{Args: []string{"-x"}}, false},
+		{"log in a directory", Executor{Path: "/bin/sim", Log: "logs/sim.log"}, false},
+		{"invalid arg", Executor{Path: "/bin/sim", Args: []string{"{{.SID"}}, false},
+		{"invalid env", Executor{Path: "/bin/sim", Env: map[string]string{"X": "{{end}}"}}, false},
+		{"invalid workdir", Executor{Path: "/bin/sim", WorkDir: "{{"}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tc.e.compile(tc.name)
+			assert.Equal(t, tc.ok, err == nil, err)
+		})
+	}
+}
+
+func TestExecutorWorkDir(t *testing.T) {
+	d := &execData{SID: 7, Dir: "/sims/7"}
+	for _, tc := range []struct {
+		workDir string
+		want    string // "" = rejected
+	}{
+		{"", "/sims/7"},
+		{"run", "/sims/7/run"},
+		{"{{.SID}}/out", "/sims/7/7/out"},
+		{"a/../b", "/sims/7/b"},
+		{"..data", "/sims/7/..data"},
+		{".", "/sims/7"},
+		{"..", ""},
+		{"../8", ""},
+		{"a/../../8", ""},
+		{"/tmp", ""},
+		{"{{.Dir}}/run", ""}, // {{.Dir}} is absolute
+	} {
+		t.Run(tc.workDir, func(t *testing.T) {
+			x, err := (&Executor{Path: "sim", WorkDir: tc.workDir}).compile("x")
+			require.NoError(t, err)
+			got, err := x.dir(d)
+			if tc.want == "" {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+
+	//-----------------------------------------------------
+	// command does not create a directory it rejects
+	//-----------------------------------------------------
+	dir := t.TempDir()
+	x, err := (&Executor{Path: "sim", WorkDir: "../escaped"}).compile("x")
+	require.NoError(t, err)
+	_, err = x.command(&execData{SID: 7, Dir: filepath.Join(dir, "7")})
+	assert.Error(t, err)
+	_, err = os.Stat(filepath.Join(dir, "escaped"))
+	assert.True(t, os.IsNotExist(err))
+}
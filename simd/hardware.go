@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/stmansour/simq/proto"
+)
+
+// detectHardware returns the hardware of this machine. What cannot be
+// detected is left 0.
+// ------------------------------------------------------------------------------
+func detectHardware() proto.MachineProfile {
+	hw := proto.MachineProfile{
+		CPUs:            runtime.NumCPU(),
+		CPUArchitecture: runtime.GOARCH,
+		OS:              runtime.GOOS,
+	}
+	switch runtime.GOOS {
+	case "linux":
+		hw.PhysicalCPUs = linuxPhysicalCPUs("/proc/cpuinfo")
+		hw.MemoryMB, hw.AvailableMemoryMB = linuxMemory("/proc/meminfo")
+	case "darwin":
+		hw.PhysicalCPUs = int(sysctlInt("hw.physicalcpu"))
+		hw.MemoryMB = sysctlInt("hw.memsize") / (1024 * 1024)
+	}
+	return hw
+}
+
+// machineProfile returns the profile simd reports: the detected hardware with
+// the CPUs, PhysicalCPUs, Memory and CPUArchitecture of simdconf.json5 in
+// place of the detected values, and the memory available now
+// ------------------------------------------------------------------------------
+func machineProfile() proto.MachineProfile {
+	p := app.hw
+	if runtime.GOOS == "linux" {
+		_, p.AvailableMemoryMB = linuxMemory("/proc/meminfo")
+	}
+	if app.cfg.CPUs > 0 {
+		p.CPUs = app.cfg.CPUs
+	}
+	if app.cfg.PhysicalCPUs > 0 {
+		p.PhysicalCPUs = app.cfg.PhysicalCPUs
+	}
+	if len(app.cfg.CPUArchitecture) > 0 {
+		p.CPUArchitecture = app.cfg.CPUArchitecture
+	}
+	if len(app.cfg.Memory) > 0 {
+		if mb, err := parseMemory(app.cfg.Memory); err == nil {
+			p.MemoryMB = mb
+		}
+	}
+	return p
+}
+
+// parseMemory converts a size like "64GB", "512MB" or "1.5TB" to MB. A plain
+// number is in MB.
+// ------------------------------------------------------------------------------
+func parseMemory(size string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	mult := 1.0
+	for _, u := range []struct {
+		suffix string
+		mult   float64
+	}{{"TB", 1024 * 1024}, {"GB", 1024}, {"MB", 1}, {"KB", 1.0 / 1024}, {"T", 1024 * 1024}, {"G", 1024}, {"M", 1}} {
+		if strings.HasSuffix(s, u.suffix) {
+			s, mult = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || !(n >= 0) || math.IsInf(n, 1) { // !(n >= 0) is also NaN
+		return 0, fmt.Errorf("invalid memory size: %q", size)
+	}
+	return int64(n * mult), nil
+}
+
+// linuxMemory returns the MemTotal and MemAvailable in path, a
+// /proc/meminfo, in MB
+// ------------------------------------------------------------------------------
+func linuxMemory(path string) (total, avail int64) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text()) // e.g. "MemTotal:  65798232 kB"
+		if len(fields) < 2 {
+			continue
+		}
+		kb, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			total = kb / 1024
+		case "MemAvailable:":
+			avail = kb / 1024
+		}
+	}
+	return total, avail
+}
+
+// linuxPhysicalCPUs returns the number of CPU cores listed in path, a
+// /proc/cpuinfo, or 0 if it does not tell
+// ------------------------------------------------------------------------------
+func linuxPhysicalCPUs(path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	cores := map[string]bool{} // "physical id/core id"
+	var phys, core string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		k, v, ok := strings.Cut(sc.Text(), ":")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(k) {
+		case "processor":
+			phys, core = "", ""
+		case "physical id":
+			phys = strings.TrimSpace(v)
+		case "core id":
+			core = strings.TrimSpace(v)
+			cores[phys+"/"+core] = true
+		}
+	}
+	return len(cores)
+}
+
+// sysctlInt returns the value of the numeric sysctl name, or 0
+// ------------------------------------------------------------------------------
+func sysctlInt(name string) int64 {
+	out, err := exec.Command("sysctl", "-n", name).Output()
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	return n
+}
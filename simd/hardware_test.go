@@ -0,0 +1,77 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMemory(t *testing.T) {
+	for _, tc := range []struct {
+		size string
+		mb   int64
+		ok   bool
+	}{
+		{"512", 512, true},
+		{"512MB", 512, true},
+		{"512M", 512, true},
+		{"8GB", 8192, true},
+		{" 8 gb ", 8192, true},
+		{"8g", 8192, true},
+		{"1.5TB", 1572864, true},
+		{"2T", 2097152, true},
+		{"2048KB", 2, true},
+		{"0", 0, true},
+		{"", 0, false},
+		{"GB", 0, false},
+		{"-1GB", 0, false},
+		{"8 GiB", 0, false},
+		{"lots", 0, false},
+		{"NaN", 0, false},
+		{"InfGB", 0, false},
+	} {
+		t.Run(tc.size, func(t *testing.T) {
+			mb, err := parseMemory(tc.size)
+			if !tc.ok {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.mb, mb)
+		})
+	}
+}
+
+func TestLinuxMemory(t *testing.T) {
+	for _, tc := range []struct {
+		file         string
+		total, avail int64
+	}{
+		{"meminfo", 64256, 47083},
+		{"meminfo-old", 3954, 0}, // before Linux 3.14 there was no MemAvailable
+		{"missing", 0, 0},
+	} {
+		t.Run(tc.file, func(t *testing.T) {
+			total, avail := linuxMemory(filepath.Join("testdata", "hardware", tc.file))
+			assert.Equal(t, tc.total, total)
+			assert.Equal(t, tc.avail, avail)
+		})
+	}
+}
+
+func TestLinuxPhysicalCPUs(t *testing.T) {
+	for _, tc := range []struct {
+		file string
+		want int
+	}{
+		{"cpuinfo-xeon", 4}, // two sockets of two cores, hyperthreaded
+		{"cpuinfo-vm", 2},   // core ids but no physical id
+		{"cpuinfo-arm", 0},  // does not tell
+		{"missing", 0},
+	} {
+		t.Run(tc.file, func(t *testing.T) {
+			assert.Equal(t, tc.want, linuxPhysicalCPUs(filepath.Join("testdata", "hardware", tc.file)))
+		})
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/yosuke-furukawa/json5/encoding/json5"
+)
+
+// Limits are the resources one simulator may use. simdconf.json5 sets the
+// limits of every simulation on the machine, and a job can tighten them in
+// the Limits of its config file. A zero value is not limited.
+type Limits struct {
+	CPUs      int    // CPUs it is pinned to, -1 = its share of the machine: CPUs / MaxSimulations
+	Memory    string // e.g. "8GB"; the cgroup's memory.max, or the address space without Cgroup
+	Nice      int    // 1-19 runs it at a lower CPU priority
+	OpenFiles int    // open files
+}
+
+// limits are the Limits of one simulation, resolved for this machine
+type limits struct {
+	cpus      []int // CPUs to pin it to, nil = any
+	memoryMB  int64
+	nice      int
+	openFiles int
+	cgroup    string // the simulation's cgroup directory, empty = none
+}
+
+// String describes l for the log
+// ------------------------------------------------------------------------------
+func (l *limits) String() string {
+	var parts []string
+	if len(l.cpus) > 0 {
+		parts = append(parts, fmt.Sprintf("cpus=%v", l.cpus))
+	}
+	if l.memoryMB > 0 {
+		parts = append(parts, fmt.Sprintf("memory=%dMB", l.memoryMB))
+	}
+	if l.nice > 0 {
+		parts = append(parts, fmt.Sprintf("nice=%d", l.nice))
+	}
+	if l.openFiles > 0 {
+		parts = append(parts, fmt.Sprintf("openfiles=%d", l.openFiles))
+	}
+	if len(l.cgroup) > 0 {
+		parts = append(parts, "cgroup="+l.cgroup)
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, " ")
+}
+
+// check returns an error if l is invalid. what names l in the message.
+// ------------------------------------------------------------------------------
+func (l *Limits) check(what string) error {
+	if l.CPUs < -1 {
+		return fmt.Errorf("%s: invalid CPUs %d, use a count or -1", what, l.CPUs)
+	}
+	if len(l.Memory) > 0 {
+		if _, err := parseMemory(l.Memory); err != nil {
+			return fmt.Errorf("%s: %v", what, err)
+		}
+	}
+	if l.Nice < 0 || l.Nice > 19 {
+		return fmt.Errorf("%s: invalid Nice %d, use 0-19", what, l.Nice)
+	}
+	if l.OpenFiles < 0 {
+		return fmt.Errorf("%s: invalid OpenFiles %d", what, l.OpenFiles)
+	}
+	return nil
+}
+
+// hard reports whether l has limits that need Linux
+// ------------------------------------------------------------------------------
+func (l *Limits) hard() bool {
+	return l.CPUs != 0 || len(l.Memory) > 0 || l.OpenFiles > 0
+}
+
+// checkLimits checks the Limits, SimUser and Cgroup of simdconf.json5
+// ------------------------------------------------------------------------------
+func checkLimits() error {
+	if err := app.cfg.Limits.check("Limits"); err != nil {
+		return err
+	}
+	if runtime.GOOS != "linux" && (app.cfg.Limits.hard() || len(app.cfg.Cgroup) > 0) {
+		return fmt.Errorf("CPUs, Memory and OpenFiles limits and Cgroup need Linux, not %s", runtime.GOOS)
+	}
+	if len(app.cfg.SimUser) > 0 {
+		if _, _, err := lookupSimUser(); err != nil {
+			return err
+		}
+		if os.Geteuid() != 0 {
+			return fmt.Errorf("simd must run as root to run simulators as %s", app.cfg.SimUser)
+		}
+	}
+	if len(app.cfg.Cgroup) > 0 {
+		if _, err := os.Stat(filepath.Join(app.cfg.Cgroup, "cgroup.subtree_control")); err != nil {
+			return fmt.Errorf("Cgroup %s is not a cgroup v2 directory: %v", app.cfg.Cgroup, err)
+		}
+	}
+	return nil
+}
+
+// lookupSimUser returns the uid and gid of SimUser
+// ------------------------------------------------------------------------------
+func lookupSimUser() (uint32, uint32, error) {
+	u, err := user.Lookup(app.cfg.SimUser)
+	if err != nil {
+		return 0, 0, fmt.Errorf("SimUser: %v", err)
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("SimUser %s: invalid uid %s", u.Username, u.Uid)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("SimUser %s: invalid gid %s", u.Username, u.Gid)
+	}
+	if uid == 0 {
+		return 0, 0, fmt.Errorf("SimUser %s is root", u.Username)
+	}
+	return uint32(uid), uint32(gid), nil
+}
+
+// jobLimits returns the Limits in the job's config file, fname. A config
+// file without them has none.
+// ------------------------------------------------------------------------------
+func jobLimits(fname string) (Limits, error) {
+	var job struct {
+		Limits Limits
+	}
+	b, err := os.ReadFile(fname)
+	if err != nil {
+		return job.Limits, err
+	}
+	if err := json5.Unmarshal(b, &job); err != nil {
+		return job.Limits, fmt.Errorf("%s: %v", filepath.Base(fname), err)
+	}
+	return job.Limits, job.Limits.check("job Limits")
+}
+
+// resolveLimits returns the limits of simulation sid: of the machine's and
+// the job's limits, the tighter one of each. A job can ask for less memory,
+// fewer open files or CPUs and a higher nice level than the machine sets,
+// but never for more, so a job config cannot lift the limits that protect
+// the machine.
+// ------------------------------------------------------------------------------
+func resolveLimits(sid int64, job Limits) *limits {
+	mach := app.cfg.Limits
+	if runtime.GOOS != "linux" && (mach.hard() || job.hard()) {
+		slog.Warn("CPUs, Memory and OpenFiles limits need Linux, ignoring them", "sid", sid)
+		mach, job = Limits{Nice: mach.Nice}, Limits{Nice: job.Nice}
+	}
+
+	r := &limits{nice: max(mach.Nice, job.Nice)}
+	machMB, _ := parseMemory(mach.Memory) // checked already
+	jobMB, _ := parseMemory(job.Memory)
+	r.memoryMB = tighter(machMB, jobMB)
+	r.openFiles = int(tighter(int64(mach.OpenFiles), int64(job.OpenFiles)))
+	if n := cpuLimit(mach.CPUs, job.CPUs); n > 0 {
+		r.cpus = pickCPUs(allowedCPUs(), n)
+	}
+	if len(app.cfg.Cgroup) > 0 {
+		r.cgroup = filepath.Join(app.cfg.Cgroup, fmt.Sprintf("simq-%d", sid))
+	}
+	return r
+}
+
+// tighter returns the tighter of the limits a and b, where 0 is no limit
+// ------------------------------------------------------------------------------
+func tighter(a, b int64) int64 {
+	if a == 0 || b > 0 && b < a {
+		return b
+	}
+	return a
+}
+
+// cpuLimit returns the number of CPUs a simulation may use under the CPUs
+// limits of the machine and the job, 0 = any
+// ------------------------------------------------------------------------------
+func cpuLimit(mach, job int) int {
+	count := func(n int) int64 {
+		if n < 0 {
+			n = max(machineProfile().CPUs/max(app.cfg.MaxSimulations, 1), 1)
+		}
+		return int64(n)
+	}
+	return int(tighter(count(mach), count(job)))
+}
+
+// pickCPUs returns n of the CPUs in allowed, those the fewest running
+// simulations are pinned to first, so that concurrent simulations get
+// different CPUs while there are enough
+// ------------------------------------------------------------------------------
+func pickCPUs(allowed []int, n int) []int {
+	if len(allowed) == 0 || n >= len(allowed) {
+		return nil // all of them, so no need to pin
+	}
+	used := map[int]int{}
+	app.simsMu.Lock()
+	for _, sim := range app.sims {
+		for _, c := range sim.CPUs {
+			used[c]++
+		}
+	}
+	app.simsMu.Unlock()
+	cpus := append([]int(nil), allowed...)
+	sort.SliceStable(cpus, func(i, j int) bool { return used[cpus[i]] < used[cpus[j]] })
+	cpus = cpus[:n]
+	sort.Ints(cpus)
+	return cpus
+}
+
+// releaseLimits removes the cgroup of simulation sid, if it has one. It must
+// be called after the simulator has exited.
+// ------------------------------------------------------------------------------
+func releaseLimits(sid int64) {
+	if len(app.cfg.Cgroup) == 0 {
+		return
+	}
+	dir := filepath.Join(app.cfg.Cgroup, fmt.Sprintf("simq-%d", sid))
+	if err := os.Remove(dir); err != nil && !os.IsNotExist(err) {
+		slog.Warn("could not remove the simulation's cgroup", "sid", sid, "cgroup", dir, "err", err)
+	}
+}
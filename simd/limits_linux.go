@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// allowedCPUs returns the CPUs simd may run on
+// ------------------------------------------------------------------------------
+func allowedCPUs() []int {
+	var set unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &set); err != nil {
+		return nil
+	}
+	var cpus []int
+	for c := 0; c < len(set)*64; c++ {
+		if set.IsSet(c) {
+			cpus = append(cpus, c)
+		}
+	}
+	return cpus
+}
+
+// prepare sets up what cmd needs before it starts: the simulation's cgroup
+// and, if there is a SimUser, the user to run as. files are the directories
+// and files the simulator must be able to write.
+// ------------------------------------------------------------------------------
+func (l *limits) prepare(cmd *exec.Cmd, files ...string) error {
+	if len(app.cfg.SimUser) > 0 {
+		uid, gid, err := lookupSimUser()
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if err := os.Lchown(f, int(uid), int(gid)); err != nil {
+				return fmt.Errorf("cannot give %s to %s: %v", f, app.cfg.SimUser, err)
+			}
+		}
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uid, Gid: gid}
+	}
+	if len(l.cgroup) == 0 {
+		return nil
+	}
+
+	//------------------------------------------------------
+	// The simulator starts in its own cgroup, so the
+	// memory and CPU limits cover everything it runs
+	//------------------------------------------------------
+	if err := os.MkdirAll(l.cgroup, 0755); err != nil {
+		return fmt.Errorf("cannot create cgroup: %v", err)
+	}
+	if l.memoryMB > 0 {
+		if err := writeCgroup(l.cgroup, "memory.max", strconv.FormatInt(l.memoryMB*1024*1024, 10)); err != nil {
+			return err
+		}
+	}
+	if n := len(l.cpus); n > 0 {
+		if err := writeCgroup(l.cgroup, "cpu.max", fmt.Sprintf("%d 100000", n*100000)); err != nil {
+			return err
+		}
+	}
+	fd, err := syscall.Open(l.cgroup, syscall.O_DIRECTORY|syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("cannot open cgroup: %v", err)
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = fd
+	return nil
+}
+
+// writeCgroup writes value to the control file name of the cgroup dir
+// ------------------------------------------------------------------------------
+func writeCgroup(dir, name, value string) error {
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0644); err != nil {
+		return fmt.Errorf("cannot set %s: %v (is the controller enabled in the parent's cgroup.subtree_control?)", name, err)
+	}
+	return nil
+}
+
+// start starts cmd with the limits. The simulator inherits the CPU affinity
+// and nice level of the thread that starts it, so it is started from a
+// thread that has them; that thread exits afterwards. The resource limits
+// can only be set once the process exists.
+// ------------------------------------------------------------------------------
+func (l *limits) start(cmd *exec.Cmd) error {
+	errc := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread() // never unlocked: the thread ends with this goroutine
+		if len(l.cpus) > 0 {
+			var set unix.CPUSet
+			for _, c := range l.cpus {
+				set.Set(c)
+			}
+			if err := unix.SchedSetaffinity(0, &set); err != nil {
+				errc <- fmt.Errorf("cannot set CPU affinity: %v", err)
+				return
+			}
+		}
+		if l.nice > 0 {
+			if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, l.nice); err != nil { // 0 is this thread
+				errc <- fmt.Errorf("cannot set nice level: %v", err)
+				return
+			}
+		}
+		errc <- cmd.Start()
+	}()
+	err := <-errc
+	if cmd.SysProcAttr.UseCgroupFD {
+		syscall.Close(cmd.SysProcAttr.CgroupFD)
+	}
+	if err != nil {
+		return err
+	}
+
+	pid := cmd.Process.Pid
+	if l.openFiles > 0 {
+		n := uint64(l.openFiles)
+		if err = unix.Prlimit(pid, unix.RLIMIT_NOFILE, &unix.Rlimit{Cur: n, Max: n}, nil); err != nil {
+			err = fmt.Errorf("cannot limit open files: %v", err)
+		}
+	}
+	if l.memoryMB > 0 && len(l.cgroup) == 0 && err == nil {
+		n := uint64(l.memoryMB) * 1024 * 1024
+		if err = unix.Prlimit(pid, unix.RLIMIT_AS, &unix.Rlimit{Cur: n, Max: n}, nil); err != nil {
+			err = fmt.Errorf("cannot limit memory: %v", err)
+		}
+	}
+	if err != nil {
+		syscall.Kill(-pid, syscall.SIGKILL) // do not leave it running without its limits
+		cmd.Wait()
+	}
+	return err
+}
@@ -0,0 +1,48 @@
+//go:build unix && !linux
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// allowedCPUs returns nil: CPU affinity needs Linux
+// ------------------------------------------------------------------------------
+func allowedCPUs() []int {
+	return nil
+}
+
+// prepare sets up the user cmd runs as, if there is a SimUser. files are the
+// directories and files the simulator must be able to write.
+// ------------------------------------------------------------------------------
+func (l *limits) prepare(cmd *exec.Cmd, files ...string) error {
+	if len(app.cfg.SimUser) == 0 {
+		return nil
+	}
+	uid, gid, err := lookupSimUser()
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := os.Lchown(f, int(uid), int(gid)); err != nil {
+			return err
+		}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uid, Gid: gid}
+	return nil
+}
+
+// start starts cmd and sets its nice level. Only the nice level is
+// supported here.
+// ------------------------------------------------------------------------------
+func (l *limits) start(cmd *exec.Cmd) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if l.nice > 0 {
+		syscall.Setpriority(syscall.PRIO_PGRP, cmd.Process.Pid, l.nice)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveLimits(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("CPUs, Memory and OpenFiles limits need Linux")
+	}
+	cfg, hw, sims := app.cfg, app.hw, app.sims
+	t.Cleanup(func() { app.cfg, app.hw, app.sims = cfg, hw, sims })
+	app.cfg.Limits = Limits{Memory: "4GB", Nice: 5, OpenFiles: 1024}
+	app.cfg.Cgroup = "/sys/fs/cgroup/simq"
+	app.cfg.CPUs, app.cfg.MaxSimulations = 8, 2
+	app.sims = nil
+
+	//-----------------------------------------------------
+	// n CPUs of this machine, or nil if that is all of them
+	//-----------------------------------------------------
+	allowed := allowedCPUs()
+	pinned := func(n int) []int {
+		if n >= len(allowed) {
+			return nil
+		}
+		return allowed[:n]
+	}
+
+	for _, tc := range []struct {
+		file      string
+		machCPUs  int // the machine's CPUs limit
+		memoryMB  int64
+		nice      int
+		openFiles int
+		cpus      []int
+		ok        bool
+	}{
+		{"none.json5", 0, 4096, 5, 1024, nil, true},
+		{"memory.json5", 0, 4096, 5, 1024, nil, true}, // cannot lift the machine's limits
+		{"smaller.json5", 0, 2048, 5, 256, nil, true},
+		{"nicer.json5", 0, 4096, 10, 1024, nil, true},
+		{"lessnice.json5", 0, 4096, 5, 1024, nil, true},
+		{"cpus.json5", 0, 4096, 5, 1024, pinned(1), true},
+		{"share.json5", 0, 4096, 5, 1024, pinned(4), true},
+		{"none.json5", 2, 4096, 5, 1024, pinned(2), true},
+		{"cpus.json5", 2, 4096, 5, 1024, pinned(1), true},
+		{"manycpus.json5", 2, 4096, 5, 1024, pinned(2), true},
+		{"share.json5", 2, 4096, 5, 1024, pinned(2), true},
+		{"manycpus.json5", -1, 4096, 5, 1024, pinned(4), true},
+		{"invalid.json5", 0, 0, 0, 0, nil, false},
+		{"broken.json5", 0, 0, 0, 0, nil, false},
+		{"missing.json5", 0, 0, 0, 0, nil, false},
+	} {
+		t.Run(fmt.Sprintf("%s machine CPUs %d", tc.file, tc.machCPUs), func(t *testing.T) {
+			app.cfg.Limits.CPUs = tc.machCPUs
+			job, err := jobLimits(filepath.Join("testdata", "limits", tc.file))
+			if !tc.ok {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			l := resolveLimits(7, job)
+			assert.Equal(t, tc.memoryMB, l.memoryMB)
+			assert.Equal(t, tc.nice, l.nice)
+			assert.Equal(t, tc.openFiles, l.openFiles)
+			assert.Equal(t, tc.cpus, l.cpus)
+			assert.Equal(t, "/sys/fs/cgroup/simq/simq-7", l.cgroup)
+		})
+	}
+}
+
+func TestCPULimit(t *testing.T) {
+	cfg, hw := app.cfg, app.hw
+	t.Cleanup(func() { app.cfg, app.hw = cfg, hw })
+	app.cfg.CPUs, app.cfg.MaxSimulations = 8, 2 // a share is 4 CPUs
+
+	for _, tc := range []struct {
+		mach, job, want int
+	}{
+		{0, 0, 0},
+		{0, 1, 1},
+		{0, 64, 64}, // pickCPUs gives it all of them
+		{0, -1, 4},
+		{2, 0, 2},
+		{2, 1, 1},
+		{2, 64, 2},
+		{2, -1, 2},
+		{6, -1, 4},
+		{-1, 0, 4},
+		{-1, 64, 4},
+		{-1, 3, 3},
+	} {
+		t.Run(fmt.Sprintf("%d %d", tc.mach, tc.job), func(t *testing.T) {
+			assert.Equal(t, tc.want, cpuLimit(tc.mach, tc.job))
+		})
+	}
+	app.cfg.CPUs, app.cfg.MaxSimulations = 1, 4
+	assert.Equal(t, 1, cpuLimit(-1, 0), "at least one CPU")
+}
+
+func TestPickCPUs(t *testing.T) {
+	sims := app.sims
+	t.Cleanup(func() { app.sims = sims })
+	eight := []int{0, 1, 2, 3, 4, 5, 6, 7}
+
+	for _, tc := range []struct {
+		name    string
+		allowed []int
+		running [][]int // CPUs of the running simulations
+		n       int
+		want    []int
+	}{
+		{"idle machine", eight, nil, 2, []int{0, 1}},
+		{"away from the busy ones", eight, [][]int{{0, 1}, {2, 3}}, 2, []int{4, 5}},
+		{"all the free ones", eight, [][]int{{0, 1}, {2, 3}}, 4, []int{4, 5, 6, 7}},
+		{"more than are free", eight, [][]int{{0, 1}, {2, 3}}, 6, []int{0, 1, 4, 5, 6, 7}},
+		{"least used", []int{0, 1, 2}, [][]int{{0, 1}, {0, 2}}, 1, []int{1}},
+		{"gaps in the allowed", []int{2, 3, 5}, [][]int{{3}}, 2, []int{2, 5}},
+		{"unpinned simulations", eight, [][]int{nil}, 1, []int{0}},
+		{"all of them", eight, nil, 8, nil},
+		{"more than there are", eight, nil, 16, nil},
+		{"affinity unknown", nil, nil, 2, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			app.sims = nil
+			for i, cpus := range tc.running {
+				app.sims = append(app.sims, Simulation{SID: int64(i + 1), CPUs: cpus})
+			}
+			assert.Equal(t, tc.want, pickCPUs(tc.allowed, tc.n))
+		})
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stmansour/simq/proto"
+)
+
+// LoadConfig says when the machine is too busy for simd to book another
+// simulation, and what simd does with its simulators while someone else is
+// using the machine. A zero threshold is not checked.
+type LoadConfig struct {
+	MaxLoadPerCPU   float64 // 1-minute load average divided by the CPUs
+	MaxCPUPercent   float64 // CPU utilization of the whole machine
+	MinFreeMemoryMB int64   // memory available without swapping
+	UserCPUPercent  float64 // CPU used by programs other than the simulators that means someone is using the machine
+	Yield           string  // what to do with the simulators while someone is: renice or pause, default nothing
+	IdleMin         int     // minutes the machine must be quiet before yielded simulators get it back, 0 = 5
+	SampleSec       int     // seconds between samples, 0 = 15
+}
+
+// enabled reports whether any load check is configured
+func (c *LoadConfig) enabled() bool {
+	return c.MaxLoadPerCPU > 0 || c.MaxCPUPercent > 0 || c.MinFreeMemoryMB > 0 || c.UserCPUPercent > 0
+}
+
+// cpuTimes are cumulative CPU times from /proc, in clock ticks
+type cpuTimes struct {
+	total, idle uint64
+	sims        map[procKey]uint64 // each simulator process's
+}
+
+// procKey tells a process from a later one that reuses its PID
+type procKey struct {
+	pid   int
+	start uint64 // clock ticks after boot
+}
+
+// loadMonitor samples the load of the machine
+type loadMonitor struct {
+	cfg        LoadConfig
+	cpus       int
+	mu         sync.Mutex
+	status     proto.LoadStatus
+	prev       cpuTimes
+	lastActive time.Time // when someone was last seen using the machine
+}
+
+// newLoadMonitor returns a load monitor for cfg on a machine with cpus CPUs
+// ------------------------------------------------------------------------------
+func newLoadMonitor(cfg LoadConfig, cpus int) *loadMonitor {
+	if cpus <= 0 {
+		cpus = 1
+	}
+	return &loadMonitor{cfg: cfg, cpus: cpus, status: proto.LoadStatus{CanBook: true, Yield: cfg.Yield}}
+}
+
+// check returns an error if cfg is invalid
+// ------------------------------------------------------------------------------
+func (c *LoadConfig) check() error {
+	switch c.Yield {
+	case "", OverflowRenice, OverflowPause:
+	default:
+		return fmt.Errorf("invalid Yield %q: use %s or %s", c.Yield, OverflowRenice, OverflowPause)
+	}
+	if c.enabled() && runtime.GOOS != "linux" {
+		return fmt.Errorf("load checks need /proc, which %s does not have", runtime.GOOS)
+	}
+	return nil
+}
+
+// canBook reports whether the load allows booking another simulation
+// ------------------------------------------------------------------------------
+func (m *loadMonitor) canBook() bool {
+	if m == nil {
+		return true
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status.CanBook
+}
+
+// yielding reports whether the simulators should give the machine to its user
+// ------------------------------------------------------------------------------
+func (m *loadMonitor) yielding() bool {
+	if m == nil {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status.UserActive && len(m.cfg.Yield) > 0
+}
+
+// snapshot returns the latest status, or nil if load checks are off
+// ------------------------------------------------------------------------------
+func (m *loadMonitor) snapshot() *proto.LoadStatus {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := m.status
+	st.Reasons = append([]string(nil), m.status.Reasons...)
+	return &st
+}
+
+// run samples the load until ctx is done
+// ------------------------------------------------------------------------------
+func (m *loadMonitor) run(ctx context.Context) {
+	every := time.Duration(m.cfg.SampleSec) * time.Second
+	if every <= 0 {
+		every = 15 * time.Second
+	}
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		m.sample(time.Now())
+		if applyThrottle() {
+			go sendHeartbeat()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sample measures the load and decides whether simd may book and whether
+// someone is using the machine
+// ------------------------------------------------------------------------------
+func (m *loadMonitor) sample(now time.Time) {
+	load1, err := readLoadavg("/proc/loadavg")
+	if err != nil {
+		slog.Warn("could not read the load average", "err", err)
+	}
+	cur, err := readCPUTimes("/proc/stat")
+	if err != nil {
+		slog.Warn("could not read the CPU times", "err", err)
+	}
+	cur.sims = simulatorTicks("/proc", simulatorPGIDs())
+	_, avail := linuxMemory("/proc/meminfo")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := &m.status
+	st.Sampled, st.Load1, st.AvailableMemoryMB = now, load1, avail
+	if dt := cur.total - m.prev.total; m.prev.total > 0 && cur.total > m.prev.total {
+		busy := dt - min(cur.idle-m.prev.idle, dt)
+		sims := min(simulatorDelta(m.prev.sims, cur.sims), busy)
+		st.CPUPercent = 100 * float64(busy) / float64(dt)
+		st.OtherCPUPercent = 100 * float64(busy-sims) / float64(dt)
+	}
+	m.prev = cur
+
+	//------------------------------------------------------
+	// May we book?
+	//------------------------------------------------------
+	st.Reasons = st.Reasons[:0]
+	c := &m.cfg
+	if perCPU := load1 / float64(m.cpus); c.MaxLoadPerCPU > 0 && perCPU > c.MaxLoadPerCPU {
+		st.Reasons = append(st.Reasons, fmt.Sprintf("load %.2f per CPU is over %.2f", perCPU, c.MaxLoadPerCPU))
+	}
+	if c.MaxCPUPercent > 0 && st.CPUPercent > c.MaxCPUPercent {
+		st.Reasons = append(st.Reasons, fmt.Sprintf("CPU %.0f%% is over %.0f%%", st.CPUPercent, c.MaxCPUPercent))
+	}
+	if c.MinFreeMemoryMB > 0 && avail > 0 && avail < c.MinFreeMemoryMB {
+		st.Reasons = append(st.Reasons, fmt.Sprintf("%dMB free memory is under %dMB", avail, c.MinFreeMemoryMB))
+	}
+
+	//------------------------------------------------------
+	// Is someone using the machine? They stay active until
+	// the machine has been quiet for IdleMin.
+	//------------------------------------------------------
+	wasActive := st.UserActive
+	if c.UserCPUPercent > 0 && st.OtherCPUPercent > c.UserCPUPercent {
+		m.lastActive = now
+	}
+	idle := time.Duration(c.IdleMin) * time.Minute
+	if idle <= 0 {
+		idle = 5 * time.Minute
+	}
+	st.UserActive = !m.lastActive.IsZero() && now.Sub(m.lastActive) < idle
+	if st.UserActive {
+		st.Reasons = append(st.Reasons, fmt.Sprintf("someone is using the machine (other programs use %.0f%% CPU)", st.OtherCPUPercent))
+	}
+	if st.UserActive != wasActive {
+		slog.Info("machine use changed", "user_active", st.UserActive, "other_cpu", st.OtherCPUPercent, "yield", c.Yield)
+	}
+
+	canBook := len(st.Reasons) == 0
+	if canBook != st.CanBook {
+		slog.Info("load gate changed", "can_book", canBook, "reasons", strings.Join(st.Reasons, "; "))
+	}
+	st.CanBook = canBook
+}
+
+// readLoadavg returns the 1-minute load average in path, a /proc/loadavg
+// ------------------------------------------------------------------------------
+func readLoadavg(path string) (float64, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("%s is empty", path)
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+// readCPUTimes returns the total and idle CPU time in path, a /proc/stat
+// ------------------------------------------------------------------------------
+func readCPUTimes(path string) (cpuTimes, error) {
+	var t cpuTimes
+	f, err := os.Open(path)
+	if err != nil {
+		return t, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text()) // cpu user nice system idle iowait irq softirq steal ...
+		if len(fields) < 5 || fields[0] != "cpu" {
+			continue
+		}
+		for i, v := range fields[1:] {
+			if i >= 8 { // guest time is already in user time
+				break
+			}
+			n, _ := strconv.ParseUint(v, 10, 64)
+			t.total += n
+			if i == 3 || i == 4 { // idle, iowait
+				t.idle += n
+			}
+		}
+		return t, nil
+	}
+	return t, fmt.Errorf("no cpu line in %s", path)
+}
+
+// simulatorPGIDs returns the process groups of the running simulators
+// ------------------------------------------------------------------------------
+func simulatorPGIDs() map[int]bool {
+	pgids := map[int]bool{}
+	app.simsMu.Lock()
+	defer app.simsMu.Unlock()
+	for _, sim := range app.sims {
+		if sim.PID > 0 {
+			pgids[sim.PID] = true
+		}
+	}
+	return pgids
+}
+
+// simulatorTicks returns the CPU time used by each process in pgids, read
+// from the stat files under proc
+// ------------------------------------------------------------------------------
+func simulatorTicks(proc string, pgids map[int]bool) map[procKey]uint64 {
+	if len(pgids) == 0 {
+		return nil
+	}
+	stats, _ := filepath.Glob(filepath.Join(proc, "[0-9]*", "stat"))
+	ticks := map[procKey]uint64{}
+	for _, path := range stats {
+		ps, err := readProcStat(path)
+		if err != nil || !pgids[ps.pgrp] {
+			continue // it exited, or is not a simulator
+		}
+		pid, err := strconv.Atoi(filepath.Base(filepath.Dir(path)))
+		if err != nil {
+			continue
+		}
+		ticks[procKey{pid, ps.start}] = ps.utime + ps.stime
+	}
+	return ticks
+}
+
+// simulatorDelta returns the CPU time the simulator processes used between
+// two samples. Only the processes in both count: the time of one that exited
+// is gone from cur, and a new one's is not all from this interval.
+// ------------------------------------------------------------------------------
+func simulatorDelta(prev, cur map[procKey]uint64) uint64 {
+	var ticks uint64
+	for k, t := range cur {
+		if p, ok := prev[k]; ok && t > p {
+			ticks += t - p
+		}
+	}
+	return ticks
+}
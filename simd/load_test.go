@@ -0,0 +1,79 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadCPUTimes(t *testing.T) {
+	for _, tc := range []struct {
+		file        string
+		total, idle uint64
+		ok          bool
+	}{
+		{"stat", 1193, 1020, true},     // guest and guest_nice are in user and nice already
+		{"stat-2.6", 1190, 1020, true}, // no steal or guest columns
+		{"stat-2.4", 1160, 1000, true}, // no iowait either
+		{"stat-nocpu", 0, 0, false},
+		{"missing", 0, 0, false},
+	} {
+		t.Run(tc.file, func(t *testing.T) {
+			got, err := readCPUTimes(filepath.Join("testdata", "load", tc.file))
+			if !tc.ok {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, cpuTimes{total: tc.total, idle: tc.idle}, got)
+		})
+	}
+}
+
+func TestReadLoadavg(t *testing.T) {
+	load, err := readLoadavg(filepath.Join("testdata", "load", "loadavg"))
+	require.NoError(t, err)
+	assert.Equal(t, 0.17, load)
+	_, err = readLoadavg(filepath.Join("testdata", "load", "missing"))
+	assert.Error(t, err)
+}
+
+func TestSimulatorTicks(t *testing.T) {
+	proc := filepath.Join("testdata", "proc")
+	for _, tc := range []struct {
+		name  string
+		pgids map[int]bool
+		want  map[procKey]uint64
+	}{
+		{"none", nil, nil},
+		{"one group of two", map[int]bool{100: true}, map[procKey]uint64{{100, 12345}: 60, {101, 12400}: 10}}, // 101's command name has a ')'
+		{"two groups", map[int]bool{100: true, 200: true}, map[procKey]uint64{{100, 12345}: 60, {101, 12400}: 10, {200, 500}: 1000}},
+		{"gone", map[int]bool{999: true}, map[procKey]uint64{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, simulatorTicks(proc, tc.pgids))
+		})
+	}
+}
+
+func TestSimulatorDelta(t *testing.T) {
+	prev := map[procKey]uint64{{100, 1}: 50, {101, 2}: 10, {200, 3}: 900}
+	for _, tc := range []struct {
+		name string
+		cur  map[procKey]uint64
+		want uint64
+	}{
+		{"all still running", map[procKey]uint64{{100, 1}: 80, {101, 2}: 15, {200, 3}: 1000}, 135},
+		{"one exited", map[procKey]uint64{{100, 1}: 80, {101, 2}: 15}, 35}, // its past time is not taken from the others'
+		{"all exited", nil, 0},
+		{"a new one", map[procKey]uint64{{100, 1}: 80, {102, 4}: 500}, 30},
+		{"its PID reused", map[procKey]uint64{{100, 9}: 5}, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, simulatorDelta(prev, tc.cur))
+		})
+	}
+	assert.Zero(t, simulatorDelta(nil, prev), "the first sample")
+}
@@ -5,6 +5,7 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
@@ -16,6 +17,8 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/stmansour/simq/client"
+	"github.com/stmansour/simq/proto"
 	"github.com/stmansour/simq/util"
 	"github.com/yosuke-furukawa/json5/encoding/json5"
 )
@@ -28,47 +31,48 @@ type SimulatorCommand struct {
 // SimdConfig is the configuration for the simulator
 type SimdConfig struct {
 	MachineID          string
-	CPUs               int
-	Memory             string
-	CPUArchitecture    string
-	Availability       string
+	CPUs               int                 // logical CPUs, 0 = detect
+	PhysicalCPUs       int                 // CPU cores, 0 = detect
+	Memory             string              // total memory, e.g. "64GB", empty = detect
+	CPUArchitecture    string              // e.g. arm64, empty = detect
+	Availability       Availability        // when simd may book; always, by default
+	Load               LoadConfig          // load thresholds for booking, and what to do while someone uses the machine
+	Executors          map[string]Executor // how to run simulators, by the name jobs use
+	DefaultExecutor    string              // executor of jobs that name none, default simwrapper
+	Limits             Limits              // resources each simulator may use; a job's config file can set its own
+	SimUser            string              // run simulators as this unprivileged user; simd must run as root
+	Cgroup             string              // cgroup v2 directory delegated to simd, for memory and CPU limits
 	DispatcherURL      string
 	FQDispatcherURL    string
 	SimdURL            string
-	MaxSimulations     int    // maximum number of simulations this machine can run
-	SimdSimulationsDir string // directory where simulations are stored
-
-}
-
-// SimulatorStatus response from simulator
-type SimulatorStatus struct {
-	ProgramStarted         string
-	RunDuration            string
-	ConfigFile             string
-	SimulationDateRange    string
-	LoopCount              int
-	GenerationsRequested   int
-	CompletedLoops         int
-	CompletedGenerations   int
-	ElapsedTimeLastGen     string
-	EstimatedTimeRemaining string
-	EstimatedCompletion    string
+	MaxSimulations     int            // maximum number of simulations this machine can run
+	SimdSimulationsDir string         // directory where simulations are stored
+	Log                util.LogConfig // log level, format and rotation
+	APIToken           string         // identifies this machine to the dispatcher
+	TLS                util.TLSConfig // serve the control listener over https
+	DispatcherTLS      util.TLSConfig // CA pin and client certificate for the dispatcher
 }
 
 var app struct {
-	cfg         SimdConfig         // configuration of this machine
-	listenPort  int                // port to listen on 8251 by default
-	sims        []Simulation       // currently running simulations
-	simsMu      sync.Mutex         // mutex for updating sims
-	HexASCIIDbg bool               // if true print reply buffers in hex and ASCII
-	HTTPHdrsDbg bool               // if true print HTTP headers
-	version     bool               // program version string
-	simdHomeDir string             // home directory - typically /usr/local/simq/simd
-	mutex       sync.Mutex         // mutex for creating the tar.gz file
-	DtStart     time.Time          // start time of the program
-	Paused      bool               // when true, do not book any more simulations
-	cancel      context.CancelFunc // used to shutdown smoothly
-	ctx         context.Context    // used to shutdown smoothly
+	cfg         SimdConfig           // configuration of this machine
+	listenPort  int                  // port to listen on 8251 by default
+	sims        []Simulation         // currently running simulations
+	simsMu      sync.Mutex           // mutex for updating sims
+	HexASCIIDbg bool                 // if true print reply buffers in hex and ASCII
+	HTTPHdrsDbg bool                 // if true print HTTP headers
+	version     bool                 // program version string
+	simdHomeDir string               // home directory - typically /usr/local/simq/simd
+	mutex       sync.Mutex           // mutex for creating the tar.gz file
+	DtStart     time.Time            // start time of the program
+	Paused      bool                 // when true, do not book any more simulations
+	cancel      context.CancelFunc   // used to shutdown smoothly
+	ctx         context.Context      // used to shutdown smoothly
+	dispatcher  *client.Client       // sends commands to the dispatcher
+	hw          proto.MachineProfile // the hardware detected at startup
+	sched       *schedule            // compiled cfg.Availability
+	schedOpen   bool                 // whether sched was open at the last check
+	load        *loadMonitor         // nil if no load checks are configured
+	executors   map[string]*executor // compiled cfg.Executors, by name
 }
 
 func readCommandLineArgs() {
@@ -82,48 +86,79 @@ func main() {
 	var err error
 	app.listenPort = 8251
 	app.Paused = false // this is the default, but I want to be very explicit about this
-	app.HTTPHdrsDbg = app.HexASCIIDbg
 
 	//-------------------------------------
 	// HANDLE COMMAND LINE ARGUMENTS
 	//-------------------------------------
 	readCommandLineArgs()
+	app.HTTPHdrsDbg = app.HexASCIIDbg
 	if app.version {
 		s := util.Version()
 		fmt.Printf("simd version: %s\n", s)
 		os.Exit(0)
 	}
 
-	//-----------------------------------------
-	// OUTPUT MESSAGES TO A LOGFILE
-	//-----------------------------------------
 	app.simdHomeDir, err = util.GetExecutableDir()
 	if err != nil {
 		log.Fatalf("Failed to get executable directory: %v", err)
 	}
-
-	fname := filepath.Join(app.simdHomeDir, "simd.log")
-	logFile, err := os.OpenFile(fname, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
-	if err != nil {
-		log.Fatalf("Failed to open log file: %v", err)
-	}
-	defer logFile.Close()
-	log.SetOutput(logFile)
-	log.Printf("----------------------------------------------------------------\n")
-	log.Printf("simd version: %s\n", util.Version())
 	app.DtStart = time.Now()
-	log.Printf("Initiated: %s\n", app.DtStart.Format(time.RFC3339))
-
 	app.sims = make([]Simulation, 0) // initialize it empty
 
 	//-------------------------------------
 	// READ CONFIG
 	//-------------------------------------
-	fname = filepath.Join(app.simdHomeDir, "simdconf.json5")
+	fname := filepath.Join(app.simdHomeDir, "simdconf.json5")
 	if err = loadConfig(fname, &app.cfg); err != nil {
 		fmt.Printf("Failed to load configuration: %v\n", err)
-		log.Printf("Failed to load configuration: %v\n", err)
-		log.Fatalf("Shutting down. Please put simdconf.json5 in the same directory as simd\n")
+		log.Fatalf("Failed to load configuration: %v. Please put simdconf.json5 in the same directory as simd\n", err)
+	}
+
+	//-----------------------------------------
+	// OUTPUT MESSAGES TO A LOGFILE
+	//-----------------------------------------
+	if app.HexASCIIDbg && len(app.cfg.Log.Level) == 0 {
+		app.cfg.Log.Level = "debug"
+	}
+	logFile, err := util.SetupLogging(filepath.Join(app.simdHomeDir, "simd.log"), app.cfg.Log)
+	if err != nil {
+		log.Fatalf("Failed to set up logging: %v", err)
+	}
+	defer logFile.Close()
+	slog.Info("simd started", "version", util.Version())
+	util.SetAuthToken(app.cfg.APIToken)
+
+	//-------------------------------------
+	// WHAT ARE WE RUNNING ON?
+	//-------------------------------------
+	app.hw = detectHardware()
+	if len(app.cfg.Memory) > 0 {
+		if _, err := parseMemory(app.cfg.Memory); err != nil {
+			log.Fatalf("Invalid Memory in simdconf.json5: %v", err)
+		}
+	}
+	profile := machineProfile()
+	slog.Info("machine profile", "detected", app.hw.String(), "reported", profile.String())
+	if app.sched, err = app.cfg.Availability.compile(); err != nil {
+		log.Fatalf("Invalid Availability in simdconf.json5: %v", err)
+	}
+	app.schedOpen, _ = app.sched.open(time.Now())
+	slog.Info("availability", "schedule", app.sched.summary, "open", app.schedOpen, "overflow", app.sched.overflow)
+	if err = app.cfg.Load.check(); err != nil {
+		log.Fatalf("Invalid Load in simdconf.json5: %v", err)
+	}
+	if app.cfg.Load.enabled() {
+		app.load = newLoadMonitor(app.cfg.Load, profile.CPUs)
+	}
+	if err = setupExecutors(); err != nil {
+		log.Fatalf("Invalid Executors in simdconf.json5: %v", err)
+	}
+	slog.Info("executors", "names", executorNames(), "default", app.cfg.DefaultExecutor)
+	if err = checkLimits(); err != nil {
+		log.Fatalf("Invalid limits in simdconf.json5: %v", err)
+	}
+	if err = util.SetClientTLS(&app.cfg.DispatcherTLS); err != nil {
+		log.Fatalf("Failed to set up TLS for the dispatcher: %v", err)
 	}
 
 	//-------------------------------------
@@ -139,13 +174,17 @@ func main() {
 		}
 		app.cfg.SimdURL = naddrs[i].IPAddress
 	}
-	log.Printf("\n-----------------------------------------------------------------\n")
-	log.Printf("simd version: %s\n", util.Version())
 	log.Printf("simd network address: %s\n", app.cfg.SimdURL)
 
 	//-------------------------------------
 	// SETUP THE HTTP LISTENER
 	//-------------------------------------
+	server := &http.Server{Addr: fmt.Sprintf(":%d", app.listenPort)}
+	if app.cfg.TLS.Enabled() {
+		if server.TLSConfig, err = util.ServerTLSConfig(&app.cfg.TLS); err != nil {
+			log.Fatalf("Failed to set up TLS: %v", err)
+		}
+	}
 	go func() {
 		http.HandleFunc("/PauseBooking", PauseBookingHandler)
 		http.HandleFunc("/ResumeBooking", ResumeBookingHandler)
@@ -153,8 +192,14 @@ func main() {
 		http.HandleFunc("/Status", StatusHandler)
 		http.HandleFunc("/CheckUpdates", CheckUpdatesHandler)
 
-		log.Printf("Starting SIMD HTTP listener on port %d\n", app.listenPort)
-		if err := http.ListenAndServe(fmt.Sprintf(":%d", app.listenPort), nil); err != nil {
+		log.Printf("Starting SIMD HTTP listener on port %d, TLS = %v\n", app.listenPort, server.TLSConfig != nil)
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ListenAndServeTLS("", "") // the certificate is in TLSConfig
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil {
 			log.Fatalf("Failed to start server: %v", err)
 		}
 	}()
@@ -170,6 +215,24 @@ func main() {
 	parsedURL.Path = path.Join(parsedURL.Path, "command")
 	app.cfg.FQDispatcherURL = parsedURL.String()
 	log.Printf("FQDispatcherURL: %s\n", app.cfg.FQDispatcherURL)
+	app.dispatcher = client.New(app.cfg.FQDispatcherURL, "simd")
+
+	//-----------------------------------------------------
+	// MAKE SURE WE SPEAK THE DISPATCHER'S PROTOCOL. If it
+	// cannot be reached now, booking will report it later.
+	//-----------------------------------------------------
+	caps, err := app.dispatcher.Capabilities(context.Background())
+	switch {
+	case util.CodeOf(err) == util.ErrIncompatible:
+		log.Fatalf("The dispatcher refused simd: %v", err)
+	case err != nil:
+		slog.Warn("could not get the dispatcher's capabilities", "err", err)
+	default:
+		if err := caps.Compatible(); err != nil {
+			log.Fatalf("Cannot work with this dispatcher: %v", err)
+		}
+		slog.Info("dispatcher is compatible", "version", caps.Version, "protocol", caps.ProtocolVersion)
+	}
 
 	//-----------------------------------------------------
 	// ENSURE THAT THE SIMULATIONS DIRECTORY EXISTS
@@ -190,6 +253,10 @@ func main() {
 	//-------------------------------------
 	app.ctx, app.cancel = context.WithCancel(context.Background())
 
+	if app.load != nil {
+		go app.load.run(app.ctx)
+	}
+
 	// Signal handling for graceful shutdown
 	go func() {
 		sigChan := make(chan os.Signal, 1)
@@ -222,10 +289,13 @@ func main() {
 	//---------------------------------------------------------------
 	ticker := time.NewTicker(time.Minute)
 	defer ticker.Stop()
+	sendHeartbeat()
 
 	for {
 		select {
 		case <-ticker.C:
+			sendHeartbeat()
+			enforceSchedule(time.Now())
 			if isAvailable() {
 				// fmt.Printf("simd >>>> isAvailable() reports: true\n") // debug
 				err := bookAndRunSimulation("Book", 0)
@@ -262,9 +332,60 @@ func loadConfig(file string, config *SimdConfig) error {
 // Check if simd is available to run simulations
 // ------------------------------------------------------------------------------
 func isAvailable() bool {
+	if app.Paused {
+		return false
+	}
+	//-------------------------------------
+	// Are we in an availability window?
+	//-------------------------------------
+	open, limit := app.sched.open(time.Now())
+	if !open {
+		return false
+	}
+	//-------------------------------------
+	// Is the machine too busy?
+	//-------------------------------------
+	if !app.load.canBook() {
+		return false
+	}
+	if limit <= 0 {
+		limit = app.cfg.MaxSimulations
+	}
 	//-------------------------------------
 	// Can we run any more simulations?
-	// trivial implementation for now...
 	//-------------------------------------
-	return len(app.sims) < app.cfg.MaxSimulations && !app.Paused
+	app.simsMu.Lock()
+	defer app.simsMu.Unlock()
+	return len(app.sims) < limit
+}
+
+// sendHeartbeat tells the dispatcher that this machine is alive, so that it
+// does not raise a "silent" alert, and which of its simulators are paused or
+// reniced, so that it does not take them for stalled or unreachable
+// ------------------------------------------------------------------------------
+func sendHeartbeat() {
+	profile := machineProfile()
+	req := proto.HeartbeatRequest{MachineID: app.cfg.MachineID, Paused: app.Paused, Profile: &profile}
+	throttle.mu.Lock()
+	done := make(map[int64]throttled, len(throttle.sims))
+	for sid, t := range throttle.sims {
+		done[sid] = t
+	}
+	throttle.mu.Unlock()
+	app.simsMu.Lock()
+	for _, sim := range app.sims {
+		req.SIDs = append(req.SIDs, sim.SID)
+		if done[sim.SID].paused {
+			req.PausedSIDs = append(req.PausedSIDs, sim.SID)
+		}
+		if done[sim.SID].reniced {
+			req.RenicedSIDs = append(req.RenicedSIDs, sim.SID)
+		}
+	}
+	app.simsMu.Unlock()
+	ctx, cancel := context.WithTimeout(app.ctx, 30*time.Second)
+	defer cancel()
+	if err := app.dispatcher.Heartbeat(ctx, &req); err != nil {
+		slog.Warn("heartbeat failed", "err", err)
+	}
 }
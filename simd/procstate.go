@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// stateFile is the file in the simulation directory where simd keeps what
+// it knows about the simulator process. The results archive does not
+// include it.
+const stateFile = "simd-state.json"
+
+// simState is what a restarted simd needs to find a simulator again
+type simState struct {
+	SID           int64
+	PID           int       // the simulator's process
+	PGID          int       // its process group, which simd signals
+	StartTicks    uint64    // start time of PID in /proc/<pid>/stat; a later process with the same PID has another
+	Started       time.Time // when simd started it
+	Port          int       // where it answers status requests, 0 = not found yet
+	Executor      string
+	CPUs          []int `json:",omitempty"`
+	Nice          int   `json:",omitempty"`
+	Paused        bool  `json:",omitempty"` // simd stopped it with SIGSTOP
+	Reniced       bool  `json:",omitempty"` // simd runs it at throttleNice
+	CorrelationID string
+}
+
+// procStat is the part of a /proc/<pid>/stat file simd uses
+type procStat struct {
+	state        byte // R, S, D, Z, T, ...
+	pgrp         int
+	utime, stime uint64 // clock ticks
+	start        uint64 // clock ticks after boot
+}
+
+// readProcStat reads path, a /proc/<pid>/stat file
+// ------------------------------------------------------------------------------
+func readProcStat(path string) (procStat, error) {
+	var ps procStat
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return ps, err
+	}
+	//--------------------------------------------------
+	// pid (comm) state ppid pgrp ... utime stime ...
+	// starttime. comm may contain anything, so split
+	// after the last ')'
+	//--------------------------------------------------
+	i := bytes.LastIndexByte(b, ')')
+	if i < 0 {
+		return ps, fmt.Errorf("%s: no command name", path)
+	}
+	fields := strings.Fields(string(b[i+1:]))
+	if len(fields) < 20 {
+		return ps, fmt.Errorf("%s: too few fields", path)
+	}
+	ps.state = fields[0][0]
+	ps.pgrp, _ = strconv.Atoi(fields[2])
+	ps.utime, _ = strconv.ParseUint(fields[11], 10, 64)
+	ps.stime, _ = strconv.ParseUint(fields[12], 10, 64)
+	ps.start, _ = strconv.ParseUint(fields[19], 10, 64)
+	return ps, nil
+}
+
+// newSimState returns the state of the simulator sim has just started
+// ------------------------------------------------------------------------------
+func newSimState(sim *Simulation) *simState {
+	st := &simState{
+		SID:           sim.SID,
+		PID:           sim.PID,
+		PGID:          sim.PID, // it leads its own process group
+		Started:       time.Now(),
+		Executor:      sim.Executor,
+		CPUs:          sim.CPUs,
+		Nice:          sim.Nice,
+		CorrelationID: sim.CorrelationID,
+	}
+	if ps, err := readProcStat(filepath.Join("/proc", strconv.Itoa(sim.PID), "stat")); err == nil {
+		st.StartTicks = ps.start
+	}
+	return st
+}
+
+// save writes st to the state file in dir. It replaces the file in one
+// step, so a crash never leaves half of it.
+// ------------------------------------------------------------------------------
+func (st *simState) save(dir string) error {
+	b, err := json.MarshalIndent(st, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, stateFile+".tmp")
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, stateFile))
+}
+
+// readSimState reads the state file in dir. It returns nil and no error if
+// there is none, e.g. for a simulation started by an older simd.
+// ------------------------------------------------------------------------------
+func readSimState(dir string) (*simState, error) {
+	b, err := os.ReadFile(filepath.Join(dir, stateFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var st simState
+	if err := json.Unmarshal(b, &st); err != nil {
+		return nil, fmt.Errorf("%s: %v", stateFile, err)
+	}
+	return &st, nil
+}
+
+// alive reports whether the simulator st describes is still running. On
+// Linux the process must also have the same start time and process group,
+// so a new process that reuses the PID is not mistaken for it.
+// ------------------------------------------------------------------------------
+func (st *simState) alive() bool {
+	if st.PID <= 0 {
+		return false
+	}
+	if runtime.GOOS != "linux" {
+		return syscall.Kill(st.PID, 0) == nil
+	}
+	ps, err := readProcStat(filepath.Join("/proc", strconv.Itoa(st.PID), "stat"))
+	if err != nil || ps.state == 'Z' {
+		return false
+	}
+	return ps.pgrp == st.PGID && (st.StartTicks == 0 || ps.start == st.StartTicks)
+}
+
+// stopped reports whether the simulator st describes is stopped, by simd's
+// SIGSTOP or anyone else's
+// ------------------------------------------------------------------------------
+func (st *simState) stopped() bool {
+	if st.Paused {
+		return true
+	}
+	ps, err := readProcStat(filepath.Join("/proc", strconv.Itoa(st.PID), "stat"))
+	return err == nil && ps.state == 'T'
+}
+
+// kill stops the simulator's whole process group
+// ------------------------------------------------------------------------------
+func (st *simState) kill() error {
+	if st.PGID <= 1 {
+		return fmt.Errorf("no process group")
+	}
+	if err := syscall.Kill(-st.PGID, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+		return err
+	}
+	return nil
+}
+
+// groupPIDs returns the processes in process group pgid, from the stat files
+// under proc
+// ------------------------------------------------------------------------------
+func groupPIDs(proc string, pgid int) []int {
+	stats, _ := filepath.Glob(filepath.Join(proc, "[0-9]*", "stat"))
+	var pids []int
+	for _, path := range stats {
+		ps, err := readProcStat(path)
+		if err != nil || ps.pgrp != pgid {
+			continue // it exited, or is someone else's
+		}
+		if pid, err := strconv.Atoi(filepath.Base(filepath.Dir(path))); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// listeningPorts returns the TCP ports that the processes in process group
+// pgid listen on, found through their sockets under proc
+// ------------------------------------------------------------------------------
+func listeningPorts(proc string, pgid int) []int {
+	var ports []int
+	seen := map[int]bool{}
+	for _, pid := range groupPIDs(proc, pgid) {
+		dir := filepath.Join(proc, strconv.Itoa(pid))
+		inodes := map[string]bool{}
+		fds, _ := os.ReadDir(filepath.Join(dir, "fd"))
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(dir, "fd", fd.Name()))
+			if err == nil && strings.HasPrefix(link, "socket:[") {
+				inodes[strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")] = true
+			}
+		}
+		if len(inodes) == 0 {
+			continue
+		}
+		for _, table := range []string{"tcp", "tcp6"} {
+			for _, port := range tcpListeners(filepath.Join(dir, "net", table), inodes) {
+				if !seen[port] {
+					seen[port] = true
+					ports = append(ports, port)
+				}
+			}
+		}
+	}
+	return ports
+}
+
+// tcpListeners returns the local ports of the listening sockets in path, a
+// /proc/<pid>/net/tcp or tcp6, whose inodes are in inodes
+// ------------------------------------------------------------------------------
+func tcpListeners(path string, inodes map[string]bool) []int {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var ports []int
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text()) // sl local rem st ... uid timeout inode
+		if len(fields) < 10 || fields[3] != "0A" || !inodes[fields[9]] {
+			continue // not a listener of ours
+		}
+		_, hexPort, ok := strings.Cut(fields[1], ":")
+		if !ok {
+			continue
+		}
+		if port, err := strconv.ParseUint(hexPort, 16, 16); err == nil {
+			ports = append(ports, int(port))
+		}
+	}
+	return ports
+}
+
+// saveState records sim's simulator in its state file
+// ------------------------------------------------------------------------------
+func (sim *Simulation) saveState() {
+	st, err := readSimState(sim.Directory)
+	if err != nil || st == nil || st.PID != sim.PID {
+		st = newSimState(sim)
+	}
+	st.Port = sim.SimPort
+	if err := st.save(sim.Directory); err != nil {
+		sim.logger().Warn("could not save the simulator's state", "err", err)
+	}
+}
+
+// saveThrottle records in sim's state file what simd did to its simulator,
+// so that a restarted simd can undo it
+// ------------------------------------------------------------------------------
+func (sim *Simulation) saveThrottle(t throttled) {
+	st, err := readSimState(sim.Directory)
+	if err != nil || st == nil || st.PID != sim.PID {
+		return // started by an older simd, or not by this one
+	}
+	st.Paused, st.Reniced = t.paused, t.reniced
+	if err := st.save(sim.Directory); err != nil {
+		sim.logger().Warn("could not save the simulator's state", "err", err)
+	}
+}
+
+// processAlive reports whether the process of sim's simulator is still
+// running, according to its state file. Without one it reports false.
+// ------------------------------------------------------------------------------
+func (sim *Simulation) processAlive() bool {
+	st, err := readSimState(sim.Directory)
+	return err == nil && st != nil && st.alive()
+}
+
+// killSimulator kills sim's simulator, found through its state file, if it
+// or anything it started is still running
+// ------------------------------------------------------------------------------
+func (sim *Simulation) killSimulator() {
+	st, err := readSimState(sim.Directory)
+	if err != nil || st == nil || !st.alive() && len(groupPIDs("/proc", st.PGID)) == 0 {
+		return
+	}
+	lg := sim.logger()
+	lg.Warn("killing the simulator", "pid", st.PID)
+	if err := st.kill(); err != nil {
+		lg.Error("could not kill the simulator", "pid", st.PID, "err", err)
+	}
+}
+
+// findSimulator finds the port sim's simulator answers on. Where there is a
+// /proc and the simulator's process is known, it looks only at the ports
+// its process group listens on; otherwise it scans the simulator ports.
+// ------------------------------------------------------------------------------
+func (sim *Simulation) findSimulator() bool {
+	if sim.PID <= 0 || runtime.GOOS != "linux" {
+		if !sim.FindRunningSimulator() {
+			return false
+		}
+		if sim.PID > 0 {
+			sim.saveState()
+		}
+		return true
+	}
+	for _, port := range listeningPorts("/proc", sim.PID) {
+		url := fmt.Sprintf("http://127.0.0.1:%d/status", port)
+		sid, ok, err := FetchSID(url)
+		if err != nil || !ok || sid != sim.SID {
+			continue
+		}
+		sim.SimPort = port
+		sim.BaseURL = fmt.Sprintf("http://127.0.0.1:%d", port)
+		sim.FQSimStatusURL = url
+		sim.saveState()
+		return true
+	}
+	return false
+}
+
+// attach finds the simulator of sim, which simd started before it was
+// restarted, through the state file in its directory. It returns true if
+// its simulator is running. A simulator the old simd paused is continued
+// first, and one it reniced is remembered so that the throttle can give it
+// its priority back. A simulator that is running but does not answer yet is
+// attached without a status URL; monitorSimulator keeps looking for it.
+// Without a state file it falls back to scanning the simulator ports.
+// ------------------------------------------------------------------------------
+func (sim *Simulation) attach() bool {
+	lg := sim.logger()
+	st, err := readSimState(sim.Directory)
+	if err != nil {
+		lg.Warn("could not read the simulator's state", "err", err)
+	}
+	if st == nil {
+		return sim.FindRunningSimulator()
+	}
+	if !st.alive() {
+		lg.Info("simulator is not running", "pid", st.PID, "started", st.Started)
+		return false
+	}
+	sim.PID, sim.Executor, sim.CPUs, sim.Nice = st.PID, st.Executor, st.CPUs, st.Nice
+	if len(st.CorrelationID) > 0 {
+		sim.CorrelationID = st.CorrelationID
+	}
+
+	//----------------------------------------------------------
+	// A stopped simulator cannot answer. applyThrottle stops
+	// it again if the schedule or the load still want that.
+	//----------------------------------------------------------
+	if st.stopped() {
+		if err := syscall.Kill(-st.PGID, syscall.SIGCONT); err != nil {
+			lg.Warn("could not continue the paused simulator", "pid", st.PID, "err", err)
+		} else {
+			lg.Info("continued the paused simulator", "pid", st.PID)
+		}
+		st.Paused = false
+		if err := st.save(sim.Directory); err != nil {
+			lg.Warn("could not save the simulator's state", "err", err)
+		}
+	}
+	if st.Reniced {
+		setThrottled(sim.SID, throttled{reniced: true})
+	}
+
+	if st.Port > 0 {
+		url := fmt.Sprintf("http://127.0.0.1:%d/status", st.Port)
+		if sid, ok, err := FetchSID(url); err == nil && ok && sid == sim.SID {
+			sim.SimPort, sim.BaseURL, sim.FQSimStatusURL = st.Port, fmt.Sprintf("http://127.0.0.1:%d", st.Port), url
+			lg.Info("re-attached to simulator", "pid", st.PID, "port", st.Port)
+			return true
+		}
+	}
+	if sim.findSimulator() {
+		lg.Info("re-attached to simulator", "pid", st.PID, "port", sim.SimPort)
+		return true
+	}
+	lg.Warn("re-attached to simulator, which does not answer yet", "pid", st.PID)
+	return true
+}
+
+// killOrphan kills the simulator still running in the simulation directory
+// dir, which the dispatcher no longer has for this machine
+// ------------------------------------------------------------------------------
+func killOrphan(dir string) {
+	st, err := readSimState(dir)
+	if err != nil || st == nil || !st.alive() {
+		return
+	}
+	lg := (&Simulation{SID: st.SID, CorrelationID: st.CorrelationID}).logger()
+	lg.Warn("killing orphaned simulator", "pid", st.PID, "started", st.Started)
+	if err := st.kill(); err != nil {
+		lg.Error("could not kill the orphaned simulator", "pid", st.PID, "err", err)
+	}
+}
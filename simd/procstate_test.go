@@ -0,0 +1,213 @@
+package main
+
+import (
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stmansour/simq/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// procState returns the state of process pid, e.g. 'T' when it is stopped
+func procState(t *testing.T, pid int) byte {
+	ps, err := readProcStat(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	require.NoError(t, err)
+	return ps.state
+}
+
+// waitState waits until process pid is in state, or is not in it if not
+func waitState(t *testing.T, pid int, state byte, not bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for (procState(t, pid) == state) == not {
+		if time.Now().After(deadline) {
+			t.Fatalf("process %d: state %c, not=%v", pid, procState(t, pid), not)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSimStateFile(t *testing.T) {
+	dir := t.TempDir()
+	st, err := readSimState(dir)
+	assert.NoError(t, err)
+	assert.Nil(t, st, "a simulation started by an older simd has none")
+
+	want := &simState{SID: 7, PID: 1234, PGID: 1234, StartTicks: 99, Port: 8090, Executor: "fake", CPUs: []int{2, 3}, Nice: 5, Paused: true, CorrelationID: "c"}
+	require.NoError(t, want.save(dir))
+	st, err = readSimState(dir)
+	require.NoError(t, err)
+	want.Started = st.Started // zero either way
+	assert.Equal(t, want, st)
+	assert.NoFileExists(t, filepath.Join(dir, stateFile+".tmp"))
+
+	//-----------------------------------------------------
+	// saveThrottle updates only the state of its own
+	// simulator
+	//-----------------------------------------------------
+	sim := &Simulation{SID: 7, PID: 1234, Directory: dir}
+	sim.saveThrottle(throttled{reniced: true})
+	st, _ = readSimState(dir)
+	assert.False(t, st.Paused)
+	assert.True(t, st.Reniced)
+	(&Simulation{SID: 7, PID: 4321, Directory: dir}).saveThrottle(throttled{paused: true})
+	st, _ = readSimState(dir)
+	assert.False(t, st.Paused)
+
+	//-----------------------------------------------------
+	// a process that is gone, or another one with its
+	// PID, is not alive
+	//-----------------------------------------------------
+	assert.False(t, (&simState{}).alive())
+	if runtime.GOOS == "linux" {
+		me := newSimState(&Simulation{PID: syscall.Getpid()})
+		me.PGID = syscall.Getpgrp()
+		assert.True(t, me.alive())
+		me.StartTicks++
+		assert.False(t, me.alive(), "started at another time")
+	}
+}
+
+func TestAttach(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("finding the simulator's port needs /proc")
+	}
+	started := useFakeSim(t)
+	saved := throttle.sims
+	throttle.sims = map[int64]throttled{}
+	t.Cleanup(func() { throttle.sims = saved })
+
+	sim := startFake(t, started, 7, "")
+	waitAnswering(t, sim)
+	dir := sim.Directory
+
+	//-----------------------------------------------------
+	// a restarted simd finds the simulator through the
+	// state file
+	//-----------------------------------------------------
+	found := buildSimFromQueueItem(&data.QueueItem{SID: 7})
+	require.True(t, found.attach())
+	assert.Equal(t, sim.PID, found.PID)
+	assert.Equal(t, sim.FQSimStatusURL, found.FQSimStatusURL)
+	assert.Equal(t, "fake", found.Executor)
+	assert.Equal(t, "corr-1", found.CorrelationID, "the one it was booked with")
+
+	//-----------------------------------------------------
+	// a stopped simulator is continued before it is asked
+	// for its status, whoever stopped it, and one the old
+	// simd reniced is remembered
+	//-----------------------------------------------------
+	for _, tc := range []struct {
+		name    string
+		paused  bool
+		reniced bool
+	}{
+		{"paused by simd", true, true},
+		{"stopped by someone else", false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			throttle.sims = map[int64]throttled{}
+			require.NoError(t, syscall.Kill(-sim.PID, syscall.SIGSTOP))
+			waitState(t, sim.PID, 'T', false)
+			st, err := readSimState(dir)
+			require.NoError(t, err)
+			st.Paused, st.Reniced = tc.paused, tc.reniced
+			require.NoError(t, st.save(dir))
+
+			found := buildSimFromQueueItem(&data.QueueItem{SID: 7})
+			require.True(t, found.attach())
+			assert.NotEqual(t, byte('T'), procState(t, sim.PID))
+			st, err = readSimState(dir)
+			require.NoError(t, err)
+			assert.False(t, st.Paused)
+			assert.False(t, isPaused(7))
+			assert.Equal(t, tc.reniced, throttle.sims[7].reniced)
+		})
+	}
+
+	//-----------------------------------------------------
+	// a running simulator that does not answer for its
+	// SID is attached without a status URL, and left
+	// running
+	//-----------------------------------------------------
+	other := &Simulation{SID: 8, Directory: dir}
+	assert.True(t, other.attach())
+	assert.Equal(t, sim.PID, other.PID)
+	assert.Empty(t, other.FQSimStatusURL)
+	st, err := readSimState(dir)
+	require.NoError(t, err)
+	assert.True(t, st.alive())
+
+	//-----------------------------------------------------
+	// killSimulator kills it, and then it is not running
+	//-----------------------------------------------------
+	other.killSimulator()
+	deadline := time.Now().Add(5 * time.Second)
+	for st.alive() && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.False(t, st.alive())
+	found = buildSimFromQueueItem(&data.QueueItem{SID: 7})
+	assert.False(t, found.attach())
+	other.killSimulator() // nothing to kill
+}
+
+func TestReadProcStat(t *testing.T) {
+	for _, tc := range []struct {
+		pid  string
+		want procStat
+		ok   bool
+	}{
+		{"100", procStat{state: 'S', pgrp: 100, utime: 50, stime: 10, start: 12345}, true},
+		{"101", procStat{state: 'R', pgrp: 100, utime: 7, stime: 3, start: 12400}, true}, // its command name is "sim) (worker"
+		{"200", procStat{state: 'S', pgrp: 200, utime: 900, stime: 100, start: 500}, true},
+		{"300", procStat{}, false}, // cut short
+		{"999", procStat{}, false}, // gone
+	} {
+		t.Run(tc.pid, func(t *testing.T) {
+			got, err := readProcStat(filepath.Join("testdata", "proc", tc.pid, "stat"))
+			if !tc.ok {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestGroupPIDs(t *testing.T) {
+	proc := filepath.Join("testdata", "proc")
+	assert.ElementsMatch(t, []int{100, 101}, groupPIDs(proc, 100))
+	assert.Equal(t, []int{200}, groupPIDs(proc, 200))
+	assert.Empty(t, groupPIDs(proc, 999))
+}
+
+func TestTCPListeners(t *testing.T) {
+	dir := filepath.Join("testdata", "proc", "100", "net")
+	for _, tc := range []struct {
+		name   string
+		table  string
+		inodes []string
+		want   []int
+	}{
+		{"ours", "tcp", []string{"12345", "12347"}, []int{8090, 8093}},
+		{"not connections", "tcp", []string{"12346"}, nil},
+		{"not someone else's", "tcp", []string{"12345"}, []int{8090}},
+		{"none of ours", "tcp", []string{"55555"}, nil},
+		{"tcp6", "tcp6", []string{"22222", "22223"}, []int{8100}}, // 22223's port is unreadable
+		{"no table", "udp", []string{"12345"}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inodes := map[string]bool{}
+			for _, i := range tc.inodes {
+				inodes[i] = true
+			}
+			assert.Equal(t, tc.want, tcpListeners(filepath.Join(dir, tc.table), inodes))
+		})
+	}
+}
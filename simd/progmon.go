@@ -3,29 +3,68 @@ package main
 import (
 	"archive/tar"
 	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"syscall"
 	"time"
+
+	"github.com/stmansour/simq/client"
+	"github.com/stmansour/simq/proto"
 )
 
+// statusClient asks simulators for their status. A simulator that is stopped
+// or hung must not hang simd, so it has a timeout.
+var statusClient = &http.Client{Timeout: 10 * time.Second}
+
+// monitor watches a simulator until it ends. The tests replace it.
+var monitor = monitorSimulator
+
+// findEvery is how often simd looks for the port of a simulator that does
+// not answer yet
+var findEvery = 3 * time.Second
+
 // Simulation defines a running simulation managed by simd
 type Simulation struct {
 	Cmd            *exec.Cmd
+	PID            int // the simulator's process, which leads its process group; 0 = unknown
 	SID            int64
 	Directory      string
+	WorkDir        string // the simulator's working directory, empty = Directory
+	Executor       string // name of the executor that runs the simulator
+	CPUs           []int  // CPUs the simulator is pinned to, nil = any
+	Nice           int    // the simulator's nice level when it is not throttled
 	MachineID      string
 	SimPort        int
 	BaseURL        string
 	FQSimStatusURL string
 	ConfigFile     string
-	LastStatus     SimulatorStatus
+	LastStatus     proto.SimulatorStatus
+	LastReported   time.Time // when LastStatus was sent to the dispatcher, zero = never
+	CorrelationID  string    // sent with every dispatcher request about this simulation
+}
+
+// logger returns a logger that tags each record with the simulation's SID
+// and correlation ID
+// -----------------------------------------------------------------------------
+func (sim *Simulation) logger() *slog.Logger {
+	return slog.With("sid", sim.SID, "corr", sim.CorrelationID)
+}
+
+// workDir returns the simulator's working directory
+// -----------------------------------------------------------------------------
+func (sim *Simulation) workDir() string {
+	if len(sim.WorkDir) == 0 {
+		return sim.Directory
+	}
+	return sim.WorkDir
 }
 
 // Start the simulator with given SID and config file.
@@ -33,25 +72,35 @@ type Simulation struct {
 //
 //	sid - the simulation ID
 //	FQConfigFileName - the fully qualified name of the config file
+//	corr - the correlation ID used when the simulation was booked
+//	executorName - the executor the job asked for, empty = the default
 //
 // -----------------------------------------------------------------------------
-func startSimulator(sid int64, FQConfigFileName string) error {
-	log.Printf("startSimulator: %d\n", sid)
+func startSimulator(sid int64, FQConfigFileName, corr, executorName string) error {
+	x, err := findExecutor(executorName)
+	if err != nil {
+		return fmt.Errorf("startSimulator: SID=%d, %v", sid, err)
+	}
+
 	//-------------------------------------------------------------
 	// Start the simulator
-	// Simulator needs to run in ./simulator/<sid>/
+	// Simulator needs to run in ./simulator/<sid>/ unless its
+	// executor says otherwise. A simulator an earlier simd left
+	// running there must not run next to the new one.
 	//-------------------------------------------------------------
 	Directory := filepath.Join(app.cfg.SimdSimulationsDir, "simulations", fmt.Sprintf("%d", sid))
-	logFile := filepath.Join(Directory, "sim.log")
-	cmd := exec.Command("/usr/local/plato/bin/simwrapper",
-		"-c", FQConfigFileName,
-		"-SID", fmt.Sprintf("%d", sid),
-		"-DISPATCHER", app.cfg.DispatcherURL) // note: we pass the base url to simulator, not the fully qualified url
-
-	//----------------------------------------------
-	// Set the working directory for the command
-	//----------------------------------------------
-	cmd.Dir = Directory
+	killOrphan(Directory)
+	logFile := filepath.Join(Directory, x.log)
+	cmd, err := x.command(&execData{
+		SID:        sid,
+		Config:     FQConfigFileName,
+		Dir:        Directory,
+		Dispatcher: app.cfg.DispatcherURL,
+		MachineID:  app.cfg.MachineID,
+	})
+	if err != nil {
+		return fmt.Errorf("startSimulator: SID=%d, executor %s: %v", sid, x.name, err)
+	}
 
 	//----------------------------------------------
 	// Redirect stdout and stderr to the log file
@@ -72,39 +121,63 @@ func startSimulator(sid int64, FQConfigFileName string) error {
 		Pgid:    0,
 	}
 
+	//----------------------------------------------
+	// Limit the resources it may use
+	//----------------------------------------------
+	job, err := jobLimits(FQConfigFileName)
+	if err != nil {
+		slog.Warn("ignoring the job's limits", "sid", sid, "err", err)
+		job = Limits{}
+	}
+	lim := resolveLimits(sid, job)
+	if err := lim.prepare(cmd, Directory, cmd.Dir, logFile); err != nil {
+		outputFile.Close()
+		releaseLimits(sid)
+		return fmt.Errorf("startSimulator: SID=%d, failed to apply limits: %v", sid, err)
+	}
+
 	//----------------------------------------------
 	// Start the process
 	//----------------------------------------------
-	if err := cmd.Start(); err != nil {
+	if err := lim.start(cmd); err != nil {
 		outputFile.Close()
+		releaseLimits(sid)
 		return fmt.Errorf("startSimulator: SID=%d, failed to start simulator: %v", sid, err)
 	}
-
-	log.Printf("startSimulator: SID=%d, simulator started\n", sid)
+	pid := cmd.Process.Pid
 
 	//----------------------------------------------
-	// Detach the process. We don't want it to stop
-	// if this process exits or dies
+	// Reap it when it exits. It is in its own
+	// process group, so it keeps running if simd
+	// exits; its state file lets the next simd
+	// find it.
 	//----------------------------------------------
-	if err := cmd.Process.Release(); err != nil {
-		return fmt.Errorf("startSimulator: SID=%d, failed to detach simulator process: %v", sid, err)
-	}
+	go func() {
+		err := cmd.Wait()
+		slog.Info("simulator process exited", "sid", sid, "corr", corr, "pid", pid, "status", err)
+	}()
 
 	//----------------------------------------------------
 	// Creating process no longer needs this file handle
 	//----------------------------------------------------
 	outputFile.Close()
 
-	log.Printf("startSimulator: SID=%d, simulator process released\n", sid)
-
 	//---------------------------------------------------------------
 	// we have a new simulation in process. Add it to the list...
 	//---------------------------------------------------------------
 	sm := Simulation{
-		SID:       sid,
-		Directory: Directory,
-		Cmd:       cmd,
+		SID:           sid,
+		Directory:     Directory,
+		WorkDir:       cmd.Dir,
+		Executor:      x.name,
+		CPUs:          lim.cpus,
+		Nice:          lim.nice,
+		Cmd:           cmd,
+		PID:           pid,
+		CorrelationID: corr,
 	}
+	sm.saveState()
+	sm.logger().Info("simulator started", "config", FQConfigFileName, "executor", x.name, "path", cmd.Path, "dir", cmd.Dir, "limits", lim.String())
 	app.simsMu.Lock() // Lock the mutex before modifying app.sims
 	app.sims = append(app.sims, sm)
 	app.simsMu.Unlock() // Unlock the mutex after modification
@@ -112,14 +185,15 @@ func startSimulator(sid int64, FQConfigFileName string) error {
 	//---------------------------------------------------------------
 	// Monitor the simulator process
 	//---------------------------------------------------------------
-	go monitorSimulator(&sm)
+	go monitor(&sm)
 
 	return nil
 }
 
 // Monitor the simulator process
 func monitorSimulator(sim *Simulation) {
-	log.Printf("monitorSimulator: monitoring simulator for SID %d @ %s\n", sim.SID, sim.BaseURL)
+	lg := sim.logger()
+	lg.Debug("monitoring simulator", "url", sim.BaseURL)
 
 	//-----------------------------------------------------------------
 	// In some cases, the simulator may already be running. But
@@ -127,31 +201,25 @@ func monitorSimulator(sim *Simulation) {
 	// be started. So, give it a few seconds to start. If it's already
 	// running then 3 seconds from now is not going to hurt anything.
 	//-----------------------------------------------------------------
-	time.Sleep(3 * time.Second)
-	maxRetries := 3
+	time.Sleep(findEvery)
 	if len(sim.FQSimStatusURL) == 0 {
-		for retryCount := 0; retryCount < maxRetries; retryCount++ {
-			// fmt.Printf("DEBUG: retryCount = %d\n", retryCount)
-			if !sim.FindRunningSimulator() {
-				time.Sleep(3 * time.Second) // we'll wait for 1 minute, up to 5 times
-				continue                    // try again
-			}
-			break
-		}
-		if len(sim.FQSimStatusURL) == 0 {
+		if !sim.waitForSimulator(3) {
 			//------------------------------------------------------------------
 			// IT IS POSSIBLE THAT WE HAD A VERY FAST SIMULATION...
 			// CHECK TO SEE IF THE SIMULATION RESULT FILES ARE PRESENT...
+			// Whatever happened, its simulator must not keep running after
+			// the simulation has ended.
 			//------------------------------------------------------------------
-			filenames, err := getFilenamesInDir(sim.Directory)
+			sim.killSimulator()
+			filenames, err := sim.resultFiles()
 			if err != nil {
 				//-----------------------------------------------------------
 				// Exhausted retries.  No files to be found.  This computer
 				// seems to be having difficulties.  Tell dispatcher to put
 				// it in the Error state.
 				//-----------------------------------------------------------
-				if err = ErrorEndThisSimulation(sim); err != nil {
-					log.Printf("monitorSimulator: failed ErrorEndThisSimulation for SID %d, err = %s\n", sim.SID, err.Error())
+				if err = ErrorEndThisSimulation(sim, "simulator did not start and left no results"); err != nil {
+					lg.Error("ErrorEndThisSimulation failed", "err", err)
 					return
 				}
 				return
@@ -173,8 +241,8 @@ func monitorSimulator(sim *Simulation) {
 				//--------------------------------------------------------
 				// We've exhausted the retries and no files can be found
 				//--------------------------------------------------------
-				if err = ErrorEndThisSimulation(sim); err != nil {
-					log.Printf("monitorSimulator: failed ErrorEndThisSimulation for SID %d, err = %s\n", sim.SID, err.Error())
+				if err = ErrorEndThisSimulation(sim, "simulator is not running and finrep.csv is missing"); err != nil {
+					lg.Error("ErrorEndThisSimulation failed", "err", err)
 				}
 				return
 			}
@@ -184,29 +252,28 @@ func monitorSimulator(sim *Simulation) {
 			//----------------------------------------------------------------------
 			if !foundResultsTar {
 				if err = sim.archiveSimulationResults(); err != nil {
-					log.Printf("monitorSimulator: failed archiveSimulationResults for SID %d, err = %s\n", sim.SID, err.Error())
-					log.Printf("monitorSimulator: removing simulation with SID %d\n", sim.SID)
-					if err = ErrorEndThisSimulation(sim); err != nil {
-						log.Printf("monitorSimulator: failed ErrorEndThisSimulation for SID %d, err = %s\n", sim.SID, err.Error())
+					lg.Error("archiving results failed, removing simulation", "err", err)
+					if err = ErrorEndThisSimulation(sim, "archiving results failed: "+err.Error()); err != nil {
+						lg.Error("ErrorEndThisSimulation failed", "err", err)
 					}
 					return
 				}
 			}
 			if err = sim.sendEndSimulationRequest(); err != nil {
-				log.Printf("monitorSimulator: failed sendEndSimulationRequest for SID %d, err = %s\n", sim.SID, err.Error())
-				log.Printf("monitorSimulator: removing simulation with SID %d\n", sim.SID)
-				if err = ErrorEndThisSimulation(sim); err != nil {
-					log.Printf("monitorSimulator: failed ErrorEndThisSimulation for SID %d, err = %s\n", sim.SID, err.Error())
+				lg.Error("EndSimulation request failed, removing simulation", "err", err)
+				if err = ErrorEndThisSimulation(sim, "EndSimulation failed: "+err.Error()); err != nil {
+					lg.Error("ErrorEndThisSimulation failed", "err", err)
 				}
 				return
 			}
-			log.Printf("monitorSimulator: successfully ended SID %d\n", sim.SID)
+			lg.Info("simulation ended")
 			return
 		}
-		log.Printf("monitorSimulator: found running simulator for SID %d @ %s\n", sim.SID, sim.BaseURL)
+		lg.Info("found running simulator", "url", sim.BaseURL)
 	} else {
-		log.Printf("monitorSimulator: simulator @ %s\n", sim.BaseURL)
+		lg.Debug("simulator status url known", "url", sim.BaseURL)
 	}
+	sim.reportURL()
 
 	//-------------------------------------------------------------
 	// Create a ticker that triggers every 5 minutes
@@ -220,34 +287,66 @@ func monitorSimulator(sim *Simulation) {
 	//-------------------------------------------------------------
 	for range ticker.C {
 		// log.Printf("simd >>>> ticker loop >>>> Simulator @ %s is still running\n", sim.BaseURL)
-		if !sim.isSimulatorRunning() {
-			log.Printf("SID: %d, simulator @ %s is no longer running", sim.SID, sim.BaseURL)
-			break
+		if isPaused(sim.SID) {
+			continue // a stopped simulator cannot answer
+		}
+		if sim.isSimulatorRunning() {
+			continue
 		}
+		//----------------------------------------------------------
+		// One failed request does not mean it finished; it may be
+		// busy or briefly unreachable. It has ended only when its
+		// process has too.
+		//----------------------------------------------------------
+		if sim.processAlive() {
+			lg.Warn("simulator does not answer but its process is running", "pid", sim.PID, "url", sim.BaseURL)
+			continue
+		}
+		lg.Info("simulator is no longer running", "url", sim.BaseURL)
+		break
 	}
 	//-------------------------------------------------------------
 	// Simulator has finished. Verify status with dispatcher. If
 	// all is well, then transmit files to the dispatcher
 	//-------------------------------------------------------------
-	log.Printf("Simulator @ %s is no longer running.\n", sim.BaseURL)
 	if err := sim.archiveSimulationResults(); err != nil {
-		log.Printf("monitorSimulator: SID: %d, failed to archive simulation results: %v", sim.SID, err)
+		lg.Error("archiving results failed", "err", err)
 		return
 	}
-	log.Printf("monitorSimulator: SID: %d, Archived simulation results to %s\n", sim.SID, sim.Directory)
+	lg.Info("results archived", "dir", sim.Directory)
 
 	//-----------------------------------------
 	// Send the results to the dispatcher
 	//-----------------------------------------
 	if err := sim.sendEndSimulationRequest(); err != nil {
-		log.Printf("monitorSimulator: SID: %d, failed to send EndSimulation request: %v", sim.SID, err)
+		lg.Error("EndSimulation request failed", "err", err)
 		return
 	}
 }
 
+// waitForSimulator looks for the port of sim's simulator until it finds it.
+// It gives up after tries attempts, but not while the simulator's process is
+// running: a simulator may take long to answer. It reports whether it found
+// the port.
+// ------------------------------------------------------------------------------
+func (sim *Simulation) waitForSimulator(tries int) bool {
+	for try := 1; ; try++ {
+		if sim.findSimulator() {
+			return true
+		}
+		if try >= tries && !sim.processAlive() {
+			return false
+		}
+		if try%100 == 0 {
+			sim.logger().Warn("simulator is running but does not answer yet", "pid", sim.PID, "tries", try)
+		}
+		time.Sleep(findEvery)
+	}
+}
+
 // Check if the simulator process is still running
 func (sim *Simulation) isSimulatorRunning() bool {
-	resp, err := http.Get(sim.FQSimStatusURL)
+	resp, err := statusClient.Get(sim.FQSimStatusURL)
 	if err != nil {
 		log.Printf("isSimulatorRunning: SID=%d failed to get simulator status: %v", sim.SID, err)
 		return false
@@ -262,15 +361,34 @@ func (sim *Simulation) isSimulatorRunning() bool {
 	if resp.StatusCode != http.StatusOK {
 		log.Printf("isSimulatorRunning: SID=%d server returned error status: %s", sim.SID, resp.Status)
 	}
-	var status SimulatorStatus
+	var status proto.SimulatorStatus
 	err = json.Unmarshal(body, &status)
 	if err != nil {
 		log.Printf("isSimulatorRunning: SID=%d error unmarshaling response body: %v", sim.SID, err)
 		return false
 	}
+	sim.reportProgress(&status)
 	return true
 }
 
+// reportProgress sends status to the dispatcher if the simulator moved on
+// since the last status it was sent
+// ----------------------------------------------------------------------------
+func (sim *Simulation) reportProgress(status *proto.SimulatorStatus) {
+	last := &sim.LastStatus
+	if last.CompletedLoops == status.CompletedLoops && last.CompletedGenerations == status.CompletedGenerations &&
+		last.LoopCount == status.LoopCount && last.EstimatedCompletion == status.EstimatedCompletion && !sim.LastReported.IsZero() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(client.WithCorrelationID(app.ctx, sim.CorrelationID), 30*time.Second)
+	defer cancel()
+	if err := app.dispatcher.ReportProgress(ctx, sim.SID, status); err != nil {
+		sim.logger().Warn("could not report progress", "err", err)
+		return
+	}
+	sim.LastStatus, sim.LastReported = *status, time.Now()
+}
+
 // archiveSimulationResults adds all the files we care in the simulation directory
 // to a tar.gz file
 // -----------------------------------------------------------------------------------
@@ -320,10 +438,18 @@ func (sim *Simulation) archiveSimulationResults() error {
 	// Search for the files that matter and add them to the archive
 	//---------------------------------------------------------------
 	patterns := []string{"*.json5", "*.csv", "*.log"} // Define file patterns to archive
+	dirs := []string{"."}
+	if rel, err := filepath.Rel(sim.Directory, sim.workDir()); err == nil && rel != "." {
+		dirs = append(dirs, rel) // the executor ran the simulator in a subdirectory
+	}
 	for _, pattern := range patterns {
-		matches, err := filepath.Glob(pattern)
-		if err != nil {
-			return fmt.Errorf("archiveSimulationResults: SID=%d, failed to find files matching pattern %s: %w", sim.SID, pattern, err)
+		var matches []string
+		for _, dir := range dirs {
+			m, err := filepath.Glob(filepath.Join(dir, pattern))
+			if err != nil {
+				return fmt.Errorf("archiveSimulationResults: SID=%d, failed to find files matching pattern %s: %w", sim.SID, pattern, err)
+			}
+			matches = append(matches, m...)
 		}
 
 		for _, filePath := range matches {
@@ -366,17 +492,34 @@ func addFileToTar(tarWriter *tar.Writer, filePath string) error {
 	return err
 }
 
-// ErrorEndThisSimulation is called when this computer has exhausted all recovery
-// methods but cannot get a simulation to work.
+// reportURL tells the dispatcher where the simulator's simtalk endpoint is,
+// so that it can poll the simulator for progress
 // ----------------------------------------------------------------------------
-func ErrorEndThisSimulation(sim *Simulation) error {
-	// TODO
-	log.Printf("*** Please implement error state\n")
+func (sim *Simulation) reportURL() {
+	if len(app.cfg.SimdURL) == 0 || sim.SimPort == 0 {
+		return
+	}
+	u := fmt.Sprintf("http://%s:%d", app.cfg.SimdURL, sim.SimPort)
+	ctx := client.WithCorrelationID(context.Background(), sim.CorrelationID)
+	if _, err := app.dispatcher.UpdateItem(ctx, &proto.UpdateItemRequest{SID: sim.SID, URL: u}); err != nil {
+		sim.logger().Warn("could not report the simulator URL", "url", u, "err", err)
+	}
+}
 
+// ErrorEndThisSimulation is called when this computer has exhausted all recovery
+// methods but cannot get a simulation to work. It tells the dispatcher to put
+// the simulation in the Error state, with reason as the message.
+// ----------------------------------------------------------------------------
+func ErrorEndThisSimulation(sim *Simulation, reason string) error {
 	//--------------------------------------
 	// REMOVE THIS SIMULATION FROM THE LIST
 	//--------------------------------------
 	RemoveSimFromList(sim)
 	log.Printf("SetToErrorState:  SID %d has been removed from app.sims\n", sim.SID)
+
+	ctx := client.WithCorrelationID(context.Background(), sim.CorrelationID)
+	if _, err := app.dispatcher.UpdateItem(ctx, &proto.UpdateItemRequest{SID: sim.SID, Error: reason}); err != nil {
+		return fmt.Errorf("ErrorEndThisSimulation: %w", err)
+	}
 	return nil
 }
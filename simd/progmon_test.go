@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSim is the simulator in testdata/fakesim, built by TestMain
+var fakeSim string
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "fakesim")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fakeSim = filepath.Join(dir, "fakesim")
+	if out, err := exec.Command("go", "build", "-o", fakeSim, "./testdata/fakesim").CombinedOutput(); err != nil {
+		fmt.Fprintf(os.Stderr, "cannot build the fake simulator: %v\n%s", err, out)
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// useFakeSim makes the fake simulator simd's default executor, with the
+// simulations in a temporary directory. The "slow" executor's simulator
+// answers after a second, and the "mute" one exits after two without ever
+// answering. The simulations that are started
+// are sent to the channel it returns instead of being monitored.
+func useFakeSim(t *testing.T) chan *Simulation {
+	cfg, executors, sims, mon := app.cfg, app.executors, app.sims, monitor
+	t.Cleanup(func() { app.cfg, app.executors, app.sims, monitor = cfg, executors, sims, mon })
+
+	app.cfg.SimdSimulationsDir = t.TempDir()
+	app.cfg.MachineID = "m1"
+	app.cfg.DispatcherURL = "http://127.0.0.1:8250"
+	app.cfg.Limits = Limits{}
+	app.cfg.Cgroup, app.cfg.SimUser = "", ""
+	app.cfg.DefaultExecutor = "fake"
+	fake := Executor{
+		Path:    fakeSim,
+		Args:    []string{"-c", "{{.Config}}", "-SID", "{{.SID}}", "-DISPATCHER", "{{.Dispatcher}}"},
+		Env:     map[string]string{"FAKESIM_ENV": "{{.MachineID}}"},
+		WorkDir: "run",
+	}
+	slow, mute := fake, fake
+	slow.Args = append([]string{"-wait", "1s"}, fake.Args...)
+	mute.Args = append([]string{"-wait", "1h", "-for", "2s"}, fake.Args...)
+	app.cfg.Executors = map[string]Executor{"fake": fake, "slow": slow, "mute": mute}
+	require.NoError(t, setupExecutors())
+	app.sims = nil
+
+	started := make(chan *Simulation, 4)
+	monitor = func(sim *Simulation) { started <- sim }
+	return started
+}
+
+// startFake starts the fake simulator of executor x, or the default one,
+// for simulation sid and returns it as startSimulator left it. The
+// simulator is killed when the test ends.
+func startFake(t *testing.T, started chan *Simulation, sid int64, x string) *Simulation {
+	job := filepath.Join(t.TempDir(), "job.json5")
+	require.NoError(t, os.WriteFile(job, []byte("{}"), 0644))
+	require.NoError(t, startSimulator(sid, job, "corr-1", x))
+	var sim *Simulation
+	select {
+	case sim = <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the simulator was not monitored")
+	}
+	t.Cleanup(func() { syscall.Kill(-sim.PID, syscall.SIGKILL) })
+	return sim
+}
+
+// waitAnswering waits until sim's simulator answers status requests
+func waitAnswering(t *testing.T, sim *Simulation) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !sim.findSimulator() {
+		if time.Now().After(deadline) {
+			t.Fatal("the simulator does not answer")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestStartSimulator(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("finding the simulator's port needs /proc")
+	}
+	started := useFakeSim(t)
+	sim := startFake(t, started, 7, "")
+
+	dir := filepath.Join(app.cfg.SimdSimulationsDir, "simulations", "7")
+	assert.Equal(t, dir, sim.Directory)
+	assert.Equal(t, filepath.Join(dir, "run"), sim.WorkDir)
+	assert.Equal(t, "fake", sim.Executor)
+	assert.Equal(t, "corr-1", sim.CorrelationID)
+	assert.Positive(t, sim.PID)
+	require.Len(t, app.sims, 1)
+	assert.Equal(t, int64(7), app.sims[0].SID)
+
+	//-----------------------------------------------------
+	// it leads its own process group, so simd can signal
+	// everything it runs
+	//-----------------------------------------------------
+	pgid, err := syscall.Getpgid(sim.PID)
+	require.NoError(t, err)
+	assert.Equal(t, sim.PID, pgid)
+
+	//-----------------------------------------------------
+	// the state file has what a restarted simd needs
+	//-----------------------------------------------------
+	st, err := readSimState(dir)
+	require.NoError(t, err)
+	require.NotNil(t, st)
+	assert.Equal(t, int64(7), st.SID)
+	assert.Equal(t, sim.PID, st.PID)
+	assert.Equal(t, sim.PID, st.PGID)
+	assert.NotZero(t, st.StartTicks)
+	assert.Equal(t, "fake", st.Executor)
+	assert.Equal(t, "corr-1", st.CorrelationID)
+	assert.Zero(t, st.Port, "not found yet")
+	assert.True(t, st.alive())
+
+	waitAnswering(t, sim)
+	st, err = readSimState(dir)
+	require.NoError(t, err)
+	assert.Equal(t, sim.SimPort, st.Port)
+	assert.Equal(t, fmt.Sprintf("http://127.0.0.1:%d/status", st.Port), sim.FQSimStatusURL)
+
+	//-----------------------------------------------------
+	// the executor's templates reached the simulator,
+	// which runs in its WorkDir and logs to sim.log
+	//-----------------------------------------------------
+	b, err := os.ReadFile(filepath.Join(dir, "sim.log"))
+	require.NoError(t, err)
+	log := string(b)
+	assert.Contains(t, log, "sid=7\n")
+	assert.Contains(t, log, "dispatcher=http://127.0.0.1:8250\n")
+	assert.Contains(t, log, "dir="+filepath.Join(dir, "run")+"\n")
+	assert.Contains(t, log, "env=m1\n")
+
+	//-----------------------------------------------------
+	// the state file outlives the simulator, which is then
+	// no longer alive
+	//-----------------------------------------------------
+	require.NoError(t, st.kill())
+	deadline := time.Now().Add(5 * time.Second)
+	for st.alive() && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.False(t, st.alive())
+	assert.False(t, sim.processAlive())
+}
+
+func TestStartSimulatorUnknownExecutor(t *testing.T) {
+	useFakeSim(t)
+	err := startSimulator(7, "job.json5", "corr-1", "nope")
+	assert.ErrorContains(t, err, `no executor "nope"`)
+	assert.Empty(t, app.sims)
+}
+
+func TestWaitForSimulator(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("finding the simulator's port needs /proc")
+	}
+	started := useFakeSim(t)
+	every := findEvery
+	findEvery = 50 * time.Millisecond
+	t.Cleanup(func() { findEvery = every })
+
+	//-----------------------------------------------------
+	// a simulator that is slow to answer is waited for
+	// after the tries are used up, while it runs
+	//-----------------------------------------------------
+	sim := startFake(t, started, 7, "slow")
+	begin := time.Now()
+	assert.True(t, sim.waitForSimulator(1))
+	assert.GreaterOrEqual(t, time.Since(begin), 500*time.Millisecond)
+	assert.NotEmpty(t, sim.FQSimStatusURL)
+
+	//-----------------------------------------------------
+	// one that exits without answering is given up on
+	//-----------------------------------------------------
+	sim = startFake(t, started, 8, "mute")
+	assert.False(t, sim.waitForSimulator(1))
+	assert.False(t, sim.processAlive())
+	assert.Empty(t, sim.FQSimStatusURL)
+}
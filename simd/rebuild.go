@@ -1,10 +1,11 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -22,42 +23,18 @@ import (
 // the list of jobs it needs to see through.
 // -----------------------------------------------------------------------------
 func RebuildSimulatorList() error {
-	var err error
-	var dataBytes []byte
 	//----------------------------------------------------------------------
 	// DOES DISPATCHER HAVE ANY "IN-PROGRESS" SIMULATIONS FOR THIS MACHINE?
+	// This gives us the list of jobs that the dispatcher thinks we're
+	// working on...
 	//----------------------------------------------------------------------
-	cmd := util.Command{
-		Command:  "GetMachineQueue",
-		Username: "simd",
-	}
-	var cmdDataStruct struct {
-		MachineID string
-	}
-	if cmdDataStruct.MachineID, err = util.GetMachineUUID(); err != nil {
+	machineID, err := util.GetMachineUUID()
+	if err != nil {
 		return fmt.Errorf("failed to get machine ID: %v", err)
 	}
-	if dataBytes, err = json.Marshal(cmdDataStruct); err != nil {
-		return fmt.Errorf("failed to marshal book request: %v", err)
-	}
-	cmd.Data = json.RawMessage(dataBytes)
-	body := util.SendRequest(app.cfg.FQDispatcherURL, &cmd)
-
-	//-----------------------------------------------------------
-	// UNMARSHAL THE RESPONSE.  This gives us the list of jobs
-	// that the dispatcher thinks we're working on...
-	//-----------------------------------------------------------
-	resp := struct {
-		Status string
-		Data   []data.QueueItem
-	}{}
-	err = json.Unmarshal(body, &resp)
+	items, err := app.dispatcher.GetMachineQueue(context.Background(), machineID)
 	if err != nil {
-		if strings.Contains(err.Error(), "unexpected end of JSON input") {
-			log.Printf("dispatcher has no jobs currently pending on this machine\n")
-			return nil
-		}
-		log.Printf("Error unmarshaling response: %v\n", err)
+		return err
 	}
 
 	//-----------------------------------------------------------------
@@ -72,7 +49,7 @@ func RebuildSimulatorList() error {
 	dirPath := filepath.Join(app.cfg.SimdSimulationsDir, "simulations")
 	dir, err := os.ReadDir(dirPath)
 	if err != nil {
-		log.Printf("RebuildSimulatorList: error reading directory: %s: %v\n", dirPath, err)
+		slog.Warn("could not read the simulations directory", "dir", dirPath, "err", err)
 	}
 	for _, entry := range dir {
 		if entry.IsDir() {
@@ -84,36 +61,27 @@ func RebuildSimulatorList() error {
 		}
 	}
 
-	//------------------
-	// DEBUG
-	//------------------
-	log.Printf("SIMD: number of in-progress directories found in %s at startup: %d\n", app.simdHomeDir, len(dirs))
-	if len(dirs) > 0 {
-		log.Printf("SIMD: dispatcher reports %d simulations belonging to this machine\n", len(resp.Data))
-		s := "      SIDs = "
-		for i := 0; i < len(resp.Data); i++ {
-			s += fmt.Sprintf("%d ", resp.Data[i].SID)
-		}
-		log.Printf("%s\n", s)
-		log.Printf("SIMD: these SID simulation directories are in simd's simulation directory:\n")
-		s = "      DIRS = "
-		for i := 0; i < len(dirs); i++ {
-			s += fmt.Sprintf("%s ", dirs[i].Dir)
-		}
-		log.Printf("%s\n", s)
+	sids := make([]int64, len(items))
+	for i := range items {
+		sids[i] = items[i].SID
+	}
+	names := make([]string, len(dirs))
+	for i := range dirs {
+		names[i] = dirs[i].Dir
 	}
+	slog.Info("rebuilding the simulation list", "dir", dirPath, "dispatcher_sids", sids, "dirs", names)
 
 	//---------------------------------------------------------------------------
 	// WHAT JOBS IN THE SIMULATION DIRECTORY WERE ALSO LISTED BY THE DISPATCHER?
 	//---------------------------------------------------------------------------
-	for i := 0; i < len(resp.Data); i++ {
+	for i := 0; i < len(items); i++ {
 		for j := 0; j < len(dirs); j++ {
 			sid, err := strconv.ParseInt(dirs[j].Dir, 10, 64)
 			if err != nil {
 				continue // not a number
 			}
-			if resp.Data[i].SID == sid {
-				log.Printf("Found simulation to recover: %d\n", resp.Data[i].SID)
+			if items[i].SID == sid {
+				slog.Info("found a simulation to recover", "sid", items[i].SID)
 				dirs[j].InDispatcher = true // this dispatcher simulation is in our simulations directory
 				break
 			}
@@ -130,8 +98,9 @@ func RebuildSimulatorList() error {
 	//---------------------------------------------------------------------
 	for i := 0; i < len(dirs); i++ {
 		if !dirs[i].InDispatcher {
-			log.Printf("Deleting simulation not found in dispatcher: %s\n", dirs[i].Dir)
+			slog.Info("deleting a simulation the dispatcher does not list", "dir", dirs[i].Dir)
 			dir := filepath.Join(app.cfg.SimdSimulationsDir, "simulations", dirs[i].Dir)
+			killOrphan(dir)
 			os.RemoveAll(dir)
 		}
 	}
@@ -139,7 +108,7 @@ func RebuildSimulatorList() error {
 	//-------------------------------------------------------------------------
 	// ANALYZE AND TRY TO RECOVER THE REMAINING ITEMS IN THE DISPATCHER'S LIST
 	//-------------------------------------------------------------------------
-	for i := 0; i < len(resp.Data); i++ {
+	for i := 0; i < len(items); i++ {
 
 		for len(app.sims) >= app.cfg.MaxSimulations {
 			time.Sleep(4 * time.Second) // Wait for a specified interval before checking again
@@ -148,13 +117,13 @@ func RebuildSimulatorList() error {
 		//----------------------------------------------------------------
 		// Now that we can accommodate another simulation, take action...
 		//----------------------------------------------------------------
-		switch resp.Data[i].State {
+		switch items[i].State {
 		case data.StateBooked:
-			recoverBookedSimulation(&resp.Data[i])
+			recoverBookedSimulation(&items[i])
 		case data.StateExecuting:
-			recoverExecutingSimulation(&resp.Data[i])
+			recoverExecutingSimulation(&items[i])
 		case data.StateCompleted:
-			recoverArchiveSimResults(&resp.Data[i])
+			recoverArchiveSimResults(&items[i])
 		}
 
 	}
@@ -168,14 +137,15 @@ func RebuildSimulatorList() error {
 // existing simulator or restart it.
 // ------------------------------------------------------------------------------
 func recoverExecutingSimulation(qi *data.QueueItem) {
-	log.Printf("simd >>>> RECOVER EXECUTING SIMULATION - attempting to recover an executing simulation, sid = %d\n", qi.SID)
+	sim := buildSimFromQueueItem(qi)
+	lg := sim.logger()
+	lg.Info("recovering an executing simulation")
 	//----------------------------------------------
 	// IS THE SIMULATOR FOR THIS JOB STILL RUNNING?
 	//----------------------------------------------
-	sim := buildSimFromQueueItem(qi)
-	if sim.FindRunningSimulator() {
-		log.Printf("simd >>>> connected with running simulator for sid = %d\n", sim.SID)
-		go monitorSimulator(&sim)
+	if sim.attach() {
+		lg.Info("re-attached to the running simulator")
+		sim.monitorAttached()
 		return
 	}
 
@@ -190,23 +160,34 @@ func recoverExecutingSimulation(qi *data.QueueItem) {
 	//----------------------------------------------------------------
 	// IF THE FILES ARE NOT THERE, WE NEED TO RESTART THE SIMULATOR
 	//----------------------------------------------------------------
-	log.Printf("simd >>>> rebooking sid = %d\n", sim.SID)
+	lg.Info("rebooking the simulation")
 	bookAndRunSimulation("Rebook", sim.SID)
 }
 
+// monitorAttached adds sim, whose running simulator attach found, to the
+// list of simulations and monitors it
+// ------------------------------------------------------------------------------
+func (sim *Simulation) monitorAttached() {
+	app.simsMu.Lock()
+	app.sims = append(app.sims, *sim)
+	app.simsMu.Unlock()
+	go monitor(sim)
+}
+
 // recoverArchiveSimResults - In this case, the simulation was apparently
 // finished but the results were not archived. Attempt to archive them
 // -----------------------------------------------------------------------
 func recoverArchiveSimResults(qi *data.QueueItem) {
-	log.Printf("simd >>>> RECOVER ARCHIVED SIMULATION RESULTS - attempting to archive simulation results for sid = %d\n", qi.SID)
 	sim := buildSimFromQueueItem(qi)
+	lg := sim.logger()
+	lg.Info("archiving the results of a completed simulation")
 
 	//--------------------------------
 	// SEE IF THE ARCHIVE FILE EXISTS
 	//--------------------------------
-	files, err := getFilenamesInDir(sim.Directory)
+	files, err := sim.resultFiles()
 	if err != nil {
-		log.Printf("simd >>>> Simulation: %d - error while loading filenames in %s: error: %v\n", sim.SID, sim.Directory, err)
+		lg.Error("could not list the result files", "dir", sim.Directory, "err", err)
 		return
 	}
 	found := false
@@ -231,15 +212,14 @@ func recoverArchiveSimResults(qi *data.QueueItem) {
 			}
 		}
 		if !found {
-			log.Printf("simd >>>> NO RESULTS FROM SIMULATOR FOUND for SID: %d\n", sim.SID)
-			log.Printf("simd >>>> REBOOKING SID: %d TO PROPERLY GENERATE RESULTS\n", sim.SID)
+			lg.Warn("no results from the simulator, rebooking the simulation")
 			bookAndRunSimulation("Rebook", sim.SID)
 			return
 		}
 
 		err = sim.archiveSimulationResults()
 		if err != nil {
-			log.Printf("simd >>>> Simulation: %d - error creating results archive in %s: error: %v\n", sim.SID, sim.Directory, err)
+			lg.Error("could not create the results archive", "dir", sim.Directory, "err", err)
 			return
 		}
 	}
@@ -248,19 +228,20 @@ func recoverArchiveSimResults(qi *data.QueueItem) {
 	//  SEND END SIMULATION REQUEST
 	//--------------------------------
 	if err = sim.sendEndSimulationRequest(); err != nil {
-		log.Printf("Failed to send end simulation request: %v", err)
+		lg.Error("could not send the end simulation request", "err", err)
 		return
 	}
 
-	log.Printf("simd >>>> Simulation: %d - results archived in %s\n", sim.SID, sim.Directory)
+	lg.Info("results archived", "dir", sim.Directory)
 }
 
 // recoverBookedSimulation - In this case, the simulation was booked but
 // we never got the simulator started.  Try to recover.
 // -------------------------------------------------------------------------
 func recoverBookedSimulation(qi *data.QueueItem) {
-	log.Printf("simd >>>> RECOVER BOOKED SIMULATION - attempting to recover a booked simulation, sid = %d\n", qi.SID)
 	sim := buildSimFromQueueItem(qi)
+	lg := sim.logger()
+	lg.Info("recovering a booked simulation")
 
 	//-----------------------------------------------------------------
 	// Because I've seen it happen, just check to see if the simulator
@@ -274,11 +255,11 @@ func recoverBookedSimulation(qi *data.QueueItem) {
 			if !strings.Contains(err.Error(), "no such file or directory") {
 				return // error occurred and logged
 			}
-			log.Printf("recoverBookedSimulation: %d - error occurred looking for files in %s: error: %v\n", qi.SID, sim.Directory, err)
+			lg.Warn("could not look for the result files", "dir", sim.Directory, "err", err)
 		}
 
 		if recovered {
-			log.Printf("simd >>>> booked simulation recovered\n")
+			lg.Info("booked simulation recovered")
 			return
 		}
 	}
@@ -289,15 +270,14 @@ func recoverBookedSimulation(qi *data.QueueItem) {
 	//------------------------------------------------------------------
 	configs, err := findJSON5Files(sim.Directory)
 	if err != nil {
-		log.Printf("recoverBookedSimulation: %d - error occurred looking for config file in %s: error: %v\n", qi.SID, sim.Directory, err)
+		lg.Warn("could not look for the config file", "dir", sim.Directory, "err", err)
 	}
 
 	//---------------------------------------------------
 	// IF WE DID NOT FIND ANY CONFIG FILES, REBOOK
 	//---------------------------------------------------
 	if len(configs) == 0 {
-		log.Printf("Simulation for SID: %d - Missing config file in directory: %s\n", qi.SID, sim.Directory)
-		log.Printf("Rebooking SID=%d...\n", qi.SID)
+		lg.Warn("no config file, rebooking the simulation", "dir", sim.Directory)
 		bookAndRunSimulation("Rebook", qi.SID)
 		return
 	}
@@ -321,8 +301,8 @@ func recoverBookedSimulation(qi *data.QueueItem) {
 	// is still running. If it's not running, we'll need to restart it. If
 	// it is running, we just need to monitor it.
 	//-----------------------------------------------------------------------
-	if sim.FindRunningSimulator() {
-		go monitorSimulator(&sim)
+	if sim.attach() {
+		sim.monitorAttached()
 		return // found the simulator!!
 	}
 
@@ -337,31 +317,32 @@ func recoverBookedSimulation(qi *data.QueueItem) {
 // the simulation is done, then archive the results.
 // ------------------------------------------------------------------------------
 func (sim *Simulation) recoverBasedOnFiles() (bool, error) {
-	filenames, err := getFilenamesInDir(sim.Directory)
+	lg := sim.logger()
+	filenames, err := sim.resultFiles()
 	if err != nil {
 		if strings.Contains(err.Error(), "no such file or directory") {
 			//------------------------------------------------------------------
 			// THE SIMULATION HAS BEEN BOOKED BY THIS COMPUTER, BUT WE DON'T
 			// HAVE THE DIRECTORY OR THE CONFIG FILE.  REBOOK IT...
 			//------------------------------------------------------------------
-			log.Printf("recoverBasedOnFiles: no simulation directory for SID=%d, rebooking ...\n", sim.SID)
+			lg.Warn("no simulation directory, rebooking the simulation", "dir", sim.Directory)
 			bookAndRunSimulation("Rebook", sim.SID)
 			return true, nil
 		}
-		log.Printf("Simulation: %d - error occurred lookng for config file in %s: error: %v\n", sim.SID, sim.Directory, err)
+		lg.Error("could not list the result files", "dir", sim.Directory, "err", err)
 		return false, err
 	}
 	for i := 0; i < len(filenames); i++ {
 		if strings.Contains(filenames[i], "finrep.csv") {
 			if err = sim.archiveSimulationResults(); err != nil {
-				log.Printf("Simulation: %d - error occurred archiving results: error: %v\n", sim.SID, err)
+				lg.Error("could not archive the results", "err", err)
 				return false, err
 			}
 			if err = sim.sendEndSimulationRequest(); err != nil {
-				log.Printf("Simulation: %d - error occurred sending end request: error: %v\n", sim.SID, err)
+				lg.Error("could not send the end simulation request", "err", err)
 				return false, err
 			}
-			log.Printf("Successfully archived results for simulation: %d\n", sim.SID)
+			lg.Info("results archived", "dir", sim.Directory)
 			return true, nil
 		}
 	}
@@ -371,17 +352,14 @@ func (sim *Simulation) recoverBasedOnFiles() (bool, error) {
 
 func logNotListening(notlistening []int) {
 	if len(notlistening) > 0 {
-		s := "nothing listening on ports: "
-		for i := 0; i < len(notlistening); i++ {
-			s += fmt.Sprintf("%d ", notlistening[i])
-		}
-		log.Printf("%s\n", s)
+		slog.Debug("nothing listening on the simulator ports", "ports", notlistening)
 	}
 }
 
 // FindRunningSimulator - Search for a running simulator that belongs to this simulation
 // If it finds the simulator running it will return true. Otherwise it returns false
-// If it returns true, then sim.URL will be set
+// If it returns true, then sim.URL will be set. It scans the simulator ports, so
+// it is only used where there is no state file or no /proc; see findSimulator.
 // --------------------------------------------------------------------------------
 func (sim *Simulation) FindRunningSimulator() bool {
 	//---------------------------------------------
@@ -397,7 +375,7 @@ func (sim *Simulation) FindRunningSimulator() bool {
 				notlistening = append(notlistening, port)
 				continue
 			}
-			log.Printf("Error searching for sid on port %d: %v", port, err)
+			slog.Warn("could not ask the simulator port for its SID", "port", port, "err", err)
 			continue
 		}
 		if foundSID && sim.SID == sid {
@@ -407,7 +385,7 @@ func (sim *Simulation) FindRunningSimulator() bool {
 			// The simulator is still running.  Save the URL
 			// and continue to monitor it as usual
 			//----------------------------------------------------
-			log.Printf("simd:  >>>>    **** CONNECTED ****   Connected with simulatorfor SID = %d on port %d\n", sim.SID, port)
+			sim.logger().Info("found the running simulator", "port", port)
 			sim.SimPort = port
 			sim.BaseURL = fmt.Sprintf("http://127.0.0.1:%d", port)
 			sim.FQSimStatusURL = url
@@ -421,7 +399,7 @@ func (sim *Simulation) FindRunningSimulator() bool {
 // FetchSID sends a request to the provided URL and extracts the "SID" field if it exists.
 func FetchSID(url string) (int64, bool, error) {
 	// Send the HTTP request
-	resp, err := http.Get(url)
+	resp, err := statusClient.Get(url)
 	if err != nil {
 		return 0, false, fmt.Errorf("failed to send request: %w", err)
 	}
@@ -499,10 +477,30 @@ func getFilenamesInDir(dirPath string) ([]string, error) {
 func buildSimFromQueueItem(qi *data.QueueItem) Simulation {
 	dir := filepath.Join(app.cfg.SimdSimulationsDir, "simulations", fmt.Sprintf("%d", qi.SID))
 	sim := Simulation{
-		SID:        qi.SID,
-		Directory:  dir,
-		ConfigFile: qi.File,
+		SID:           qi.SID,
+		Directory:     dir,
+		ConfigFile:    qi.File,
+		CorrelationID: util.NewCorrelationID(),
+	}
+	if x, err := findExecutor(qi.Executor); err == nil {
+		sim.Executor = x.name
+		sim.WorkDir, _ = x.dir(&execData{SID: qi.SID, Dir: dir, Dispatcher: app.cfg.DispatcherURL, Executor: x.name, MachineID: app.cfg.MachineID})
 	}
 
 	return sim
 }
+
+// resultFiles returns the names of the files in the simulation directory
+// and, if the simulator runs in a subdirectory, in that one too
+// ------------------------------------------------------------------------------
+func (sim *Simulation) resultFiles() ([]string, error) {
+	names, err := getFilenamesInDir(sim.Directory)
+	if err != nil || sim.workDir() == sim.Directory {
+		return names, err
+	}
+	more, err := getFilenamesInDir(sim.workDir())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return append(names, more...), nil
+}
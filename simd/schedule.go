@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yosuke-furukawa/json5/encoding/json5"
+)
+
+// Overflow policies: what happens to the simulations still running when the
+// availability schedule closes
+const (
+	OverflowFinish = "finish" // let them run to the end (default)
+	OverflowRenice = "renice" // lower their CPU priority
+	OverflowPause  = "pause"  // stop them until the schedule opens again
+)
+
+// Window is a weekly period in which simd may book simulations
+type Window struct {
+	Days           string // e.g. "Mon-Fri", "Sat,Sun", "1-5" (0 and 7 are Sunday), empty or "*" = every day
+	Start          string // "HH:MM", default 00:00
+	End            string // "HH:MM", default 24:00. An End before Start runs past midnight into the next day.
+	MaxSimulations int    // limit during this window, 0 = MaxSimulations
+}
+
+// Availability says when simd may book simulations. Without windows or
+// holidays, it may book at any time. In simdconf.json5 it can also be the
+// string "always".
+type Availability struct {
+	Timezone              string   // IANA name like "America/Los_Angeles", default local time
+	Windows               []Window // weekly windows
+	Holidays              []string // "YYYY-MM-DD" dates that are open all day
+	HolidayMaxSimulations int      // limit on holidays, 0 = MaxSimulations
+	Overflow              string   // finish, renice or pause
+}
+
+// UnmarshalJSON accepts an Availability object or the string "always". It
+// is called with the json5 text of simdconf.json5.
+// ------------------------------------------------------------------------------
+func (a *Availability) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json5.Unmarshal(b, &s); err == nil {
+		if len(s) > 0 && s != "always" {
+			return fmt.Errorf("Availability must be \"always\" or a schedule, not %q", s)
+		}
+		*a = Availability{}
+		return nil
+	}
+	type plain Availability // plain has no UnmarshalJSON
+	return json5.Unmarshal(b, (*plain)(a))
+}
+
+// window is a compiled Window
+type window struct {
+	days       [7]bool // indexed by time.Weekday
+	start, end int     // minutes after midnight; end may be 1440
+	max        int
+}
+
+// schedule is a compiled Availability
+type schedule struct {
+	loc        *time.Location
+	windows    []window
+	holidays   map[string]bool // "YYYY-MM-DD"
+	holidayMax int
+	overflow   string
+	summary    string
+}
+
+var dayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// parseDay converts a day name or cron day number to a time.Weekday
+// ------------------------------------------------------------------------------
+func parseDay(s string) (int, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 && n <= 7 {
+		return n % 7, nil
+	}
+	for i, d := range dayNames {
+		if len(s) >= 3 && strings.HasPrefix(s, d) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid day: %q", s)
+}
+
+// parseDays converts a Window's Days to the set of days it covers
+// ------------------------------------------------------------------------------
+func parseDays(s string) ([7]bool, error) {
+	var days [7]bool
+	s = strings.TrimSpace(s)
+	if len(s) == 0 || s == "*" {
+		return [7]bool{true, true, true, true, true, true, true}, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		a, err := parseDay(from)
+		if err != nil {
+			return days, err
+		}
+		b := a
+		if isRange {
+			if b, err = parseDay(to); err != nil {
+				return days, err
+			}
+		}
+		for d := a; ; d = (d + 1) % 7 { // ranges may wrap, e.g. Fri-Mon
+			days[d] = true
+			if d == b {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// parseClock converts "HH:MM" to minutes after midnight. "24:00" is 1440.
+// ------------------------------------------------------------------------------
+func parseClock(s string, def int) (int, error) {
+	if len(strings.TrimSpace(s)) == 0 {
+		return def, nil
+	}
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err == nil {
+		return t.Hour()*60 + t.Minute(), nil
+	}
+	if strings.TrimSpace(s) == "24:00" {
+		return 24 * 60, nil
+	}
+	return 0, fmt.Errorf("invalid time of day: %q", s)
+}
+
+// compile checks a and returns its schedule
+// ------------------------------------------------------------------------------
+func (a *Availability) compile() (*schedule, error) {
+	sc := &schedule{loc: time.Local, holidays: map[string]bool{}, holidayMax: a.HolidayMaxSimulations, overflow: a.Overflow}
+	if len(a.Timezone) > 0 {
+		loc, err := time.LoadLocation(a.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Timezone: %v", err)
+		}
+		sc.loc = loc
+	}
+	switch sc.overflow {
+	case "":
+		sc.overflow = OverflowFinish
+	case OverflowFinish, OverflowRenice, OverflowPause:
+	default:
+		return nil, fmt.Errorf("invalid Overflow %q: use %s, %s or %s", a.Overflow, OverflowFinish, OverflowRenice, OverflowPause)
+	}
+	var parts []string
+	for i, w := range a.Windows {
+		var cw window
+		var err error
+		if cw.days, err = parseDays(w.Days); err != nil {
+			return nil, fmt.Errorf("window %d: %v", i+1, err)
+		}
+		if cw.start, err = parseClock(w.Start, 0); err != nil {
+			return nil, fmt.Errorf("window %d: %v", i+1, err)
+		}
+		if cw.end, err = parseClock(w.End, 24*60); err != nil {
+			return nil, fmt.Errorf("window %d: %v", i+1, err)
+		}
+		cw.max = w.MaxSimulations
+		sc.windows = append(sc.windows, cw)
+		days := w.Days
+		if len(days) == 0 {
+			days = "*"
+		}
+		parts = append(parts, fmt.Sprintf("%s %02d:%02d-%02d:%02d", days, cw.start/60, cw.start%60, cw.end/60, cw.end%60))
+	}
+	for _, h := range a.Holidays {
+		d, err := time.Parse("2006-01-02", strings.TrimSpace(h))
+		if err != nil {
+			return nil, fmt.Errorf("invalid holiday %q, use YYYY-MM-DD", h)
+		}
+		sc.holidays[d.Format("2006-01-02")] = true
+	}
+	if len(a.Holidays) > 0 {
+		parts = append(parts, fmt.Sprintf("%d holidays", len(a.Holidays)))
+	}
+	if len(parts) == 0 {
+		sc.summary = "always"
+	} else {
+		sc.summary = strings.Join(parts, "; ") + " " + sc.loc.String()
+	}
+	return sc, nil
+}
+
+// always reports whether the schedule is open at all times
+// ------------------------------------------------------------------------------
+func (sc *schedule) always() bool {
+	return len(sc.windows) == 0 && len(sc.holidays) == 0
+}
+
+// open reports whether simd may book at t, and the limit on simulations
+// then (0 = MaxSimulations)
+// ------------------------------------------------------------------------------
+func (sc *schedule) open(t time.Time) (bool, int) {
+	if sc.always() {
+		return true, 0
+	}
+	t = t.In(sc.loc)
+	if sc.holidays[t.Format("2006-01-02")] {
+		return true, sc.holidayMax
+	}
+	now := t.Hour()*60 + t.Minute()
+	today := t.Weekday()
+	yesterday := (today + 6) % 7
+	for _, w := range sc.windows {
+		switch {
+		case w.start < w.end:
+			if w.days[today] && now >= w.start && now < w.end {
+				return true, w.max
+			}
+		default: // runs past midnight; start == end is a whole day
+			if w.days[today] && now >= w.start || w.days[yesterday] && now < w.end {
+				return true, w.max
+			}
+		}
+	}
+	return false, 0
+}
+
+// enforceSchedule applies the overflow policy to the running simulations when
+// the schedule closes and undoes it when it opens again
+// ------------------------------------------------------------------------------
+func enforceSchedule(now time.Time) {
+	open, _ := app.sched.open(now)
+	throttle.mu.Lock()
+	changed := open != app.schedOpen
+	app.schedOpen = open
+	throttle.mu.Unlock()
+	if changed {
+		slog.Info("availability changed", "open", open, "schedule", app.sched.summary)
+	}
+	if applyThrottle() {
+		go sendHeartbeat()
+	}
+}
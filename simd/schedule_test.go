@@ -0,0 +1,185 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	_ "time/tzdata" // the fixtures name time zones
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yosuke-furukawa/json5/encoding/json5"
+)
+
+// weekdays returns the set of days ds
+func weekdays(ds ...time.Weekday) [7]bool {
+	var days [7]bool
+	for _, d := range ds {
+		days[d] = true
+	}
+	return days
+}
+
+// loadSchedule compiles the Availability in testdata/schedule/name
+func loadSchedule(t *testing.T, name string) *schedule {
+	b, err := os.ReadFile(filepath.Join("testdata", "schedule", name))
+	require.NoError(t, err)
+	var a Availability
+	require.NoError(t, json5.Unmarshal(b, &a))
+	sc, err := a.compile()
+	require.NoError(t, err)
+	return sc
+}
+
+func TestParseDays(t *testing.T) {
+	all := weekdays(time.Sunday, time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday)
+	for _, tc := range []struct {
+		days string
+		want [7]bool
+		ok   bool
+	}{
+		{"", all, true},
+		{"*", all, true},
+		{"Mon-Fri", weekdays(time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday), true},
+		{"Fri-Mon", weekdays(time.Friday, time.Saturday, time.Sunday, time.Monday), true},
+		{"Sat-Sun", weekdays(time.Saturday, time.Sunday), true},
+		{"sun-sun", weekdays(time.Sunday), true},
+		{"Sat,Sun", weekdays(time.Saturday, time.Sunday), true},
+		{"monday, Wednesday", weekdays(time.Monday, time.Wednesday), true},
+		{"1-5", weekdays(time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday), true},
+		{"5-1", weekdays(time.Friday, time.Saturday, time.Sunday, time.Monday), true},
+		{"0", weekdays(time.Sunday), true},
+		{"7", weekdays(time.Sunday), true},
+		{"6-7", weekdays(time.Saturday, time.Sunday), true},
+		{"Mo", [7]bool{}, false},
+		{"8", [7]bool{}, false},
+		{"Mon-", [7]bool{}, false},
+		{"Mon,,Tue", [7]bool{}, false},
+		{"weekdays", [7]bool{}, false},
+	} {
+		t.Run(tc.days, func(t *testing.T) {
+			got, err := parseDays(tc.days)
+			if !tc.ok {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestParseClock(t *testing.T) {
+	for _, tc := range []struct {
+		clock string
+		want  int
+		ok    bool
+	}{
+		{"", -1, true}, // the default
+		{"00:00", 0, true},
+		{"08:30", 510, true},
+		{"7:05", 425, true},
+		{"23:59", 1439, true},
+		{"24:00", 1440, true},
+		{" 24:00 ", 1440, true},
+		{"24:01", 0, false},
+		{"25:00", 0, false},
+		{"12", 0, false},
+		{"noon", 0, false},
+	} {
+		t.Run(tc.clock, func(t *testing.T) {
+			got, err := parseClock(tc.clock, -1)
+			if !tc.ok {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestScheduleOpen(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+	at := func(loc *time.Location, s string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04", s, loc)
+		require.NoError(t, err)
+		return tm
+	}
+
+	for _, tc := range []struct {
+		file string
+		t    time.Time
+		open bool
+		max  int
+	}{
+		//-------------------------------------------------
+		// 2024-12-23 is a Monday
+		//-------------------------------------------------
+		{"nights.json5", at(ny, "2024-12-23 12:00"), false, 0},
+		{"nights.json5", at(ny, "2024-12-23 18:00"), true, 2},
+		{"nights.json5", at(ny, "2024-12-24 02:00"), true, 2}, // past midnight, Monday's window
+		{"nights.json5", at(ny, "2024-12-24 07:59"), true, 2},
+		{"nights.json5", at(ny, "2024-12-24 08:00"), false, 0},
+		{"nights.json5", at(ny, "2024-12-23 03:00"), false, 0}, // Sunday night is not a weeknight
+		{"nights.json5", at(ny, "2024-12-21 07:00"), true, 2},  // Friday's window comes first
+		{"nights.json5", at(ny, "2024-12-21 12:00"), true, 4},
+		{"nights.json5", at(ny, "2024-12-25 12:00"), true, 8}, // holiday
+		{"nights.json5", at(ny, "2024-12-26 00:30"), true, 2}, // Wednesday's window, not the holiday
+
+		//-------------------------------------------------
+		// the schedule's time zone decides, including its
+		// daylight saving time
+		//-------------------------------------------------
+		{"nights.json5", at(time.UTC, "2024-12-25 03:00"), true, 2},  // 22:00 on the 24th in New York
+		{"nights.json5", at(time.UTC, "2024-12-23 22:00"), false, 0}, // 17:00 EST
+		{"nights.json5", at(time.UTC, "2024-07-01 22:00"), true, 2},  // 18:00 EDT
+
+		//-------------------------------------------------
+		// 2024-12-27 is a Friday
+		//-------------------------------------------------
+		{"longweekend.json5", at(time.UTC, "2024-12-26 23:00"), false, 0},
+		{"longweekend.json5", at(time.UTC, "2024-12-27 11:59"), false, 0},
+		{"longweekend.json5", at(time.UTC, "2024-12-27 12:00"), true, 0},
+		{"longweekend.json5", at(time.UTC, "2024-12-29 03:00"), true, 0},
+		{"longweekend.json5", at(time.UTC, "2024-12-31 11:59"), true, 0}, // Monday's window
+		{"longweekend.json5", at(time.UTC, "2024-12-31 12:00"), false, 0},
+		{"longweekend.json5", at(time.UTC, "2025-01-01 12:00"), false, 0},
+
+		{"always.json5", at(time.UTC, "2024-12-23 03:00"), true, 0},
+	} {
+		t.Run(tc.file+" "+tc.t.Format(time.RFC3339), func(t *testing.T) {
+			open, max := loadSchedule(t, tc.file).open(tc.t)
+			assert.Equal(t, tc.open, open)
+			assert.Equal(t, tc.max, max)
+		})
+	}
+}
+
+func TestScheduleCompile(t *testing.T) {
+	sc := loadSchedule(t, "nights.json5")
+	assert.Equal(t, OverflowPause, sc.overflow)
+	assert.Equal(t, "Mon-Fri 18:00-08:00; Sat,Sun 00:00-24:00; 1 holidays America/New_York", sc.summary)
+	assert.True(t, loadSchedule(t, "always.json5").always())
+
+	for _, tc := range []struct {
+		name string
+		a    Availability
+	}{
+		{"timezone", Availability{Timezone: "Mars/Olympus_Mons"}},
+		{"overflow", Availability{Overflow: "kill"}},
+		{"days", Availability{Windows: []Window{{Days: "Mon-Someday"}}}},
+		{"start", Availability{Windows: []Window{{Start: "9am"}}}},
+		{"end", Availability{Windows: []Window{{End: "24:30"}}}},
+		{"holiday", Availability{Holidays: []string{"12/25/2024"}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tc.a.compile()
+			assert.Error(t, err)
+		})
+	}
+	var a Availability
+	assert.Error(t, json5.Unmarshal([]byte(`"sometimes"`), &a))
+}
@@ -0,0 +1,39 @@
+// fakesim is a stand-in simulator for the simd tests. It serves /status
+// with its SID, the way the simulators do, and prints what it was started
+// with so that the tests can check it. With -wait it is slow to start
+// answering.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+func main() {
+	sid := flag.Int64("SID", 0, "simulation ID")
+	cfg := flag.String("c", "", "config file")
+	disp := flag.String("DISPATCHER", "", "dispatcher URL")
+	life := flag.Duration("for", time.Minute, "exit after this long")
+	wait := flag.Duration("wait", 0, "answer only after this long")
+	flag.Parse()
+	time.AfterFunc(*life, func() { os.Exit(0) })
+
+	wd, _ := os.Getwd()
+	fmt.Printf("sid=%d\nconfig=%s\ndispatcher=%s\ndir=%s\nenv=%s\n", *sid, *cfg, *disp, wd, os.Getenv("FAKESIM_ENV"))
+
+	time.Sleep(*wait)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"SID": *sid, "LoopCount": 1})
+	})
+	http.Serve(ln, nil)
+}
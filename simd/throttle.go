@@ -0,0 +1,124 @@
+package main
+
+import (
+	"sync"
+	"syscall"
+)
+
+// throttleNice is the nice level of reniced simulators. When they are no
+// longer throttled they get the nice level of their Limits back.
+const throttleNice = 19
+
+// throttled is what simd did to a simulator to give the machine back
+type throttled struct {
+	paused  bool // stopped with SIGSTOP
+	reniced bool // running at throttleNice
+}
+
+// throttle keeps what was done to each simulator. Both the availability
+// schedule and the load monitor can ask for a simulator to be paused or
+// reniced; it is continued or given its priority back only when neither
+// does.
+var throttle struct {
+	mu   sync.Mutex
+	sims map[int64]throttled // SID -> what was done to it
+}
+
+// isPaused reports whether simd has stopped the simulator of simulation sid
+// ------------------------------------------------------------------------------
+func isPaused(sid int64) bool {
+	throttle.mu.Lock()
+	defer throttle.mu.Unlock()
+	return throttle.sims[sid].paused
+}
+
+// setThrottled records that the simulator of simulation sid is in state t,
+// e.g. one a restarted simd found reniced
+// ------------------------------------------------------------------------------
+func setThrottled(sid int64, t throttled) {
+	throttle.mu.Lock()
+	defer throttle.mu.Unlock()
+	if throttle.sims == nil {
+		throttle.sims = map[int64]throttled{}
+	}
+	throttle.sims[sid] = t
+}
+
+// applyThrottle pauses or renices the running simulators, or undoes that, as
+// the availability schedule and the load monitor want. Each simulator's state
+// file records what was done to it. It reports whether it changed anything,
+// which the dispatcher should then be told.
+// ------------------------------------------------------------------------------
+func applyThrottle() bool {
+	throttle.mu.Lock()
+	defer throttle.mu.Unlock()
+	if throttle.sims == nil {
+		throttle.sims = map[int64]throttled{}
+	}
+
+	//------------------------------------------------------
+	// What do the schedule and the load monitor want?
+	//------------------------------------------------------
+	want := throttled{}
+	closed := !app.schedOpen
+	yield := app.load.yielding()
+	want.paused = closed && app.sched.overflow == OverflowPause || yield && app.cfg.Load.Yield == OverflowPause
+	want.reniced = closed && app.sched.overflow == OverflowRenice || yield && app.cfg.Load.Yield == OverflowRenice
+
+	app.simsMu.Lock()
+	sims := make([]Simulation, len(app.sims))
+	copy(sims, app.sims)
+	app.simsMu.Unlock()
+
+	changed := false
+	running := map[int64]bool{}
+	for i := range sims {
+		sim := &sims[i]
+		running[sim.SID] = true
+		have := throttle.sims[sim.SID]
+		if have == want {
+			continue
+		}
+		lg := sim.logger().With("pid", sim.PID, "schedule_open", !closed, "user_active", yield)
+		if sim.PID <= 0 {
+			lg.Warn("simulator process unknown, cannot pause or renice it")
+			throttle.sims[sim.SID] = want // do not warn again
+			continue
+		}
+		if have.paused != want.paused {
+			sig := syscall.SIGCONT
+			if want.paused {
+				sig = syscall.SIGSTOP
+			}
+			if err := syscall.Kill(-sim.PID, sig); err != nil {
+				lg.Warn("could not signal the simulator", "signal", sig, "err", err)
+			} else {
+				have.paused = want.paused
+				lg.Info("simulator signaled", "signal", sig)
+			}
+		}
+		if have.reniced != want.reniced {
+			nice := sim.Nice // raising it back may need privileges
+			if want.reniced {
+				nice = throttleNice
+			}
+			if err := syscall.Setpriority(syscall.PRIO_PGRP, sim.PID, nice); err != nil {
+				lg.Warn("could not renice the simulator", "nice", nice, "err", err)
+			} else {
+				lg.Info("simulator reniced", "nice", nice)
+			}
+			have.reniced = want.reniced
+		}
+		if have != throttle.sims[sim.SID] {
+			changed = true
+			sim.saveThrottle(have)
+		}
+		throttle.sims[sim.SID] = have
+	}
+	for sid := range throttle.sims {
+		if !running[sid] {
+			delete(throttle.sims, sid)
+		}
+	}
+	return changed
+}
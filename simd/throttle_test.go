@@ -0,0 +1,117 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stmansour/simq/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startSleeper starts a process that leads its own process group, like a
+// simulator, and kills it when the test ends
+func startSleeper(t *testing.T) int {
+	cmd := exec.Command("sleep", "60")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	require.NoError(t, cmd.Start())
+	t.Cleanup(func() {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		cmd.Wait()
+	})
+	return cmd.Process.Pid
+}
+
+// procNice returns the nice level of process pid
+func procNice(t *testing.T, pid int) int {
+	b, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	require.NoError(t, err)
+	fields := strings.Fields(string(b[strings.LastIndexByte(string(b), ')')+1:]))
+	nice, err := strconv.Atoi(fields[16])
+	require.NoError(t, err)
+	return nice
+}
+
+func TestApplyThrottle(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("checking the simulator's state needs /proc")
+	}
+	sims, sched, open, load, cfg, saved := app.sims, app.sched, app.schedOpen, app.load, app.cfg.Load, throttle.sims
+	t.Cleanup(func() {
+		app.sims, app.sched, app.schedOpen, app.load, app.cfg.Load, throttle.sims = sims, sched, open, load, cfg, saved
+	})
+	throttle.sims = nil
+
+	pid := startSleeper(t)
+	dir := t.TempDir()
+	sim := Simulation{SID: 7, PID: pid, Directory: dir}
+	require.NoError(t, newSimState(&sim).save(dir))
+	app.sims = []Simulation{sim, {SID: 8, Directory: t.TempDir()}} // 8's process is unknown
+
+	//-----------------------------------------------------
+	// each step sets the schedule and the machine's use,
+	// and says what the simulator should then be
+	//-----------------------------------------------------
+	for _, tc := range []struct {
+		name       string
+		closed     bool
+		overflow   string
+		userActive bool
+		yield      string
+		paused     bool
+		reniced    bool
+		changed    bool
+	}{
+		{"open and quiet", false, OverflowPause, false, OverflowRenice, false, false, false},
+		{"closed, pause", true, OverflowPause, false, OverflowRenice, true, false, true},
+		{"still closed", true, OverflowPause, false, OverflowRenice, true, false, false},
+		{"closed and in use", true, OverflowPause, true, OverflowRenice, true, true, true},
+		{"open and in use", false, OverflowPause, true, OverflowRenice, false, true, true},
+		{"in use, yield nothing", false, OverflowPause, true, "", false, false, true},
+		{"closed, finish", true, OverflowFinish, false, "", false, false, false},
+		{"closed, renice", true, OverflowRenice, false, "", false, true, true},
+		{"in use, pause", false, OverflowRenice, true, OverflowPause, true, false, true},
+		{"open again", false, OverflowFinish, false, OverflowPause, false, false, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			app.schedOpen = !tc.closed
+			app.sched = &schedule{overflow: tc.overflow}
+			app.cfg.Load = LoadConfig{Yield: tc.yield}
+			app.load = &loadMonitor{cfg: app.cfg.Load, status: proto.LoadStatus{UserActive: tc.userActive}}
+
+			assert.Equal(t, tc.changed, applyThrottle())
+			assert.Equal(t, throttled{paused: tc.paused, reniced: tc.reniced}, throttle.sims[7])
+			assert.Equal(t, tc.paused, isPaused(7))
+			if tc.paused {
+				waitState(t, pid, 'T', false)
+			} else {
+				waitState(t, pid, 'T', true)
+			}
+			nice := procNice(t, pid)
+			switch {
+			case tc.reniced:
+				assert.Equal(t, throttleNice, nice)
+			case os.Geteuid() == 0: // others may not raise the priority again
+				assert.Equal(t, 0, nice)
+			}
+
+			st, err := readSimState(dir)
+			require.NoError(t, err)
+			assert.Equal(t, tc.paused, st.Paused, "the state file says what was done")
+			assert.Equal(t, tc.reniced, st.Reniced)
+		})
+	}
+
+	//-----------------------------------------------------
+	// simulations that ended are forgotten
+	//-----------------------------------------------------
+	app.sims = nil
+	assert.False(t, applyThrottle())
+	assert.Empty(t, throttle.sims)
+}
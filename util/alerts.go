@@ -0,0 +1,15 @@
+package util
+
+// AlertConfig sets the thresholds of the dispatcher's alert rules and what
+// it does, besides logging, when one matches. A rule whose threshold is
+// negative is off.
+type AlertConfig struct {
+	OverdueMin     int     // alert this many minutes after a simulation's DtEstimate passes, 0 = 60
+	StallMin       int     // alert when a booked simulation is not updated for this many minutes, 0 = 120
+	SilentMin      int     // alert when a machine is not heard from for this many minutes, 0 = 15
+	ErrorRate      float64 // alert when this fraction of the recent simulations failed, 0 = 0.5
+	ErrorWindowMin int     // recent simulations finished in the last this many minutes, 0 = 60
+	ErrorMinCount  int     // judge the error rate over at least this many simulations, 0 = 5
+	WebhookURL     string  // POST each new alert here as JSON
+	Command        string  // run this with sh -c for each new alert, with the alert as JSON on stdin
+}
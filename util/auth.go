@@ -0,0 +1,56 @@
+package util
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Roles that an API token can have
+const (
+	RoleUser    = "user"    // a person using psq
+	RoleMachine = "machine" // a simd process
+	RoleAdmin   = "admin"   // may run every command
+)
+
+// APIToken identifies a caller of the dispatcher. The dispatcher's list of
+// tokens is a secret and belongs in extres.json5.
+type APIToken struct {
+	Token string // the bearer token the caller sends
+	Name  string // username for a user, machine ID or host name for a machine
+	Role  string // user, machine or admin
+
+	// MachineID is, for a machine, the MachineID simd books with. The
+	// machine may only act on the simulations booked with it. Default: Name.
+	MachineID string `json:",omitempty"`
+}
+
+// authToken is sent with every request to the dispatcher when set
+var authToken string
+
+// SetAuthToken sets the bearer token that SetAuthHeader adds to requests
+// sent to the dispatcher.
+// -----------------------------------------------------------------
+func SetAuthToken(token string) {
+	authToken = token
+}
+
+// SetAuthHeader adds the bearer token, if there is one, to req. Use it for
+// requests to the dispatcher that are not made with the Send functions.
+// -----------------------------------------------------------------
+func SetAuthHeader(req *http.Request) {
+	if len(authToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+authToken)
+	}
+}
+
+// BearerToken returns the token from the request's Authorization header, or
+// "" if there is none.
+// -----------------------------------------------------------------
+func BearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(h) <= len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(h[len(prefix):])
+}
@@ -0,0 +1,100 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrorCode is the machine-readable reason for a failed service call. Clients
+// should branch on the code, never on the text of the message.
+type ErrorCode string
+
+// Error codes. The HTTP status of an error reply follows from its code.
+const (
+	ErrBadRequest     ErrorCode = "BAD_REQUEST"     // 400 the request is malformed or has invalid data
+	ErrUnknownCommand ErrorCode = "UNKNOWN_COMMAND" // 400 the command is not in the handler table
+	ErrIncompatible   ErrorCode = "INCOMPATIBLE"    // 400 the client speaks a protocol version the dispatcher does not
+	ErrUnauthorized   ErrorCode = "UNAUTHORIZED"    // 401 no API token, or an unknown one
+	ErrForbidden      ErrorCode = "FORBIDDEN"       // 403 the caller may not do this
+	ErrNotFound       ErrorCode = "NOT_FOUND"       // 404 no such simulation or file
+	ErrConflict       ErrorCode = "CONFLICT"        // 409 the simulation is not in a state that allows this
+	ErrInternal       ErrorCode = "INTERNAL"        // 500 anything else
+)
+
+// Codes that accompany a successful reply
+const (
+	CodeQueueEmpty ErrorCode = "QUEUE_EMPTY" // Book: nothing is waiting to be booked
+	CodePaused     ErrorCode = "PAUSED"      // Book: the dispatcher is paused
+)
+
+// HTTPStatus returns the HTTP status for an error reply with code c
+// -----------------------------------------------------------------
+func (c ErrorCode) HTTPStatus() int {
+	switch c {
+	case ErrBadRequest, ErrUnknownCommand, ErrIncompatible:
+		return http.StatusBadRequest
+	case ErrUnauthorized:
+		return http.StatusUnauthorized
+	case ErrForbidden:
+		return http.StatusForbidden
+	case ErrNotFound:
+		return http.StatusNotFound
+	case ErrConflict:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// SvcError is the body of every error reply
+type SvcError struct {
+	Status  string // always "error"
+	Code    ErrorCode
+	Message string
+}
+
+// Error is an error with an ErrorCode. Wrap it with %w to add context; the
+// code is still found by CodeOf.
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Errorf returns an *Error with the given code and formatted message
+// -----------------------------------------------------------------
+func Errorf(code ErrorCode, format string, a ...interface{}) error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// CodeOf returns the code of err, ErrInternal if it has none, or "" if err
+// is nil.
+// -----------------------------------------------------------------
+func CodeOf(err error) ErrorCode {
+	if err == nil {
+		return ""
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ErrInternal
+}
+
+// DecodeError returns the error in reply body, or nil if body is not an
+// error reply.
+// -----------------------------------------------------------------
+func DecodeError(body []byte) error {
+	var e SvcError
+	if err := json.Unmarshal(body, &e); err != nil || e.Status != "error" {
+		return nil
+	}
+	if len(e.Code) == 0 {
+		e.Code = ErrInternal
+	}
+	return &Error{Code: e.Code, Message: e.Message}
+}
@@ -12,16 +12,34 @@ import (
 // ExternalResources is used to store sensitive or secret config values
 // for gaining access to external resources.
 type ExternalResources struct {
-	Env                int    // 0 = dev, 1 = qa, 2 = production
-	DbUser             string // database user
-	DbName             string // database name
-	DbPass             string // database password
-	DbHost             string // database host
-	DbPort             int    // database port
-	DbType             string // mysql or postgres or sqlite or ...
-	SimResultsDir      string // directory to store simulation results
-	DispatcherQueueDir string // where dispatcher stores queued configs
-	SimdSimulationsDir string // where simulator stores simulations
+	Env                int         // 0 = dev, 1 = qa, 2 = production
+	DbUser             string      // database user
+	DbName             string      // database name
+	DbPass             string      // database password
+	DbHost             string      // database host
+	DbPort             int         // database port
+	DbType             string      // mysql or postgres or sqlite or ...
+	SimResultsDir      string      // directory to store simulation results
+	DispatcherQueueDir string      // where dispatcher stores queued configs
+	SimdSimulationsDir string      // where simulator stores simulations
+	ResultStore        string      // where results are kept: "filesystem" (default) or "s3"
+	S3Endpoint         string      // S3-compatible endpoint, e.g. https://s3.us-west-2.amazonaws.com
+	S3Region           string      // S3 region, default us-east-1
+	S3Bucket           string      // bucket that holds the results
+	S3Prefix           string      // optional key prefix within the bucket
+	S3AccessKeyID      string      // S3 access key
+	S3SecretAccessKey  string      // S3 secret key
+	MinFreeDiskMB      int64       // health checks fail when a data directory has less free space than this
+	Log                LogConfig   // log level, format and rotation
+	APITokens          []APIToken  // callers allowed to use the dispatcher; if empty, anyone can
+	TLS                TLSConfig   // serve https with this certificate; CAFile requires client certificates
+	WebhookRetries     int         // webhook delivery retries after the first attempt, 0 = 5, < 0 = none
+	WebhookDeadLetter  string      // JSON lines file of failed webhook deliveries, default webhook-deadletter.log next to the dispatcher
+	LeaseTimeoutMin    int         // a booked simulation not updated for this many minutes is reported as expired, 0 = 1440
+	SMTP               SMTPConfig  // mail server for email notifications; email is off without one
+	Alerts             AlertConfig // alert rule thresholds and actions
+	PollMin            int         // poll running simulators for progress every this many minutes, 0 = 5, < 0 = never
+	PollConcurrency    int         // simulators polled at once, 0 = 8
 }
 
 // Define constant variables for DEV, QA, and PROD as per corrected mapping
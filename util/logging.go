@@ -0,0 +1,213 @@
+package util
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CorrelationHeader is the HTTP header that carries a request's correlation
+// ID. simd creates one when it books a simulation and sends it with every
+// request it makes about that simulation; the dispatcher echoes it in its
+// reply and in its log records so that a SID can be traced across machines.
+const CorrelationHeader = "X-Correlation-ID"
+
+// LogConfig describes how a program logs. It is read from the program's
+// config file; the zero value logs text at info level to a file that is
+// never rotated.
+type LogConfig struct {
+	Level       string // debug, info (default), warn or error
+	Format      string // text (default) or json
+	MaxSizeMB   int    // rotate when the file reaches this size, 0 = no limit
+	RotateHours int    // rotate when the file is this old, 0 = never
+	MaxBackups  int    // number of rotated files to keep, 0 = keep all
+}
+
+// NewCorrelationID returns a new random correlation ID
+// -----------------------------------------------------------------------------
+func NewCorrelationID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// ParseLogLevel converts a level name to a slog.Level
+// -----------------------------------------------------------------------------
+func ParseLogLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, fmt.Errorf("unknown log level: %q", s)
+}
+
+// SetupLogging sends all logging, including the standard log package, to the
+// file fname as described by cfg. The caller should Close the returned file
+// on exit.
+// -----------------------------------------------------------------------------
+func SetupLogging(fname string, cfg LogConfig) (*RotatingFile, error) {
+	level, err := ParseLogLevel(cfg.Level)
+	if err != nil {
+		return nil, err
+	}
+	rf, err := NewRotatingFile(fname, cfg)
+	if err != nil {
+		return nil, err
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	switch strings.ToLower(cfg.Format) {
+	case "", "text":
+		h = slog.NewTextHandler(rf, opts)
+	case "json":
+		h = slog.NewJSONHandler(rf, opts)
+	default:
+		rf.Close()
+		return nil, fmt.Errorf("unknown log format: %q", cfg.Format)
+	}
+	slog.SetDefault(slog.New(h)) // log.Printf now goes through h at info level
+	return rf, nil
+}
+
+// RotatingFile is an io.WriteCloser that appends to a log file and rotates it
+// when it grows past MaxSizeMB or gets older than RotateHours. Rotated files
+// are renamed to <name>.<timestamp> and the oldest are removed once there are
+// more than MaxBackups of them.
+type RotatingFile struct {
+	fname      string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	mu      sync.Mutex
+	f       *os.File
+	size    int64
+	opened  time.Time
+	nowFunc func() time.Time
+}
+
+// NewRotatingFile opens fname for appending
+// -----------------------------------------------------------------------------
+func NewRotatingFile(fname string, cfg LogConfig) (*RotatingFile, error) {
+	rf := &RotatingFile{
+		fname:      fname,
+		maxSize:    int64(cfg.MaxSizeMB) * 1024 * 1024,
+		maxAge:     time.Duration(cfg.RotateHours) * time.Hour,
+		maxBackups: cfg.MaxBackups,
+		nowFunc:    time.Now,
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.fname, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f = f
+	rf.size = info.Size()
+	rf.opened = rf.nowFunc()
+	return nil
+}
+
+// Write appends p to the file, rotating first if needed
+// -----------------------------------------------------------------------------
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return 0, os.ErrClosed
+	}
+	if rf.needsRotation(int64(len(p))) {
+		if err := rf.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "log rotation failed: %v\n", err)
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *RotatingFile) needsRotation(n int64) bool {
+	if rf.size == 0 {
+		return false
+	}
+	if rf.maxSize > 0 && rf.size+n > rf.maxSize {
+		return true
+	}
+	return rf.maxAge > 0 && rf.nowFunc().Sub(rf.opened) >= rf.maxAge
+}
+
+func (rf *RotatingFile) rotate() error {
+	rf.f.Close()
+	rf.f = nil
+	backup := fmt.Sprintf("%s.%s", rf.fname, rf.nowFunc().Format("20060102-150405"))
+	for i := 1; fileExists(backup); i++ {
+		backup = fmt.Sprintf("%s.%s.%d", rf.fname, rf.nowFunc().Format("20060102-150405"), i)
+	}
+	if err := os.Rename(rf.fname, backup); err != nil {
+		rf.open() // keep logging to the current file
+		return err
+	}
+	rf.prune()
+	return rf.open()
+}
+
+// prune removes the oldest backups beyond maxBackups
+func (rf *RotatingFile) prune() {
+	if rf.maxBackups <= 0 {
+		return
+	}
+	backups, _ := filepath.Glob(rf.fname + ".*")
+	if len(backups) <= rf.maxBackups {
+		return
+	}
+	sort.Strings(backups) // timestamps sort chronologically
+	for _, b := range backups[:len(backups)-rf.maxBackups] {
+		os.Remove(b)
+	}
+}
+
+// Close closes the file
+// -----------------------------------------------------------------------------
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return nil
+	}
+	err := rf.f.Close()
+	rf.f = nil
+	return err
+}
+
+func fileExists(fname string) bool {
+	_, err := os.Stat(fname)
+	return err == nil
+}
+
+var _ io.WriteCloser = (*RotatingFile)(nil)
@@ -0,0 +1,135 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testRotatingFile opens a RotatingFile in a temporary directory whose clock
+// is *now
+func testRotatingFile(t *testing.T, cfg LogConfig, now *time.Time) *RotatingFile {
+	fname := filepath.Join(t.TempDir(), "simq.log")
+	rf, err := NewRotatingFile(fname, cfg)
+	require.NoError(t, err)
+	rf.nowFunc = func() time.Time { return *now }
+	rf.opened = *now
+	t.Cleanup(func() { rf.Close() })
+	return rf
+}
+
+// backups returns the rotated files of rf, oldest first
+func backups(t *testing.T, rf *RotatingFile) []string {
+	names, err := filepath.Glob(rf.fname + ".*")
+	require.NoError(t, err)
+	sort.Strings(names)
+	for i, n := range names {
+		names[i] = strings.TrimPrefix(filepath.Base(n), filepath.Base(rf.fname)+".")
+	}
+	return names
+}
+
+func TestNeedsRotation(t *testing.T) {
+	now := time.Date(2024, 12, 23, 8, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name    string
+		maxSize int64
+		maxAge  time.Duration
+		size    int64
+		n       int64
+		age     time.Duration
+		want    bool
+	}{
+		{"empty file", 10, time.Hour, 0, 100, 2 * time.Hour, false},
+		{"fits", 10, 0, 5, 5, 0, false},
+		{"too big", 10, 0, 5, 6, 0, true},
+		{"no size limit", 0, 0, 5, 1 << 30, 0, false},
+		{"young", 0, time.Hour, 5, 1, 59 * time.Minute, false},
+		{"old", 0, time.Hour, 5, 1, time.Hour, true},
+		{"no age limit", 0, 0, 5, 1, 1000 * time.Hour, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rf := &RotatingFile{maxSize: tc.maxSize, maxAge: tc.maxAge, size: tc.size, opened: now.Add(-tc.age)}
+			rf.nowFunc = func() time.Time { return now }
+			assert.Equal(t, tc.want, rf.needsRotation(tc.n))
+		})
+	}
+}
+
+func TestRotateBySize(t *testing.T) {
+	now := time.Date(2024, 12, 23, 8, 0, 0, 0, time.UTC)
+	rf := testRotatingFile(t, LogConfig{}, &now)
+	rf.maxSize = 10
+
+	_, err := rf.Write([]byte("0123456789"))
+	require.NoError(t, err)
+	assert.Empty(t, backups(t, rf), "exactly full")
+
+	_, err = rf.Write([]byte("abc"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"20241223-080000"}, backups(t, rf))
+	b, err := os.ReadFile(rf.fname + ".20241223-080000")
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(b))
+	b, err = os.ReadFile(rf.fname)
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(b))
+
+	//-----------------------------------------------------
+	// a second rotation in the same second does not
+	// overwrite the first
+	//-----------------------------------------------------
+	_, err = rf.Write([]byte("defghijk"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"20241223-080000", "20241223-080000.1"}, backups(t, rf))
+}
+
+func TestRotateByAge(t *testing.T) {
+	now := time.Date(2024, 12, 23, 8, 0, 0, 0, time.UTC)
+	rf := testRotatingFile(t, LogConfig{RotateHours: 24}, &now)
+
+	_, err := rf.Write([]byte("monday\n"))
+	require.NoError(t, err)
+	now = now.Add(23 * time.Hour)
+	_, err = rf.Write([]byte("still monday's\n"))
+	require.NoError(t, err)
+	assert.Empty(t, backups(t, rf))
+
+	now = now.Add(time.Hour)
+	_, err = rf.Write([]byte("tuesday\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"20241224-080000"}, backups(t, rf))
+	b, err := os.ReadFile(rf.fname)
+	require.NoError(t, err)
+	assert.Equal(t, "tuesday\n", string(b))
+	assert.Equal(t, now, rf.opened, "the new file's age counts from its rotation")
+}
+
+func TestPrune(t *testing.T) {
+	now := time.Date(2024, 12, 23, 8, 0, 0, 0, time.UTC)
+	rf := testRotatingFile(t, LogConfig{RotateHours: 1, MaxBackups: 2}, &now)
+
+	for i := 0; i < 4; i++ {
+		_, err := rf.Write([]byte("x\n"))
+		require.NoError(t, err)
+		now = now.Add(time.Hour)
+	}
+	_, err := rf.Write([]byte("x\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"20241223-110000", "20241223-120000"}, backups(t, rf), "the newest two")
+
+	//-----------------------------------------------------
+	// without MaxBackups nothing is removed
+	//-----------------------------------------------------
+	rf.maxBackups = 0
+	now = now.Add(time.Hour)
+	_, err = rf.Write([]byte("x\n"))
+	require.NoError(t, err)
+	assert.Len(t, backups(t, rf), 3)
+}
@@ -4,15 +4,12 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"io"
-	"log"
-	"mime/multipart"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"runtime"
 	"strings"
 	"time"
@@ -24,13 +21,6 @@ type NetworkInfo struct {
 	Hostname  string
 }
 
-// Command represents the structure of a command
-type Command struct {
-	Command  string
-	Username string
-	Data     json.RawMessage
-}
-
 // SvcStatus200 is a simple status message return
 type SvcStatus200 struct {
 	Status  string
@@ -142,96 +132,6 @@ func GetMachineUUID() (string, error) {
 	}
 }
 
-// SendRequest sends a request to the server
-// -----------------------------------------------------------------
-func SendRequest(url string, cmd *Command) []byte {
-	cmdBytes, _ := json.Marshal(cmd)
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(cmdBytes))
-	if err != nil {
-		fmt.Printf("Error sending request: %v\n", err)
-		return nil
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		fmt.Printf("Received non-OK HTTP status: %s\n", resp.Status)
-		return nil
-	}
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Printf("Error reading response: %v\n", err)
-		return nil
-	}
-
-	// PrintHexAndASCII(body, 256)
-	return body
-}
-
-// SendMultipartRequest sends a multipart request to the server
-// -----------------------------------------------------------------
-func SendMultipartRequest(url string, cmd *Command, filePath string) ([]byte, error) {
-	var b bytes.Buffer
-	writer := multipart.NewWriter(&b)
-
-	// Marshal the Command struct
-	cmdBytes, err := json.Marshal(cmd)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal command: %v", err)
-	}
-
-	// Create the JSON part
-	part, err := writer.CreateFormField("data")
-	if err != nil {
-		return nil, fmt.Errorf("failed to create form field: %v", err)
-	}
-	_, err = part.Write(cmdBytes)
-	if err != nil {
-		return nil, fmt.Errorf("failed to write command data: %v", err)
-	}
-
-	// Add file part
-	file, err := os.Open(filePath)
-	if err != nil {
-		return nil, fmt.Errorf("error opening file: %v", err)
-	}
-	defer file.Close()
-
-	part, err = writer.CreateFormFile("file", filepath.Base(filePath))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create form file: %v", err)
-	}
-	_, err = io.Copy(part, file)
-	if err != nil {
-		return nil, fmt.Errorf("error copying file content: %v", err)
-	}
-
-	writer.Close()
-
-	req, err := http.NewRequest("POST", url, &b)
-	if err != nil {
-		return nil, fmt.Errorf("error creating request: %v", err)
-	}
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("error sending request: %v", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		return nil, fmt.Errorf("received non-OK HTTP status: %s", resp.Status)
-	}
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("error reading response: %v", err)
-	}
-	return body, nil
-}
-
 // CheckPort tries to establish a TCP connection to the given port and returns true if successful
 func CheckPort(port int) bool {
 	address := fmt.Sprintf("localhost:%d", port)
@@ -254,17 +154,32 @@ func ScanPorts(startPort, endPort int) []int {
 	return openPorts
 }
 
-// SvcErrorReturn formats an error return to the grid widget and sends it
+// SvcErrorReturn sends err as an error reply. The HTTP status and the Code
+// in the reply come from the err's ErrorCode; errors without one are
+// reported as ErrInternal.
 func SvcErrorReturn(w http.ResponseWriter, err error) {
-	log.Printf("%v\n", err)
-	var e SvcStatus200
-	e.Status = "error"
-	e.Message = err.Error()
+	slog.Error(err.Error(), "corr", w.Header().Get(CorrelationHeader))
+	if m, ok := w.(ErrorMarker); ok {
+		m.MarkError(err)
+	}
+	e := SvcError{
+		Status:  "error",
+		Code:    CodeOf(err),
+		Message: err.Error(),
+	}
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Code.HTTPStatus())
 	b, _ := json.Marshal(e)
 	SvcWrite(w, b)
 }
 
+// ErrorMarker is implemented by response writers that want to know when a
+// service call ends in an error. The error's status is lost if the handler
+// already wrote its header, so the status code alone does not always tell.
+type ErrorMarker interface {
+	MarkError(err error)
+}
+
 // SvcWriteResponse finishes the transaction with the W2UI client
 func SvcWriteResponse(w http.ResponseWriter, g interface{}) {
 	w.Header().Set("Content-Type", "application/json") // we're marshaling the data as json
@@ -0,0 +1,35 @@
+package util
+
+import (
+	"net"
+	"strconv"
+)
+
+// SMTPConfig describes the mail server the dispatcher sends notifications
+// through. It is read from the dispatcher's config file; email is off while
+// Host is empty.
+type SMTPConfig struct {
+	Host      string // mail server
+	Port      int    // 0 = 25
+	Username  string // if set, authenticate with PLAIN auth
+	Password  string
+	From      string // sender address, default simq@<hostname>
+	DigestMin int    // digests are sent this often, in minutes, 0 = 60
+	Templates string // file of text/template definitions that replace the built-in ones
+}
+
+// Enabled reports whether email should be sent
+// -----------------------------------------------------------------
+func (c *SMTPConfig) Enabled() bool {
+	return len(c.Host) > 0
+}
+
+// Addr returns the host:port of the mail server
+// -----------------------------------------------------------------
+func (c *SMTPConfig) Addr() string {
+	port := c.Port
+	if port == 0 {
+		port = 25
+	}
+	return net.JoinHostPort(c.Host, strconv.Itoa(port))
+}
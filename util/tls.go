@@ -0,0 +1,114 @@
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// TLSConfig describes one side of a TLS connection. It is read from the
+// config files of the dispatcher, simd and psq. All files are PEM.
+//
+// On a server, CertFile and KeyFile are the server's certificate and turn
+// TLS on. If CAFile is set, clients must present a certificate signed by
+// that CA (mutual TLS).
+//
+// On a client, CAFile pins the server: its certificate must be signed by
+// that CA rather than by one of the system's roots. CertFile and KeyFile,
+// if set, are the client certificate sent for mutual TLS.
+type TLSConfig struct {
+	CertFile   string
+	KeyFile    string
+	CAFile     string
+	ServerName string // client only: the name expected in the server's certificate, if not the host in the URL
+}
+
+// Enabled reports whether a server should use TLS
+// -----------------------------------------------------------------
+func (c *TLSConfig) Enabled() bool {
+	return len(c.CertFile) > 0
+}
+
+// ServerTLSConfig returns the tls.Config for a server described by c
+// -----------------------------------------------------------------
+func ServerTLSConfig(c *TLSConfig) (*tls.Config, error) {
+	if len(c.CertFile) == 0 || len(c.KeyFile) == 0 {
+		return nil, fmt.Errorf("TLS needs both CertFile and KeyFile")
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load server certificate: %v", err)
+	}
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if len(c.CAFile) > 0 {
+		if cfg.ClientCAs, err = loadCertPool(c.CAFile); err != nil {
+			return nil, err
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// ClientTLSConfig returns the tls.Config for a client described by c
+// -----------------------------------------------------------------
+func ClientTLSConfig(c *TLSConfig) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: c.ServerName,
+	}
+	var err error
+	if len(c.CAFile) > 0 {
+		if cfg.RootCAs, err = loadCertPool(c.CAFile); err != nil {
+			return nil, err
+		}
+	}
+	if len(c.CertFile) > 0 || len(c.KeyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func loadCertPool(fname string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in %s", fname)
+	}
+	return pool, nil
+}
+
+// httpClient is used for every request to the dispatcher and to simd
+var httpClient = http.DefaultClient
+
+// SetClientTLS makes HTTPClient, and so the dispatcher client, use the TLS
+// settings in c for https URLs.
+// -----------------------------------------------------------------
+func SetClientTLS(c *TLSConfig) error {
+	cfg, err := ClientTLSConfig(c)
+	if err != nil {
+		return err
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = cfg
+	httpClient = &http.Client{Transport: t}
+	return nil
+}
+
+// HTTPClient returns the client to use for requests to the dispatcher and
+// to simd. Requests made with it honor SetClientTLS.
+// -----------------------------------------------------------------
+func HTTPClient() *http.Client {
+	return httpClient
+}